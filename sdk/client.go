@@ -0,0 +1,151 @@
+// Package sdk is a client for registering services with the gateway
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+)
+
+var (
+	ErrServiceNotFound      = errors.New("service not found")
+	ErrServiceAlreadyExists = errors.New("service already exists")
+	ErrInvalidRequest       = errors.New("invalid request")
+)
+
+// Error is returned when the gateway responds with a non 2xx status code
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("gateway responded %d: %s", e.StatusCode, e.Message)
+}
+
+// Unwrap maps the response to one of the sentinel errors so callers can use errors.Is
+func (e *Error) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusNotFound, e.Message == ErrServiceNotFound.Error():
+		return ErrServiceNotFound
+	case e.StatusCode == http.StatusConflict:
+		return ErrServiceAlreadyExists
+	case e.StatusCode == http.StatusBadRequest:
+		return ErrInvalidRequest
+	default:
+		return nil
+	}
+}
+
+// Response is the body returned by the register, update and deregister endpoints
+type Response struct {
+	Message string `json:"message"`
+}
+
+type HealthCheck struct {
+	Enabled bool   `json:"enabled"`
+	Uri     string `json:"uri"`
+}
+
+// Service is a service as listed by the gateway, only the plain settings are decoded
+type Service struct {
+	Addr                string        `json:"addr"`
+	FallbackUris        []string      `json:"fallbackUris"`
+	Health              HealthCheck   `json:"health"`
+	DecompressRequest   bool          `json:"decompressRequest"`
+	MaxDecompressedSize int64         `json:"maxDecompressedSize"`
+	WriteTimeout        time.Duration `json:"writeTimeout"`
+}
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewClient creates a client for the gateway at baseURL e.g. "http://localhost:8080",
+// http.DefaultClient is used if httpClient is nil
+func NewClient(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{baseURL: strings.TrimSuffix(baseURL, "/"), httpClient: httpClient}
+}
+
+// Register registers a new service, registering an existing name returns ErrServiceAlreadyExists
+func (c *Client) Register(ctx context.Context, conf config.ServiceConf) (*Response, error) {
+	var res Response
+	if err := c.do(ctx, http.MethodPost, "/services/register", conf, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Update replaces the configuration of an existing service
+func (c *Client) Update(ctx context.Context, conf config.ServiceConf) (*Response, error) {
+	var res Response
+	if err := c.do(ctx, http.MethodPost, "/services/update", conf, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Deregister removes the service from the gateway
+func (c *Client) Deregister(ctx context.Context, name string) (*Response, error) {
+	var res Response
+	body := struct {
+		Name string `json:"name"`
+	}{Name: name}
+	if err := c.do(ctx, http.MethodPost, "/services/deregister", body, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// List returns the registered services keyed by name
+func (c *Client) List(ctx context.Context) (map[string]Service, error) {
+	var res map[string]Service
+	if err := c.do(ctx, http.MethodGet, "/services", nil, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// do sends the request with body marshalled as json and decodes the response into out
+func (c *Client) do(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("marshal request: %w", err)
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(resp.Body)
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package auth
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
@@ -10,49 +11,78 @@ import (
 	"time"
 
 	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/ArmaanKatyal/go-api-gateway/server/observability"
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type Claims struct {
 	Service string `json:"service"`
 	jwt.RegisteredClaims
+	// every claim of the token, to check the required ones
+	all jwt.MapClaims
+}
+
+// UnmarshalJSON decodes the claims of the token and keeps all of them
+func (c *Claims) UnmarshalJSON(b []byte) error {
+	type claims Claims
+	if err := json.Unmarshal(b, (*claims)(c)); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &c.all)
 }
 
 type JwtError error
 
 const (
-	DefaultSecret = "test"
+	DefaultSecret    = "test"
+	DefaultAlgorithm = "HS256"
+	DefaultTokenTTL  = 3600
 )
 
 var (
 	ErrTokenMissing JwtError = errors.New("missing auth token")
 	ErrInvalidToken JwtError = errors.New("invalid auth token")
+	ErrAuthDisabled JwtError = errors.New("auth is disabled")
+	// ErrMissingClaim is an invalid token lacking one of the required claims
+	ErrMissingClaim JwtError = fmt.Errorf("%w: missing required claim", ErrInvalidToken)
 )
 
 type JwtAuth struct {
-	Enabled   bool     `json:"enabled"`
-	Anonymous bool     `json:"anonymous"`
-	Routes    []string `json:"routes"`
-	secret    []byte
+	Enabled        bool     `json:"enabled"`
+	Anonymous      bool     `json:"anonymous"`
+	Routes         []string `json:"routes"`
+	Algorithm      string   `json:"algorithm"`
+	TokenTTL       int      `json:"tokenTTL"`
+	Leeway         int      `json:"leeway"`
+	RequiredClaims []string `json:"requiredClaims"`
+	secret         []byte
 }
 
 func (j *JwtAuth) getSecret() []byte {
 	return j.secret
 }
 
+// resolvePath returns the path without its first segment naming the service, empty if the
+// path has no route e.g. /svc or /svc/
 func resolvePath(path string) string {
 	parts := strings.Split(path, "/")
-	if len(parts) < 2 {
+	if len(parts) < 3 {
 		return ""
 	}
 	return strings.Join(parts[2:], "/")
 }
 
-// Authenticate checks if the request has a valid JWT token in the header
+// Authenticate checks if the request has a valid JWT token in the header, the route is the
+// path of the request without its first segment naming the service
 func (j *JwtAuth) Authenticate(r *http.Request) JwtError {
+	return j.AuthenticateRoute(r, "/"+resolvePath(r.URL.Path))
+}
+
+// AuthenticateRoute checks if the request has a valid JWT token in the header when the route
+// resolved by the gateway requires authentication
+func (j *JwtAuth) AuthenticateRoute(r *http.Request, path string) JwtError {
 	token := r.Header.Get("Authorization")
-	path := "/" + resolvePath(r.URL.Path)
-	slog.Info("Authenticating request", "path", path)
+	observability.Logger(r.Context()).Info("Authenticating request", "path", path)
 	exists := j.pathInRoutes(path)
 	if exists && j.IsEnabled() {
 		if token == "" {
@@ -66,7 +96,7 @@ func (j *JwtAuth) Authenticate(r *http.Request) JwtError {
 		claims := &Claims{}
 		parsed, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
 			return j.getSecret(), nil
-		})
+		}, jwt.WithLeeway(j.leeway()))
 		if err != nil {
 			if j.Anonymous {
 				slog.Warn("Anonymous request", "path", path)
@@ -81,7 +111,7 @@ func (j *JwtAuth) Authenticate(r *http.Request) JwtError {
 		}
 
 		// Check expiration
-		if claims.ExpiresAt.Unix() < time.Now().Unix() {
+		if claims.ExpiresAt.Unix()+int64(j.Leeway) < time.Now().Unix() {
 			slog.Error("Token expired", "path", path)
 			if j.Anonymous {
 				slog.Warn("Anonymous request", "path", path)
@@ -90,6 +120,15 @@ func (j *JwtAuth) Authenticate(r *http.Request) JwtError {
 			return ErrInvalidToken
 		}
 
+		if missing, ok := j.missingClaim(claims); !ok {
+			if j.Anonymous {
+				slog.Warn("Anonymous request", "path", path)
+				return nil
+			}
+			slog.Error("Token missing required claim", "claim", missing, "path", path)
+			return ErrMissingClaim
+		}
+
 		c, err := json.Marshal(claims)
 		if err != nil {
 			slog.Error("Error marshalling claims", "error", err.Error(), "path", path)
@@ -102,24 +141,101 @@ func (j *JwtAuth) Authenticate(r *http.Request) JwtError {
 	return nil
 }
 
+// Renew validates the token and issues a new one with the same claims, which expires
+// TokenTTL seconds from now. Anonymous access doesn't apply, the token must be valid.
+func (j *JwtAuth) Renew(token string) (string, error) {
+	if !j.IsEnabled() {
+		return "", ErrAuthDisabled
+	}
+	if token == "" {
+		return "", ErrTokenMissing
+	}
+	claims := jwt.MapClaims{}
+	parsed, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		return j.getSecret(), nil
+	}, jwt.WithValidMethods([]string{j.Algorithm}), jwt.WithExpirationRequired(), jwt.WithLeeway(j.leeway()))
+	if err != nil || !parsed.Valid {
+		slog.Error("Error renewing token", "error", err)
+		return "", ErrInvalidToken
+	}
+
+	now := time.Now()
+	claims["iat"] = jwt.NewNumericDate(now)
+	claims["exp"] = jwt.NewNumericDate(now.Add(time.Duration(j.TokenTTL) * time.Second))
+	renewed, err := jwt.NewWithClaims(jwt.GetSigningMethod(j.Algorithm), claims).SignedString(j.getSecret())
+	if err != nil {
+		slog.Error("Error signing token", "error", err.Error())
+		return "", err
+	}
+	return renewed, nil
+}
+
+func (j *JwtAuth) leeway() time.Duration {
+	return time.Duration(j.Leeway) * time.Second
+}
+
+// missingClaim returns the first required claim absent from the verified claims, ok is false
+// if one is missing
+func (j *JwtAuth) missingClaim(claims *Claims) (string, bool) {
+	for _, name := range j.RequiredClaims {
+		if v, ok := claims.all[name]; !ok || v == nil {
+			return name, false
+		}
+	}
+	return "", true
+}
+
 func (j *JwtAuth) pathInRoutes(path string) bool {
 	for _, route := range j.Routes {
-		if route == path {
+		if matchRoute(route, path) {
 			return true
 		}
 	}
 	return false
 }
 
+// matchRoute reports whether the path matches the route, a * segment matches any single segment
+// and a trailing * matches the rest of the path, even if empty, e.g. /admin/* matches /admin,
+// /admin/ and /admin/users/1
+func matchRoute(route string, path string) bool {
+	if route == path {
+		return true
+	}
+	rs := strings.Split(strings.Trim(route, "/"), "/")
+	ps := strings.Split(strings.Trim(path, "/"), "/")
+	for i, seg := range rs {
+		if seg == "*" && i == len(rs)-1 {
+			return true
+		}
+		if i == len(ps) {
+			return false
+		}
+		if seg != "*" && seg != ps[i] {
+			return false
+		}
+	}
+	return len(rs) == len(ps)
+}
+
 func (j *JwtAuth) IsEnabled() bool {
 	return j.Enabled
 }
 
 func NewJwtAuth(conf *config.AuthSettings, reader io.Reader) *JwtAuth {
 	ja := &JwtAuth{
-		Enabled:   conf.Enabled,
-		Anonymous: conf.Anonymous,
-		Routes:    conf.Routes,
+		Enabled:        conf.Enabled,
+		Anonymous:      conf.Anonymous,
+		Routes:         conf.Routes,
+		Algorithm:      conf.Algorithm,
+		TokenTTL:       conf.TokenTTL,
+		Leeway:         conf.Leeway,
+		RequiredClaims: conf.RequiredClaims,
+	}
+	if ja.Algorithm == "" {
+		ja.Algorithm = DefaultAlgorithm
+	}
+	if ja.TokenTTL == 0 {
+		ja.TokenTTL = DefaultTokenTTL
 	}
 
 	// Read from the provided reader, regardless of the type
@@ -60,6 +60,64 @@ func TestAuthPathInRoutes(t *testing.T) {
 	})
 }
 
+func TestAuthMatchRoute(t *testing.T) {
+	tests := []struct {
+		name  string
+		route string
+		path  string
+		want  bool
+	}{
+		{"exact", "/orders", "/orders", true},
+		{"exact nested", "/orders/export", "/orders/export", true},
+		{"exact is not a prefix", "/orders", "/orders/1", false},
+		{"prefix", "/admin/*", "/admin/users", true},
+		{"prefix nested", "/admin/*", "/admin/users/1/roles", true},
+		{"prefix matches its root", "/admin/*", "/admin", true},
+		{"prefix matches its root with a slash", "/admin/*", "/admin/", true},
+		{"prefix is a whole segment", "/admin/*", "/administrator", false},
+		{"wildcard segment", "/users/*/orders", "/users/42/orders", true},
+		{"wildcard segment only one", "/users/*/orders", "/users/42/7/orders", false},
+		{"wildcard different tail", "/users/*/orders", "/users/42/invoices", false},
+		{"public route", "/admin/*", "/public/admin", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, matchRoute(tt.route, tt.path))
+		})
+	}
+}
+
+func TestAuthAuthenticateRoute(t *testing.T) {
+	j := NewJwtAuth(&config.AuthSettings{Enabled: true, Routes: []string{"/admin/*"}}, bytes.NewReader([]byte("test")))
+	// the route resolved by the gateway is used rather than the path of the request
+	r := generateRequest("", "/api/v1/admin/users")
+	assert.Equal(t, ErrTokenMissing, j.AuthenticateRoute(r, "/admin/users"))
+	assert.Nil(t, j.AuthenticateRoute(r, "/users"))
+	// the root of a protected prefix is protected too
+	assert.Equal(t, ErrTokenMissing, j.AuthenticateRoute(r, "/admin"))
+	assert.Equal(t, ErrTokenMissing, j.AuthenticateRoute(r, "/admin/"))
+}
+
+func TestAuthAuthenticateShortPaths(t *testing.T) {
+	j := NewJwtAuth(&config.AuthSettings{Enabled: true, Routes: []string{"/route1", "/a/b/c"}}, bytes.NewReader([]byte("test")))
+	tests := []struct {
+		path string
+		want error
+	}{
+		{"", nil},
+		{"/svc", nil},
+		{"/svc/", nil},
+		{"/svc/route1", ErrTokenMissing},
+		{"/svc/a/b/c", ErrTokenMissing},
+		{"/svc/a/b", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.want, j.Authenticate(generateRequest("", tt.path)))
+		})
+	}
+}
+
 func TestAuthIsEnabled(t *testing.T) {
 	input := "test_secret_data"
 	reader := bytes.NewReader([]byte(input))
@@ -159,3 +217,98 @@ func TestAuthAuthenticate(t *testing.T) {
 		assert.JSONEq(t, string(expected), req.Header.Get("X-Claims"))
 	})
 }
+
+func TestAuthRenew(t *testing.T) {
+	newAuth := func(enabled bool) *JwtAuth {
+		return NewJwtAuth(&config.AuthSettings{Enabled: enabled, TokenTTL: 7200}, bytes.NewReader([]byte("secret")))
+	}
+	t.Run("valid token renewed", func(t *testing.T) {
+		exp := time.Now().Add(time.Minute)
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"sub":     "orders",
+			"service": "test",
+			"exp":     exp.Unix(),
+		}).SignedString([]byte("secret"))
+		assert.Nil(t, err)
+
+		renewed, err := newAuth(true).Renew(token)
+		assert.Nil(t, err)
+		claims := jwt.MapClaims{}
+		_, err = jwt.ParseWithClaims(renewed, claims, func(token *jwt.Token) (interface{}, error) {
+			return []byte("secret"), nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, "orders", claims["sub"])
+		assert.Equal(t, "test", claims["service"])
+		renewedExp, err := claims.GetExpirationTime()
+		assert.Nil(t, err)
+		assert.True(t, renewedExp.After(exp))
+		assert.WithinDuration(t, time.Now().Add(2*time.Hour), renewedExp.Time, 5*time.Second)
+	})
+	t.Run("expired token", func(t *testing.T) {
+		token, err := generateToken("secret", time.Now().Add(-time.Minute).Unix())
+		assert.Nil(t, err)
+		_, err = newAuth(true).Renew(token)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+	t.Run("token signed with another secret", func(t *testing.T) {
+		token, err := generateToken("forged", time.Now().Add(time.Minute).Unix())
+		assert.Nil(t, err)
+		_, err = newAuth(true).Renew(token)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+	t.Run("missing token", func(t *testing.T) {
+		_, err := newAuth(true).Renew("")
+		assert.ErrorIs(t, err, ErrTokenMissing)
+	})
+	t.Run("auth disabled", func(t *testing.T) {
+		_, err := newAuth(false).Renew("token")
+		assert.ErrorIs(t, err, ErrAuthDisabled)
+	})
+}
+
+func TestAuthRequiredClaims(t *testing.T) {
+	newAuth := func(required []string) *JwtAuth {
+		return NewJwtAuth(&config.AuthSettings{Enabled: true, Routes: []string{"/route1"}, RequiredClaims: required}, bytes.NewReader([]byte("test")))
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"service":   "test",
+		"tenant_id": "acme",
+		"exp":       time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("test"))
+	assert.Nil(t, err)
+
+	t.Run("all required claims", func(t *testing.T) {
+		req := generateRequest(token, "/test/route1")
+		assert.Nil(t, newAuth([]string{"tenant_id", "service"}).Authenticate(req))
+		assert.NotEmpty(t, req.Header.Get("X-Claims"))
+	})
+	t.Run("missing required claim", func(t *testing.T) {
+		req := generateRequest(token, "/test/route1")
+		err := newAuth([]string{"tenant_id", "role"}).Authenticate(req)
+		assert.ErrorIs(t, err, ErrMissingClaim)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+		assert.Empty(t, req.Header.Get("X-Claims"))
+	})
+	t.Run("null required claim", func(t *testing.T) {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"service":   "test",
+			"tenant_id": nil,
+			"exp":       time.Now().Add(time.Hour).Unix(),
+		}).SignedString([]byte("test"))
+		assert.Nil(t, err)
+		assert.ErrorIs(t, newAuth([]string{"tenant_id"}).Authenticate(generateRequest(token, "/test/route1")), ErrMissingClaim)
+	})
+	t.Run("no required claims", func(t *testing.T) {
+		assert.Nil(t, newAuth(nil).Authenticate(generateRequest(token, "/test/route1")))
+	})
+}
+
+func TestAuthLeeway(t *testing.T) {
+	token, err := generateToken("test", time.Now().Add(-30*time.Second).Unix())
+	assert.Nil(t, err)
+	strict := NewJwtAuth(&config.AuthSettings{Enabled: true, Routes: []string{"/route1"}}, bytes.NewReader([]byte("test")))
+	assert.ErrorIs(t, strict.Authenticate(generateRequest(token, "/test/route1")), ErrInvalidToken)
+	lenient := NewJwtAuth(&config.AuthSettings{Enabled: true, Routes: []string{"/route1"}, Leeway: 60}, bytes.NewReader([]byte("test")))
+	assert.Nil(t, lenient.Authenticate(generateRequest(token, "/test/route1")))
+}
@@ -2,11 +2,18 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/go-playground/validator/v10"
 	"github.com/sony/gobreaker/v2"
 	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -16,6 +23,11 @@ import (
 var AppConfig Conf
 var Validate *validator.Validate
 
+var ErrTemplateNotFound = errors.New("service template not found")
+
+// ErrUnresolvableAddress is a service address whose host doesn't resolve
+var ErrUnresolvableAddress = errors.New("service address doesn't resolve")
+
 func init() {
 	Validate = validator.New(validator.WithRequiredStructEnabled())
 }
@@ -25,6 +37,15 @@ type CircuitSettings struct {
 	Timeout      uint    `yaml:"timeout"`
 	Interval     uint    `yaml:"interval"`
 	FailureRatio float64 `yaml:"failureRatio"`
+	// number of requests in the interval before the failure ratio can open the circuit, defaults to 5
+	MinimumRequests int `yaml:"minimumRequests" validate:"min=0"`
+	// the longest (seconds) a single attempt may take before it is cancelled and counted as a failure,
+	// 0 leaves the attempt unbounded
+	RequestTimeout int `yaml:"requestTimeout" validate:"min=0"`
+	// save the state of the circuit to StateFile on shutdown and restore it on startup, so a circuit
+	// opened shortly before a restart stays open. It stays open for a whole Timeout from the restart
+	PersistState bool   `yaml:"persistState"`
+	StateFile    string `yaml:"stateFile" validate:"required_if=PersistState true"`
 }
 
 func (cs *CircuitSettings) Into(name string) gobreaker.Settings {
@@ -33,23 +54,130 @@ func (cs *CircuitSettings) Into(name string) gobreaker.Settings {
 		Timeout:  time.Duration(cs.Timeout) * time.Second,
 		Interval: time.Duration(cs.Interval) * time.Second,
 		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			if int(counts.Requests) < cs.MinimumRequests {
+				return false
+			}
 			failureRatio := float64(counts.TotalFailures) / float64(counts.Requests)
 			return failureRatio >= cs.FailureRatio
 		},
 	}
 }
 
+type RetryBudgetSettings struct {
+	// maximum number of retries in flight across all the services
+	MaxConcurrent int `yaml:"maxConcurrent"`
+	// maximum retries in flight as a percentage of the requests in flight
+	MaxPercentage float64 `yaml:"maxPercentage"`
+}
+
+type ServiceRetryBudgetSettings struct {
+	// maximum number of retries to the service per window, unlimited if 0
+	MaxRetries int `yaml:"maxRetries" validate:"min=0"`
+	// window (secs) the retries are refilled over, defaults to 10
+	Window int `yaml:"window" validate:"min=0"`
+}
+
+type RetryPolicySettings struct {
+	// the failures retried: every failure to reach the service by default (errors), only refused and
+	// reset connections (connection_errors_only), or also the responses with a retriable status
+	// (retriable_statuses)
+	Mode string `yaml:"mode" validate:"omitempty,oneof=errors connection_errors_only retriable_statuses"`
+	// statuses retried in the retriable_statuses mode, defaults to 502, 503 and 504
+	Statuses []int `yaml:"statuses" validate:"dive,min=500,max=599"`
+	// largest request body (bytes) kept to be sent again, defaults to 1048576. A request with a
+	// larger body is sent once without retries.
+	MaxBodyBytes int64 `yaml:"maxBodyBytes" validate:"min=0"`
+}
+
+type AuthFailureSettings struct {
+	// upstream statuses treated as auth failures, defaults to 401 and 403
+	Statuses []int `yaml:"statuses" validate:"dive,min=400,max=499"`
+	// delete the cached response of the request
+	PurgeCache bool `yaml:"purgeCache"`
+	// send the request once more without the X-Claims header so the service authenticates it itself
+	StripClaims bool `yaml:"stripClaims"`
+}
+
 type RateLimiterSettings struct {
 	Enabled         bool `yaml:"enabled"`
 	Rate            int  `yaml:"rate"`
 	Burst           int  `yaml:"burst"`
 	CleanupInterval int  `yaml:"cleanupInterval"`
+	// file every rate limited request is logged to as a JSON line, separately from the
+	// application logs. Only read from Server.RateLimiter, disabled if empty
+	EventLog string `yaml:"eventLog"`
+	// delay the requests over the limit instead of rejecting them, only for the service limiters
+	Queue RateLimiterQueueSettings `yaml:"queue"`
+}
+
+type DebugLogBodiesSettings struct {
+	Enabled bool `yaml:"enabled"`
+	// the most bytes logged of a body, defaults to 4096
+	MaxBytes int `yaml:"maxBytes" validate:"min=0"`
+	// fields of JSON and form-urlencoded bodies whose values are replaced before logging, matched case insensitively
+	RedactFields []string `yaml:"redactFields"`
+}
+
+type ForwardHeadersSettings struct {
+	// request headers forwarded to the service, matched case insensitively. Every header is
+	// forwarded if empty, otherwise only these and the ones the service needs e.g. Content-Type
+	AllowList []string `yaml:"allowList"`
+}
+
+type AccessLogSettings struct {
+	// log only a fraction of the successful requests, errors are always logged
+	Sampled bool `yaml:"sampled"`
+	// fraction (0.0-1.0) of the successful requests logged when sampled
+	SampleRate float64 `yaml:"sampleRate" validate:"min=0,max=1"`
+}
+
+type PathDepthSettings struct {
+	// the fewest segments of the request path forwarded to the service, unbounded if 0
+	MinDepth int `yaml:"minDepth" validate:"min=0"`
+	// the most segments of the request path forwarded to the service, unbounded if 0
+	MaxDepth int `yaml:"maxDepth" validate:"omitempty,gtefield=MinDepth"`
+}
+
+type ServiceMetricsSettings struct {
+	// name the metrics of the service {prefix}_{service}_... in a registry of its own served at
+	// /services/{name}/metrics, instead of labelling the gateway metrics with the service
+	PerServiceNamespace bool `yaml:"perServiceNamespace"`
+}
+
+type RateLimiterQueueSettings struct {
+	Enabled bool `yaml:"enabled"`
+	// the longest (ms) a request waits for the limiter, requests which would wait longer are rejected
+	MaxWait int `yaml:"maxWait" validate:"min=0"`
 }
 
 type CacheSettings struct {
-	Enabled            bool `yaml:"enabled"`
+	Enabled bool `yaml:"enabled"`
+	// Deprecated: use DefaultTTL, it is used as the default ttl when that isn't set
 	ExpirationInterval uint `yaml:"expirationInterval"`
-	CleanupInterval    uint `yaml:"cleanupInterval"`
+	// time (secs) a response is cached when its Cache-Control has no max-age, defaults to 5
+	DefaultTTL uint `yaml:"defaultTTL"`
+	// interval (secs) at which the expired entries are removed, defaults to 10
+	CleanupInterval uint `yaml:"cleanupInterval"`
+	// store of the cached responses, memory (default) or noop
+	Backend string `yaml:"backend" validate:"omitempty,oneof=memory noop"`
+	// advertise with a HIT or MISS header if the response was served from the cache
+	StatusHeader CacheHeaderSettings `yaml:"statusHeader"`
+	// prefixes of the response content types which are cached e.g. "application/json" or
+	// "text/", every content type is cached when empty
+	CacheableContentTypes []string `yaml:"cacheableContentTypes"`
+	// invalidate the cached responses of a url after a POST, PUT, PATCH or DELETE to it,
+	// the responses of these methods are not cached
+	WriteThrough bool `yaml:"writeThrough"`
+	// reset the expiration of an entry on every hit so frequently read entries stay cached
+	SlidingExpiration bool `yaml:"slidingExpiration"`
+	// the largest response body (bytes) cached, larger ones are still forwarded. Unlimited if 0
+	MaxBodySize int64 `yaml:"maxBodySize" validate:"min=0"`
+}
+
+type CacheHeaderSettings struct {
+	Enabled bool `yaml:"enabled"`
+	// name of the header, defaults to X-Cache
+	Name string `yaml:"name"`
 }
 
 type AuthSettings struct {
@@ -58,27 +186,185 @@ type AuthSettings struct {
 	Anonymous bool `yaml:"anonymous"`
 	// path to the secret file
 	Secret string `yaml:"secret"`
-	// list of routes that require authentication
+	// list of routes that require authentication, a * segment matches any segment and a trailing * the route and any nested one e.g. /admin/*
 	Routes []string `yaml:"routes"`
+	// signing algorithm of the tokens issued on renewal, defaults to HS256
+	Algorithm string `yaml:"algorithm" validate:"omitempty,oneof=HS256 HS384 HS512"`
+	// lifetime (secs) of the tokens issued on renewal, defaults to 3600
+	TokenTTL int `yaml:"tokenTTL"`
+	// clock skew (secs) tolerated when validating the expiration and not before times
+	Leeway int `yaml:"leeway" validate:"min=0"`
+	// claims every token must have e.g. tenant_id, tokens missing one are rejected with a 403
+	RequiredClaims []string `yaml:"requiredClaims"`
 }
 
 type HealthCheckSettings struct {
 	Enabled bool `yaml:"enabled"`
 	// path to the health check endpoint
 	Uri string `yaml:"uri"`
+	// method of the health check request, defaults to GET
+	Method string `yaml:"method"`
+	// body sent with the health check request and its content type
+	Body        string `yaml:"body"`
+	ContentType string `yaml:"contentType"`
+	// the service is only healthy if the response body contains the string, not checked if empty
+	SuccessBodyContains string `yaml:"successBodyContains"`
+}
+
+type UpstreamTLSSettings struct {
+	// server name used for SNI and certificate verification instead of the address host
+	ServerName string `yaml:"serverName"`
+	// skip verifying the upstream certificate, only for local dev
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+}
+
+type UpstreamTransportSettings struct {
+	// the maximum duration (secs) for establishing the connection, defaults to 5
+	DialTimeout int `yaml:"dialTimeout"`
+	// the maximum duration (secs) for the tls handshake, defaults to 5
+	TLSHandshakeTimeout int `yaml:"tlsHandshakeTimeout"`
+	// the maximum duration (secs) to wait for the response headers once the request is
+	// written, the body is not bounded by it. Defaults to 30
+	ResponseHeaderTimeout int `yaml:"responseHeaderTimeout"`
+	// network used to connect to the service, tcp (default) or unix
+	Network string `yaml:"network" validate:"omitempty,oneof=tcp unix"`
+	// path of the socket when the network is unix, the service address is still used as the host
+	SocketPath string `yaml:"socketPath" validate:"required_if=Network unix"`
+}
+
+type MockSettings struct {
+	Enabled bool `yaml:"enabled"`
+	// path to the yaml file with the mocked responses
+	File string `yaml:"file"`
+}
+
+type MatchRuleSettings struct {
+	// header whose value is matched against the pattern
+	Header  string `yaml:"header" validate:"required"`
+	Pattern string `yaml:"pattern" validate:"required"`
+	// address to forward the request to when the pattern matches
+	Addr string `yaml:"addr" validate:"required"`
+}
+
+type CanarySettings struct {
+	// address receiving a share of the traffic
+	Addr string `yaml:"addr"`
+	// percentage of the requests sent to the canary
+	Weight int `yaml:"weight" validate:"min=0,max=100"`
+}
+
+type ResponseHeaderSettings struct {
+	// headers set on every response to the client, replacing the ones sent by the service
+	Add map[string]string `yaml:"add"`
 }
 
 type ServiceConf struct {
+	// name of the registry template whose settings are used as defaults for this service
+	Template  string   `yaml:"template"`
 	Name      string   `yaml:"name" validate:"required"`
 	Addr      string   `yaml:"addr" validate:"required"`
 	WhiteList []string `yaml:"whitelist" validate:"required"`
-	// uri to redirect to if the service is down
+	// scheme used when the address has none, http (default) or https
+	Scheme string `yaml:"scheme" validate:"omitempty,oneof=http https"`
+	// labels used to select the service e.g. env: blue, see /services/labels/route
+	Labels map[string]string `yaml:"labels"`
+	// group of the service e.g. payments, GET /services?group= lists the services of a group
+	Group string `yaml:"group"`
+	// tags of the service e.g. production, GET /services?tag= lists the services with every tag
+	Tags []string `yaml:"tags"`
+	// uris tried in order when the circuit of the service is open
+	FallbackUris []string `yaml:"fallbackUris"`
+	// Deprecated: use FallbackUris, a fallbackUri is tried before them
 	FallbackUri    string              `yaml:"fallbackUri"`
 	Health         HealthCheckSettings `yaml:"health" validate:"required"`
 	Auth           AuthSettings        `yaml:"auth"`
 	Cache          CacheSettings       `yaml:"cache"`
 	CircuitBreaker CircuitSettings     `yaml:"circuitBreaker"`
 	RateLimiter    RateLimiterSettings `yaml:"rateLimiter"`
+	UpstreamTLS    UpstreamTLSSettings `yaml:"upstreamTLS"`
+	// timeouts of the connections to the service
+	UpstreamTransport UpstreamTransportSettings `yaml:"upstreamTransport"`
+	// serve canned responses instead of forwarding, meant for local development
+	Mock MockSettings `yaml:"mock"`
+	// rules evaluated in order to route requests to a different address based on a header
+	MatchRules []MatchRuleSettings `yaml:"matchRules" validate:"dive"`
+	// send a percentage of the requests to a canary address
+	Canary CanarySettings `yaml:"canary"`
+	// name of the cookie whose value pins a client to one of the weighted backends,
+	// the gateway sets it when the request doesn't have one. Empty disables sticky sessions
+	StickyCookie string `yaml:"stickyCookie"`
+	// headers added to the responses of the service, including the ones served from the cache
+	ResponseHeaders ResponseHeaderSettings `yaml:"responseHeaders"`
+	// leave the query string out of the route metrics label, the query is still forwarded
+	IgnoreQueryInRoute bool `yaml:"ignoreQueryInRoute"`
+	// let POST requests change their method with the X-HTTP-Method-Override header or the _method
+	// query parameter, for clients which can't send PUT, PATCH or DELETE
+	HTTPMethodOverride bool `yaml:"httpMethodOverride"`
+	// forward the trailers of the requests to the service and the trailers of its responses to the
+	// clients e.g. for gRPC-Web, they are dropped otherwise
+	ForwardTrailers bool `yaml:"forwardTrailers"`
+	// prefix prepended to the upstream path after the service name is stripped, e.g. /internal
+	// forwards /orders/get/123 to /internal/get/123
+	UpstreamPathPrefix string `yaml:"upstreamPathPrefix"`
+	// decompress gzip and deflate encoded request bodies before forwarding
+	DecompressRequest bool `yaml:"decompressRequest"`
+	// maximum size in bytes of a decompressed request body, defaults to 10MB
+	MaxDecompressedSize int64 `yaml:"maxDecompressedSize"`
+	// the maximum duration (secs) for writing the response once the headers are sent, defaults to 5.
+	// A negative value disables it for streaming services. Server.WriteTimeout is the upper bound
+	WriteTimeout int `yaml:"writeTimeout"`
+	// maximum number of requests handled at once, excess requests are rejected with a 503.
+	// Zero means unlimited
+	MaxConcurrentRequests int `yaml:"maxConcurrentRequests" validate:"min=0"`
+	// number of times a request which failed to reach the service is retried, responses are never retried
+	Retries int `yaml:"retries" validate:"min=0"`
+	// limits the retries to the service, the global retry budget still applies
+	RetryBudget ServiceRetryBudgetSettings `yaml:"retryBudget"`
+	// which failures are retried
+	RetryPolicy RetryPolicySettings `yaml:"retryPolicy"`
+	// the maximum duration (secs) of a request to the service including reading its response, unlimited if 0
+	TimeoutSeconds int `yaml:"timeoutSeconds" validate:"min=0"`
+	// timeouts (secs) overriding TimeoutSeconds for the paths after the service name matching a
+	// pattern, the patterns are exact paths or globs e.g. /report/*
+	EndpointTimeouts map[string]int `yaml:"endpointTimeouts" validate:"dive,min=0"`
+	// timeouts (secs) overriding TimeoutSeconds for the requests with a method e.g. POST: 30, the
+	// endpoint timeouts take precedence
+	MethodTimeouts map[string]int `yaml:"methodTimeouts" validate:"dive,min=0"`
+	// how to react to the service rejecting a request as unauthorized
+	AuthFailure AuthFailureSettings `yaml:"authFailure"`
+	// treatment of the inbound Forwarded and X-Forwarded-* headers: strip them, append to them or
+	// set them to the resolved client. By default they're only appended to for trusted proxies
+	ForwardedHeaders string `yaml:"forwardedHeaders" validate:"omitempty,oneof=strip append set"`
+	// route the paths matching the pattern to the service when no service is named after their
+	// first segment, e.g. /static/** or /api/v[12]/*. The leading literal segments are stripped
+	PathPattern string `yaml:"pathPattern"`
+	// log the request and response bodies for debugging, never enable it in production
+	DebugLogBodies DebugLogBodiesSettings `yaml:"debugLogBodies"`
+	// restricts the request headers forwarded to the service
+	ForwardHeaders ForwardHeadersSettings `yaml:"forwardHeaders"`
+	// sampling of the access log of the requests to the service
+	AccessLog AccessLogSettings `yaml:"accessLog"`
+	// range of the number of segments of the paths forwarded to the service, others get a 404
+	PathDepthRouting PathDepthSettings `yaml:"pathDepthRouting"`
+	// the most upgraded e.g. websocket connections to the service open at once, unlimited if 0
+	MaxWebSocketConnections int `yaml:"maxWebSocketConnections" validate:"min=0"`
+	// the maximum size in bytes of the request headers sent to the service, larger requests get a
+	// 431. Defaults to Server.MaxHeaderBytes, which also bounds it as the headers are read first
+	MaxHeaderBytes int `yaml:"maxHeaderBytes" validate:"min=0"`
+	// metrics of the service, labelled in the gateway metrics by default
+	Metrics ServiceMetricsSettings `yaml:"metrics"`
+	// fraction (0.0-1.0) of the requests to the service whose info logs are written, all of them
+	// if unset. The errors are always logged
+	LogSampleRate *float64 `yaml:"logSampleRate" validate:"omitempty,min=0,max=1"`
+}
+
+// Fallbacks returns the fallback uris in the order they are tried, the deprecated
+// fallbackUri is the first of them
+func (sc *ServiceConf) Fallbacks() []string {
+	if sc.FallbackUri == "" || slices.Contains(sc.FallbackUris, sc.FallbackUri) {
+		return slices.Clone(sc.FallbackUris)
+	}
+	return append([]string{sc.FallbackUri}, sc.FallbackUris...)
 }
 
 type Conf struct {
@@ -89,28 +375,155 @@ type Conf struct {
 		ReadTimeout int `yaml:"readTimeout"`
 		// the maximum duration before timing out writes of the response
 		WriteTimeout int `yaml:"writeTimeout"`
+		// the maximum duration (secs) for reading the request headers, it also bounds the tls handshake. Defaults to 5
+		ReadHeaderTimeout int `yaml:"readHeaderTimeout"`
+		// the maximum duration (secs) a keep-alive connection waits for the next request, defaults to 60
+		IdleTimeout int `yaml:"idleTimeout"`
+		// the maximum size in bytes of the request headers, defaults to 1MB
+		MaxHeaderBytes int `yaml:"maxHeaderBytes"`
+		// the maximum number of request header values forwarded to the services, the requests
+		// over it are rejected with a 431. Unlimited if 0
+		MaxForwardedHeaders int `yaml:"maxForwardedHeaders"`
+		// the maximum total size in bytes of the names and values of the request headers forwarded
+		// to the services, the requests over it are rejected with a 431. Unlimited if 0
+		MaxForwardedHeaderBytes int `yaml:"maxForwardedHeaderBytes"`
+		// the maximum number of concurrently open client connections, unlimited if 0
+		MaxConnections int `yaml:"maxConnections"`
+		// the maximum number of requests to the services in flight at once across all of them,
+		// requests over it are rejected with a 503. Unlimited if 0
+		MaxConcurrentUpstream int `yaml:"maxConcurrentUpstream"`
+		// the maximum number of requests to the services handled at once across all of them, the
+		// low priority requests are rejected with a 503 first as it fills up. Unlimited if 0
+		MaxConcurrentRequests int `yaml:"maxConcurrentRequests"`
+		// header with the priority of a request: low, normal or high. Defaults to X-Priority, it
+		// is only honored from the trusted proxies. While MaxConcurrentRequests is set it is
+		// stripped before forwarding. The requests without it are normal
+		PriorityHeader string `yaml:"priorityHeader"`
 		// the maximum duration before timing out the graceful shutdown
 		GracefulTimeout int `yaml:"gracefulTimeout"`
+		// the duration (secs) /ready reports unavailable before the graceful shutdown starts
+		PreShutdownDelay int `yaml:"preShutdownDelay"`
+		// /ready reports unavailable while more than this percentage of the circuit breakers of
+		// the services are open, disabled if 0
+		MaxOpenBreakersPercent float64 `yaml:"maxOpenBreakersPercent"`
 
 		TLSConfig struct {
 			Enabled bool `yaml:"enabled"`
 			// path to the certificate and key files
 			CertFile string `yaml:"certFile"`
 			KeyFile  string `yaml:"keyFile"`
+			// replace the key encrypting the session tickets every RotationInterval, otherwise
+			// the key is the same for the lifetime of the process
+			RotateSessionTickets bool `yaml:"rotateSessionTickets"`
+			// hours between the session ticket key rotations, defaults to 24
+			RotationInterval int `yaml:"rotationInterval"`
 		}
 
 		Metrics struct {
 			Prefix  string    `yaml:"prefix"`
 			Buckets []float64 `yaml:"buckets"`
+			// window (secs) of the per service request and error rates, defaults to 60
+			StatsWindow int `yaml:"statsWindow"`
+			// buckets (bytes) of the response size histogram, defaults to 100B to 1MB
+			SizeBuckets []float64 `yaml:"sizeBuckets"`
 		} `yaml:"metrics"`
 
 		RateLimiter RateLimiterSettings `yaml:"rateLimiter"`
+		// give every client a separate global limit per service it resolves to, so traffic to one
+		// service doesn't use up the limit of the others. Unresolved requests share one limit
+		RateLimitPerRoute bool `yaml:"rateLimitPerRoute"`
+		// sampling of the access log of the requests not sampled by their service
+		AccessLog AccessLogSettings `yaml:"accessLog"`
+		// limits every client ip across the requests forwarded to all the services, checked
+		// after the global and before the service rate limiters
+		PerIPRateLimiter RateLimiterSettings `yaml:"perIPRateLimiter"`
+		// route the requests by their Host header to a service name, e.g. tenant-a.gateway.com: tenant-a.
+		// The whole path is forwarded, path based routing applies to the hosts not listed
+		VirtualHosts map[string]string `yaml:"virtualHosts"`
+
+		// limits the retries of all the services, zero limits are not enforced
+		RetryBudget RetryBudgetSettings `yaml:"retryBudget"`
+
+		// replay the response of requests repeated with the same idempotency key, for all services
+		Deduplication struct {
+			Enabled bool `yaml:"enabled"`
+			// name of the idempotency key header, defaults to Idempotency-Key
+			Header string `yaml:"header"`
+			// duration (secs) a response is kept, defaults to 86400
+			TTL int `yaml:"ttl"`
+		} `yaml:"deduplication"`
+
+		Admin struct {
+			// path to the file with the bearer token required by the admin endpoints,
+			// the endpoints reject every request when it is not set
+			TokenFile string `yaml:"tokenFile"`
+		} `yaml:"admin"`
+
+		Debug struct {
+			// expose the pprof handlers and /debug/state, protected by the admin token
+			Pprof bool `yaml:"pprof"`
+		} `yaml:"debug"`
+
+		// ips or cidrs of the proxies whose Forwarded and X-Forwarded-* headers are trusted
+		TrustedProxies []string `yaml:"trustedProxies"`
+
+		// id correlating a request across the gateway and the services
+		Correlation struct {
+			// headers checked in order for an id sent by the client, a new id is generated if
+			// none is set. Defaults to the outbound header
+			InboundHeaders []string `yaml:"inboundHeaders"`
+			// header carrying the id to the services, defaults to X-Trace-Id
+			OutboundHeader string `yaml:"outboundHeader"`
+		} `yaml:"correlation"`
 	}
 
 	Registry struct {
 		// Interval (secs) at which the service will send a heartbeat to all registered services
 		HeartbeatInterval int `yaml:"heartbeatInterval"`
-		Services          []ServiceConf
+		// Reject registering or updating a service with an address already used by another service
+		EnforceUniqueAddresses bool `yaml:"enforceUniqueAddresses"`
+		// check the health of a service when it is registered or updated and report it in the response
+		CheckOnRegister bool `yaml:"checkOnRegister"`
+		// fail a config reload if a service address doesn't resolve, by default the service
+		// keeps its previous settings
+		StrictAddressValidation bool `yaml:"strictAddressValidation"`
+		// shared settings referenced by services with ServiceConf.Template
+		Templates map[string]ServiceConf `yaml:"templates"`
+		Services  []ServiceConf
+	}
+}
+
+// ApplyTemplate merges the template referenced by the service, if any, as its defaults
+func (c *Conf) ApplyTemplate(s ServiceConf) (ServiceConf, error) {
+	if s.Template == "" {
+		return s, nil
+	}
+	t, ok := c.Registry.Templates[s.Template]
+	if !ok {
+		return s, fmt.Errorf("%w: %s", ErrTemplateNotFound, s.Template)
+	}
+	return MergeWithTemplate(t, s), nil
+}
+
+// MergeWithTemplate deep merges the service settings over the template. Every non zero
+// value of override is kept, so a template can't be used to e.g. disable a bool setting.
+func MergeWithTemplate(template, override ServiceConf) ServiceConf {
+	merged := template
+	mergeValue(reflect.ValueOf(&merged).Elem(), reflect.ValueOf(override))
+	return merged
+}
+
+func mergeValue(dst, src reflect.Value) {
+	if src.Kind() != reflect.Struct {
+		if !src.IsZero() {
+			dst.Set(src)
+		}
+		return
+	}
+	for i := 0; i < src.NumField(); i++ {
+		if dst.Field(i).CanSet() {
+			mergeValue(dst.Field(i), src.Field(i))
+		}
 	}
 }
 
@@ -134,16 +547,80 @@ func (c *Conf) Verify() bool {
 	if c.Server.WriteTimeout == 0 {
 		c.Server.WriteTimeout = 10
 	}
+	if c.Server.ReadHeaderTimeout == 0 {
+		c.Server.ReadHeaderTimeout = 5
+	}
+	if c.Server.IdleTimeout == 0 {
+		c.Server.IdleTimeout = 60
+	}
+	if c.Server.MaxHeaderBytes == 0 {
+		c.Server.MaxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+	if c.Server.TLSConfig.RotationInterval == 0 {
+		c.Server.TLSConfig.RotationInterval = 24
+	}
+	if c.Server.TLSConfig.RotationInterval < 0 {
+		slog.Error("Invalid session ticket rotation interval", "rotationInterval", c.Server.TLSConfig.RotationInterval)
+		return false
+	}
+	if c.Server.ReadHeaderTimeout < 1 || c.Server.IdleTimeout < 1 || c.Server.MaxHeaderBytes < 0 || c.Server.MaxConnections < 0 ||
+		c.Server.MaxConcurrentUpstream < 0 || c.Server.MaxConcurrentRequests < 0 || c.Server.MaxForwardedHeaders < 0 ||
+		c.Server.MaxForwardedHeaderBytes < 0 {
+		slog.Error("Invalid server limits", "readHeaderTimeout", c.Server.ReadHeaderTimeout,
+			"idleTimeout", c.Server.IdleTimeout, "maxHeaderBytes", c.Server.MaxHeaderBytes, "maxConnections", c.Server.MaxConnections,
+			"maxConcurrentUpstream", c.Server.MaxConcurrentUpstream, "maxConcurrentRequests", c.Server.MaxConcurrentRequests,
+			"maxForwardedHeaders", c.Server.MaxForwardedHeaders, "maxForwardedHeaderBytes", c.Server.MaxForwardedHeaderBytes)
+		return false
+	}
+	if c.Server.MaxOpenBreakersPercent < 0 || c.Server.MaxOpenBreakersPercent > 100 {
+		slog.Error("Invalid open circuit breakers threshold", "maxOpenBreakersPercent", c.Server.MaxOpenBreakersPercent)
+		return false
+	}
+	if c.Server.RetryBudget.MaxConcurrent < 0 || c.Server.RetryBudget.MaxPercentage < 0 || c.Server.RetryBudget.MaxPercentage > 100 {
+		slog.Error("Invalid retry budget", "maxConcurrent", c.Server.RetryBudget.MaxConcurrent, "maxPercentage", c.Server.RetryBudget.MaxPercentage)
+		return false
+	}
+	// prometheus panics registering a histogram whose buckets aren't strictly increasing
+	if !increasing(c.Server.Metrics.Buckets) || !increasing(c.Server.Metrics.SizeBuckets) {
+		slog.Error("Invalid metrics buckets, they must be strictly increasing", "buckets", c.Server.Metrics.Buckets,
+			"sizeBuckets", c.Server.Metrics.SizeBuckets)
+		return false
+	}
+	if err := Validate.Struct(c.Server.AccessLog); err != nil {
+		slog.Error("Invalid access log sampling", "sampleRate", c.Server.AccessLog.SampleRate, "error", err.Error())
+		return false
+	}
 	if c.Registry.HeartbeatInterval == 0 {
 		c.Registry.HeartbeatInterval = 30
 	}
+	for i, s := range c.Registry.Services {
+		merged, err := c.ApplyTemplate(s)
+		if err != nil {
+			slog.Error("Invalid service template", "service", s.Name, "error", err.Error())
+			return false
+		}
+		c.Registry.Services[i] = merged
+	}
+	return true
+}
+
+// Path is the configuration file loaded on start and reloaded on SIGHUP
+var Path = "./config/config.yaml"
+
+// increasing reports whether every bucket is greater than the one before it
+func increasing(buckets []float64) bool {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return false
+		}
+	}
 	return true
 }
 
 // LoadConf loads the configuration from the config.yaml file
 func LoadConf() {
 	c := Conf{}
-	yamlFile, err := os.ReadFile("./config/config.yaml")
+	yamlFile, err := os.ReadFile(Path)
 	if err != nil {
 		slog.Error("yamlFile.Get err", "error", err.Error())
 	}
@@ -160,6 +637,57 @@ func LoadConf() {
 	slog.Info("Config loaded successfully")
 }
 
+// ReloadConf loads the services of the configuration file again for the registry to register or
+// update them, the rest of the configuration only applies on restart. A service whose address
+// doesn't resolve is left out so the registry keeps its current settings, unless
+// Registry.StrictAddressValidation fails the whole reload.
+func ReloadConf(path string) ([]ServiceConf, error) {
+	c := Conf{}
+	yamlFile, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(yamlFile, &c); err != nil {
+		return nil, err
+	}
+	if !c.Verify() {
+		return nil, errors.New("config verification failed")
+	}
+	services := make([]ServiceConf, 0, len(c.Registry.Services))
+	for _, s := range c.Registry.Services {
+		if err := Validate.Struct(s); err != nil {
+			return nil, fmt.Errorf("service %s: %w", s.Name, err)
+		}
+		if err := resolveAddress(s.Addr); err != nil {
+			if c.Registry.StrictAddressValidation {
+				return nil, fmt.Errorf("service %s: %w", s.Name, err)
+			}
+			slog.Warn("Service address doesn't resolve, keeping the current settings", "service", s.Name,
+				"address", s.Addr, "error", err.Error())
+			continue
+		}
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+// resolveAddress looks up the host of a service address, with or without a scheme and port
+func resolveAddress(addr string) error {
+	host := addr
+	if u, err := url.Parse(addr); err == nil && u.Host != "" {
+		host = u.Hostname()
+	} else if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if host == "" {
+		return nil
+	}
+	if _, err := net.LookupHost(host); err != nil {
+		return fmt.Errorf("%w: %s", ErrUnresolvableAddress, err.Error())
+	}
+	return nil
+}
+
 func GetCertFile() string {
 	// Append path to root folder
 	certPath := filepath.Join(GetWd(), AppConfig.Server.TLSConfig.CertFile)
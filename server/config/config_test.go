@@ -0,0 +1,168 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+const templateConf = `
+server:
+  host: localhost
+  port: "8080"
+registry:
+  templates:
+    secured:
+      whitelist: &all
+        - "ALL"
+      health:
+        enabled: true
+        uri: "/health"
+      auth:
+        enabled: true
+        secret: "path/to/secret"
+        routes:
+          - "/private"
+      cache:
+        enabled: true
+        expirationInterval: 60
+  services:
+    - name: orders
+      template: secured
+      addr: "localhost:3000"
+    - name: payments
+      template: secured
+      addr: "localhost:3001"
+      whitelist: *all
+      cache:
+        expirationInterval: 10
+`
+
+func TestMergeWithTemplate(t *testing.T) {
+	c := Conf{}
+	assert.Nil(t, yaml.Unmarshal([]byte(templateConf), &c))
+	assert.True(t, c.Verify())
+
+	orders, payments := c.Registry.Services[0], c.Registry.Services[1]
+	assert.Equal(t, "localhost:3000", orders.Addr)
+	assert.Equal(t, "localhost:3001", payments.Addr)
+	for _, s := range []ServiceConf{orders, payments} {
+		assert.Equal(t, AuthSettings{Enabled: true, Secret: "path/to/secret", Routes: []string{"/private"}}, s.Auth)
+		assert.Equal(t, HealthCheckSettings{Enabled: true, Uri: "/health"}, s.Health)
+		assert.Equal(t, []string{"ALL"}, s.WhiteList)
+		assert.True(t, s.Cache.Enabled)
+	}
+	assert.Equal(t, uint(60), orders.Cache.ExpirationInterval)
+	assert.Equal(t, uint(10), payments.Cache.ExpirationInterval)
+	// the template itself is not modified by the merge
+	assert.Equal(t, uint(60), c.Registry.Templates["secured"].Cache.ExpirationInterval)
+	assert.Nil(t, Validate.Struct(orders))
+}
+
+func TestApplyTemplateNotFound(t *testing.T) {
+	c := Conf{}
+	_, err := c.ApplyTemplate(ServiceConf{Name: "orders", Template: "missing"})
+	assert.ErrorIs(t, err, ErrTemplateNotFound)
+
+	c.Server.Host, c.Server.Port = "localhost", "8080"
+	c.Registry.Services = []ServiceConf{{Name: "orders", Template: "missing"}}
+	assert.False(t, c.Verify())
+}
+
+func TestValidateUpstreamTransport(t *testing.T) {
+	conf := ServiceConf{Name: "orders", Addr: "orders.internal", WhiteList: []string{"ALL"}, Health: HealthCheckSettings{Uri: "/health"}}
+	conf.UpstreamTransport = UpstreamTransportSettings{Network: "unix"}
+	assert.NotNil(t, Validate.Struct(conf))
+	conf.UpstreamTransport.SocketPath = "/run/orders.sock"
+	assert.Nil(t, Validate.Struct(conf))
+	conf.UpstreamTransport.Network = "udp"
+	assert.NotNil(t, Validate.Struct(conf))
+}
+
+func TestServiceConfFallbacks(t *testing.T) {
+	conf := ServiceConf{FallbackUri: "eu.internal"}
+	assert.Equal(t, []string{"eu.internal"}, conf.Fallbacks())
+	conf.FallbackUris = []string{"us.internal", "ap.internal"}
+	assert.Equal(t, []string{"eu.internal", "us.internal", "ap.internal"}, conf.Fallbacks())
+	conf.FallbackUri = "ap.internal"
+	assert.Equal(t, []string{"us.internal", "ap.internal"}, conf.Fallbacks())
+	assert.Empty(t, (&ServiceConf{}).Fallbacks())
+}
+
+func TestVerifyServerLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*Conf)
+		valid bool
+	}{
+		{"defaults", func(c *Conf) {}, true},
+		{"configured", func(c *Conf) { c.Server.ReadHeaderTimeout, c.Server.IdleTimeout, c.Server.MaxHeaderBytes = 2, 30, 4096 }, true},
+		{"negative read header timeout", func(c *Conf) { c.Server.ReadHeaderTimeout = -1 }, false},
+		{"negative idle timeout", func(c *Conf) { c.Server.IdleTimeout = -1 }, false},
+		{"negative max header bytes", func(c *Conf) { c.Server.MaxHeaderBytes = -1 }, false},
+		{"max connections", func(c *Conf) { c.Server.MaxConnections = 100 }, true},
+		{"negative max connections", func(c *Conf) { c.Server.MaxConnections = -1 }, false},
+		{"negative max concurrent upstream", func(c *Conf) { c.Server.MaxConcurrentUpstream = -1 }, false},
+		{"increasing buckets", func(c *Conf) {
+			c.Server.Metrics.Buckets, c.Server.Metrics.SizeBuckets = []float64{0.1, 0.5, 1}, []float64{100, 1000}
+		}, true},
+		{"unsorted buckets", func(c *Conf) { c.Server.Metrics.Buckets = []float64{0.5, 0.1} }, false},
+		{"duplicate size buckets", func(c *Conf) { c.Server.Metrics.SizeBuckets = []float64{100, 100, 1000} }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Conf{}
+			c.Server.Host = "localhost"
+			c.Server.Port = "8080"
+			tt.setup(&c)
+			assert.Equal(t, tt.valid, c.Verify())
+			if tt.valid {
+				assert.GreaterOrEqual(t, c.Server.ReadHeaderTimeout, 1)
+				assert.GreaterOrEqual(t, c.Server.IdleTimeout, 1)
+				assert.Positive(t, c.Server.MaxHeaderBytes)
+			}
+		})
+	}
+}
+
+func TestReloadConf(t *testing.T) {
+	const reloaded = `
+server:
+  host: localhost
+  port: "8080"
+registry:
+  strictAddressValidation: %t
+  services:
+    - name: orders
+      addr: "localhost:3100"
+      whitelist: ["ALL"]
+      health:
+        uri: "/health"
+    - name: payments
+      addr: "payments.invalid:3101"
+      whitelist: ["ALL"]
+      health:
+        uri: "/health"
+`
+
+	t.Run("unresolvable service left out", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		assert.Nil(t, os.WriteFile(path, []byte(fmt.Sprintf(reloaded, false)), 0o644))
+		services, err := ReloadConf(path)
+		assert.Nil(t, err)
+		assert.Len(t, services, 1)
+		assert.Equal(t, "orders", services[0].Name)
+		assert.Equal(t, "localhost:3100", services[0].Addr)
+	})
+
+	t.Run("strict validation fails the reload", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		assert.Nil(t, os.WriteFile(path, []byte(fmt.Sprintf(reloaded, true)), 0o644))
+		_, err := ReloadConf(path)
+		assert.ErrorIs(t, err, ErrUnresolvableAddress)
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/middleware"
+)
+
+// DebugState is a snapshot of the gateway internals used to diagnose leaks under load
+type DebugState struct {
+	Services   int `json:"services"`
+	Goroutines int `json:"goroutines"`
+	// requests currently being handled per service
+	InFlight            map[string]int64    `json:"inFlight"`
+	RateLimiterVisitors RateLimiterVisitors `json:"rateLimiterVisitors"`
+	// breaker state per service, only services with the breaker enabled are listed
+	CircuitBreakers map[string]string `json:"circuitBreakers"`
+}
+
+type RateLimiterVisitors struct {
+	Global   int            `json:"global"`
+	Services map[string]int `json:"services"`
+}
+
+// LogLevelBody is the level of the logger e.g. debug, info, warn or error
+type LogLevelBody struct {
+	Level string `json:"level"`
+}
+
+// loadAdminToken reads the admin token from the file, an unset or unreadable file disables the admin endpoints
+func loadAdminToken(path string) []byte {
+	if path == "" {
+		return nil
+	}
+	token, err := os.ReadFile(path)
+	if err != nil {
+		slog.Error("Unable to read admin token file", "path", path, "error", err.Error())
+		return nil
+	}
+	return bytes.TrimSpace(token)
+}
+
+// registerDebugRoutes registers the pprof handlers and /debug/state behind the admin auth
+func registerDebugRoutes(mux *http.ServeMux, rh *RequestHandler) {
+	admin := middleware.AdminAuthMiddleware(rh.AdminToken)
+	mux.Handle("/debug/pprof/", admin(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", admin(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", admin(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", admin(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", admin(http.HandlerFunc(pprof.Trace)))
+	mux.Handle("GET /debug/state", admin(http.HandlerFunc(rh.DebugState)))
+}
+
+// State returns a snapshot of the gateway internals
+func (rh *RequestHandler) State() DebugState {
+	state := DebugState{
+		Goroutines: runtime.NumGoroutine(),
+		InFlight:   make(map[string]int64),
+		RateLimiterVisitors: RateLimiterVisitors{
+			Global:   rh.RateLimiter.VisitorCount(),
+			Services: make(map[string]int),
+		},
+		CircuitBreakers: make(map[string]string),
+	}
+	sr := rh.ServiceRegistry
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	state.Services = len(sr.Services)
+	for name, s := range sr.Services {
+		state.InFlight[name] = s.InFlight()
+		if s.IsRateLimiterEnabled() {
+			state.RateLimiterVisitors.Services[name] = s.RateLimiter.VisitorCount()
+		}
+		if s.CircuitBreaker.IsEnabled() {
+			state.CircuitBreakers[name] = s.CircuitBreaker.State()
+		}
+	}
+	return state
+}
+
+// DebugState returns the gateway internals as json
+func (rh *RequestHandler) DebugState(w http.ResponseWriter, r *http.Request) {
+	slog.Info("Get debug state", "req", RequestToMap(r))
+	j, err := json.Marshal(rh.State())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(j); err != nil {
+		slog.Error("Error writing response", "error", err.Error())
+	}
+}
+
+// SetLogLevel changes the level of the logger without a restart e.g. to debug temporarily
+func (rh *RequestHandler) SetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var body LogLevelBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(body.Level)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	previous := LogLevel.Level()
+	LogLevel.Set(level)
+	slog.Warn("Log level changed", "from", previous.String(), "to", level.String(), "req", RequestToMap(r))
+	j, err := json.Marshal(LogLevelBody{Level: level.String()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(j); err != nil {
+		slog.Error("Error writing response", "error", err.Error())
+	}
+}
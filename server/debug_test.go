@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/ArmaanKatyal/go-api-gateway/server/testutil"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugRoutes(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "admin")
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("admin-token\n"), 0o600))
+	gw, cleanup := testutil.NewTestGateway(t, []config.ServiceConf{
+		{
+			Name:           "orders",
+			CircuitBreaker: config.CircuitSettings{Enabled: true, Timeout: 60, FailureRatio: 0.5},
+			RateLimiter:    config.RateLimiterSettings{Enabled: true, Rate: 100, Burst: 100, CleanupInterval: 60},
+		},
+		{Name: "payments"},
+	}, func(c *config.Conf) {
+		c.Server.Debug.Pprof = true
+		c.Server.Admin.TokenFile = tokenFile
+	})
+	defer cleanup()
+	admin := http.Header{"Authorization": {"Bearer admin-token"}}
+
+	get(t, gw.BaseURL+"/orders/list", nil)
+	code, body := get(t, gw.BaseURL+"/debug/state", admin)
+	assert.Equal(t, http.StatusOK, code)
+	var fields map[string]json.RawMessage
+	assert.Nil(t, json.Unmarshal([]byte(body), &fields))
+	for _, f := range []string{"services", "goroutines", "inFlight", "rateLimiterVisitors", "circuitBreakers"} {
+		assert.Contains(t, fields, f)
+	}
+	var state DebugState
+	assert.Nil(t, json.Unmarshal([]byte(body), &state))
+	assert.Equal(t, 2, state.Services)
+	assert.Equal(t, map[string]int64{"orders": 0, "payments": 0}, state.InFlight)
+	assert.Equal(t, map[string]int{"orders": 1}, state.RateLimiterVisitors.Services)
+	assert.Equal(t, map[string]string{"orders": "closed"}, state.CircuitBreakers)
+
+	code, _ = get(t, gw.BaseURL+"/debug/pprof/", admin)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = get(t, gw.BaseURL+"/debug/state", nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = get(t, gw.BaseURL+"/debug/pprof/", http.Header{"Authorization": {"Bearer wrong"}})
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestDebugRoutesDisabled(t *testing.T) {
+	gw, cleanup := testutil.NewTestGateway(t, nil)
+	defer cleanup()
+	// without debug the path is handled as a request to a "debug" service
+	code, _ := get(t, gw.BaseURL+"/debug/state", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestSetLogLevel(t *testing.T) {
+	defer func(level slog.Level) { LogLevel.Set(level) }(LogLevel.Level())
+	LogLevel.Set(slog.LevelDebug)
+	tokenFile := filepath.Join(t.TempDir(), "admin")
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("admin-token"), 0o600))
+	gw, cleanup := testutil.NewTestGateway(t, nil, func(c *config.Conf) {
+		c.Server.Admin.TokenFile = tokenFile
+	})
+	defer cleanup()
+	admin := http.Header{"Authorization": {"Bearer admin-token"}}
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: LogLevel}))
+
+	code, body := send(t, http.MethodPost, gw.BaseURL+"/admin/loglevel", admin, []byte(`{"level":"warn"}`))
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"level":"WARN"}`, body)
+	logger.Debug("filtered debug")
+	logger.Info("filtered info")
+	logger.Warn("kept warn")
+	assert.NotContains(t, buf.String(), "filtered")
+	assert.Contains(t, buf.String(), "kept warn")
+
+	code, _ = send(t, http.MethodPost, gw.BaseURL+"/admin/loglevel", admin, []byte(`{"level":"debug"}`))
+	assert.Equal(t, http.StatusOK, code)
+	logger.Debug("restored debug")
+	assert.Contains(t, buf.String(), "restored debug")
+
+	code, _ = send(t, http.MethodPost, gw.BaseURL+"/admin/loglevel", admin, []byte(`{"level":"verbose"}`))
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = send(t, http.MethodPost, gw.BaseURL+"/admin/loglevel", nil, []byte(`{"level":"error"}`))
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, slog.LevelDebug, LogLevel.Level())
+}
+
+func TestRateLimiterStateEndpoint(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "admin")
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("admin-token"), 0o600))
+	gw, cleanup := testutil.NewTestGateway(t, []config.ServiceConf{{
+		Name:        "orders",
+		RateLimiter: config.RateLimiterSettings{Enabled: true, Rate: 100, Burst: 200, CleanupInterval: 60},
+	}}, func(c *config.Conf) {
+		c.Server.Admin.TokenFile = tokenFile
+	})
+	defer cleanup()
+	admin := http.Header{"Authorization": {"Bearer admin-token"}}
+
+	get(t, gw.BaseURL+"/orders/list", nil)
+	code, body := get(t, gw.BaseURL+"/services/orders/rate-limiter/state", admin)
+	assert.Equal(t, http.StatusOK, code)
+	var state struct {
+		Enabled        bool    `json:"enabled"`
+		Rate           float64 `json:"rate"`
+		Burst          int     `json:"burst"`
+		ActiveVisitors int     `json:"active_visitors"`
+		Visitors       []struct {
+			IP       string    `json:"ip"`
+			Tokens   float64   `json:"tokens"`
+			LastSeen time.Time `json:"last_seen"`
+		} `json:"visitors"`
+	}
+	assert.Nil(t, json.Unmarshal([]byte(body), &state))
+	assert.True(t, state.Enabled)
+	assert.Equal(t, 100.0, state.Rate)
+	assert.Equal(t, 200, state.Burst)
+	assert.Equal(t, 1, state.ActiveVisitors)
+	if assert.Len(t, state.Visitors, 1) {
+		assert.Equal(t, "127.0.0.1", state.Visitors[0].IP)
+		assert.InDelta(t, 199, state.Visitors[0].Tokens, 1)
+		assert.False(t, state.Visitors[0].LastSeen.IsZero())
+	}
+
+	code, _ = get(t, gw.BaseURL+"/services/orders/rate-limiter/state", nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = get(t, gw.BaseURL+"/services/missing/rate-limiter/state", admin)
+	assert.Equal(t, http.StatusNotFound, code)
+}
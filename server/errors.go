@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/auth"
+	"github.com/ArmaanKatyal/go-api-gateway/server/feature"
+)
+
+var (
+	ErrServiceNotFound      = errors.New("service not found")
+	ErrServiceAlreadyExists = errors.New("service already exists")
+	ErrDuplicateAddress     = errors.New("service address already registered")
+	ErrCacheFailure         = errors.New("cache failure")
+	ErrForwardFailure       = errors.New("forward failure")
+	ErrAuthFailure          = errors.New("auth failure")
+	ErrSecretUnavailable    = errors.New("secret file unavailable")
+	ErrHookFailure          = errors.New("hook failure")
+	ErrInvalidPatch         = errors.New("invalid service patch")
+	ErrUpstreamLimit        = errors.New("upstream concurrency limit reached")
+	ErrServiceBusy          = errors.New("service concurrency limit reached")
+	ErrRateLimited          = errors.New("rate limit exceeded")
+	ErrWebSocketLimit       = errors.New("websocket connection limit reached")
+	ErrUpstreamTimeout      = errors.New("upstream timeout")
+	ErrHeadersTooLarge      = errors.New("request headers too large")
+	ErrBodyTooLarge         = errors.New("request body too large")
+	ErrNotWhitelisted       = errors.New("ip not whitelisted")
+	ErrBadRequest           = errors.New("bad request")
+	ErrMockNotFound         = errors.New("no mock defined")
+)
+
+// OpError records the operation and service an error occurred for
+type OpError struct {
+	Op      string
+	Service string
+	Err     error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("operation %s: %v", e.Op, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// opError wraps err with the operation and the sentinel kind used to derive the status code
+func opError(op string, service string, kind error, err error) error {
+	if err == nil {
+		return &OpError{Op: op, Service: service, Err: kind}
+	}
+	return &OpError{Op: op, Service: service, Err: fmt.Errorf("%w: %w", kind, err)}
+}
+
+// StatusCode derives the http status code returned for an error
+func StatusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrServiceNotFound), errors.Is(err, ErrMockNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, auth.ErrMissingClaim):
+		return http.StatusForbidden
+	case errors.Is(err, ErrAuthFailure), errors.Is(err, ErrNotWhitelisted):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrServiceAlreadyExists), errors.Is(err, ErrDuplicateAddress):
+		return http.StatusConflict
+	case errors.Is(err, ErrSecretUnavailable):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrInvalidPatch):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUpstreamLimit), errors.Is(err, ErrWebSocketLimit), errors.Is(err, ErrServiceBusy):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrUpstreamTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrHeadersTooLarge):
+		return http.StatusRequestHeaderFieldsTooLarge
+	case errors.Is(err, ErrBodyTooLarge), errors.Is(err, feature.ErrBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrBadRequest):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// isRejection reports whether the request was rejected by a limit of the gateway, the client
+// may send it again shortly
+func isRejection(err error) bool {
+	return errors.Is(err, ErrUpstreamLimit) || errors.Is(err, ErrWebSocketLimit) || errors.Is(err, ErrServiceBusy) ||
+		errors.Is(err, ErrRateLimited)
+}
+
+// errorMessage returns the message written to the client for an error
+func errorMessage(err error) string {
+	switch {
+	case errors.Is(err, auth.ErrTokenMissing):
+		return "token missing"
+	case errors.Is(err, auth.ErrInvalidToken):
+		return "invalid token"
+	case errors.Is(err, ErrAuthFailure):
+		return "auth failed"
+	case errors.Is(err, ErrNotWhitelisted):
+		return "unauthorized"
+	case errors.Is(err, ErrServiceNotFound):
+		return "service not found"
+	case errors.Is(err, ErrUpstreamLimit):
+		return "too many upstream requests"
+	case errors.Is(err, ErrWebSocketLimit):
+		return "too many websocket connections"
+	case errors.Is(err, ErrUpstreamTimeout):
+		return "service timed out"
+	case errors.Is(err, ErrHeadersTooLarge):
+		return "request headers too large"
+	case errors.Is(err, ErrBodyTooLarge):
+		return "request body too large"
+	case errors.Is(err, ErrForwardFailure):
+		return "service is down"
+	case errors.Is(err, ErrSecretUnavailable):
+		return "secret file unavailable"
+	default:
+		return http.StatusText(StatusCode(err))
+	}
+}
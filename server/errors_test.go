@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/auth"
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/ArmaanKatyal/go-api-gateway/server/feature"
+	"github.com/ArmaanKatyal/go-api-gateway/server/testutil"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpError(t *testing.T) {
+	t.Run("sentinel without cause", func(t *testing.T) {
+		err := opError("resolve service", "svc", ErrServiceNotFound, nil)
+		assert.True(t, errors.Is(err, ErrServiceNotFound))
+		assert.Equal(t, "operation resolve service: service not found", err.Error())
+	})
+	t.Run("sentinel and cause", func(t *testing.T) {
+		err := opError("authenticate", "svc", ErrAuthFailure, auth.ErrInvalidToken)
+		assert.True(t, errors.Is(err, ErrAuthFailure))
+		assert.True(t, errors.Is(err, auth.ErrInvalidToken))
+		var opErr *OpError
+		assert.True(t, errors.As(err, &opErr))
+		assert.Equal(t, "authenticate", opErr.Op)
+		assert.Equal(t, "svc", opErr.Service)
+	})
+}
+
+func TestStatusCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+		message  string
+	}{
+		{name: "service not found", err: opError("resolve service", "svc", ErrServiceNotFound, nil), expected: http.StatusNotFound, message: "service not found"},
+		{name: "token missing", err: opError("authenticate", "svc", ErrAuthFailure, auth.ErrTokenMissing), expected: http.StatusUnauthorized, message: "token missing"},
+		{name: "invalid token", err: opError("authenticate", "svc", ErrAuthFailure, auth.ErrInvalidToken), expected: http.StatusUnauthorized, message: "invalid token"},
+		{name: "missing claim", err: opError("authenticate", "svc", ErrAuthFailure, auth.ErrMissingClaim), expected: http.StatusForbidden, message: "invalid token"},
+		{name: "auth failure", err: opError("authenticate", "svc", ErrAuthFailure, errors.New("other")), expected: http.StatusUnauthorized, message: "auth failed"},
+		{name: "forward failure", err: opError("forward", "svc", ErrForwardFailure, errors.New("refused")), expected: http.StatusInternalServerError, message: "service is down"},
+		{name: "upstream timeout", err: opError("circuit breaker", "svc", ErrForwardFailure, opError("forward", "svc", ErrUpstreamTimeout, context.DeadlineExceeded)), expected: http.StatusGatewayTimeout, message: "service timed out"},
+		{name: "headers too large", err: opError("forward", "svc", ErrHeadersTooLarge, nil), expected: http.StatusRequestHeaderFieldsTooLarge, message: "request headers too large"},
+		{name: "service busy", err: opError("acquire", "svc", ErrServiceBusy, nil), expected: http.StatusServiceUnavailable, message: "Service Unavailable"},
+		{name: "rate limited", err: opError("rate limit", "svc", ErrRateLimited, nil), expected: http.StatusTooManyRequests, message: "Too Many Requests"},
+		{name: "cache failure", err: opError("set cache", "svc", ErrCacheFailure, nil), expected: http.StatusInternalServerError, message: "Internal Server Error"},
+		{name: "duplicate service", err: ErrServiceAlreadyExists, expected: http.StatusConflict, message: "Conflict"},
+		{name: "not whitelisted", err: opError("whitelist", "svc", ErrNotWhitelisted, errors.New("ip 10.0.0.1")), expected: http.StatusUnauthorized, message: "unauthorized"},
+		{name: "bad request body", err: opError("decompress request", "svc", ErrBadRequest, errors.New("gzip: invalid header")), expected: http.StatusBadRequest, message: "Bad Request"},
+		{name: "decompressed body too large", err: opError("decompress request", "svc", ErrBadRequest, feature.ErrBodyTooLarge), expected: http.StatusRequestEntityTooLarge, message: "Request Entity Too Large"},
+		{name: "no mock", err: opError("match mock", "svc", ErrMockNotFound, nil), expected: http.StatusNotFound, message: "Not Found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, StatusCode(tt.err))
+			assert.Equal(t, tt.message, errorMessage(tt.err))
+		})
+	}
+}
+
+func TestHandleRequestServiceNotFound(t *testing.T) {
+	gw, cleanup := testutil.NewTestGateway(t, []config.ServiceConf{{Name: "known"}})
+	defer cleanup()
+
+	code, body := get(t, gw.BaseURL+"/unknown/path", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "service not found\n", body)
+	gw.AssertMetric(t, gw.Prefix+"_requests_total", 1)
+}
@@ -0,0 +1,60 @@
+package feature
+
+import (
+	"net/http"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+)
+
+// ClaimsHeader carries the claims of the verified token to the services
+const ClaimsHeader = "X-Claims"
+
+// AuthFailurePolicy is how the gateway reacts to a service rejecting a request as unauthorized
+type AuthFailurePolicy struct {
+	Statuses    map[int]bool `json:"statuses"`
+	PurgeCache  bool         `json:"purgeCache"`
+	StripClaims bool         `json:"stripClaims"`
+}
+
+// NewAuthFailurePolicy returns nil if neither purging the cache nor stripping the claims is enabled,
+// the statuses default to 401 and 403
+func NewAuthFailurePolicy(conf *config.AuthFailureSettings) *AuthFailurePolicy {
+	if !conf.PurgeCache && !conf.StripClaims {
+		return nil
+	}
+	statuses := conf.Statuses
+	if len(statuses) == 0 {
+		statuses = []int{http.StatusUnauthorized, http.StatusForbidden}
+	}
+	p := &AuthFailurePolicy{
+		Statuses:    make(map[int]bool, len(statuses)),
+		PurgeCache:  conf.PurgeCache,
+		StripClaims: conf.StripClaims,
+	}
+	for _, s := range statuses {
+		p.Statuses[s] = true
+	}
+	return p
+}
+
+// Matches checks if the status of the upstream response is an auth failure
+func (p *AuthFailurePolicy) Matches(status int) bool {
+	return p != nil && p.Statuses[status]
+}
+
+// ShouldPurge checks if the cached response must be purged after the upstream responded with the status
+func (p *AuthFailurePolicy) ShouldPurge(status int) bool {
+	return p.Matches(status) && p.PurgeCache
+}
+
+// StripsClaims checks if the request with the header would be sent again without its claims on
+// an auth failure, its body must then be kept
+func (p *AuthFailurePolicy) StripsClaims(h http.Header) bool {
+	return p != nil && p.StripClaims && h.Get(ClaimsHeader) != ""
+}
+
+// ShouldRetryWithoutClaims checks if a request carrying claims must be sent again without them
+// after the upstream responded with the status
+func (p *AuthFailurePolicy) ShouldRetryWithoutClaims(status int, h http.Header) bool {
+	return p.Matches(status) && p.StripsClaims(h)
+}
@@ -0,0 +1,118 @@
+package feature
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+)
+
+const (
+	// DefaultBodyLogMaxBytes is the most bytes logged of a body when the service doesn't configure it
+	DefaultBodyLogMaxBytes = 4096
+	Redacted               = "[REDACTED]"
+)
+
+// BodyLogger logs the request and response bodies of a service for debugging. The values of the
+// redacted fields of JSON and form-urlencoded bodies are replaced before the body is truncated to MaxBytes.
+type BodyLogger struct {
+	MaxBytes     int             `json:"maxBytes"`
+	RedactFields map[string]bool `json:"redactFields"`
+}
+
+// NewBodyLogger returns nil if logging the bodies is disabled
+func NewBodyLogger(conf *config.DebugLogBodiesSettings) *BodyLogger {
+	if !conf.Enabled {
+		return nil
+	}
+	b := &BodyLogger{MaxBytes: conf.MaxBytes, RedactFields: make(map[string]bool, len(conf.RedactFields))}
+	if b.MaxBytes <= 0 {
+		b.MaxBytes = DefaultBodyLogMaxBytes
+	}
+	for _, f := range conf.RedactFields {
+		b.RedactFields[strings.ToLower(f)] = true
+	}
+	return b
+}
+
+// LogRequest logs the body of the request, which is restored so it can still be forwarded
+func (b *BodyLogger) LogRequest(service string, r *http.Request) error {
+	if b == nil || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	slog.Info("Request body", "service", service, "method", r.Method, "path", r.URL.Path,
+		"size", len(body), "body", b.Format(body))
+	return nil
+}
+
+// LogResponse logs the body of the response to the request
+func (b *BodyLogger) LogResponse(service string, r *http.Request, status int, body []byte) {
+	if b == nil {
+		return
+	}
+	slog.Info("Response body", "service", service, "method", r.Method, "path", r.URL.Path, "status", status,
+		"size", len(body), "body", b.Format(body))
+}
+
+// Format redacts the fields of a JSON or form-urlencoded body and truncates it to MaxBytes
+func (b *BodyLogger) Format(body []byte) string {
+	if len(b.RedactFields) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err == nil {
+			if redacted, err := json.Marshal(b.redact(v)); err == nil {
+				body = redacted
+			}
+		} else {
+			body = b.redactForm(body)
+		}
+	}
+	if len(body) > b.MaxBytes {
+		return string(body[:b.MaxBytes]) + "...(truncated)"
+	}
+	return string(body)
+}
+
+// redact replaces the values of the redacted fields at any depth
+func (b *BodyLogger) redact(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, field := range t {
+			if b.RedactFields[strings.ToLower(k)] {
+				t[k] = Redacted
+			} else {
+				t[k] = b.redact(field)
+			}
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = b.redact(t[i])
+		}
+	}
+	return v
+}
+
+// redactForm replaces the values of the redacted fields of a form-urlencoded body, a body
+// which isn't a form is returned as is
+func (b *BodyLogger) redactForm(body []byte) []byte {
+	if _, err := url.ParseQuery(string(body)); err != nil || !bytes.ContainsRune(body, '=') {
+		return body
+	}
+	pairs := strings.Split(string(body), "&")
+	for i, pair := range pairs {
+		key, _, _ := strings.Cut(pair, "=")
+		if name, err := url.QueryUnescape(key); err == nil && b.RedactFields[strings.ToLower(name)] {
+			pairs[i] = key + "=" + Redacted
+		}
+	}
+	return []byte(strings.Join(pairs, "&"))
+}
@@ -0,0 +1,55 @@
+package feature
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyLoggerFormat(t *testing.T) {
+	b := NewBodyLogger(&config.DebugLogBodiesSettings{Enabled: true, MaxBytes: 45, RedactFields: []string{"Password", "token"}})
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"redacted", `{"user":"gopher","password":"secret"}`, `{"password":"[REDACTED]","user":"gopher"}`},
+		{"nested", `{"auth":[{"TOKEN":"abc"}]}`, `{"auth":[{"TOKEN":"[REDACTED]"}]}`},
+		{"truncated", strings.Repeat("a", 50), strings.Repeat("a", 45) + "...(truncated)"},
+		{"redacted before truncation", `{"password":"secret","user":"` + strings.Repeat("a", 40) + `"}`, `{"password":"[REDACTED]","user":"` + strings.Repeat("a", 12) + "...(truncated)"},
+		{"form", "user=go&password=secret&Token=abc", "user=go&password=[REDACTED]&Token=[REDACTED]"},
+		{"escaped form field", "pass%77ord=secret", "pass%77ord=[REDACTED]"},
+		{"not json nor form", "password: secret", "password: secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, b.Format([]byte(tt.body)))
+		})
+	}
+}
+
+func TestBodyLoggerDisabled(t *testing.T) {
+	b := NewBodyLogger(&config.DebugLogBodiesSettings{MaxBytes: 10})
+	assert.Nil(t, b)
+	// a disabled logger doesn't touch the body
+	r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader("body"))
+	body := r.Body
+	assert.Nil(t, b.LogRequest("orders", r))
+	assert.Equal(t, body, r.Body)
+}
+
+func TestBodyLoggerLogRequest(t *testing.T) {
+	b := NewBodyLogger(&config.DebugLogBodiesSettings{Enabled: true})
+	assert.Equal(t, DefaultBodyLogMaxBytes, b.MaxBytes)
+	r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"id":1}`))
+	assert.Nil(t, b.LogRequest("orders", r))
+	// the body can still be forwarded
+	body, err := io.ReadAll(r.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"id":1}`, string(body))
+}
@@ -1,11 +1,14 @@
 package feature
 
 import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ArmaanKatyal/go-api-gateway/server/config"
-
-	"github.com/patrickmn/go-cache"
 )
 
 type CacheExpiration int
@@ -15,38 +18,289 @@ const (
 	NoExpiration      CacheExpiration = -1
 )
 
+// DefaultCacheTTL is the ttl (secs) of the responses without a max-age when the service doesn't configure one
+const DefaultCacheTTL = 5
+
+const (
+	DefaultStatusHeader = "X-Cache"
+	CacheHit            = "HIT"
+	CacheMiss           = "MISS"
+)
+
 type CacheHandler struct {
-	Enabled            bool `json:"enabled"`
-	ExpirationInterval uint `json:"expirationInterval"`
-	CleanupInterval    uint `json:"cleanupInterval"`
-	cache              *cache.Cache
+	Enabled bool `json:"enabled"`
+	// ttl of the responses without a max-age
+	DefaultTTL      uint   `json:"defaultTTL"`
+	CleanupInterval uint   `json:"cleanupInterval"`
+	HeaderEnabled   bool   `json:"headerEnabled"`
+	HeaderName      string `json:"headerName"`
+	// ContentTypes are the prefixes of the cached content types, all are cached if empty
+	ContentTypes []string `json:"contentTypes"`
+	WriteThrough bool     `json:"writeThrough"`
+	// reset the expiration of an entry on every hit
+	SlidingExpiration bool `json:"slidingExpiration"`
+	// largest body cached, unlimited if 0
+	MaxBodySize int64 `json:"maxBodySize"`
+	cache       Cache
+	mu          sync.Mutex
+	// keys of the cached entries per resource and the resource of every key, only
+	// tracked for write through caches so a write can invalidate the resource
+	resources   map[string]map[string]struct{}
+	keyResource map[string]string
+	// ttl every entry was set with, a sliding expiration refreshes it with the same ttl
+	ttls map[string]CacheExpiration
+	// serializes the sets so every replaced entry is released from the size
+	setMu sync.Mutex
+	// bytes of the bodies cached
+	size         atomic.Int64
+	onSizeChange atomic.Pointer[func(int64)]
 }
 
 func NewCacheHandler(conf *config.CacheSettings) *CacheHandler {
 	// If 0, set to default values
-	if conf.ExpirationInterval == 0 {
-		conf.ExpirationInterval = 5
+	if conf.DefaultTTL == 0 {
+		conf.DefaultTTL = conf.ExpirationInterval
+	}
+	if conf.DefaultTTL == 0 {
+		conf.DefaultTTL = DefaultCacheTTL
 	}
 	if conf.CleanupInterval == 0 {
 		conf.CleanupInterval = 10
 	}
-	return &CacheHandler{
-		Enabled:            conf.Enabled,
-		ExpirationInterval: conf.ExpirationInterval,
-		CleanupInterval:    conf.CleanupInterval,
-		cache: cache.New(time.Duration(conf.ExpirationInterval)*time.Second,
-			time.Duration(conf.CleanupInterval)*time.Second),
+	if conf.StatusHeader.Name == "" {
+		conf.StatusHeader.Name = DefaultStatusHeader
+	}
+	c := &CacheHandler{
+		Enabled:           conf.Enabled,
+		DefaultTTL:        conf.DefaultTTL,
+		CleanupInterval:   conf.CleanupInterval,
+		HeaderEnabled:     conf.StatusHeader.Enabled,
+		HeaderName:        conf.StatusHeader.Name,
+		ContentTypes:      conf.CacheableContentTypes,
+		WriteThrough:      conf.WriteThrough,
+		SlidingExpiration: conf.SlidingExpiration,
+		MaxBodySize:       conf.MaxBodySize,
+		resources:         make(map[string]map[string]struct{}),
+		keyResource:       make(map[string]string),
+		ttls:              make(map[string]CacheExpiration),
+	}
+	c.cache = NewCache(conf, c.evicted)
+	return c
+}
+
+// evicted releases the size of a deleted or expired entry and untracks its key
+func (c *CacheHandler) evicted(key string, value interface{}) {
+	c.addSize(-entrySize(value, nil))
+	c.mu.Lock()
+	delete(c.ttls, key)
+	c.mu.Unlock()
+	if c.WriteThrough {
+		c.untrack(key)
+	}
+}
+
+// entrySize estimates the bytes held by a cached value by the size of its body, a cached
+// response reports the bytes of its gzip encoded variant to onGrow until it is evicted
+func entrySize(value interface{}, onGrow func(int64)) int64 {
+	switch v := value.(type) {
+	case *CachedResponse:
+		return v.track(onGrow)
+	case []byte:
+		return int64(len(v))
+	case string:
+		return int64(len(v))
 	}
+	return 0
+}
+
+func (c *CacheHandler) addSize(delta int64) {
+	if delta == 0 {
+		return
+	}
+	size := c.size.Add(delta)
+	if hook := c.onSizeChange.Load(); hook != nil {
+		(*hook)(size)
+	}
+}
+
+// Size returns the bytes of the bodies cached and their gzip encoded variants, the expired entries count until the janitor removes them
+func (c *CacheHandler) Size() int64 {
+	return c.size.Load()
+}
+
+// OnSizeChange sets the func called with the size of the cache whenever an entry is set or
+// removed, it may be called from the janitor of the cache
+func (c *CacheHandler) OnSizeChange(f func(int64)) {
+	c.onSizeChange.Store(&f)
 }
 
 func (c *CacheHandler) Get(key string) (interface{}, bool) {
+	if c.SlidingExpiration {
+		return c.GetAndRefresh(key)
+	}
 	return c.cache.Get(key)
 }
 
+// GetAndRefresh returns the entry and resets its expiration to the full ttl it was set with
+func (c *CacheHandler) GetAndRefresh(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.cache.Get(key)
+	if !ok {
+		return v, ok
+	}
+	exp := c.ttls[key]
+	// replace so an entry invalidated in the meantime isn't brought back
+	if r, replaceable := c.cache.(replacer); replaceable {
+		_ = r.Replace(key, v, exp)
+	} else {
+		c.cache.Set(key, v, exp)
+	}
+	return v, ok
+}
+
+// replacer is a store which can set an entry only if it still exists
+type replacer interface {
+	Replace(string, interface{}, CacheExpiration) error
+}
+
 func (c *CacheHandler) Set(key string, value interface{}, exp CacheExpiration) {
-	c.cache.Set(key, value, time.Duration(exp))
+	if !c.cache.Enabled() {
+		c.cache.Set(key, value, exp)
+		return
+	}
+	c.setMu.Lock()
+	defer c.setMu.Unlock()
+	// delete the previous entry first, overwriting it even once expired wouldn't release its size
+	c.cache.Delete(key)
+	c.cache.Set(key, value, exp)
+	c.addSize(entrySize(value, c.addSize))
+	if c.SlidingExpiration {
+		c.mu.Lock()
+		c.ttls[key] = exp
+		c.mu.Unlock()
+	}
 }
 
+func (c *CacheHandler) Delete(key string) {
+	c.cache.Delete(key)
+}
+
+// SetResource stores the value and, for write through caches, tracks the key under the
+// resource e.g. the request url so the entry is invalidated by a write to the resource
+func (c *CacheHandler) SetResource(resource string, key string, value interface{}, exp CacheExpiration) {
+	// set first so the eviction of the previous entry doesn't untrack the new one
+	c.Set(key, value, exp)
+	if !c.WriteThrough {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys, ok := c.resources[resource]
+	if !ok {
+		keys = make(map[string]struct{})
+		c.resources[resource] = keys
+	}
+	keys[key] = struct{}{}
+	c.keyResource[key] = resource
+}
+
+// Invalidate deletes every entry cached for the resource
+func (c *CacheHandler) Invalidate(resource string) {
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.resources[resource]))
+	for k := range c.resources[resource] {
+		keys = append(keys, k)
+	}
+	c.mu.Unlock()
+	// the eviction callback untracks the keys and takes the lock
+	for _, k := range keys {
+		c.Delete(k)
+	}
+}
+
+func (c *CacheHandler) untrack(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resource, ok := c.keyResource[key]
+	if !ok {
+		return
+	}
+	delete(c.keyResource, key)
+	delete(c.resources[resource], key)
+	if len(c.resources[resource]) == 0 {
+		delete(c.resources, resource)
+	}
+}
+
+func (c *CacheHandler) IsWriteThrough() bool {
+	return c.WriteThrough
+}
+
+// ExpirationFor returns the ttl of a response with the header, the max-age of its Cache-Control
+// if it has one and the default ttl otherwise
+func (c *CacheHandler) ExpirationFor(h http.Header) CacheExpiration {
+	if ttl, ok := MaxAge(h); ok {
+		return CacheExpiration(ttl)
+	}
+	return CacheExpiration(time.Duration(c.DefaultTTL) * time.Second)
+}
+
+// MaxAge returns the freshness lifetime set by the Cache-Control header of a response, s-maxage
+// takes precedence over max-age as the gateway is a shared cache. ok is false if neither is set.
+func MaxAge(h http.Header) (time.Duration, bool) {
+	maxAge, sharedMaxAge := -1, -1
+	for _, v := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			secs, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil || secs < 0 {
+				continue
+			}
+			switch strings.ToLower(name) {
+			case "max-age":
+				maxAge = secs
+			case "s-maxage":
+				sharedMaxAge = secs
+			}
+		}
+	}
+	switch {
+	case sharedMaxAge >= 0:
+		return time.Duration(sharedMaxAge) * time.Second, true
+	case maxAge >= 0:
+		return time.Duration(maxAge) * time.Second, true
+	default:
+		return 0, false
+	}
+}
+
+// FitsBody reports whether a body of size bytes can be cached
+func (c *CacheHandler) FitsBody(size int) bool {
+	return c.MaxBodySize == 0 || int64(size) <= c.MaxBodySize
+}
+
+// IsEnabled is false if the cache is disabled or its backend never keeps anything
 func (c *CacheHandler) IsEnabled() bool {
-	return c.Enabled
+	return c.Enabled && c.cache.Enabled()
+}
+
+// StatusHeader returns the name of the header advertising cache hits and misses,
+// ok is false if the cache or the header is disabled
+func (c *CacheHandler) StatusHeader() (string, bool) {
+	return c.HeaderName, c.Enabled && c.HeaderEnabled
+}
+
+// IsCacheableContentType checks the content type of a response against the cacheable prefixes
+func (c *CacheHandler) IsCacheableContentType(contentType string) bool {
+	if len(c.ContentTypes) == 0 {
+		return true
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	for _, prefix := range c.ContentTypes {
+		if strings.HasPrefix(contentType, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
 }
@@ -1,11 +1,12 @@
 package feature
 
 import (
+	"bytes"
+	"net/http"
 	"testing"
 	"time"
 
 	"github.com/ArmaanKatyal/go-api-gateway/server/config"
-	"github.com/patrickmn/go-cache"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,20 +18,25 @@ func TestCacheHandler(t *testing.T) {
 	}{
 		{
 			name:     "default values",
-			given:    config.CacheSettings{Enabled: false, ExpirationInterval: 0, CleanupInterval: 0},
-			expected: config.CacheSettings{Enabled: false, ExpirationInterval: 5, CleanupInterval: 10},
+			given:    config.CacheSettings{Enabled: false, DefaultTTL: 0, CleanupInterval: 0},
+			expected: config.CacheSettings{Enabled: false, DefaultTTL: 5, CleanupInterval: 10},
 		},
 		{
 			name:     "custom values",
-			given:    config.CacheSettings{Enabled: true, ExpirationInterval: 10, CleanupInterval: 20},
-			expected: config.CacheSettings{Enabled: true, ExpirationInterval: 10, CleanupInterval: 20},
+			given:    config.CacheSettings{Enabled: true, DefaultTTL: 10, CleanupInterval: 20},
+			expected: config.CacheSettings{Enabled: true, DefaultTTL: 10, CleanupInterval: 20},
+		},
+		{
+			name:     "deprecated expiration interval",
+			given:    config.CacheSettings{Enabled: true, ExpirationInterval: 30},
+			expected: config.CacheSettings{Enabled: true, DefaultTTL: 30, CleanupInterval: 10},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			cacheHandler := NewCacheHandler(&tt.given)
 			assert.Equal(t, tt.expected.Enabled, cacheHandler.Enabled)
-			assert.Equal(t, tt.expected.ExpirationInterval, cacheHandler.ExpirationInterval)
+			assert.Equal(t, tt.expected.DefaultTTL, cacheHandler.DefaultTTL)
 			assert.Equal(t, tt.expected.CleanupInterval, cacheHandler.CleanupInterval)
 		})
 	}
@@ -60,12 +66,12 @@ func TestCacheGet(t *testing.T) {
 	})
 	t.Run("expired value", func(t *testing.T) {
 		cacheHandler := CacheHandler{
-			Enabled:            true,
-			ExpirationInterval: 1,
-			CleanupInterval:    1,
-			cache:              cache.New(time.Duration(1)*time.Millisecond, time.Duration(1)*time.Millisecond),
+			Enabled:         true,
+			DefaultTTL:      1,
+			CleanupInterval: 1,
+			cache:           NewMemoryCache(time.Millisecond, time.Millisecond, nil),
 		}
-		cacheHandler.cache.Set("test", "value", time.Duration(1)*time.Millisecond)
+		cacheHandler.cache.Set("test", "value", CacheExpiration(time.Millisecond))
 		time.Sleep(10 * time.Millisecond)
 		value, found := cacheHandler.Get("test")
 		assert.False(t, found)
@@ -90,3 +96,221 @@ func TestCacheSet(t *testing.T) {
 		assert.Equal(t, "new value", value)
 	})
 }
+
+func TestCacheStatusHeader(t *testing.T) {
+	tests := []struct {
+		name         string
+		given        config.CacheSettings
+		expectedName string
+		expectedOk   bool
+	}{
+		{
+			name:         "default name",
+			given:        config.CacheSettings{Enabled: true, StatusHeader: config.CacheHeaderSettings{Enabled: true}},
+			expectedName: DefaultStatusHeader,
+			expectedOk:   true,
+		},
+		{
+			name:         "custom name",
+			given:        config.CacheSettings{Enabled: true, StatusHeader: config.CacheHeaderSettings{Enabled: true, Name: "X-Gateway-Cache"}},
+			expectedName: "X-Gateway-Cache",
+			expectedOk:   true,
+		},
+		{
+			name:         "header disabled",
+			given:        config.CacheSettings{Enabled: true},
+			expectedName: DefaultStatusHeader,
+			expectedOk:   false,
+		},
+		{
+			name:         "cache disabled",
+			given:        config.CacheSettings{StatusHeader: config.CacheHeaderSettings{Enabled: true}},
+			expectedName: DefaultStatusHeader,
+			expectedOk:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, ok := NewCacheHandler(&tt.given).StatusHeader()
+			assert.Equal(t, tt.expectedName, name)
+			assert.Equal(t, tt.expectedOk, ok)
+		})
+	}
+}
+
+func TestCacheIsCacheableContentType(t *testing.T) {
+	tests := []struct {
+		name         string
+		contentTypes []string
+		given        string
+		expected     bool
+	}{
+		{name: "unset caches everything", given: "application/octet-stream", expected: true},
+		{name: "exact match", contentTypes: []string{"application/json"}, given: "application/json", expected: true},
+		{name: "with parameters", contentTypes: []string{"application/json"}, given: "application/json; charset=utf-8", expected: true},
+		{name: "prefix match", contentTypes: []string{"text/"}, given: "text/html", expected: true},
+		{name: "case insensitive", contentTypes: []string{"application/json"}, given: "Application/JSON", expected: true},
+		{name: "not allowed", contentTypes: []string{"application/json", "text/"}, given: "application/octet-stream", expected: false},
+		{name: "missing content type", contentTypes: []string{"application/json"}, given: "", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCacheHandler(&config.CacheSettings{Enabled: true, CacheableContentTypes: tt.contentTypes})
+			assert.Equal(t, tt.expected, c.IsCacheableContentType(tt.given))
+		})
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	t.Run("write through", func(t *testing.T) {
+		c := NewCacheHandler(&config.CacheSettings{Enabled: true, WriteThrough: true})
+		c.SetResource("/orders/1", "a", []byte("a"), DefaultExpiration)
+		c.SetResource("/orders/1", "b", []byte("b"), DefaultExpiration)
+		c.SetResource("/orders/2", "c", []byte("c"), DefaultExpiration)
+		c.Invalidate("/orders/1")
+		_, ok := c.Get("a")
+		assert.False(t, ok)
+		_, ok = c.Get("b")
+		assert.False(t, ok)
+		_, ok = c.Get("c")
+		assert.True(t, ok)
+		assert.NotContains(t, c.resources, "/orders/1")
+		assert.Len(t, c.keyResource, 1)
+	})
+	t.Run("expired entries untracked", func(t *testing.T) {
+		c := NewCacheHandler(&config.CacheSettings{Enabled: true, WriteThrough: true})
+		c.SetResource("/orders/1", "a", []byte("a"), CacheExpiration(time.Millisecond))
+		time.Sleep(5 * time.Millisecond)
+		c.cache.(*MemoryCache).DeleteExpired()
+		assert.Empty(t, c.resources)
+		assert.Empty(t, c.keyResource)
+	})
+	t.Run("not tracked without write through", func(t *testing.T) {
+		c := NewCacheHandler(&config.CacheSettings{Enabled: true})
+		c.SetResource("/orders/1", "a", []byte("a"), DefaultExpiration)
+		assert.Empty(t, c.resources)
+		c.Invalidate("/orders/1")
+		_, ok := c.Get("a")
+		assert.True(t, ok)
+	})
+}
+
+func TestCacheSize(t *testing.T) {
+	c := NewCacheHandler(&config.CacheSettings{Enabled: true, WriteThrough: true})
+	var reported []int64
+	c.OnSizeChange(func(size int64) { reported = append(reported, size) })
+
+	c.Set("a", NewCachedResponse(make([]byte, 100), http.Header{}), DefaultExpiration)
+	c.SetResource("/orders/1", "b", []byte("0123456789"), DefaultExpiration)
+	assert.Equal(t, int64(110), c.Size())
+	// replacing an entry releases the previous body
+	c.Set("a", NewCachedResponse(make([]byte, 40), http.Header{}), DefaultExpiration)
+	assert.Equal(t, int64(50), c.Size())
+
+	// purged and invalidated entries are released
+	c.Delete("a")
+	assert.Equal(t, int64(10), c.Size())
+	c.Invalidate("/orders/1")
+	assert.Equal(t, int64(0), c.Size())
+	assert.Equal(t, []int64{100, 110, 10, 50, 10, 0}, reported)
+
+	// as are the expired ones once removed, even if they were overwritten first
+	c.Set("c", []byte("0123456789"), CacheExpiration(time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	c.Set("c", []byte("01234"), CacheExpiration(time.Millisecond))
+	assert.Equal(t, int64(5), c.Size())
+	time.Sleep(5 * time.Millisecond)
+	c.cache.(*MemoryCache).DeleteExpired()
+	assert.Equal(t, int64(0), c.Size())
+
+	// the gzip encoded variant counts once added, and no longer once the entry is evicted
+	cached := NewCachedResponse(bytes.Repeat([]byte("a"), 100), http.Header{})
+	c.Set("d", cached, DefaultExpiration)
+	gzipped, err := cached.Gzipped()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100+len(gzipped)), c.Size())
+	c.Delete("d")
+	assert.Equal(t, int64(0), c.Size())
+	evicted := NewCachedResponse(bytes.Repeat([]byte("a"), 100), http.Header{})
+	c.Set("e", evicted, DefaultExpiration)
+	c.Delete("e")
+	_, err = evicted.Gzipped()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), c.Size())
+
+	// nothing is held by the noop backend
+	noop := NewCacheHandler(&config.CacheSettings{Enabled: true, Backend: NoopCacheBackend})
+	noop.Set("a", []byte("value"), DefaultExpiration)
+	assert.Equal(t, int64(0), noop.Size())
+}
+
+func TestCacheSlidingExpiration(t *testing.T) {
+	sliding := NewCacheHandler(&config.CacheSettings{Enabled: true, ExpirationInterval: 1, SlidingExpiration: true})
+	fixed := NewCacheHandler(&config.CacheSettings{Enabled: true, ExpirationInterval: 1})
+	for _, c := range []*CacheHandler{sliding, fixed} {
+		c.Set("key", []byte("value"), DefaultExpiration)
+	}
+
+	// read twice within the ttl, then past the original expiration
+	for _, wait := range []time.Duration{400 * time.Millisecond, 400 * time.Millisecond, 400 * time.Millisecond} {
+		time.Sleep(wait)
+		_, ok := sliding.Get("key")
+		assert.True(t, ok)
+	}
+	_, ok := fixed.Get("key")
+	assert.False(t, ok)
+
+	// an entry is refreshed with its own ttl, not the default one
+	sliding.Set("short", []byte("value"), CacheExpiration(300*time.Millisecond))
+	time.Sleep(200 * time.Millisecond)
+	_, ok = sliding.Get("short")
+	assert.True(t, ok)
+	time.Sleep(400 * time.Millisecond)
+	_, ok = sliding.Get("short")
+	assert.False(t, ok)
+
+	// GetAndRefresh doesn't create missing entries
+	_, ok = fixed.GetAndRefresh("missing")
+	assert.False(t, ok)
+	_, ok = fixed.Get("missing")
+	assert.False(t, ok)
+}
+
+func TestCacheExpirationFor(t *testing.T) {
+	c := NewCacheHandler(&config.CacheSettings{Enabled: true, DefaultTTL: 30})
+	tests := []struct {
+		name         string
+		cacheControl string
+		expected     time.Duration
+	}{
+		{"no cache control", "", 30 * time.Second},
+		{"no max-age", "no-store", 30 * time.Second},
+		{"max-age", "public, max-age=120", 120 * time.Second},
+		{"s-maxage takes precedence", "max-age=120, s-maxage=60", 60 * time.Second},
+		{"invalid max-age", "max-age=soon", 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			if tt.cacheControl != "" {
+				h.Set("Cache-Control", tt.cacheControl)
+			}
+			assert.Equal(t, CacheExpiration(tt.expected), c.ExpirationFor(h))
+		})
+	}
+
+	ttl, ok := MaxAge(http.Header{"Cache-Control": {"max-age=0"}})
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), ttl)
+}
+
+func TestCacheSetUsesExpiration(t *testing.T) {
+	c := NewCacheHandler(&config.CacheSettings{Enabled: true, DefaultTTL: 60})
+	c.Set("short", "v", c.ExpirationFor(http.Header{"Cache-Control": {"max-age=1"}}))
+	c.Set("default", "v", c.ExpirationFor(http.Header{}))
+	time.Sleep(1100 * time.Millisecond)
+	_, ok := c.Get("short")
+	assert.False(t, ok)
+	_, ok = c.Get("default")
+	assert.True(t, ok)
+}
@@ -0,0 +1,99 @@
+package feature
+
+import (
+	"time"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	MemoryCacheBackend = "memory"
+	NoopCacheBackend   = "noop"
+)
+
+// Cache is the store the cached responses are kept in, the CacheHandler implements the
+// gateway behavior e.g. write through invalidation on top of it
+type Cache interface {
+	Get(string) (interface{}, bool)
+	Set(string, interface{}, CacheExpiration)
+	Delete(string)
+	// Flush deletes every entry
+	Flush()
+	// Enabled is false for a store which never keeps anything
+	Enabled() bool
+}
+
+// NewCache returns the store of the configured backend, the entries expire after the
+// default ttl unless they are set with their own. onEvicted is called with the key and value of every deleted or
+// expired entry.
+func NewCache(conf *config.CacheSettings, onEvicted func(string, interface{})) Cache {
+	switch conf.Backend {
+	case NoopCacheBackend:
+		return NoopCache{}
+	default:
+		return NewMemoryCache(time.Duration(conf.DefaultTTL)*time.Second,
+			time.Duration(conf.CleanupInterval)*time.Second, onEvicted)
+	}
+}
+
+// MemoryCache keeps the entries in memory, they are removed by a janitor every cleanup interval
+type MemoryCache struct {
+	cache *cache.Cache
+}
+
+func NewMemoryCache(expiration time.Duration, cleanup time.Duration, onEvicted func(string, interface{})) *MemoryCache {
+	c := cache.New(expiration, cleanup)
+	if onEvicted != nil {
+		c.OnEvicted(onEvicted)
+	}
+	return &MemoryCache{cache: c}
+}
+
+func (m *MemoryCache) Get(key string) (interface{}, bool) {
+	return m.cache.Get(key)
+}
+
+func (m *MemoryCache) Set(key string, value interface{}, exp CacheExpiration) {
+	m.cache.Set(key, value, time.Duration(exp))
+}
+
+func (m *MemoryCache) Delete(key string) {
+	m.cache.Delete(key)
+}
+
+func (m *MemoryCache) Flush() {
+	m.cache.Flush()
+}
+
+func (m *MemoryCache) Enabled() bool {
+	return true
+}
+
+// Replace sets the entry only if it still exists
+func (m *MemoryCache) Replace(key string, value interface{}, exp CacheExpiration) error {
+	return m.cache.Replace(key, value, time.Duration(exp))
+}
+
+// DeleteExpired removes the expired entries without waiting for the janitor
+func (m *MemoryCache) DeleteExpired() {
+	m.cache.DeleteExpired()
+}
+
+// NoopCache never keeps anything, every read is a miss
+type NoopCache struct{}
+
+func (NoopCache) Get(string) (interface{}, bool) {
+	return nil, false
+}
+
+func (NoopCache) Set(string, interface{}, CacheExpiration) {}
+
+func (NoopCache) Delete(string) {}
+
+func (NoopCache) Flush() {}
+
+func (NoopCache) Enabled() bool {
+	return false
+}
@@ -0,0 +1,70 @@
+package feature
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheBackends(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		stores  bool
+	}{
+		{"memory", MemoryCacheBackend, true},
+		{"default", "", true},
+		{"noop", NoopCacheBackend, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var evicted []string
+			c := NewCache(&config.CacheSettings{Backend: tt.backend, ExpirationInterval: 5, CleanupInterval: 10},
+				func(key string, _ interface{}) { evicted = append(evicted, key) })
+			assert.Equal(t, tt.stores, c.Enabled())
+
+			c.Set("a", "value", DefaultExpiration)
+			v, ok := c.Get("a")
+			assert.Equal(t, tt.stores, ok)
+			if tt.stores {
+				assert.Equal(t, "value", v)
+			} else {
+				assert.Nil(t, v)
+			}
+
+			c.Delete("a")
+			_, ok = c.Get("a")
+			assert.False(t, ok)
+
+			c.Set("b", "value", DefaultExpiration)
+			c.Set("c", "value", DefaultExpiration)
+			c.Flush()
+			_, ok = c.Get("b")
+			assert.False(t, ok)
+			_, ok = c.Get("c")
+			assert.False(t, ok)
+
+			c.Set("d", "value", CacheExpiration(time.Millisecond))
+			time.Sleep(5 * time.Millisecond)
+			_, ok = c.Get("d")
+			assert.False(t, ok)
+
+			if tt.stores {
+				// flushing doesn't notify the evictions
+				assert.Equal(t, []string{"a"}, evicted)
+			} else {
+				assert.Empty(t, evicted)
+			}
+		})
+	}
+}
+
+func TestCacheHandlerNoopBackend(t *testing.T) {
+	c := NewCacheHandler(&config.CacheSettings{Enabled: true, Backend: NoopCacheBackend, WriteThrough: true})
+	assert.False(t, c.IsEnabled())
+	c.SetResource("/orders/1", "a", []byte("a"), DefaultExpiration)
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+}
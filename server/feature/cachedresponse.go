@@ -0,0 +1,111 @@
+package feature
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CachedResponse is a response kept in the cache. The body is stored once as sent by the
+// service and its gzip encoded variant is added on the first hit from a client accepting it.
+type CachedResponse struct {
+	Body        []byte `json:"-"`
+	ContentType string `json:"contentType"`
+	// content encoding the service applied to Body, such a body is always served as is
+	Encoding string `json:"encoding"`
+	mu       sync.Mutex
+	gzipped  []byte
+	// called with the size of the gzip encoded variant once it is added, nil if not cached
+	onGrow func(int64)
+}
+
+// NewCachedResponse creates the cache entry of a response with the body and header
+func NewCachedResponse(body []byte, header http.Header) *CachedResponse {
+	return &CachedResponse{
+		Body:        body,
+		ContentType: header.Get("Content-Type"),
+		Encoding:    header.Get("Content-Encoding"),
+	}
+}
+
+// Negotiate returns the body served to a client sending the Accept-Encoding header and its
+// content encoding, empty for the unencoded body. ok is false if the body was encoded by the
+// service in a way the client doesn't accept.
+func (c *CachedResponse) Negotiate(acceptEncoding string) ([]byte, string, bool) {
+	if c.Encoding != "" {
+		return c.Body, c.Encoding, AcceptsEncoding(acceptEncoding, c.Encoding)
+	}
+	if !AcceptsEncoding(acceptEncoding, "gzip") {
+		return c.Body, "", true
+	}
+	gzipped, err := c.Gzipped()
+	if err != nil {
+		return c.Body, "", true
+	}
+	return gzipped, "gzip", true
+}
+
+// Gzipped returns the gzip encoded body, it is compressed on the first call only
+func (c *CachedResponse) Gzipped() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gzipped != nil {
+		return c.gzipped, nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(c.Body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	c.gzipped = buf.Bytes()
+	if c.onGrow != nil {
+		c.onGrow(int64(len(c.gzipped)))
+	}
+	return c.gzipped, nil
+}
+
+// track sets the func the response reports its growth to, nil stops the reports once it is
+// evicted. It returns the bytes of the body and its encoded variant.
+func (c *CachedResponse) track(onGrow func(int64)) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onGrow = onGrow
+	return int64(len(c.Body) + len(c.gzipped))
+}
+
+// AcceptsEncoding reports whether a request with the Accept-Encoding header accepts a response
+// with the content encoding, a zero quality refuses the encoding
+func AcceptsEncoding(acceptEncoding string, encoding string) bool {
+	encoding = strings.ToLower(encoding)
+	if encoding == "x-gzip" {
+		encoding = "gzip"
+	}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		if coding != encoding && coding != "*" {
+			continue
+		}
+		refused := false
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			v, err := strconv.ParseFloat(q, 64)
+			refused = err == nil && v == 0
+		}
+		if coding != "*" {
+			return !refused
+		}
+		if !refused {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package feature
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		given    string
+		expected bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, GZIP", true},
+		{"gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"identity", false},
+		{"*", true},
+		{"gzip;q=0, *", false},
+		{"*;q=0", false},
+		{"x-gzip", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.given, func(t *testing.T) {
+			assert.Equal(t, tt.expected, AcceptsEncoding(tt.given, "gzip"))
+		})
+	}
+	assert.True(t, AcceptsEncoding("gzip, br", "br"))
+	assert.False(t, AcceptsEncoding("gzip", "br"))
+}
+
+func TestCachedResponseNegotiate(t *testing.T) {
+	c := NewCachedResponse([]byte("hello"), http.Header{"Content-Type": {"text/plain"}})
+	assert.Equal(t, "text/plain", c.ContentType)
+
+	body, encoding, ok := c.Negotiate("identity")
+	assert.True(t, ok)
+	assert.Equal(t, "hello", string(body))
+	assert.Empty(t, encoding)
+	assert.Nil(t, c.gzipped)
+
+	body, encoding, ok = c.Negotiate("gzip")
+	assert.True(t, ok)
+	assert.Equal(t, "gzip", encoding)
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	assert.Nil(t, err)
+	plain, err := io.ReadAll(zr)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(plain))
+	// the compressed variant is kept
+	again, _, _ := c.Negotiate("gzip")
+	assert.Same(t, &body[0], &again[0])
+
+	// a body encoded by the service is served as is
+	encoded := NewCachedResponse([]byte("br"), http.Header{"Content-Encoding": {"br"}})
+	body, encoding, ok = encoded.Negotiate("br")
+	assert.True(t, ok)
+	assert.Equal(t, "br", string(body))
+	assert.Equal(t, "br", encoding)
+	_, _, ok = encoded.Negotiate("gzip")
+	assert.False(t, ok)
+}
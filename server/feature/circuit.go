@@ -1,33 +1,225 @@
 package feature
 
 import (
+	"encoding/json"
+	"errors"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/ArmaanKatyal/go-api-gateway/server/config"
 	"github.com/sony/gobreaker/v2"
 )
 
+// DefaultMinimumRequests is the number of requests before the circuit can open when the service doesn't configure it
+const DefaultMinimumRequests = 5
+
+// defaultCircuitTimeout is how long gobreaker keeps the circuit open when the timeout isn't configured
+const defaultCircuitTimeout = 60 * time.Second
+
+// errRestoredFailure is the synthetic failure used to restore the counts of a persisted circuit
+var errRestoredFailure = errors.New("restored failure")
+
 type CircuitBreaker struct {
 	Settings config.CircuitSettings `json:"settings"`
 	breaker  *gobreaker.CircuitBreaker[[]byte]
+	mu       sync.Mutex
+	// time the circuit last opened
+	openedAt time.Time
+}
+
+// CircuitCounts are the counts of the current generation of the breaker, they are reset
+// whenever the state changes
+type CircuitCounts struct {
+	State                string `json:"state"`
+	Requests             uint32 `json:"requests"`
+	TotalSuccesses       uint32 `json:"total_successes"`
+	TotalFailures        uint32 `json:"total_failures"`
+	ConsecutiveSuccesses uint32 `json:"consecutive_successes"`
+	ConsecutiveFailures  uint32 `json:"consecutive_failures"`
+	// set only while the circuit is open
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+// CircuitState is the state of a circuit breaker saved to its state file
+type CircuitState struct {
+	CircuitCounts
+	SavedAt time.Time `json:"saved_at"`
 }
 
 func NewCircuitBreaker(svcName string, settings config.CircuitSettings) *CircuitBreaker {
-	return &CircuitBreaker{
-		Settings: settings,
-		breaker:  gobreaker.NewCircuitBreaker[[]byte](settings.Into(svcName)),
+	if settings.MinimumRequests == 0 {
+		settings.MinimumRequests = DefaultMinimumRequests
+	}
+	cb := &CircuitBreaker{Settings: settings}
+	st := settings.Into(svcName)
+	st.OnStateChange = func(_ string, _ gobreaker.State, to gobreaker.State) {
+		if to == gobreaker.StateOpen {
+			cb.mu.Lock()
+			cb.openedAt = time.Now()
+			cb.mu.Unlock()
+		}
+	}
+	cb.breaker = gobreaker.NewCircuitBreaker[[]byte](st)
+	if settings.PersistState {
+		cb.restoreFrom(svcName, settings.StateFile)
+	}
+	return cb
+}
+
+// restoreFrom restores the state of the breaker saved to the state file if it was saved within
+// the timeout of the breaker, older states are expected to have recovered
+func (cb *CircuitBreaker) restoreFrom(svcName string, stateFile string) {
+	states, err := LoadCircuitStates(stateFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Unable to load circuit breaker state", "service", svcName, "file", stateFile, "error", err.Error())
+		}
+		return
+	}
+	state, ok := states[svcName]
+	timeout := time.Duration(cb.Settings.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = defaultCircuitTimeout
+	}
+	if !ok || time.Since(state.SavedAt) > timeout {
+		return
+	}
+	cb.restore(state)
+	slog.Info("Restored circuit breaker state", "service", svcName, "state", cb.State())
+}
+
+// restore replays the counts of a saved state through the breaker as synthetic requests.
+// An open circuit is opened again with enough failures and reports the time it opened, it
+// stays open for a whole Timeout from the restart though. A half-open one starts closed. The
+// counts of a closed circuit are scaled down to MinimumRequests requests with the same failure
+// ratio, the successes are replayed before the failures so the replay can't open it. The
+// consecutive counts are therefore approximated.
+func (cb *CircuitBreaker) restore(state CircuitState) {
+	succeed := func() ([]byte, error) { return nil, nil }
+	fail := func() ([]byte, error) { return nil, errRestoredFailure }
+	switch state.State {
+	case gobreaker.StateOpen.String():
+		for i := 0; i < cb.Settings.MinimumRequests && !cb.IsOpen(); i++ {
+			_, _ = cb.breaker.Execute(fail)
+		}
+		if state.OpenedAt != nil && cb.IsOpen() {
+			cb.mu.Lock()
+			cb.openedAt = *state.OpenedAt
+			cb.mu.Unlock()
+		}
+	case gobreaker.StateClosed.String():
+		successes, failures := replayCounts(state.TotalSuccesses, state.TotalFailures, uint64(cb.Settings.MinimumRequests))
+		for i := uint64(0); i < successes; i++ {
+			_, _ = cb.breaker.Execute(succeed)
+		}
+		for i := uint64(0); i < failures && !cb.IsOpen(); i++ {
+			_, _ = cb.breaker.Execute(fail)
+		}
 	}
 }
 
+// replayCounts returns the successes and failures to replay for the saved counts, at most window
+// requests in total. The failure ratio is rounded down so it doesn't grow past the saved one
+func replayCounts(successes uint32, failures uint32, window uint64) (uint64, uint64) {
+	total := uint64(successes) + uint64(failures)
+	if total <= window {
+		return uint64(successes), uint64(failures)
+	}
+	replayed := uint64(failures) * window / total
+	return window - replayed, replayed
+}
+
 func (cb *CircuitBreaker) Execute(service string, f func() ([]byte, error)) ([]byte, error) {
 	slog.Info("Forwarding request using circuit breaker", "service", service, "breaker", cb.breaker.Name)
 	return cb.breaker.Execute(f)
 }
 
+// RequestTimeout returns the longest a single attempt may take, 0 if it is unbounded
+func (cb *CircuitBreaker) RequestTimeout() time.Duration {
+	return time.Duration(cb.Settings.RequestTimeout) * time.Second
+}
+
 func (cb *CircuitBreaker) IsOpen() bool {
 	return cb.breaker.State() == gobreaker.StateOpen
 }
 
+// State returns the state of the breaker i.e. closed, half-open or open
+func (cb *CircuitBreaker) State() string {
+	return cb.breaker.State().String()
+}
+
+// Counts returns the state of the breaker with its counts
+func (cb *CircuitBreaker) Counts() CircuitCounts {
+	state := cb.breaker.State()
+	counts := cb.breaker.Counts()
+	c := CircuitCounts{
+		State:                state.String(),
+		Requests:             counts.Requests,
+		TotalSuccesses:       counts.TotalSuccesses,
+		TotalFailures:        counts.TotalFailures,
+		ConsecutiveSuccesses: counts.ConsecutiveSuccesses,
+		ConsecutiveFailures:  counts.ConsecutiveFailures,
+	}
+	if state == gobreaker.StateOpen {
+		cb.mu.Lock()
+		openedAt := cb.openedAt
+		cb.mu.Unlock()
+		c.OpenedAt = &openedAt
+	}
+	return c
+}
+
+// Snapshot returns the state of the breaker to save to its state file
+func (cb *CircuitBreaker) Snapshot() CircuitState {
+	return CircuitState{CircuitCounts: cb.Counts(), SavedAt: time.Now()}
+}
+
+// StateFile returns the file the state of the breaker is saved to, empty if it isn't persisted
+func (cb *CircuitBreaker) StateFile() string {
+	if !cb.Settings.Enabled || !cb.Settings.PersistState {
+		return ""
+	}
+	return cb.Settings.StateFile
+}
+
 func (cb *CircuitBreaker) IsEnabled() bool {
 	return cb.Settings.Enabled
 }
+
+// LoadCircuitStates reads the states of the circuit breakers by service from a state file
+func LoadCircuitStates(path string) (map[string]CircuitState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var states map[string]CircuitState
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// SaveCircuitStates writes the states of the circuit breakers by service to a state file. The
+// file is replaced at once so a crash while saving doesn't leave a truncated file behind.
+func SaveCircuitStates(path string, states map[string]CircuitState) error {
+	data, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,170 @@
+package feature
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakerMinimumRequests(t *testing.T) {
+	fail := func() ([]byte, error) { return nil, errors.New("upstream down") }
+	tests := []struct {
+		name            string
+		minimumRequests int
+		expected        int
+	}{
+		{"default", 0, DefaultMinimumRequests},
+		{"configured", 3, 3},
+		{"first failure", 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := NewCircuitBreaker("test", config.CircuitSettings{Enabled: true, Timeout: 60, FailureRatio: 0.5, MinimumRequests: tt.minimumRequests})
+			for i := 1; i < tt.expected; i++ {
+				_, _ = cb.Execute("test", fail)
+				assert.False(t, cb.IsOpen(), "opened after %d failures", i)
+			}
+			_, _ = cb.Execute("test", fail)
+			assert.True(t, cb.IsOpen())
+		})
+	}
+}
+
+func TestCircuitBreakerFailureRatio(t *testing.T) {
+	cb := NewCircuitBreaker("test", config.CircuitSettings{Enabled: true, Timeout: 60, FailureRatio: 0.5, MinimumRequests: 5})
+	ok := func() ([]byte, error) { return nil, nil }
+	fail := func() ([]byte, error) { return nil, errors.New("upstream down") }
+	// 2 failures out of 5 requests is below the ratio
+	for _, f := range []func() ([]byte, error){ok, ok, ok, fail, fail} {
+		_, _ = cb.Execute("test", f)
+	}
+	assert.False(t, cb.IsOpen())
+	_, _ = cb.Execute("test", fail)
+	assert.True(t, cb.IsOpen())
+}
+
+func TestCircuitBreakerRequestTimeout(t *testing.T) {
+	// the timeout is configured in seconds like the other durations of the breaker
+	cb := NewCircuitBreaker("test", config.CircuitSettings{Enabled: true, Timeout: 60, RequestTimeout: 2})
+	assert.Equal(t, 2*time.Second, cb.RequestTimeout())
+	cb = NewCircuitBreaker("test", config.CircuitSettings{Enabled: true, Timeout: 60})
+	assert.Equal(t, time.Duration(0), cb.RequestTimeout())
+}
+
+func TestReplayCounts(t *testing.T) {
+	tests := []struct {
+		name                string
+		successes, failures uint32
+		window              uint64
+		expectedSuccesses   uint64
+		expectedFailures    uint64
+	}{
+		{"within the window", 2, 1, 5, 2, 1},
+		{"scaled down", 600, 400, 10, 6, 4},
+		{"ratio rounded down", 2, 1, 2, 2, 0},
+		{"largest counts", math.MaxUint32, math.MaxUint32, 5, 3, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			successes, failures := replayCounts(tt.successes, tt.failures, tt.window)
+			assert.Equal(t, tt.expectedSuccesses, successes)
+			assert.Equal(t, tt.expectedFailures, failures)
+		})
+	}
+}
+
+func TestCircuitBreakerPersistState(t *testing.T) {
+	fail := func() ([]byte, error) { return nil, errors.New("upstream down") }
+	ok := func() ([]byte, error) { return nil, nil }
+	// every test saves to a state file of its own
+	newSettings := func(t *testing.T) config.CircuitSettings {
+		return config.CircuitSettings{
+			Enabled:         true,
+			Timeout:         60,
+			FailureRatio:    0.5,
+			MinimumRequests: 3,
+			PersistState:    true,
+			StateFile:       filepath.Join(t.TempDir(), "circuit-state.json"),
+		}
+	}
+
+	t.Run("open circuit restored open", func(t *testing.T) {
+		settings := newSettings(t)
+		cb := NewCircuitBreaker("orders", settings)
+		for i := 0; i < 3; i++ {
+			_, _ = cb.Execute("orders", fail)
+		}
+		assert.True(t, cb.IsOpen())
+		openedAt := *cb.Counts().OpenedAt
+		assert.Nil(t, SaveCircuitStates(settings.StateFile, map[string]CircuitState{"orders": cb.Snapshot()}))
+
+		// a restart re-creates the breaker from the state file
+		restarted := NewCircuitBreaker("orders", settings)
+		assert.True(t, restarted.IsOpen())
+		assert.True(t, openedAt.Equal(*restarted.Counts().OpenedAt))
+		// other services don't pick up the state
+		assert.False(t, NewCircuitBreaker("payments", settings).IsOpen())
+	})
+
+	t.Run("closed counts restored", func(t *testing.T) {
+		settings := newSettings(t)
+		cb := NewCircuitBreaker("orders", settings)
+		for _, f := range []func() ([]byte, error){ok, ok, fail} {
+			_, _ = cb.Execute("orders", f)
+		}
+		assert.Nil(t, SaveCircuitStates(settings.StateFile, map[string]CircuitState{"orders": cb.Snapshot()}))
+
+		restarted := NewCircuitBreaker("orders", settings)
+		counts := restarted.Counts()
+		assert.Equal(t, "closed", counts.State)
+		assert.Equal(t, uint32(3), counts.Requests)
+		assert.Equal(t, uint32(2), counts.TotalSuccesses)
+		assert.Equal(t, uint32(1), counts.TotalFailures)
+		// the restored failure counts towards opening the circuit
+		_, _ = restarted.Execute("orders", fail)
+		assert.True(t, restarted.IsOpen())
+	})
+
+	t.Run("large closed counts scaled down", func(t *testing.T) {
+		settings := newSettings(t)
+		state := CircuitState{
+			CircuitCounts: CircuitCounts{State: "closed", Requests: 4_000_000_000, TotalSuccesses: 3_000_000_000, TotalFailures: 1_000_000_000},
+			SavedAt:       time.Now(),
+		}
+		assert.Nil(t, SaveCircuitStates(settings.StateFile, map[string]CircuitState{"orders": state}))
+
+		counts := NewCircuitBreaker("orders", settings).Counts()
+		assert.Equal(t, "closed", counts.State)
+		assert.Equal(t, uint32(3), counts.Requests)
+		assert.Equal(t, uint32(3), counts.TotalSuccesses)
+		assert.Equal(t, uint32(0), counts.TotalFailures)
+	})
+
+	t.Run("stale state ignored", func(t *testing.T) {
+		settings := newSettings(t)
+		cb := NewCircuitBreaker("orders", settings)
+		for i := 0; i < 3; i++ {
+			_, _ = cb.Execute("orders", fail)
+		}
+		state := cb.Snapshot()
+		state.SavedAt = time.Now().Add(-2 * time.Minute)
+		assert.Nil(t, SaveCircuitStates(settings.StateFile, map[string]CircuitState{"orders": state}))
+		assert.False(t, NewCircuitBreaker("orders", settings).IsOpen())
+	})
+
+	t.Run("not persisted", func(t *testing.T) {
+		settings := newSettings(t)
+		assert.Equal(t, settings.StateFile, NewCircuitBreaker("orders", settings).StateFile())
+		disabled := settings
+		disabled.PersistState = false
+		assert.Empty(t, NewCircuitBreaker("orders", disabled).StateFile())
+		missing := settings
+		missing.StateFile = filepath.Join(t.TempDir(), "missing.json")
+		assert.False(t, NewCircuitBreaker("orders", missing).IsOpen())
+	})
+}
@@ -0,0 +1,47 @@
+package feature
+
+import (
+	"net/http"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/google/uuid"
+)
+
+const DefaultCorrelationHeader = "X-Trace-Id"
+
+// Correlation resolves the id correlating a request across the gateway and the services
+type Correlation struct {
+	// headers checked in order for the id sent by the client
+	InboundHeaders []string `json:"inboundHeaders"`
+	// header carrying the id to the services
+	OutboundHeader string `json:"outboundHeader"`
+}
+
+func NewCorrelation() *Correlation {
+	conf := config.AppConfig.Server.Correlation
+	if conf.OutboundHeader == "" {
+		conf.OutboundHeader = DefaultCorrelationHeader
+	}
+	if len(conf.InboundHeaders) == 0 {
+		conf.InboundHeaders = []string{conf.OutboundHeader}
+	}
+	return &Correlation{
+		InboundHeaders: conf.InboundHeaders,
+		OutboundHeader: conf.OutboundHeader,
+	}
+}
+
+// ID returns the id of the first inbound header set on the request or a new one
+func (c *Correlation) ID(r *http.Request) string {
+	for _, name := range c.InboundHeaders {
+		if id := r.Header.Get(name); id != "" {
+			return id
+		}
+	}
+	return uuid.NewString()
+}
+
+// Set sets the id on the outbound header, replacing any value the client sent
+func (c *Correlation) Set(h http.Header, id string) {
+	h.Set(c.OutboundHeader, id)
+}
@@ -0,0 +1,45 @@
+package feature
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCorrelationDefaults(t *testing.T) {
+	defer func(c config.Conf) { config.AppConfig = c }(config.AppConfig)
+	config.AppConfig = config.Conf{}
+	c := NewCorrelation()
+	assert.Equal(t, DefaultCorrelationHeader, c.OutboundHeader)
+	assert.Equal(t, []string{DefaultCorrelationHeader}, c.InboundHeaders)
+}
+
+func TestCorrelationID(t *testing.T) {
+	c := &Correlation{InboundHeaders: []string{"X-Request-Id", "X-Correlation-Id"}, OutboundHeader: "X-Trace-Id"}
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected string
+	}{
+		{"request id", http.Header{"X-Request-Id": {"req-1"}}, "req-1"},
+		{"correlation id", http.Header{"X-Correlation-Id": {"corr-1"}}, "corr-1"},
+		{"first header in order", http.Header{"X-Correlation-Id": {"corr-1"}, "X-Request-Id": {"req-1"}}, "req-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header = tt.header
+			assert.Equal(t, tt.expected, c.ID(r))
+		})
+	}
+	t.Run("generated", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Trace-Id", "not-inbound")
+		_, err := uuid.Parse(c.ID(r))
+		assert.Nil(t, err)
+	})
+}
@@ -0,0 +1,56 @@
+package feature
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxDecompressedSize is used when no limit is configured for the decompressed body
+const DefaultMaxDecompressedSize int64 = 10 << 20
+
+var ErrBodyTooLarge = errors.New("decompressed body exceeds the size limit")
+
+// DecompressRequest replaces a gzip or deflate encoded request body with the decoded body
+// and adjusts the Content-Encoding and Content-Length headers. Other encodings are left as is.
+// The decoded body is buffered and rejected with ErrBodyTooLarge if it exceeds limit bytes.
+func DecompressRequest(r *http.Request, limit int64) error {
+	var reader io.ReadCloser
+	var err error
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(r.Body)
+	case "deflate":
+		reader, err = zlib.NewReader(r.Body)
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("decompress %s body: %w", encoding, err)
+	}
+	defer reader.Close()
+	if limit <= 0 {
+		limit = DefaultMaxDecompressedSize
+	}
+	// read one byte past the limit to detect bodies which exceed it
+	body, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return fmt.Errorf("decompress %s body: %w", encoding, err)
+	}
+	if int64(len(body)) > limit {
+		return ErrBodyTooLarge
+	}
+	_ = r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Del("Content-Encoding")
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
@@ -0,0 +1,69 @@
+package feature
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func compress(t *testing.T, encoding string, data string) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	}
+	_, err := w.Write([]byte(data))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestDecompressRequest(t *testing.T) {
+	payload := `{"key":"value"}`
+	for _, encoding := range []string{"gzip", "deflate"} {
+		t.Run(encoding, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(compress(t, encoding, payload)))
+			r.Header.Set("Content-Encoding", encoding)
+			r.Header.Set("Content-Length", "10")
+			assert.Nil(t, DecompressRequest(r, 0))
+			body, err := io.ReadAll(r.Body)
+			assert.Nil(t, err)
+			assert.Equal(t, payload, string(body))
+			assert.Empty(t, r.Header.Get("Content-Encoding"))
+			assert.Equal(t, "15", r.Header.Get("Content-Length"))
+			assert.Equal(t, int64(len(payload)), r.ContentLength)
+			assert.Nil(t, r.Body.Close())
+		})
+	}
+	t.Run("plain body untouched", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(payload)))
+		assert.Nil(t, DecompressRequest(r, 0))
+		body, err := io.ReadAll(r.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, payload, string(body))
+	})
+	t.Run("invalid gzip body", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(payload)))
+		r.Header.Set("Content-Encoding", "gzip")
+		assert.NotNil(t, DecompressRequest(r, 0))
+	})
+	t.Run("body within limit", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(compress(t, "gzip", payload)))
+		r.Header.Set("Content-Encoding", "gzip")
+		assert.Nil(t, DecompressRequest(r, int64(len(payload))))
+	})
+	t.Run("body exceeds limit", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(compress(t, "gzip", payload)))
+		r.Header.Set("Content-Encoding", "gzip")
+		assert.ErrorIs(t, DecompressRequest(r, int64(len(payload))-1), ErrBodyTooLarge)
+	})
+}
@@ -0,0 +1,104 @@
+package feature
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+)
+
+const (
+	DefaultDeduplicationHeader = "Idempotency-Key"
+	DefaultDeduplicationTTL    = 86400
+)
+
+// StoredResponse is a response replayed for a duplicate request
+type StoredResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// DeduplicationStore keeps the responses of requests made with an idempotency key
+type DeduplicationStore struct {
+	Enabled bool   `json:"enabled"`
+	Header  string `json:"header"`
+	TTL     int    `json:"ttl"`
+	cache   *CacheHandler
+	mu      sync.Mutex
+	// keys of the requests being handled, a duplicate doesn't reach the service meanwhile
+	inFlight map[string]bool
+}
+
+func NewDeduplicationStore() *DeduplicationStore {
+	conf := config.AppConfig.Server.Deduplication
+	if conf.Header == "" {
+		conf.Header = DefaultDeduplicationHeader
+	}
+	if conf.TTL == 0 {
+		conf.TTL = DefaultDeduplicationTTL
+	}
+	return &DeduplicationStore{
+		Enabled:  conf.Enabled,
+		Header:   conf.Header,
+		TTL:      conf.TTL,
+		inFlight: make(map[string]bool),
+		cache: NewCacheHandler(&config.CacheSettings{
+			Enabled:         conf.Enabled,
+			DefaultTTL:      uint(conf.TTL),
+			CleanupInterval: uint(conf.TTL),
+		}),
+	}
+}
+
+func (d *DeduplicationStore) IsEnabled() bool {
+	return d.Enabled
+}
+
+// Key hashes the request with its idempotency key and the identity of the caller, so a
+// response is only replayed to the caller which made the request
+func (d *DeduplicationStore) Key(method string, url string, idempotencyKey string, identity string) string {
+	h := sha256.Sum256([]byte(method + " " + url + " " + idempotencyKey + " " + identity))
+	return hex.EncodeToString(h[:])
+}
+
+// CallerIdentity returns the credentials of the caller, its authorization and the claims of
+// its token once authenticated
+func CallerIdentity(r *http.Request) string {
+	return r.Header.Get("Authorization") + "\n" + strings.Join(r.Header.Values(ClaimsHeader), "\n")
+}
+
+// Begin marks the request as being handled, it returns false if a request with the same key
+// already is
+func (d *DeduplicationStore) Begin(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.inFlight[key] {
+		return false
+	}
+	d.inFlight[key] = true
+	return true
+}
+
+// End marks the request as handled
+func (d *DeduplicationStore) End(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.inFlight, key)
+}
+
+func (d *DeduplicationStore) Get(key string) (*StoredResponse, bool) {
+	v, ok := d.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	resp, ok := v.(*StoredResponse)
+	return resp, ok
+}
+
+func (d *DeduplicationStore) Set(key string, resp *StoredResponse) {
+	d.cache.Set(key, resp, DefaultExpiration)
+}
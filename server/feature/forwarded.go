@@ -0,0 +1,231 @@
+package feature
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Forwarded is a single element of the RFC 7239 Forwarded header
+type Forwarded struct {
+	For   string
+	Proto string
+	Host  string
+}
+
+// ParseForwarded parses the comma separated elements of a Forwarded header
+func ParseForwarded(header string) []Forwarded {
+	var elements []Forwarded
+	for _, element := range strings.Split(header, ",") {
+		if strings.TrimSpace(element) == "" {
+			continue
+		}
+		var f Forwarded
+		for _, pair := range strings.Split(element, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				continue
+			}
+			v = strings.Trim(v, `"`)
+			switch strings.ToLower(k) {
+			case "for":
+				f.For = forwardedNode(v)
+			case "proto":
+				f.Proto = strings.ToLower(v)
+			case "host":
+				f.Host = v
+			}
+		}
+		elements = append(elements, f)
+	}
+	return elements
+}
+
+// forwardedNode strips the optional port and brackets from a node e.g. "[2001:db8::1]:4711"
+func forwardedNode(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.Trim(node, "[]")
+}
+
+// RemoteIP returns the ip of a host:port address or the address itself if it has no port
+func RemoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// TrustedProxies resolves the client of a request from the forwarding headers, which are
+// only trusted when set by one of the configured proxies
+type TrustedProxies struct {
+	networks []*net.IPNet
+}
+
+// NewTrustedProxies creates the resolver from a list of ips or cidrs, invalid entries are skipped
+func NewTrustedProxies(proxies []string) *TrustedProxies {
+	tp := &TrustedProxies{}
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(p)
+		if err != nil {
+			slog.Error("invalid trusted proxy", "proxy", p, "error", err.Error())
+			continue
+		}
+		tp.networks = append(tp.networks, network)
+	}
+	return tp
+}
+
+// IsTrusted checks if the ip belongs to a trusted proxy
+func (tp *TrustedProxies) IsTrusted(ip string) bool {
+	if tp == nil {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range tp.networks {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// hops returns the forwarding chain of the request, the Forwarded header takes
+// precedence over the X-Forwarded-* headers
+func hops(r *http.Request) []Forwarded {
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		return ParseForwarded(strings.Join(values, ","))
+	}
+	var elements []Forwarded
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, ip := range strings.Split(v, ",") {
+			elements = append(elements, Forwarded{For: forwardedNode(strings.TrimSpace(ip))})
+		}
+	}
+	if len(elements) > 0 {
+		last := &elements[len(elements)-1]
+		last.Proto = strings.ToLower(r.Header.Get("X-Forwarded-Proto"))
+		last.Host = r.Header.Get("X-Forwarded-Host")
+	}
+	return elements
+}
+
+// Resolve returns the client ip, proto and host of the request. The chain is walked from the
+// closest hop and stops at the first node which is not a trusted proxy.
+func (tp *TrustedProxies) Resolve(r *http.Request) Forwarded {
+	res := Forwarded{For: RemoteIP(r.RemoteAddr), Proto: "http", Host: r.Host}
+	if r.TLS != nil {
+		res.Proto = "https"
+	}
+	if !tp.IsTrusted(res.For) {
+		return res
+	}
+	chain := hops(r)
+	for i := len(chain) - 1; i >= 0; i-- {
+		h := chain[i]
+		if net.ParseIP(h.For) == nil {
+			// obfuscated or unknown node, nothing further can be trusted
+			break
+		}
+		res.For = h.For
+		if h.Proto != "" {
+			res.Proto = h.Proto
+		}
+		if h.Host != "" {
+			res.Host = h.Host
+		}
+		if !tp.IsTrusted(h.For) {
+			break
+		}
+	}
+	return res
+}
+
+// Policies for the forwarding headers received by a service, by default the headers are
+// appended to if the peer is a trusted proxy and replaced otherwise
+const (
+	// ForwardedStrip drops the inbound headers, the service only sees the gateway peer
+	ForwardedStrip = "strip"
+	// ForwardedAppend always appends to the inbound headers, for a gateway only reachable internally
+	ForwardedAppend = "append"
+	// ForwardedSet replaces the inbound headers with the client resolved through the trusted proxies
+	ForwardedSet = "set"
+)
+
+// ForwardHeaders sets the forwarding headers of the upstream request h for the incoming
+// request r. Headers received from an untrusted peer are replaced instead of appended to.
+func (tp *TrustedProxies) ForwardHeaders(h http.Header, r *http.Request) {
+	tp.ForwardHeadersWithPolicy(h, r, "")
+}
+
+// ForwardHeadersWithPolicy sets the forwarding headers of the upstream request h for the incoming
+// request r, treating the inbound headers according to the policy
+func (tp *TrustedProxies) ForwardHeadersWithPolicy(h http.Header, r *http.Request, policy string) {
+	peer := RemoteIP(r.RemoteAddr)
+	proto, host := "http", r.Host
+	if r.TLS != nil {
+		proto = "https"
+	}
+	client := tp.Resolve(r)
+	switch policy {
+	case ForwardedStrip:
+		stripForwarded(h)
+		client = Forwarded{For: peer, Proto: proto, Host: host}
+	case ForwardedSet:
+		stripForwarded(h)
+		peer, proto, host = client.For, client.Proto, client.Host
+	case ForwardedAppend:
+		if v := h.Get("X-Forwarded-Proto"); v != "" {
+			client.Proto = v
+		}
+		if v := h.Get("X-Forwarded-Host"); v != "" {
+			client.Host = v
+		}
+	default:
+		if !tp.IsTrusted(peer) {
+			h.Del("Forwarded")
+			h.Del("X-Forwarded-For")
+		}
+	}
+	node := peer
+	if strings.Contains(node, ":") {
+		node = "[" + node + "]"
+	}
+	h.Add("Forwarded", "for="+forwardedValue(node)+";proto="+proto+";host="+forwardedValue(host))
+	if prior := strings.Join(h.Values("X-Forwarded-For"), ", "); prior != "" {
+		h.Set("X-Forwarded-For", prior+", "+peer)
+	} else {
+		h.Set("X-Forwarded-For", peer)
+	}
+	h.Set("X-Forwarded-Proto", client.Proto)
+	h.Set("X-Forwarded-Host", client.Host)
+}
+
+// stripForwarded deletes the Forwarded and every X-Forwarded-* header
+func stripForwarded(h http.Header) {
+	for k := range h {
+		if k == "Forwarded" || strings.HasPrefix(k, "X-Forwarded-") {
+			delete(h, k)
+		}
+	}
+}
+
+// forwardedValue quotes the value if it contains characters which are not allowed in a token
+func forwardedValue(v string) string {
+	if strings.ContainsAny(v, ":[]") {
+		return `"` + v + `"`
+	}
+	return v
+}
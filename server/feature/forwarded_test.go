@@ -0,0 +1,141 @@
+package feature
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseForwarded(t *testing.T) {
+	elements := ParseForwarded(`for=192.0.2.60;proto=HTTPS;host=example.com, for="[2001:db8:cafe::17]:4711", by=203.0.113.43`)
+	assert.Equal(t, []Forwarded{
+		{For: "192.0.2.60", Proto: "https", Host: "example.com"},
+		{For: "2001:db8:cafe::17"},
+		{},
+	}, elements)
+}
+
+func TestNewTrustedProxies(t *testing.T) {
+	tp := NewTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "::1", "invalid"})
+	assert.Len(t, tp.networks, 3)
+	assert.True(t, tp.IsTrusted("10.1.2.3"))
+	assert.True(t, tp.IsTrusted("192.168.1.1"))
+	assert.False(t, tp.IsTrusted("192.168.1.2"))
+	assert.True(t, tp.IsTrusted("::1"))
+	assert.False(t, tp.IsTrusted("unknown"))
+}
+
+func TestResolve(t *testing.T) {
+	tp := NewTrustedProxies([]string{"10.0.0.0/8"})
+	tests := []struct {
+		name     string
+		remote   string
+		header   http.Header
+		expected Forwarded
+	}{
+		{
+			name:     "forwarded from trusted proxy",
+			remote:   "10.0.0.1:1234",
+			header:   http.Header{"Forwarded": {"for=192.0.2.60;proto=https;host=example.com"}},
+			expected: Forwarded{For: "192.0.2.60", Proto: "https", Host: "example.com"},
+		},
+		{
+			name:     "forwarded from untrusted peer ignored",
+			remote:   "192.0.2.1:1234",
+			header:   http.Header{"Forwarded": {"for=192.0.2.60;proto=https;host=example.com"}},
+			expected: Forwarded{For: "192.0.2.1", Proto: "http", Host: "gateway"},
+		},
+		{
+			name:     "spoofed hops before the first untrusted node ignored",
+			remote:   "10.0.0.1:1234",
+			header:   http.Header{"Forwarded": {"for=1.1.1.1, for=192.0.2.60, for=10.0.0.2;proto=https"}},
+			expected: Forwarded{For: "192.0.2.60", Proto: "https", Host: "gateway"},
+		},
+		{
+			name:     "obfuscated node stops the walk",
+			remote:   "10.0.0.1:1234",
+			header:   http.Header{"Forwarded": {"for=_hidden, for=10.0.0.2"}},
+			expected: Forwarded{For: "10.0.0.2", Proto: "http", Host: "gateway"},
+		},
+		{
+			name:     "x-forwarded-for fallback",
+			remote:   "10.0.0.1:1234",
+			header:   http.Header{"X-Forwarded-For": {"192.0.2.60, 10.0.0.2"}, "X-Forwarded-Proto": {"https"}},
+			expected: Forwarded{For: "192.0.2.60", Proto: "https", Host: "gateway"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://gateway/", nil)
+			r.RemoteAddr = tt.remote
+			r.Header = tt.header
+			assert.Equal(t, tt.expected, tp.Resolve(r))
+		})
+	}
+}
+
+func TestForwardHeaders(t *testing.T) {
+	tp := NewTrustedProxies([]string{"10.0.0.0/8"})
+	t.Run("trusted peer appended", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://gateway/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header = http.Header{"Forwarded": {"for=192.0.2.60;proto=https"}, "X-Forwarded-For": {"192.0.2.60"}}
+		h := r.Header.Clone()
+		tp.ForwardHeaders(h, r)
+		assert.Equal(t, []string{"for=192.0.2.60;proto=https", "for=10.0.0.1;proto=http;host=gateway"}, h.Values("Forwarded"))
+		assert.Equal(t, "192.0.2.60, 10.0.0.1", h.Get("X-Forwarded-For"))
+		assert.Equal(t, "https", h.Get("X-Forwarded-Proto"))
+	})
+	t.Run("untrusted peer replaced", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://gateway:8080/", nil)
+		r.RemoteAddr = "[2001:db8::1]:1234"
+		r.Header = http.Header{"Forwarded": {"for=1.1.1.1"}, "X-Forwarded-For": {"1.1.1.1"}}
+		h := r.Header.Clone()
+		tp.ForwardHeaders(h, r)
+		assert.Equal(t, []string{`for="[2001:db8::1]";proto=http;host="gateway:8080"`}, h.Values("Forwarded"))
+		assert.Equal(t, "2001:db8::1", h.Get("X-Forwarded-For"))
+		assert.Equal(t, "gateway:8080", h.Get("X-Forwarded-Host"))
+	})
+}
+
+func TestForwardHeadersPolicy(t *testing.T) {
+	tp := NewTrustedProxies([]string{"10.0.0.0/8"})
+	tests := []struct {
+		name      string
+		policy    string
+		peer      string
+		forwarded []string
+		xff       string
+		proto     string
+	}{
+		{"strip untrusted peer", ForwardedStrip, "203.0.113.5:1234", []string{"for=203.0.113.5;proto=http;host=gateway"}, "203.0.113.5", "http"},
+		{"strip trusted peer", ForwardedStrip, "10.0.0.1:1234", []string{"for=10.0.0.1;proto=http;host=gateway"}, "10.0.0.1", "http"},
+		{"append untrusted peer", ForwardedAppend, "203.0.113.5:1234", []string{"for=6.6.6.6", "for=203.0.113.5;proto=http;host=gateway"}, "6.6.6.6, 203.0.113.5", "https"},
+		{"set untrusted peer", ForwardedSet, "203.0.113.5:1234", []string{"for=203.0.113.5;proto=http;host=gateway"}, "203.0.113.5", "http"},
+		{"set trusted peer", ForwardedSet, "10.0.0.1:1234", []string{"for=6.6.6.6;proto=http;host=gateway"}, "6.6.6.6", "http"},
+		{"default untrusted peer", "", "203.0.113.5:1234", []string{"for=203.0.113.5;proto=http;host=gateway"}, "203.0.113.5", "http"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://gateway/", nil)
+			r.RemoteAddr = tt.peer
+			// spoofed by the client
+			r.Header = http.Header{
+				"Forwarded":          {"for=6.6.6.6"},
+				"X-Forwarded-For":    {"6.6.6.6"},
+				"X-Forwarded-Proto":  {"https"},
+				"X-Forwarded-Prefix": {"/admin"},
+			}
+			h := r.Header.Clone()
+			tp.ForwardHeadersWithPolicy(h, r, tt.policy)
+			assert.Equal(t, tt.forwarded, h.Values("Forwarded"))
+			assert.Equal(t, tt.xff, h.Get("X-Forwarded-For"))
+			assert.Equal(t, tt.proto, h.Get("X-Forwarded-Proto"))
+			if tt.policy == ForwardedStrip || tt.policy == ForwardedSet {
+				assert.Empty(t, h.Get("X-Forwarded-Prefix"))
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package feature
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+)
+
+// MandatoryHeaders are forwarded even if the allow list of the service doesn't name them, the
+// service can't read the body or upgrade the connection without them
+var MandatoryHeaders = []string{
+	"Accept", "Accept-Encoding", "Connection", "Content-Encoding", "Content-Length", "Content-Type",
+	"Te", "Upgrade", ClaimsHeader,
+}
+
+// websocketHeaderPrefix is the prefix of the headers negotiating a websocket connection
+const websocketHeaderPrefix = "Sec-Websocket-"
+
+// HeaderAllowList is the set of the request headers forwarded to a service, the others are dropped
+type HeaderAllowList struct {
+	Headers map[string]bool `json:"headers"`
+}
+
+// NewHeaderAllowList returns nil if the service forwards every header
+func NewHeaderAllowList(conf *config.ForwardHeadersSettings) *HeaderAllowList {
+	if len(conf.AllowList) == 0 {
+		return nil
+	}
+	a := &HeaderAllowList{Headers: make(map[string]bool, len(conf.AllowList)+len(MandatoryHeaders))}
+	for _, h := range MandatoryHeaders {
+		a.Headers[h] = true
+	}
+	for _, h := range conf.AllowList {
+		a.Headers[http.CanonicalHeaderKey(h)] = true
+	}
+	return a
+}
+
+// Allows checks if the header is forwarded, the names are matched case insensitively
+func (a *HeaderAllowList) Allows(name string) bool {
+	if a == nil {
+		return true
+	}
+	name = http.CanonicalHeaderKey(name)
+	return a.Headers[name] || strings.HasPrefix(name, websocketHeaderPrefix)
+}
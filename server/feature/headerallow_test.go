@@ -0,0 +1,25 @@
+package feature
+
+import (
+	"testing"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderAllowList(t *testing.T) {
+	assert.Nil(t, NewHeaderAllowList(&config.ForwardHeadersSettings{}))
+	var all *HeaderAllowList
+	assert.True(t, all.Allows("X-Anything"))
+
+	a := NewHeaderAllowList(&config.ForwardHeadersSettings{AllowList: []string{"authorization", "X-Tenant-ID"}})
+	assert.True(t, a.Allows("Authorization"))
+	assert.True(t, a.Allows("x-tenant-id"))
+	assert.True(t, a.Allows("X-Tenant-Id"))
+	assert.False(t, a.Allows("Cookie"))
+	assert.False(t, a.Allows("X-Internal-Debug"))
+	// mandatory headers
+	assert.True(t, a.Allows("Content-Type"))
+	assert.True(t, a.Allows("X-Claims"))
+	assert.True(t, a.Allows("sec-websocket-key"))
+}
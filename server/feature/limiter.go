@@ -1,7 +1,9 @@
 package feature
 
 import (
+	"context"
 	"log/slog"
+	"sort"
 	"sync"
 	"time"
 
@@ -12,8 +14,9 @@ import (
 type LimiterType string
 
 const (
-	GlobalLimiter  LimiterType = "Global"
-	ServiceLimiter LimiterType = "Service"
+	GlobalLimiter      LimiterType = "Global"
+	ServiceLimiter     LimiterType = "Service"
+	GlobalPerIPLimiter LimiterType = "GlobalPerIP"
 )
 
 type Visitor struct {
@@ -29,38 +32,82 @@ type BaseRateLimiter struct {
 	Rate        rate.Limit
 	Burst       int
 	Cleanup     int
+	// called with the number of visitors when it changes
+	onVisitorsChange func(int)
+	// closed by Stop to end the visitor cleanup
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
-// CleanupVisitors periodically cleans up visitors which inturn reset the limits
+// CleanupVisitors periodically cleans up visitors which inturn reset the limits, until Stop is called
 func (rl *BaseRateLimiter) CleanupVisitors() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
 	for {
-		time.Sleep(time.Minute)
-		rl.mu.Lock()
-		switch rl.limitertype {
-		case GlobalLimiter:
-			slog.Info("cleaning up global visitors")
-		case ServiceLimiter:
-			slog.Info("cleaning up service visitors")
+		select {
+		case <-rl.stop:
+			return
+		case <-ticker.C:
+			rl.RemoveStaleVisitors()
 		}
-		for ip, v := range rl.visitors {
-			if time.Since(v.LastSeen) > time.Duration(rl.Cleanup)*time.Second {
-				delete(rl.visitors, ip)
-			}
+	}
+}
+
+// Stop ends the visitor cleanup of the limiter, e.g. once its service is replaced
+func (rl *BaseRateLimiter) Stop() {
+	rl.stopOnce.Do(func() {
+		if rl.stop != nil {
+			close(rl.stop)
 		}
-		rl.mu.Unlock()
+	})
+}
+
+// RemoveStaleVisitors removes the visitors not seen for longer than the cleanup interval
+func (rl *BaseRateLimiter) RemoveStaleVisitors() {
+	rl.mu.Lock()
+	switch rl.limitertype {
+	case GlobalLimiter:
+		slog.Info("cleaning up global visitors")
+	case ServiceLimiter:
+		slog.Info("cleaning up service visitors")
+	case GlobalPerIPLimiter:
+		slog.Info("cleaning up global per ip visitors")
 	}
+	for ip, v := range rl.visitors {
+		if time.Since(v.LastSeen) > time.Duration(rl.Cleanup)*time.Second {
+			delete(rl.visitors, ip)
+		}
+	}
+	rl.visitorsChanged()
+	rl.mu.Unlock()
 }
 
-func (rl *BaseRateLimiter) AddIP(ip string) *Visitor {
+// OnVisitorsChange sets the func called with the number of visitors when visitors are added
+// or removed, nil stops the calls. It is called with the limiter lock held so the changes are
+// reported in order, it must not call the limiter.
+func (rl *BaseRateLimiter) OnVisitorsChange(f func(int)) {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
+	rl.onVisitorsChange = f
+}
+
+// visitorsChanged reports the number of visitors, rl.mu must be held
+func (rl *BaseRateLimiter) visitorsChanged() {
+	if rl.onVisitorsChange != nil {
+		rl.onVisitorsChange(len(rl.visitors))
+	}
+}
 
+func (rl *BaseRateLimiter) AddIP(ip string) *Visitor {
+	rl.mu.Lock()
 	v := &Visitor{
 		Limiter:  rate.NewLimiter(rl.Rate, rl.Burst),
 		LastSeen: time.Now(),
 	}
 
 	rl.visitors[ip] = v
+	rl.visitorsChanged()
+	rl.mu.Unlock()
 	return v
 }
 
@@ -71,16 +118,68 @@ func (rl *BaseRateLimiter) GetVisitor(ip string) *Visitor {
 		rl.mu.Unlock()
 		return rl.AddIP(ip)
 	}
+	v.LastSeen = time.Now()
 	rl.mu.Unlock()
 	return v
 }
 
+// VisitorCount returns the number of visitors currently tracked
+func (rl *BaseRateLimiter) VisitorCount() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return len(rl.visitors)
+}
+
 func (rl *BaseRateLimiter) IsEnabled() bool {
 	return rl.Enabled
 }
 
+// MaxVisitorsInState is the most visitors listed by the state of a rate limiter
+const MaxVisitorsInState = 100
+
+// RateLimiterState is the state of a rate limiter exported for monitoring
+type RateLimiterState struct {
+	Enabled        bool           `json:"enabled"`
+	Rate           rate.Limit     `json:"rate"`
+	Burst          int            `json:"burst"`
+	ActiveVisitors int            `json:"active_visitors"`
+	Visitors       []VisitorState `json:"visitors"`
+}
+
+type VisitorState struct {
+	IP       string    `json:"ip"`
+	Tokens   float64   `json:"tokens"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// State returns the state of the limiter with the MaxVisitorsInState visitors seen last
+func (rl *BaseRateLimiter) State() RateLimiterState {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	visitors := make([]VisitorState, 0, len(rl.visitors))
+	for ip, v := range rl.visitors {
+		visitors = append(visitors, VisitorState{IP: ip, Tokens: v.Limiter.Tokens(), LastSeen: v.LastSeen})
+	}
+	sort.Slice(visitors, func(i, j int) bool {
+		return visitors[i].LastSeen.After(visitors[j].LastSeen)
+	})
+	if len(visitors) > MaxVisitorsInState {
+		visitors = visitors[:MaxVisitorsInState]
+	}
+	return RateLimiterState{
+		Enabled:        rl.Enabled,
+		Rate:           rl.Rate,
+		Burst:          rl.Burst,
+		ActiveVisitors: len(rl.visitors),
+		Visitors:       visitors,
+	}
+}
+
 type ServiceRateLimiter struct {
 	BaseRateLimiter
+	// delay the requests over the limit by up to MaxWait instead of rejecting them
+	Queue   bool
+	MaxWait time.Duration
 }
 
 func NewServiceRateLimiter(conf *config.RateLimiterSettings) *ServiceRateLimiter {
@@ -90,17 +189,52 @@ func NewServiceRateLimiter(conf *config.RateLimiterSettings) *ServiceRateLimiter
 			Enabled:     conf.Enabled,
 			mu:          sync.Mutex{},
 			visitors:    make(map[string]*Visitor),
+			stop:        make(chan struct{}),
 			Rate:        rate.Limit(conf.Rate),
 			Burst:       conf.Burst,
 			Cleanup:     conf.CleanupInterval,
 		},
+		Queue:   conf.Queue.Enabled,
+		MaxWait: time.Duration(conf.Queue.MaxWait) * time.Millisecond,
 	}
 	go rl.CleanupVisitors()
 	return rl
 }
 
+// Allow checks the limit of the visitor. With the queue a request over the limit waits for its
+// turn if it comes within MaxWait, it is rejected if the wait is longer or ctx is done first.
+func (rl *ServiceRateLimiter) Allow(ctx context.Context, key string) bool {
+	v := rl.GetVisitor(key)
+	if !rl.Queue {
+		return v.Limiter.Allow()
+	}
+	res := v.Limiter.Reserve()
+	if !res.OK() {
+		return false
+	}
+	delay := res.Delay()
+	if delay == 0 {
+		return true
+	}
+	if delay > rl.MaxWait {
+		res.Cancel()
+		return false
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		res.Cancel()
+		return false
+	}
+}
+
 type GlobalRateLimiter struct {
 	BaseRateLimiter
+	// limit the clients separately per top level route
+	PerRoute bool
 }
 
 func NewGlobalRateLimiter() *GlobalRateLimiter {
@@ -110,10 +244,46 @@ func NewGlobalRateLimiter() *GlobalRateLimiter {
 			Enabled:     config.AppConfig.Server.RateLimiter.Enabled,
 			mu:          sync.Mutex{},
 			visitors:    make(map[string]*Visitor),
+			stop:        make(chan struct{}),
 			Rate:        rate.Limit(config.AppConfig.Server.RateLimiter.Rate),
 			Burst:       config.AppConfig.Server.RateLimiter.Burst,
 			Cleanup:     config.AppConfig.Server.RateLimiter.CleanupInterval,
 		},
+		PerRoute: config.AppConfig.Server.RateLimitPerRoute,
+	}
+	go rl.CleanupVisitors()
+	return rl
+}
+
+// Key returns the key of the visitor making a request to the service, the client ip or with
+// PerRoute the service and the client ip. The requests resolving to no registered service
+// share a single key per client ip
+func (rl *GlobalRateLimiter) Key(ip string, service string) string {
+	if !rl.PerRoute || service == "" {
+		return ip
+	}
+	return service + "|" + ip
+}
+
+// GlobalPerIPRateLimiter limits every client ip across the requests to all the services, unlike
+// the GlobalRateLimiter it only applies to the requests forwarded to the services and isn't
+// split by route
+type GlobalPerIPRateLimiter struct {
+	BaseRateLimiter
+}
+
+func NewGlobalPerIPRateLimiter(conf *config.RateLimiterSettings) *GlobalPerIPRateLimiter {
+	rl := &GlobalPerIPRateLimiter{
+		BaseRateLimiter: BaseRateLimiter{
+			limitertype: GlobalPerIPLimiter,
+			Enabled:     conf.Enabled,
+			mu:          sync.Mutex{},
+			visitors:    make(map[string]*Visitor),
+			stop:        make(chan struct{}),
+			Rate:        rate.Limit(conf.Rate),
+			Burst:       conf.Burst,
+			Cleanup:     conf.CleanupInterval,
+		},
 	}
 	go rl.CleanupVisitors()
 	return rl
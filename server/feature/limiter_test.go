@@ -1 +1,122 @@
 package feature
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterVisitorsChange(t *testing.T) {
+	rl := NewServiceRateLimiter(&config.RateLimiterSettings{Enabled: true, Rate: 1, Burst: 1, CleanupInterval: 0})
+	var counts []int
+	rl.OnVisitorsChange(func(n int) { counts = append(counts, n) })
+
+	rl.GetVisitor("10.0.0.1")
+	rl.GetVisitor("10.0.0.2")
+	// known visitors don't change the count
+	rl.GetVisitor("10.0.0.1")
+	assert.Equal(t, []int{1, 2}, counts)
+	assert.Equal(t, 2, rl.VisitorCount())
+
+	rl.RemoveStaleVisitors()
+	assert.Equal(t, []int{1, 2, 0}, counts)
+	assert.Equal(t, 0, rl.VisitorCount())
+}
+
+func TestRateLimiterStop(t *testing.T) {
+	rl := NewServiceRateLimiter(&config.RateLimiterSettings{Enabled: true, Rate: 1, Burst: 1})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rl.CleanupVisitors()
+	}()
+	rl.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("visitor cleanup not stopped")
+	}
+	// stopping again is a no-op
+	rl.Stop()
+}
+
+func TestRateLimiterState(t *testing.T) {
+	rl := NewServiceRateLimiter(&config.RateLimiterSettings{Enabled: true, Rate: 1, Burst: 10, CleanupInterval: 60})
+	for i, used := range []int{0, 3, 7} {
+		v := rl.GetVisitor(fmt.Sprintf("10.0.0.%d", i+1))
+		assert.True(t, v.Limiter.AllowN(time.Now(), used))
+		time.Sleep(time.Millisecond)
+	}
+	// a visitor seen again moves up
+	rl.GetVisitor("10.0.0.2")
+
+	state := rl.State()
+	assert.True(t, state.Enabled)
+	assert.Equal(t, 1.0, float64(state.Rate))
+	assert.Equal(t, 10, state.Burst)
+	assert.Equal(t, 3, state.ActiveVisitors)
+	// the visitors seen last come first
+	assert.Len(t, state.Visitors, 3)
+	for i, expected := range []struct {
+		ip     string
+		tokens float64
+	}{{"10.0.0.2", 7}, {"10.0.0.3", 3}, {"10.0.0.1", 10}} {
+		assert.Equal(t, expected.ip, state.Visitors[i].IP)
+		assert.InDelta(t, expected.tokens, state.Visitors[i].Tokens, 0.5)
+	}
+
+	// the list is capped, the count isn't
+	for i := 0; i < MaxVisitorsInState; i++ {
+		rl.AddIP(fmt.Sprintf("10.0.1.%d", i))
+	}
+	state = rl.State()
+	assert.Equal(t, MaxVisitorsInState+3, state.ActiveVisitors)
+	assert.Len(t, state.Visitors, MaxVisitorsInState)
+}
+
+func TestGlobalRateLimiterKey(t *testing.T) {
+	rl := &GlobalRateLimiter{}
+	assert.Equal(t, "10.0.0.1", rl.Key("10.0.0.1", "orders"))
+
+	rl.PerRoute = true
+	assert.Equal(t, "orders|10.0.0.1", rl.Key("10.0.0.1", "orders"))
+	assert.NotEqual(t, rl.Key("10.0.0.1", "orders"), rl.Key("10.0.0.1", "users"))
+	// unresolved requests share the key of the client
+	assert.Equal(t, "10.0.0.1", rl.Key("10.0.0.1", ""))
+}
+
+func TestServiceRateLimiterQueue(t *testing.T) {
+	t.Run("rejected without queue", func(t *testing.T) {
+		rl := NewServiceRateLimiter(&config.RateLimiterSettings{Enabled: true, Rate: 10, Burst: 1})
+		assert.True(t, rl.Allow(context.Background(), "1.1.1.1"))
+		assert.False(t, rl.Allow(context.Background(), "1.1.1.1"))
+	})
+	t.Run("delayed within max wait", func(t *testing.T) {
+		rl := NewServiceRateLimiter(&config.RateLimiterSettings{Enabled: true, Rate: 10, Burst: 1,
+			Queue: config.RateLimiterQueueSettings{Enabled: true, MaxWait: 500}})
+		assert.True(t, rl.Allow(context.Background(), "1.1.1.1"))
+		start := time.Now()
+		assert.True(t, rl.Allow(context.Background(), "1.1.1.1"))
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	})
+	t.Run("rejected over max wait", func(t *testing.T) {
+		rl := NewServiceRateLimiter(&config.RateLimiterSettings{Enabled: true, Rate: 1, Burst: 1,
+			Queue: config.RateLimiterQueueSettings{Enabled: true, MaxWait: 100}})
+		assert.True(t, rl.Allow(context.Background(), "1.1.1.1"))
+		start := time.Now()
+		assert.False(t, rl.Allow(context.Background(), "1.1.1.1"))
+		assert.Less(t, time.Since(start), 50*time.Millisecond)
+	})
+	t.Run("rejected when cancelled", func(t *testing.T) {
+		rl := NewServiceRateLimiter(&config.RateLimiterSettings{Enabled: true, Rate: 1, Burst: 1,
+			Queue: config.RateLimiterQueueSettings{Enabled: true, MaxWait: 5000}})
+		assert.True(t, rl.Allow(context.Background(), "1.1.1.1"))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.False(t, rl.Allow(ctx, "1.1.1.1"))
+	})
+}
@@ -0,0 +1,46 @@
+package feature
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// LogSampler picks the requests whose logs are written and counts them, so the requests
+// left out can be summarized
+type LogSampler struct {
+	// fraction (0.0-1.0) of the requests logged
+	Rate    float64 `json:"rate"`
+	sampled atomic.Int64
+	total   atomic.Int64
+}
+
+// NewLogSampler creates a sampler logging every request if rate is nil
+func NewLogSampler(rate *float64) *LogSampler {
+	if rate == nil {
+		return &LogSampler{Rate: 1}
+	}
+	return &LogSampler{Rate: *rate}
+}
+
+// Sample reports whether the logs of a request are written, a nil sampler logs every request
+func (s *LogSampler) Sample() bool {
+	if s == nil {
+		return true
+	}
+	s.total.Add(1)
+	if rand.Float64() < s.Rate {
+		s.sampled.Add(1)
+		return true
+	}
+	return false
+}
+
+// IsSampled is false if every request is logged
+func (s *LogSampler) IsSampled() bool {
+	return s != nil && s.Rate < 1
+}
+
+// Reset returns the number of logged and of all the requests since the last reset and starts over
+func (s *LogSampler) Reset() (int64, int64) {
+	return s.sampled.Swap(0), s.total.Swap(0)
+}
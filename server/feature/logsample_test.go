@@ -0,0 +1,41 @@
+package feature
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogSampler(t *testing.T) {
+	sample := func(s *LogSampler, n int) int {
+		logged := 0
+		for i := 0; i < n; i++ {
+			if s.Sample() {
+				logged++
+			}
+		}
+		return logged
+	}
+	all := NewLogSampler(nil)
+	assert.False(t, all.IsSampled())
+	assert.Equal(t, 100, sample(all, 100))
+
+	none := 0.0
+	s := NewLogSampler(&none)
+	assert.True(t, s.IsSampled())
+	assert.Equal(t, 0, sample(s, 100))
+	sampled, total := s.Reset()
+	assert.Equal(t, int64(0), sampled)
+	assert.Equal(t, int64(100), total)
+	// the counts start over
+	sampled, total = s.Reset()
+	assert.Equal(t, int64(0), sampled+total)
+
+	half := 0.5
+	s = NewLogSampler(&half)
+	logged := sample(s, 1000)
+	assert.InDelta(t, 500, logged, 100)
+	sampled, total = s.Reset()
+	assert.Equal(t, int64(logged), sampled)
+	assert.Equal(t, int64(1000), total)
+}
@@ -0,0 +1,46 @@
+package feature
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+)
+
+type MatchRule struct {
+	Header  string `json:"header"`
+	Pattern string `json:"pattern"`
+	Addr    string `json:"addr"`
+	re      *regexp.Regexp
+}
+
+// HeaderRouter routes requests to a different address when a header matches a rule
+type HeaderRouter struct {
+	Rules []MatchRule `json:"rules"`
+}
+
+// NewHeaderRouter compiles the patterns of the rules, an invalid pattern is an error
+func NewHeaderRouter(rules []config.MatchRuleSettings) (*HeaderRouter, error) {
+	hr := &HeaderRouter{Rules: make([]MatchRule, 0, len(rules))}
+	for _, r := range rules {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match rule pattern for header %s: %w", r.Header, err)
+		}
+		hr.Rules = append(hr.Rules, MatchRule{Header: r.Header, Pattern: r.Pattern, Addr: r.Addr, re: re})
+	}
+	return hr, nil
+}
+
+// Match returns the address of the first rule matching the headers
+func (hr *HeaderRouter) Match(h http.Header) (string, bool) {
+	for _, r := range hr.Rules {
+		for _, v := range h.Values(r.Header) {
+			if r.re.MatchString(v) {
+				return r.Addr, true
+			}
+		}
+	}
+	return "", false
+}
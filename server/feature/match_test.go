@@ -0,0 +1,49 @@
+package feature
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHeaderRouter(t *testing.T) {
+	t.Run("valid patterns", func(t *testing.T) {
+		hr, err := NewHeaderRouter([]config.MatchRuleSettings{{Header: "X-Api-Version", Pattern: "^v2$", Addr: "v2:80"}})
+		assert.Nil(t, err)
+		assert.Len(t, hr.Rules, 1)
+	})
+	t.Run("invalid pattern", func(t *testing.T) {
+		hr, err := NewHeaderRouter([]config.MatchRuleSettings{{Header: "X-Api-Version", Pattern: "v(2", Addr: "v2:80"}})
+		assert.NotNil(t, err)
+		assert.Nil(t, hr)
+	})
+}
+
+func TestHeaderRouterMatch(t *testing.T) {
+	hr, err := NewHeaderRouter([]config.MatchRuleSettings{
+		{Header: "X-Api-Version", Pattern: "^v2$", Addr: "v2:80"},
+		{Header: "X-Api-Version", Pattern: "^v", Addr: "any:80"},
+		{Header: "X-Beta", Pattern: "true", Addr: "beta:80"},
+	})
+	assert.Nil(t, err)
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected string
+		matched  bool
+	}{
+		{name: "first rule", header: http.Header{"X-Api-Version": {"v2"}}, expected: "v2:80", matched: true},
+		{name: "rules evaluated in order", header: http.Header{"X-Api-Version": {"v3"}}, expected: "any:80", matched: true},
+		{name: "other header", header: http.Header{"X-Beta": {"true"}}, expected: "beta:80", matched: true},
+		{name: "no match", header: http.Header{"X-Api-Version": {"2"}}, expected: "", matched: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, ok := hr.Match(tt.header)
+			assert.Equal(t, tt.matched, ok)
+			assert.Equal(t, tt.expected, addr)
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package feature
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	MethodOverrideHeader = "X-HTTP-Method-Override"
+	MethodOverrideParam  = "_method"
+)
+
+// overridableMethods are the methods a POST can be overridden with
+var overridableMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// OverrideMethod replaces the method of a POST request with the one in the X-HTTP-Method-Override
+// header or the _method query parameter, the header takes precedence. The override is removed
+// from the request so the service doesn't apply it again. It returns false if the method is unchanged.
+func OverrideMethod(r *http.Request) (string, bool) {
+	if r.Method != http.MethodPost {
+		return "", false
+	}
+	query := r.URL.Query()
+	method := r.Header.Get(MethodOverrideHeader)
+	if method == "" {
+		method = query.Get(MethodOverrideParam)
+	}
+	method = strings.ToUpper(strings.TrimSpace(method))
+	if !overridableMethods[method] {
+		return "", false
+	}
+	r.Method = method
+	r.Header.Del(MethodOverrideHeader)
+	if query.Has(MethodOverrideParam) {
+		query.Del(MethodOverrideParam)
+		r.URL.RawQuery = query.Encode()
+	}
+	return method, true
+}
@@ -0,0 +1,43 @@
+package feature
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverrideMethod(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		header   string
+		expected string
+		ok       bool
+	}{
+		{"header", http.MethodPost, "/orders/1", "DELETE", http.MethodDelete, true},
+		{"lowercase header", http.MethodPost, "/orders/1", "patch", http.MethodPatch, true},
+		{"query parameter", http.MethodPost, "/orders/1?_method=PUT&a=b", "", http.MethodPut, true},
+		{"header takes precedence", http.MethodPost, "/orders/1?_method=PUT", "DELETE", http.MethodDelete, true},
+		{"invalid method", http.MethodPost, "/orders/1", "CONNECT", http.MethodPost, false},
+		{"no override", http.MethodPost, "/orders/1", "", http.MethodPost, false},
+		{"only POST is overridden", http.MethodGet, "/orders/1", "DELETE", http.MethodGet, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.url, nil)
+			if tt.header != "" {
+				r.Header.Set(MethodOverrideHeader, tt.header)
+			}
+			_, ok := OverrideMethod(r)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.expected, r.Method)
+			if ok {
+				assert.Empty(t, r.Header.Get(MethodOverrideHeader))
+				assert.False(t, r.URL.Query().Has(MethodOverrideParam))
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package feature
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+
+	"gopkg.in/yaml.v3"
+)
+
+// MockResponse is a canned response served for the matching method and route
+type MockResponse struct {
+	// empty method matches any method
+	Method  string            `yaml:"method" json:"method"`
+	Route   string            `yaml:"route" json:"route"`
+	Status  int               `yaml:"status" json:"status"`
+	Headers map[string]string `yaml:"headers" json:"headers"`
+	Body    string            `yaml:"body" json:"body"`
+}
+
+type MockHandler struct {
+	Enabled   bool           `json:"enabled"`
+	File      string         `json:"file"`
+	Responses []MockResponse `json:"responses"`
+}
+
+// NewMockHandler loads the mocked responses from the configured file
+func NewMockHandler(conf *config.MockSettings) *MockHandler {
+	m := &MockHandler{
+		Enabled: conf.Enabled,
+		File:    conf.File,
+	}
+	if !conf.Enabled {
+		return m
+	}
+	data, err := os.ReadFile(conf.File)
+	if err != nil {
+		slog.Error("failed to read mock file", "path", conf.File, "error", err.Error())
+		return m
+	}
+	if err := yaml.Unmarshal(data, &m.Responses); err != nil {
+		slog.Error("failed to parse mock file", "path", conf.File, "error", err.Error())
+	}
+	for i := range m.Responses {
+		if m.Responses[i].Status == 0 {
+			m.Responses[i].Status = http.StatusOK
+		}
+	}
+	return m
+}
+
+// Match returns the first mocked response for the method and route
+func (m *MockHandler) Match(method string, route string) (*MockResponse, bool) {
+	for i := range m.Responses {
+		r := &m.Responses[i]
+		if r.Route == route && (r.Method == "" || strings.EqualFold(r.Method, method)) {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+func (m *MockHandler) IsEnabled() bool {
+	return m.Enabled
+}
+
+// Write writes the mocked response
+func (r *MockResponse) Write(w http.ResponseWriter) error {
+	for k, v := range r.Headers {
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(r.Status)
+	_, err := w.Write([]byte(r.Body))
+	return err
+}
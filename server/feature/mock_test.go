@@ -0,0 +1,69 @@
+package feature
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const mockFile = `
+- method: GET
+  route: /users
+  status: 201
+  headers:
+    Content-Type: application/json
+  body: '{"id":1}'
+- route: /any
+`
+
+func writeMockFile(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "mock.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(mockFile), 0o600))
+	return path
+}
+
+func TestNewMockHandler(t *testing.T) {
+	t.Run("loads responses", func(t *testing.T) {
+		m := NewMockHandler(&config.MockSettings{Enabled: true, File: writeMockFile(t)})
+		assert.True(t, m.IsEnabled())
+		assert.Len(t, m.Responses, 2)
+		assert.Equal(t, http.StatusOK, m.Responses[1].Status)
+	})
+	t.Run("missing file", func(t *testing.T) {
+		m := NewMockHandler(&config.MockSettings{Enabled: true, File: "/does/not/exist"})
+		assert.True(t, m.IsEnabled())
+		assert.Empty(t, m.Responses)
+	})
+	t.Run("disabled", func(t *testing.T) {
+		m := NewMockHandler(&config.MockSettings{Enabled: false, File: writeMockFile(t)})
+		assert.False(t, m.IsEnabled())
+		assert.Empty(t, m.Responses)
+	})
+}
+
+func TestMockMatch(t *testing.T) {
+	m := NewMockHandler(&config.MockSettings{Enabled: true, File: writeMockFile(t)})
+	_, ok := m.Match(http.MethodGet, "/users")
+	assert.True(t, ok)
+	_, ok = m.Match(http.MethodPost, "/users")
+	assert.False(t, ok)
+	_, ok = m.Match(http.MethodDelete, "/any")
+	assert.True(t, ok)
+	_, ok = m.Match(http.MethodGet, "/missing")
+	assert.False(t, ok)
+}
+
+func TestMockWrite(t *testing.T) {
+	m := NewMockHandler(&config.MockSettings{Enabled: true, File: writeMockFile(t)})
+	resp, _ := m.Match(http.MethodGet, "/users")
+	w := httptest.NewRecorder()
+	assert.Nil(t, resp.Write(w))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, `{"id":1}`, w.Body.String())
+}
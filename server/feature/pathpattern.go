@@ -0,0 +1,67 @@
+package feature
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// ErrInvalidPathPattern is a pattern with a malformed glob or a ** which isn't the last segment
+var ErrInvalidPathPattern = errors.New("invalid path pattern")
+
+// PathPattern matches request paths segment by segment with the globs of path.Match, a last
+// segment ** matches any number of remaining segments e.g. /static/** or /api/v[12]/*
+type PathPattern struct {
+	segments []string
+	// number of leading segments without glob characters, they're stripped from the route
+	literal int
+	rest    bool
+}
+
+func NewPathPattern(pattern string) (*PathPattern, error) {
+	segments := strings.Split(strings.Trim(pattern, "/"), "/")
+	p := &PathPattern{}
+	for i, seg := range segments {
+		if seg == "**" {
+			if i != len(segments)-1 {
+				return nil, ErrInvalidPathPattern
+			}
+			p.rest = true
+			break
+		}
+		if _, err := path.Match(seg, ""); err != nil {
+			return nil, ErrInvalidPathPattern
+		}
+		p.segments = append(p.segments, seg)
+	}
+	for _, seg := range p.segments {
+		if strings.ContainsAny(seg, `*?[\`) {
+			break
+		}
+		p.literal++
+	}
+	return p, nil
+}
+
+// Match checks if the path matches the pattern and returns the path after its leading literal
+// segments, /static/css/main.css matched by /static/** returns /css/main.css
+func (p *PathPattern) Match(urlPath string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(urlPath, "/"), "/")
+	if len(parts) < len(p.segments) || (!p.rest && len(parts) != len(p.segments)) {
+		return "", false
+	}
+	for i, seg := range p.segments {
+		if ok, _ := path.Match(seg, parts[i]); !ok {
+			return "", false
+		}
+	}
+	if p.literal == len(parts) {
+		return "", true
+	}
+	return "/" + strings.Join(parts[p.literal:], "/"), true
+}
+
+// Literal is the number of leading literal segments, the more the more specific the pattern
+func (p *PathPattern) Literal() int {
+	return p.literal
+}
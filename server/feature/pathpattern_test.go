@@ -0,0 +1,41 @@
+package feature
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathPattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		path    string
+		suffix  string
+		matched bool
+	}{
+		{"rest", "/static/**", "/static/css/main.css", "/css/main.css", true},
+		{"rest without remainder", "/static/**", "/static", "", true},
+		{"rest other prefix", "/static/**", "/assets/css/main.css", "", false},
+		{"glob segment", "/api/v[12]/*", "/api/v1/orders", "/v1/orders", true},
+		{"glob segment mismatch", "/api/v[12]/*", "/api/v3/orders", "", false},
+		{"too many segments", "/api/v[12]/*", "/api/v1/orders/1", "", false},
+		{"too few segments", "/api/v[12]/*", "/api/v1", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPathPattern(tt.pattern)
+			assert.Nil(t, err)
+			suffix, ok := p.Match(tt.path)
+			assert.Equal(t, tt.matched, ok)
+			assert.Equal(t, tt.suffix, suffix)
+		})
+	}
+}
+
+func TestPathPatternInvalid(t *testing.T) {
+	for _, pattern := range []string{"/static/**/css", "/api/v[12"} {
+		_, err := NewPathPattern(pattern)
+		assert.ErrorIs(t, err, ErrInvalidPathPattern)
+	}
+}
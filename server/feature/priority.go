@@ -0,0 +1,106 @@
+package feature
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+)
+
+// DefaultPriorityHeader is the header with the priority of a request when it isn't configured
+const DefaultPriorityHeader = "X-Priority"
+
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// share of the capacity in use above which the requests of a priority are rejected
+var priorityThresholds = map[Priority]float64{
+	PriorityLow:    0.8,
+	PriorityNormal: 0.95,
+	PriorityHigh:   1,
+}
+
+// ParsePriority parses the value of the priority header, unknown values are normal
+func ParsePriority(v string) Priority {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "low":
+		return PriorityLow
+	case "high":
+		return PriorityHigh
+	default:
+		return PriorityNormal
+	}
+}
+
+// PrioritySemaphore limits the requests handled at once across the gateway to Max. As it fills
+// up the low priority requests are rejected first, above 80% of the capacity, then the normal
+// ones above 95% so the remaining capacity is kept for the high priority ones. A zero Max is
+// not enforced.
+type PrioritySemaphore struct {
+	Max    int    `json:"max"`
+	Header string `json:"header"`
+	// the priority header is only honored from these proxies, the other requests are normal
+	Proxies *TrustedProxies `json:"-"`
+	// requests in flight
+	inFlight atomic.Int64
+}
+
+func NewPrioritySemaphore(proxies *TrustedProxies) *PrioritySemaphore {
+	header := config.AppConfig.Server.PriorityHeader
+	if header == "" {
+		header = DefaultPriorityHeader
+	}
+	return &PrioritySemaphore{Max: config.AppConfig.Server.MaxConcurrentRequests, Header: header, Proxies: proxies}
+}
+
+// Priority returns the priority of the request, the header of a client which isn't a trusted
+// proxy is ignored so clients can't skip ahead on their own
+func (s *PrioritySemaphore) Priority(r *http.Request) Priority {
+	if !s.Proxies.IsTrusted(RemoteIP(r.RemoteAddr)) {
+		return PriorityNormal
+	}
+	return ParsePriority(r.Header.Get(s.Header))
+}
+
+// TryAcquire reserves a slot for a request of the priority without blocking, it returns false if
+// the capacity in use is over the threshold of the priority. Release must be called once the
+// request completes.
+func (s *PrioritySemaphore) TryAcquire(p Priority) bool {
+	n := s.inFlight.Add(1)
+	if s.Max > 0 && float64(n-1) >= priorityThresholds[p]*float64(s.Max) {
+		s.inFlight.Add(-1)
+		return false
+	}
+	return true
+}
+
+// Release frees the slot reserved by TryAcquire
+func (s *PrioritySemaphore) Release() {
+	s.inFlight.Add(-1)
+}
+
+// InFlight returns the number of requests in flight
+func (s *PrioritySemaphore) InFlight() int64 {
+	return s.inFlight.Load()
+}
+
+func (s *PrioritySemaphore) IsEnabled() bool {
+	return s != nil && s.Max > 0
+}
@@ -0,0 +1,67 @@
+package feature
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePriority(t *testing.T) {
+	assert.Equal(t, PriorityLow, ParsePriority("low"))
+	assert.Equal(t, PriorityHigh, ParsePriority(" HIGH "))
+	assert.Equal(t, PriorityNormal, ParsePriority("normal"))
+	assert.Equal(t, PriorityNormal, ParsePriority(""))
+	assert.Equal(t, PriorityNormal, ParsePriority("urgent"))
+}
+
+func TestPrioritySemaphorePriority(t *testing.T) {
+	s := &PrioritySemaphore{Header: DefaultPriorityHeader, Proxies: NewTrustedProxies([]string{"10.0.0.0/8"})}
+	request := func(remoteAddr string, priority string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set(DefaultPriorityHeader, priority)
+		return r
+	}
+	assert.Equal(t, PriorityHigh, s.Priority(request("10.0.0.1:1234", "high")))
+	assert.Equal(t, PriorityLow, s.Priority(request("10.0.0.1:1234", "low")))
+	// the header of an untrusted client is ignored
+	assert.Equal(t, PriorityNormal, s.Priority(request("192.0.2.1:1234", "high")))
+	assert.Equal(t, PriorityNormal, (&PrioritySemaphore{Header: DefaultPriorityHeader}).Priority(request("10.0.0.1:1234", "high")))
+}
+
+func TestPrioritySemaphore(t *testing.T) {
+	s := &PrioritySemaphore{Max: 20}
+	// low priority requests fill up to 80% of the capacity
+	for i := 0; i < 16; i++ {
+		assert.True(t, s.TryAcquire(PriorityLow))
+	}
+	assert.False(t, s.TryAcquire(PriorityLow))
+	// normal ones up to 95%
+	for i := 0; i < 3; i++ {
+		assert.True(t, s.TryAcquire(PriorityNormal))
+	}
+	assert.False(t, s.TryAcquire(PriorityNormal))
+	// and the high priority ones take the rest
+	assert.True(t, s.TryAcquire(PriorityHigh))
+	assert.False(t, s.TryAcquire(PriorityHigh))
+	assert.Equal(t, int64(20), s.InFlight())
+
+	s.Release()
+	assert.False(t, s.TryAcquire(PriorityLow))
+	assert.True(t, s.TryAcquire(PriorityHigh))
+
+	// a single slot is taken by any priority
+	single := &PrioritySemaphore{Max: 1}
+	assert.True(t, single.TryAcquire(PriorityLow))
+	assert.False(t, single.TryAcquire(PriorityHigh))
+
+	unlimited := &PrioritySemaphore{}
+	assert.False(t, unlimited.IsEnabled())
+	for i := 0; i < 100; i++ {
+		assert.True(t, unlimited.TryAcquire(PriorityLow))
+	}
+	var nilSemaphore *PrioritySemaphore
+	assert.False(t, nilSemaphore.IsEnabled())
+}
@@ -0,0 +1,176 @@
+package feature
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultRetryBudgetWindow is the window (secs) of a service retry budget when it doesn't configure one
+	DefaultRetryBudgetWindow = 10
+	// DefaultRetryMaxBodyBytes is the largest request body kept to be sent again
+	DefaultRetryMaxBodyBytes = 1 << 20
+	// IdempotencyKeyHeader marks a request as safe to send again whatever its method
+	IdempotencyKeyHeader = "Idempotency-Key"
+)
+
+// RetryBudget caps the retries in flight across all the services so retries can't
+// amplify the load on failing services. A limit of zero is not enforced.
+type RetryBudget struct {
+	MaxConcurrent int     `json:"maxConcurrent"`
+	MaxPercentage float64 `json:"maxPercentage"`
+	// retries in flight
+	retries atomic.Int64
+	// requests in flight, the percentage is relative to it
+	requests atomic.Int64
+}
+
+func NewRetryBudget(conf *config.RetryBudgetSettings) *RetryBudget {
+	return &RetryBudget{
+		MaxConcurrent: conf.MaxConcurrent,
+		MaxPercentage: conf.MaxPercentage,
+	}
+}
+
+// Begin counts a request in flight, End must be called once it completes
+func (b *RetryBudget) Begin() {
+	b.requests.Add(1)
+}
+
+func (b *RetryBudget) End() {
+	b.requests.Add(-1)
+}
+
+// TryAcquire reserves a retry, it returns false if the budget is exhausted.
+// Release must be called once the retry attempt completes.
+func (b *RetryBudget) TryAcquire() bool {
+	n := b.retries.Add(1)
+	if b.MaxConcurrent > 0 && n > int64(b.MaxConcurrent) {
+		b.retries.Add(-1)
+		return false
+	}
+	// a single retry is always allowed by the percentage so a lone request can still retry
+	if b.MaxPercentage > 0 && n > 1 && float64(n) > b.MaxPercentage/100*float64(b.requests.Load()) {
+		b.retries.Add(-1)
+		return false
+	}
+	return true
+}
+
+// Release frees the retry reserved by TryAcquire
+func (b *RetryBudget) Release() {
+	b.retries.Add(-1)
+}
+
+// InFlight returns the number of retries in flight
+func (b *RetryBudget) InFlight() int64 {
+	return b.retries.Load()
+}
+
+// ServiceRetryBudget is a token bucket of the retries to a service, refilled with MaxRetries
+// retries per Window. Once it is spent retries are dropped until it refills. A nil budget or
+// zero MaxRetries is not enforced.
+type ServiceRetryBudget struct {
+	MaxRetries int `json:"maxRetries"`
+	Window     int `json:"window"`
+	limiter    *rate.Limiter
+}
+
+func NewServiceRetryBudget(conf *config.ServiceRetryBudgetSettings) *ServiceRetryBudget {
+	window := conf.Window
+	if window == 0 {
+		window = DefaultRetryBudgetWindow
+	}
+	b := &ServiceRetryBudget{MaxRetries: conf.MaxRetries, Window: window}
+	if b.MaxRetries > 0 {
+		every := time.Duration(window) * time.Second / time.Duration(b.MaxRetries)
+		b.limiter = rate.NewLimiter(rate.Every(every), b.MaxRetries)
+	}
+	return b
+}
+
+// Allow takes a retry from the budget, it returns false if the budget is spent
+func (b *ServiceRetryBudget) Allow() bool {
+	if b == nil || b.limiter == nil {
+		return true
+	}
+	return b.limiter.Allow()
+}
+
+// Modes of a RetryPolicy
+const (
+	RetryOnErrors           = "errors"
+	RetryOnConnectionErrors = "connection_errors_only"
+	RetryOnStatuses         = "retriable_statuses"
+)
+
+// RetryPolicy decides which failed attempts of a request to a service are retried. A nil
+// policy retries every failure to reach the service. Only the idempotent requests are retried.
+type RetryPolicy struct {
+	Mode         string       `json:"mode"`
+	Statuses     map[int]bool `json:"statuses"`
+	MaxBodyBytes int64        `json:"maxBodyBytes"`
+}
+
+// NewRetryPolicy defaults the mode to errors, the statuses to 502, 503 and 504 and the
+// body limit to DefaultRetryMaxBodyBytes
+func NewRetryPolicy(conf *config.RetryPolicySettings) *RetryPolicy {
+	p := &RetryPolicy{Mode: conf.Mode, MaxBodyBytes: conf.MaxBodyBytes}
+	if p.Mode == "" {
+		p.Mode = RetryOnErrors
+	}
+	if p.MaxBodyBytes == 0 {
+		p.MaxBodyBytes = DefaultRetryMaxBodyBytes
+	}
+	if p.Mode != RetryOnStatuses {
+		return p
+	}
+	statuses := conf.Statuses
+	if len(statuses) == 0 {
+		statuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	p.Statuses = make(map[int]bool, len(statuses))
+	for _, s := range statuses {
+		p.Statuses[s] = true
+	}
+	return p
+}
+
+// ShouldRetry checks if an attempt is retried given its response, or its error if it failed to
+// reach the service
+func (p *RetryPolicy) ShouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return p == nil || p.Mode != RetryOnConnectionErrors || IsConnectionError(err)
+	}
+	return p != nil && resp != nil && p.Statuses[resp.StatusCode]
+}
+
+// Retriable checks if the request is safe to send again, its method is idempotent or it
+// carries an Idempotency-Key
+func (p *RetryPolicy) Retriable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.Header.Get(IdempotencyKeyHeader) != ""
+}
+
+// BodyLimit returns the largest request body kept to be sent again
+func (p *RetryPolicy) BodyLimit() int64 {
+	if p == nil {
+		return DefaultRetryMaxBodyBytes
+	}
+	return p.MaxBodyBytes
+}
+
+// IsConnectionError checks if the connection to the service was refused or reset, the request
+// then can't have been handled by the service and is safe to send again
+func IsConnectionError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
@@ -0,0 +1,176 @@
+package feature
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryBudgetMaxConcurrent(t *testing.T) {
+	b := NewRetryBudget(&config.RetryBudgetSettings{MaxConcurrent: 2})
+	assert.True(t, b.TryAcquire())
+	assert.True(t, b.TryAcquire())
+	assert.False(t, b.TryAcquire())
+	assert.Equal(t, int64(2), b.InFlight())
+	b.Release()
+	assert.True(t, b.TryAcquire())
+}
+
+func TestRetryBudgetMaxPercentage(t *testing.T) {
+	b := NewRetryBudget(&config.RetryBudgetSettings{MaxPercentage: 20})
+	// a lone request can retry
+	b.Begin()
+	assert.True(t, b.TryAcquire())
+	assert.False(t, b.TryAcquire())
+	// 20% of 10 requests in flight
+	for i := 0; i < 9; i++ {
+		b.Begin()
+	}
+	assert.True(t, b.TryAcquire())
+	assert.False(t, b.TryAcquire())
+	b.End()
+	b.Release()
+	b.Release()
+	assert.Equal(t, int64(0), b.InFlight())
+}
+
+func TestRetryBudgetUnlimited(t *testing.T) {
+	b := NewRetryBudget(&config.RetryBudgetSettings{})
+	for i := 0; i < 100; i++ {
+		assert.True(t, b.TryAcquire())
+	}
+}
+
+func TestRetryBudgetConcurrent(t *testing.T) {
+	b := NewRetryBudget(&config.RetryBudgetSettings{MaxConcurrent: 5})
+	var acquired, peak atomic.Int64
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if !b.TryAcquire() {
+				return
+			}
+			n := acquired.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			acquired.Add(-1)
+			b.Release()
+		}()
+	}
+	close(start)
+	wg.Wait()
+	assert.LessOrEqual(t, peak.Load(), int64(5))
+	assert.Equal(t, int64(0), b.InFlight())
+}
+
+func TestServiceRetryBudget(t *testing.T) {
+	b := NewServiceRetryBudget(&config.ServiceRetryBudgetSettings{MaxRetries: 2, Window: 60})
+	assert.Equal(t, 60, b.Window)
+	assert.True(t, b.Allow())
+	assert.True(t, b.Allow())
+	assert.False(t, b.Allow())
+
+	// unlimited budgets
+	b = NewServiceRetryBudget(&config.ServiceRetryBudgetSettings{})
+	assert.Equal(t, DefaultRetryBudgetWindow, b.Window)
+	for i := 0; i < 10; i++ {
+		assert.True(t, b.Allow())
+	}
+	var nilBudget *ServiceRetryBudget
+	assert.True(t, nilBudget.Allow())
+}
+
+func TestRetryPolicy(t *testing.T) {
+	refused := fmt.Errorf("forward: %w", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)})
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	eof := errors.New("EOF")
+	failed := &http.Response{StatusCode: http.StatusInternalServerError}
+	unavailable := &http.Response{StatusCode: http.StatusServiceUnavailable}
+	tests := []struct {
+		name        string
+		conf        config.RetryPolicySettings
+		retried     []error
+		notRetried  []error
+		statuses    []*http.Response
+		notStatuses []*http.Response
+	}{
+		{
+			name:        "errors by default",
+			retried:     []error{refused, reset, eof},
+			notStatuses: []*http.Response{failed, unavailable},
+		},
+		{
+			name:        "connection errors only",
+			conf:        config.RetryPolicySettings{Mode: RetryOnConnectionErrors},
+			retried:     []error{refused, reset},
+			notRetried:  []error{eof},
+			notStatuses: []*http.Response{failed, unavailable},
+		},
+		{
+			name:        "default retriable statuses",
+			conf:        config.RetryPolicySettings{Mode: RetryOnStatuses},
+			retried:     []error{refused, eof},
+			statuses:    []*http.Response{unavailable},
+			notStatuses: []*http.Response{failed},
+		},
+		{
+			name:        "configured retriable statuses",
+			conf:        config.RetryPolicySettings{Mode: RetryOnStatuses, Statuses: []int{500}},
+			statuses:    []*http.Response{failed},
+			notStatuses: []*http.Response{unavailable},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewRetryPolicy(&tt.conf)
+			for _, err := range tt.retried {
+				assert.True(t, p.ShouldRetry(nil, err), err.Error())
+			}
+			for _, err := range tt.notRetried {
+				assert.False(t, p.ShouldRetry(nil, err), err.Error())
+			}
+			for _, resp := range tt.statuses {
+				assert.True(t, p.ShouldRetry(resp, nil), resp.StatusCode)
+			}
+			for _, resp := range tt.notStatuses {
+				assert.False(t, p.ShouldRetry(resp, nil), resp.StatusCode)
+			}
+		})
+	}
+
+	var nilPolicy *RetryPolicy
+	assert.True(t, nilPolicy.ShouldRetry(nil, eof))
+	assert.False(t, nilPolicy.ShouldRetry(unavailable, nil))
+}
+
+func TestRetryPolicyRetriable(t *testing.T) {
+	p := NewRetryPolicy(&config.RetryPolicySettings{})
+	assert.Equal(t, int64(DefaultRetryMaxBodyBytes), p.BodyLimit())
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete} {
+		assert.True(t, p.Retriable(httptest.NewRequest(method, "/", nil)), method)
+	}
+	for _, method := range []string{http.MethodPost, http.MethodPatch} {
+		r := httptest.NewRequest(method, "/", nil)
+		assert.False(t, p.Retriable(r), method)
+		r.Header.Set(IdempotencyKeyHeader, "key-1")
+		assert.True(t, p.Retriable(r), method)
+	}
+}
@@ -0,0 +1,69 @@
+package feature
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// EndpointTimeouts is the timeout of the requests to a service, overridden per method and per endpoint
+type EndpointTimeouts struct {
+	Default time.Duration `json:"default"`
+	// timeouts of the paths matching a pattern, an exact path or a glob
+	Endpoints map[string]time.Duration `json:"endpoints"`
+	// timeouts of the requests by upper case method
+	Methods map[string]time.Duration `json:"methods"`
+}
+
+// NewEndpointTimeouts converts the timeouts in seconds, a zero timeout is unlimited
+func NewEndpointTimeouts(secs int, endpoints map[string]int, methods map[string]int) (*EndpointTimeouts, error) {
+	et := &EndpointTimeouts{
+		Default:   time.Duration(secs) * time.Second,
+		Endpoints: make(map[string]time.Duration, len(endpoints)),
+		Methods:   make(map[string]time.Duration, len(methods)),
+	}
+	for method, s := range methods {
+		et.Methods[strings.ToUpper(method)] = time.Duration(s) * time.Second
+	}
+	for pattern, s := range endpoints {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid endpoint timeout pattern %s: %w", pattern, err)
+		}
+		et.Endpoints[pattern] = time.Duration(s) * time.Second
+	}
+	return et, nil
+}
+
+// MatchRequest returns the timeout of the requests with the method to the path, the endpoint
+// timeouts take precedence over the method ones. An exact endpoint takes precedence over the
+// globs, and the longest matching glob over the shorter ones.
+func (et *EndpointTimeouts) MatchRequest(method string, p string) time.Duration {
+	if d, ok := et.matchEndpoint(p); ok {
+		return d
+	}
+	if d, ok := et.Methods[strings.ToUpper(method)]; ok {
+		return d
+	}
+	return et.Default
+}
+
+// matchEndpoint returns the timeout of the endpoint pattern matching the path, false if none does
+func (et *EndpointTimeouts) matchEndpoint(p string) (time.Duration, bool) {
+	if d, ok := et.Endpoints[p]; ok {
+		return d, true
+	}
+	matched := ""
+	for pattern := range et.Endpoints {
+		if ok, _ := path.Match(pattern, p); !ok {
+			continue
+		}
+		if len(pattern) > len(matched) || (len(pattern) == len(matched) && pattern < matched) {
+			matched = pattern
+		}
+	}
+	if matched == "" {
+		return 0, false
+	}
+	return et.Endpoints[matched], true
+}
@@ -0,0 +1,48 @@
+package feature
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointTimeouts(t *testing.T) {
+	et, err := NewEndpointTimeouts(10, map[string]int{
+		"/report/*":       60,
+		"/report/monthly": 120,
+		"/status":         2,
+		"/*/export":       30,
+	}, nil)
+	assert.Nil(t, err)
+	tests := []struct {
+		path     string
+		expected time.Duration
+	}{
+		{"/status", 2 * time.Second},
+		{"/report/daily", 60 * time.Second},
+		{"/report/monthly", 120 * time.Second},
+		{"/orders/export", 30 * time.Second},
+		{"/report/daily/pdf", 10 * time.Second},
+		{"/orders", 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.expected, et.MatchRequest(http.MethodGet, tt.path))
+		})
+	}
+
+	_, err = NewEndpointTimeouts(0, map[string]int{"/report/[": 60}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestMethodTimeouts(t *testing.T) {
+	et, err := NewEndpointTimeouts(10, map[string]int{"/report/*": 60}, map[string]int{"GET": 2, "post": 30})
+	assert.Nil(t, err)
+	assert.Equal(t, 2*time.Second, et.MatchRequest("GET", "/orders"))
+	assert.Equal(t, 30*time.Second, et.MatchRequest("POST", "/orders"))
+	assert.Equal(t, 10*time.Second, et.MatchRequest("DELETE", "/orders"))
+	// the endpoint timeouts take precedence
+	assert.Equal(t, 60*time.Second, et.MatchRequest("GET", "/report/daily"))
+}
@@ -0,0 +1,50 @@
+package feature
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+)
+
+const (
+	DefaultDialTimeout           = 5
+	DefaultTLSHandshakeTimeout   = 5
+	DefaultResponseHeaderTimeout = 30
+)
+
+// NewUpstreamTransport builds the transport used to forward requests to a service
+func NewUpstreamTransport(tlsConf *config.UpstreamTLSSettings, conf *config.UpstreamTransportSettings) *http.Transport {
+	if conf.DialTimeout == 0 {
+		conf.DialTimeout = DefaultDialTimeout
+	}
+	if conf.TLSHandshakeTimeout == 0 {
+		conf.TLSHandshakeTimeout = DefaultTLSHandshakeTimeout
+	}
+	if conf.ResponseHeaderTimeout == 0 {
+		conf.ResponseHeaderTimeout = DefaultResponseHeaderTimeout
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(conf.DialTimeout) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	t.DialContext = dialer.DialContext
+	if conf.Network == "unix" {
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", conf.SocketPath)
+		}
+	}
+	t.TLSHandshakeTimeout = time.Duration(conf.TLSHandshakeTimeout) * time.Second
+	t.ResponseHeaderTimeout = time.Duration(conf.ResponseHeaderTimeout) * time.Second
+	t.TLSClientConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: tlsConf.ServerName,
+		// Note: only for local dev
+		InsecureSkipVerify: tlsConf.InsecureSkipVerify, //nolint:gosec
+	}
+	return t
+}
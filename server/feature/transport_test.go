@@ -0,0 +1,182 @@
+package feature
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// selfSignedCert generates a certificate which is only valid for example.com
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestUpstreamTransport(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	var sni string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sni = r.TLS.ServerName
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	t.Run("server name override", func(t *testing.T) {
+		tr := NewUpstreamTransport(&config.UpstreamTLSSettings{ServerName: "example.com"}, &config.UpstreamTransportSettings{})
+		tr.TLSClientConfig.RootCAs = pool
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "example.com", sni)
+		_ = resp.Body.Close()
+	})
+	t.Run("ip used as server name", func(t *testing.T) {
+		tr := NewUpstreamTransport(&config.UpstreamTLSSettings{}, &config.UpstreamTransportSettings{})
+		tr.TLSClientConfig.RootCAs = pool
+		_, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		assert.NotNil(t, err)
+	})
+	t.Run("insecure skip verify", func(t *testing.T) {
+		tr := NewUpstreamTransport(&config.UpstreamTLSSettings{InsecureSkipVerify: true}, &config.UpstreamTransportSettings{})
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		_ = resp.Body.Close()
+	})
+}
+
+func TestUpstreamTransportDefaults(t *testing.T) {
+	conf := &config.UpstreamTransportSettings{}
+	tr := NewUpstreamTransport(&config.UpstreamTLSSettings{}, conf)
+	assert.Equal(t, DefaultDialTimeout, conf.DialTimeout)
+	assert.Equal(t, DefaultTLSHandshakeTimeout*time.Second, tr.TLSHandshakeTimeout)
+	assert.Equal(t, DefaultResponseHeaderTimeout*time.Second, tr.ResponseHeaderTimeout)
+}
+
+func TestUpstreamTransportTimeouts(t *testing.T) {
+	conf := &config.UpstreamTransportSettings{TLSHandshakeTimeout: 1, ResponseHeaderTimeout: 1}
+
+	t.Run("tls handshake delayed", func(t *testing.T) {
+		t.Parallel()
+		// accepts connections but never answers the client hello
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		defer l.Close()
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+		tr := NewUpstreamTransport(&config.UpstreamTLSSettings{InsecureSkipVerify: true}, conf)
+		start := time.Now()
+		_, err = (&http.Client{Transport: tr}).Get("https://" + l.Addr().String())
+		assert.ErrorContains(t, err, "TLS handshake timeout")
+		assert.Less(t, time.Since(start), 2*time.Second)
+	})
+	t.Run("response headers delayed", func(t *testing.T) {
+		t.Parallel()
+		done := make(chan struct{})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-done:
+			case <-time.After(3 * time.Second):
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer srv.Close()
+		defer close(done)
+		tr := NewUpstreamTransport(&config.UpstreamTLSSettings{}, conf)
+		start := time.Now()
+		_, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		assert.ErrorContains(t, err, "timeout awaiting response headers")
+		assert.Less(t, time.Since(start), 2*time.Second)
+	})
+	t.Run("response body delayed", func(t *testing.T) {
+		t.Parallel()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			time.Sleep(1500 * time.Millisecond)
+			_, _ = w.Write([]byte("slow"))
+		}))
+		defer srv.Close()
+		tr := NewUpstreamTransport(&config.UpstreamTLSSettings{}, conf)
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, "slow", string(body))
+	})
+}
+
+// unixServer starts a server listening on a unix socket and returns the socket path
+func unixServer(t *testing.T, h http.Handler) (*httptest.Server, string) {
+	// t.TempDir can exceed the maximum length of a socket path
+	dir, err := os.MkdirTemp("", "gw")
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	path := filepath.Join(dir, "upstream.sock")
+	l, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	srv := httptest.NewUnstartedServer(h)
+	srv.Listener = l
+	srv.Start()
+	return srv, path
+}
+
+func TestUpstreamTransportUnixSocket(t *testing.T) {
+	var host string
+	srv, path := unixServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	tr := NewUpstreamTransport(&config.UpstreamTLSSettings{}, &config.UpstreamTransportSettings{Network: "unix", SocketPath: path})
+	resp, err := (&http.Client{Transport: tr}).Get("http://orders.internal/")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "orders.internal", host)
+	_ = resp.Body.Close()
+}
@@ -0,0 +1,114 @@
+package feature
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"sync"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+)
+
+type weightedEntry struct {
+	Value  string `json:"value"`
+	Weight int    `json:"weight"`
+}
+
+// WeightedPicker randomly picks an entry with a probability proportional to its weight,
+// entries with a weight of zero or less are never picked. It splits the traffic of a service
+// with its canary and of a label route among the services it matches. The fallbacks of a
+// service are not weighted, they are tried in the order they are configured.
+type WeightedPicker struct {
+	mu      sync.RWMutex
+	entries []weightedEntry
+	total   int
+}
+
+func NewWeightedPicker() *WeightedPicker {
+	return &WeightedPicker{}
+}
+
+// NewCanaryPicker sends the configured percentage of the traffic to the canary and the rest to addr
+func NewCanaryPicker(addr string, conf *config.CanarySettings) *WeightedPicker {
+	p := NewWeightedPicker()
+	if conf.Addr == "" {
+		p.Set(addr, 1)
+		return p
+	}
+	p.Set(addr, 100-conf.Weight)
+	p.Set(conf.Addr, conf.Weight)
+	return p
+}
+
+// Set adds the value or updates its weight if it already exists
+func (p *WeightedPicker) Set(value string, weight int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.entries {
+		if p.entries[i].Value == value {
+			p.entries[i].Weight = weight
+			p.updateTotal()
+			return
+		}
+	}
+	p.entries = append(p.entries, weightedEntry{Value: value, Weight: weight})
+	p.updateTotal()
+}
+
+// Remove removes the value from the picker
+func (p *WeightedPicker) Remove(value string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.entries {
+		if p.entries[i].Value == value {
+			p.entries = append(p.entries[:i], p.entries[i+1:]...)
+			p.updateTotal()
+			return
+		}
+	}
+}
+
+func (p *WeightedPicker) updateTotal() {
+	p.total = 0
+	for _, e := range p.entries {
+		if e.Weight > 0 {
+			p.total += e.Weight
+		}
+	}
+}
+
+// Pick returns a random value, ok is false if there is no entry with a positive weight
+func (p *WeightedPicker) Pick() (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.total == 0 {
+		return "", false
+	}
+	return p.pick(rand.IntN(p.total))
+}
+
+// PickKey returns the value the key maps to, the same key always picks the same value as
+// long as the entries don't change and keys are distributed according to the weights
+func (p *WeightedPicker) PickKey(key string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.total == 0 {
+		return "", false
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return p.pick(int(h.Sum64() % uint64(p.total)))
+}
+
+// pick returns the value at n in [0, total), p.mu must be held
+func (p *WeightedPicker) pick(n int) (string, bool) {
+	for _, e := range p.entries {
+		if e.Weight <= 0 {
+			continue
+		}
+		if n < e.Weight {
+			return e.Value, true
+		}
+		n -= e.Weight
+	}
+	return "", false
+}
@@ -0,0 +1,100 @@
+package feature
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeightedPickerDistribution(t *testing.T) {
+	p := NewWeightedPicker()
+	p.Set("a", 1)
+	p.Set("b", 3)
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		v, ok := p.Pick()
+		assert.True(t, ok)
+		counts[v]++
+	}
+	assert.InDelta(t, 2500, counts["a"], 300)
+	assert.InDelta(t, 7500, counts["b"], 300)
+}
+
+func TestWeightedPickerZeroWeight(t *testing.T) {
+	p := NewWeightedPicker()
+	p.Set("a", 1)
+	p.Set("b", 0)
+	p.Set("c", -1)
+	for i := 0; i < 1000; i++ {
+		v, _ := p.Pick()
+		assert.Equal(t, "a", v)
+	}
+	p.Set("a", 0)
+	_, ok := p.Pick()
+	assert.False(t, ok)
+}
+
+func TestWeightedPickerSingleEntry(t *testing.T) {
+	p := NewWeightedPicker()
+	_, ok := p.Pick()
+	assert.False(t, ok)
+	p.Set("a", 5)
+	v, ok := p.Pick()
+	assert.True(t, ok)
+	assert.Equal(t, "a", v)
+	p.Remove("a")
+	_, ok = p.Pick()
+	assert.False(t, ok)
+}
+
+func TestWeightedPickerConcurrent(t *testing.T) {
+	p := NewWeightedPicker()
+	p.Set("a", 1)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				p.Set("b", j%3)
+				v, ok := p.Pick()
+				assert.True(t, ok)
+				assert.Contains(t, []string{"a", "b"}, v)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestNewCanaryPicker(t *testing.T) {
+	v, _ := NewCanaryPicker("primary", &config.CanarySettings{}).Pick()
+	assert.Equal(t, "primary", v)
+	v, _ = NewCanaryPicker("primary", &config.CanarySettings{Addr: "canary", Weight: 100}).Pick()
+	assert.Equal(t, "canary", v)
+	v, _ = NewCanaryPicker("primary", &config.CanarySettings{Addr: "canary", Weight: 0}).Pick()
+	assert.Equal(t, "primary", v)
+}
+
+func TestWeightedPickerPickKey(t *testing.T) {
+	p := NewWeightedPicker()
+	p.Set("a", 1)
+	p.Set("b", 3)
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("session-%d", i)
+		v, ok := p.PickKey(key)
+		assert.True(t, ok)
+		// the same key sticks to the same value
+		again, _ := p.PickKey(key)
+		assert.Equal(t, v, again)
+		counts[v]++
+	}
+	assert.InDelta(t, 2500, counts["a"], 300)
+	assert.InDelta(t, 7500, counts["b"], 300)
+
+	_, ok := NewWeightedPicker().PickKey("session")
+	assert.False(t, ok)
+}
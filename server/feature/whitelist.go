@@ -1,5 +1,10 @@
 package feature
 
+import (
+	"net"
+	"strings"
+)
+
 type IPWhiteList struct {
 	Whitelist map[string]bool `json:"whitelist"`
 }
@@ -13,7 +18,7 @@ func PopulateIPWhiteList(w *IPWhiteList, ipList []string) {
 			if ip == "ALL" {
 				continue
 			}
-			w.Whitelist[ip] = true
+			w.Whitelist[NormalizeIP(ip)] = true
 		}
 	}
 }
@@ -29,7 +34,7 @@ func (w *IPWhiteList) Allowed(ip string) bool {
 	if _, exists := w.Whitelist["ALL"]; exists {
 		return true
 	}
-	if _, found := w.Whitelist[ip]; !found {
+	if _, found := w.Whitelist[NormalizeIP(ip)]; !found {
 		return false
 	}
 	return true
@@ -40,5 +45,23 @@ func (w *IPWhiteList) GetWhitelist() map[string]bool {
 }
 
 func (w *IPWhiteList) UpdateWhitelist(newList map[string]bool) {
-	w.Whitelist = newList
+	normalized := make(map[string]bool, len(newList))
+	for ip, v := range newList {
+		normalized[NormalizeIP(ip)] = v
+	}
+	w.Whitelist = normalized
+}
+
+func isValidIP(address string) bool {
+	return net.ParseIP(address) != nil
+}
+
+// NormalizeIP returns the canonical form of an ipv4 or ipv6 address, so "[::1]" and
+// "0:0:0:0:0:0:0:1" are the same client. Anything else is returned as is.
+func NormalizeIP(ip string) string {
+	trimmed := strings.Trim(ip, "[]")
+	if !isValidIP(trimmed) {
+		return ip
+	}
+	return net.ParseIP(trimmed).String()
 }
@@ -67,6 +67,36 @@ func TestAllowed(t *testing.T) {
 				return w
 			},
 		},
+		{
+			name:     "ipv6 exists",
+			input:    RemoteIP("[::1]:12345"),
+			expected: true,
+			setup: func() *IPWhiteList {
+				w := NewIPWhiteList()
+				PopulateIPWhiteList(w, []string{"::1"})
+				return w
+			},
+		},
+		{
+			name:     "ipv6 in expanded form",
+			input:    "::1",
+			expected: true,
+			setup: func() *IPWhiteList {
+				w := NewIPWhiteList()
+				PopulateIPWhiteList(w, []string{"0:0:0:0:0:0:0:1"})
+				return w
+			},
+		},
+		{
+			name:     "ipv6 doesn't exist",
+			input:    "2001:db8::1",
+			expected: false,
+			setup: func() *IPWhiteList {
+				w := NewIPWhiteList()
+				PopulateIPWhiteList(w, []string{"::1"})
+				return w
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,43 @@
+package main
+
+import "net/http"
+
+// PreForwardHook is called with the incoming request before it is forwarded to the service,
+// changes to the request e.g. its headers are forwarded
+type PreForwardHook func(*http.Request, *Service) error
+
+// PostForwardHook is called with the response of the service before it is written to the client,
+// it isn't called for the requests forwarded through the circuit breaker
+type PostForwardHook func(*http.Response, *Service) error
+
+// AddPreForwardHook registers a hook called before every request is forwarded, the request
+// fails with a 500 if the hook returns an error. Hooks must be added before serving requests.
+func (rh *RequestHandler) AddPreForwardHook(fn func(*http.Request, *Service) error) {
+	rh.preForwardHooks = append(rh.preForwardHooks, fn)
+}
+
+// AddPostForwardHook registers a hook called with every response of the services, the request
+// fails with a 500 if the hook returns an error. Hooks must be added before serving requests.
+func (rh *RequestHandler) AddPostForwardHook(fn func(*http.Response, *Service) error) {
+	rh.postForwardHooks = append(rh.postForwardHooks, fn)
+}
+
+// runPreForwardHooks calls the pre forward hooks in order, stopping at the first error
+func (rh *RequestHandler) runPreForwardHooks(r *http.Request, s *Service) error {
+	for _, hook := range rh.preForwardHooks {
+		if err := hook(r, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPostForwardHooks calls the post forward hooks in order, stopping at the first error
+func (rh *RequestHandler) runPostForwardHooks(resp *http.Response, s *Service) error {
+	for _, hook := range rh.postForwardHooks {
+		if err := hook(resp, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
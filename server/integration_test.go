@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/ArmaanKatyal/go-api-gateway/server/testutil"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	testutil.NewGateway = func() (http.Handler, func()) {
+		rh := NewRequestHandler()
+		return InitializeRoutes(rh), rh.ServiceRegistry.Stop
+	}
+	os.Exit(m.Run())
+}
+
+func get(t *testing.T, url string, header http.Header) (int, string) {
+	t.Helper()
+	return send(t, http.MethodGet, url, header, nil)
+}
+
+func send(t *testing.T, method string, url string, header http.Header, body []byte) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	assert.Nil(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return resp.StatusCode, string(respBody)
+}
+
+func TestIntegrationAuth(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	assert.Nil(t, os.WriteFile(secret, []byte("integration"), 0o600))
+	gw, cleanup := testutil.NewTestGateway(t, []config.ServiceConf{{
+		Name: "auth",
+		Auth: config.AuthSettings{Enabled: true, Secret: secret, Routes: []string{"/private", "/admin/*"}},
+	}})
+	defer cleanup()
+
+	code, _ := get(t, gw.BaseURL+"/auth/private", nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, 0, gw.Upstream("auth").Received(http.MethodGet, "/private"))
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"service": "integration",
+		"exp":     time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("integration"))
+	assert.Nil(t, err)
+	code, body := get(t, gw.BaseURL+"/auth/private", http.Header{"Authorization": {token}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "auth /private", body)
+	gw.AssertUpstreamReceived(t, "auth", http.MethodGet, "/private")
+	assert.NotEmpty(t, gw.Upstream("auth").Requests()[0].Header.Get("X-Claims"))
+	gw.AssertMetric(t, gw.Prefix+"_requests_total", 2)
+
+	// nested routes match the wildcard, the other routes stay public
+	code, _ = get(t, gw.BaseURL+"/auth/admin/users/1", nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = get(t, gw.BaseURL+"/auth/public/admin", nil)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestIntegrationRateLimit(t *testing.T) {
+	gw, cleanup := testutil.NewTestGateway(t, []config.ServiceConf{{
+		Name:        "limited",
+		RateLimiter: config.RateLimiterSettings{Enabled: true, Rate: 1, Burst: 1, CleanupInterval: 60},
+	}})
+	defer cleanup()
+
+	code, _ := get(t, gw.BaseURL+"/limited/", nil)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = get(t, gw.BaseURL+"/limited/", nil)
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	assert.Equal(t, 1, gw.Upstream("limited").Received(http.MethodGet, "/"))
+	gw.AssertMetric(t, gw.Prefix+"_requests_total", 2)
+	gw.AssertMetric(t, gw.Prefix+"_rate_limited_requests_total", 1)
+	gw.AssertMetric(t, gw.Prefix+"_rate_limiter_active_visitors", 1)
+}
+
+func TestIntegrationCircuitBreakerFallback(t *testing.T) {
+	gw, cleanup := testutil.NewTestGateway(t, []config.ServiceConf{
+		{
+			Name:           "primary",
+			FallbackUri:    "secondary",
+			CircuitBreaker: config.CircuitSettings{Enabled: true, Timeout: 60, FailureRatio: 0.5, MinimumRequests: 1},
+		},
+		{Name: "secondary"},
+	})
+	defer cleanup()
+
+	// take the primary down so the breaker trips and the fallback is used
+	gw.Upstream("primary").Close()
+	code, body := get(t, gw.BaseURL+"/primary/fallback", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "secondary /fallback", body)
+	gw.AssertUpstreamReceived(t, "secondary", http.MethodGet, "/fallback")
+}
+
+func TestIntegrationCacheHit(t *testing.T) {
+	gw, cleanup := testutil.NewTestGateway(t, []config.ServiceConf{{
+		Name:           "cached",
+		Cache:          config.CacheSettings{Enabled: true, ExpirationInterval: 60, CleanupInterval: 60},
+		CircuitBreaker: config.CircuitSettings{Enabled: true, Timeout: 60, FailureRatio: 0.5},
+	}})
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		code, body := get(t, gw.BaseURL+"/cached/resource", nil)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "cached /resource", body)
+	}
+	assert.Equal(t, 1, gw.Upstream("cached").Received(http.MethodGet, "/resource"))
+	gw.AssertMetric(t, gw.Prefix+"_requests_total", 3)
+}
+
+func TestIntegrationHealthCheck(t *testing.T) {
+	gw, cleanup := testutil.NewTestGateway(t, []config.ServiceConf{{
+		Name:   "healthy",
+		Health: config.HealthCheckSettings{Enabled: true, Uri: "/health"},
+	}})
+	defer cleanup()
+
+	code, body := get(t, gw.BaseURL+"/health", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "OK", body)
+	assert.Eventually(t, func() bool {
+		return gw.Upstream("healthy").Received(http.MethodGet, "/health") > 0
+	}, 3*time.Second, 100*time.Millisecond)
+}
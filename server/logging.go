@@ -11,6 +11,12 @@ import (
 	"github.com/fatih/color"
 )
 
+// LogLevel is the level of the default logger, it can be changed at runtime through /admin/loglevel
+var LogLevel = new(slog.LevelVar)
+
+// discardLogger drops every record, it logs the requests left out by sampling
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
 type PrettyHandlerOptions struct {
 	SlogOpts slog.HandlerOptions
 }
@@ -3,20 +3,25 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"golang.org/x/net/netutil"
 )
 
 func main() {
 	// Initialize logger
+	LogLevel.Set(slog.LevelDebug)
 	opts := PrettyHandlerOptions{
 		SlogOpts: slog.HandlerOptions{
-			Level: slog.LevelDebug,
+			Level: LogLevel,
 		},
 	}
 	handler := NewPrettyHandler(os.Stdout, opts)
@@ -29,43 +34,114 @@ func main() {
 	rh := NewRequestHandler()
 	router := InitializeRoutes(rh)
 
-	tlsConfig := &tls.Config{
-		MinVersion: tls.VersionTLS12,
+	server := newServer(router)
+	ln, err := newListener(server.Addr)
+	if err != nil {
+		slog.Error("Error starting server", "error", err.Error())
+		os.Exit(1)
 	}
-	server := &http.Server{
-		Addr:         ":" + config.AppConfig.Server.Port,
-		Handler:      router,
-		ReadTimeout:  time.Duration(config.AppConfig.Server.ReadTimeout) * time.Second,
-		WriteTimeout: time.Duration(config.AppConfig.Server.WriteTimeout) * time.Second,
-		TLSConfig:    tlsConfig,
+
+	if config.TLSEnabled() {
+		ln, err = newTLSListener(ln, server.TLSConfig, config.GetCertFile(), config.GetKeyFile())
+		if err != nil {
+			slog.Error("Error loading certificate", "error", err.Error())
+			os.Exit(1)
+		}
+		if tc := config.AppConfig.Server.TLSConfig; tc.RotateSessionTickets {
+			rotator, err := startSessionTicketRotation(server.TLSConfig, time.Duration(tc.RotationInterval)*time.Hour)
+			if err != nil {
+				slog.Error("Error generating session ticket key", "error", err.Error())
+				os.Exit(1)
+			}
+			defer rotator.Stop()
+		}
 	}
 
 	slog.Info("API Gateway started", "port", config.AppConfig.Server.Port)
+	go serve(server, ln)
+
+	// Reload the services of the config file on SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 	go func() {
-		// Start server
-		if config.TLSEnabled() {
-			if err := server.ListenAndServeTLS(config.GetCertFile(), config.GetKeyFile()); err != nil {
-				slog.Error("Error starting server", "error", err.Error())
-				os.Exit(1)
-			}
-		} else {
-			if err := server.ListenAndServe(); err != nil {
-				slog.Error("Error starting server", "error", err.Error())
-				os.Exit(1)
+		for range reload {
+			if err := rh.ServiceRegistry.Reload(config.Path); err != nil {
+				slog.Error("Error reloading config", "error", err.Error())
 			}
 		}
 	}()
 
 	// Graceful shutdown
 	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
 	<-stop
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.AppConfig.Server.GracefulTimeout)*time.Second)
-	defer cancel()
-	slog.Info("Gracefully shutting down server")
-	if err := server.Shutdown(ctx); err != nil {
+	err = gracefulShutdown(server, rh,
+		time.Duration(config.AppConfig.Server.PreShutdownDelay)*time.Second,
+		time.Duration(config.AppConfig.Server.GracefulTimeout)*time.Second)
+	if err != nil {
 		slog.Error("Error shutting down server", "error", err.Error())
 		os.Exit(1)
 	}
 }
+
+// newServer creates the http server with the timeouts and limits of the configuration
+func newServer(handler http.Handler) *http.Server {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	return &http.Server{
+		Addr:              ":" + config.AppConfig.Server.Port,
+		Handler:           handler,
+		ReadTimeout:       time.Duration(config.AppConfig.Server.ReadTimeout) * time.Second,
+		ReadHeaderTimeout: time.Duration(config.AppConfig.Server.ReadHeaderTimeout) * time.Second,
+		WriteTimeout:      time.Duration(config.AppConfig.Server.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(config.AppConfig.Server.IdleTimeout) * time.Second,
+		MaxHeaderBytes:    config.AppConfig.Server.MaxHeaderBytes,
+		TLSConfig:         tlsConfig,
+	}
+}
+
+// newListener listens on the address, accepting at most Server.MaxConnections connections at once.
+// Connections over the limit wait in the backlog until another one is closed.
+func newListener(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if n := config.AppConfig.Server.MaxConnections; n > 0 {
+		ln = netutil.LimitListener(ln, n)
+	}
+	return ln, nil
+}
+
+// serve accepts the connections of the listener until the server is shut down, the process exits
+// if the server fails. The shutdown isn't a failure, gracefulShutdown finishes it
+func serve(server *http.Server, ln net.Listener) {
+	if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Error starting server", "error", err.Error())
+		os.Exit(1)
+	}
+}
+
+// gracefulShutdown fails readiness for delay so load balancers deregister the gateway
+// and then shuts the server down, saving the circuit breaker states for the next start
+func gracefulShutdown(server *http.Server, rh *RequestHandler, delay time.Duration, timeout time.Duration) error {
+	rh.Drain()
+	if delay > 0 {
+		slog.Info("Draining before shutdown", "delay", delay.String())
+		time.Sleep(delay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	slog.Info("Gracefully shutting down server")
+	err := server.Shutdown(ctx)
+	if rh.ServiceRegistry != nil {
+		rh.ServiceRegistry.Stop()
+		rh.ServiceRegistry.SaveCircuitStates()
+	}
+	if cerr := rh.RateLimitEvents.Close(); cerr != nil {
+		slog.Error("Error closing rate limit event log", "error", cerr.Error())
+	}
+	return err
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/ArmaanKatyal/go-api-gateway/server/feature"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	rh := &RequestHandler{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ready", rh.Ready)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := &http.Server{Handler: mux}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ln) }()
+
+	ready := func() int {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/ready")
+		if err != nil {
+			return 0
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, ready())
+
+	done := make(chan error, 1)
+	go func() { done <- gracefulShutdown(server, rh, 500*time.Millisecond, time.Second) }()
+
+	// readiness flips while the server is still accepting connections
+	assert.Eventually(t, func() bool { return ready() == http.StatusServiceUnavailable }, 400*time.Millisecond, 10*time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("shutdown finished before the pre shutdown delay")
+	default:
+	}
+
+	// then the shutdown proceeds
+	assert.Nil(t, <-done)
+	assert.True(t, errors.Is(<-served, http.ErrServerClosed))
+	assert.Equal(t, 0, ready())
+}
+
+func TestGracefulShutdownSavesCircuitStates(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "circuit-state.json")
+	sc := testServiceConf("orders", "localhost:9000")
+	sc.CircuitBreaker = config.CircuitSettings{Enabled: true, Timeout: 60, FailureRatio: 0.5, MinimumRequests: 1, PersistState: true, StateFile: stateFile}
+	s, err := NewService(&sc)
+	assert.Nil(t, err)
+	rh := &RequestHandler{ServiceRegistry: newTestRegistry()}
+	assert.Nil(t, rh.ServiceRegistry.Register("orders", s))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := &http.Server{Handler: http.NewServeMux()}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		serve(server, ln)
+	}()
+
+	// the server closing doesn't end the process before the states are saved
+	assert.Nil(t, gracefulShutdown(server, rh, 0, time.Second))
+	<-served
+	states, err := feature.LoadCircuitStates(stateFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "closed", states["orders"].State)
+}
+
+func TestNewServer(t *testing.T) {
+	defer func(c config.Conf) { config.AppConfig = c }(config.AppConfig)
+	c := config.Conf{}
+	c.Server.Host = "localhost"
+	c.Server.Port = "8080"
+	c.Server.IdleTimeout = 120
+	assert.True(t, c.Verify())
+	config.AppConfig = c
+
+	server := newServer(http.NewServeMux())
+	assert.Equal(t, ":8080", server.Addr)
+	assert.Equal(t, 5*time.Second, server.ReadTimeout)
+	assert.Equal(t, 5*time.Second, server.ReadHeaderTimeout)
+	assert.Equal(t, 10*time.Second, server.WriteTimeout)
+	assert.Equal(t, 120*time.Second, server.IdleTimeout)
+	assert.Equal(t, http.DefaultMaxHeaderBytes, server.MaxHeaderBytes)
+}
+
+// serveLimited serves a server created with newServer on a local listener created with newListener
+func serveLimited(t *testing.T, c config.Conf) (string, func()) {
+	t.Helper()
+	prev := config.AppConfig
+	c.Server.Host = "localhost"
+	c.Server.Port = "0"
+	assert.True(t, c.Verify())
+	config.AppConfig = c
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {})
+	server := newServer(mux)
+	ln, err := newListener("127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() { _ = server.Serve(ln) }()
+	return ln.Addr().String(), func() {
+		_ = server.Close()
+		config.AppConfig = prev
+	}
+}
+
+// roundTrip sends a keep-alive request on the connection and reads the response
+func roundTrip(conn net.Conn) error {
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: gateway\r\n\r\n")); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	c := config.Conf{}
+	c.Server.IdleTimeout = 1
+	addr, cleanup := serveLimited(t, c)
+	defer cleanup()
+
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.Nil(t, roundTrip(conn))
+
+	// the server closes the connection once it has been idle for the timeout
+	start := time.Now()
+	assert.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+}
+
+func TestServerMaxConnections(t *testing.T) {
+	c := config.Conf{}
+	c.Server.MaxConnections = 1
+	addr, cleanup := serveLimited(t, c)
+	defer cleanup()
+
+	first, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	assert.Nil(t, roundTrip(first))
+
+	// the second connection isn't served while the first one is open
+	second, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer second.Close()
+	served := make(chan error, 1)
+	go func() { served <- roundTrip(second) }()
+	select {
+	case <-served:
+		t.Fatal("connection over the limit was served")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	assert.Nil(t, first.Close())
+	select {
+	case err := <-served:
+		assert.Nil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not served after the limit was freed")
+	}
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// statusWriter records the status code of the response, a handler which writes nothing
+// responds with a 200
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func newStatusWriter(w http.ResponseWriter) *statusWriter {
+	return &statusWriter{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if !sw.wroteHeader {
+		sw.status, sw.wroteHeader = code, true
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	sw.wroteHeader = true
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// tlsInfo returns the negotiated tls version and cipher suite of the connection, empty for plaintext
+func tlsInfo(r *http.Request) (string, string) {
+	if r.TLS == nil {
+		return "", ""
+	}
+	return tls.VersionName(r.TLS.Version), tls.CipherSuiteName(r.TLS.CipherSuite)
+}
+
+// AccessLogSampler returns the fraction (0.0-1.0) of the successful requests like r to log
+type AccessLogSampler func(r *http.Request) float64
+
+// AccessLogMiddleware logs every request once it is handled with its status, duration and
+// the tls version and cipher of the client connection. The successful requests are sampled
+// at the rate returned by sampler, all of them are logged if it is nil.
+func AccessLogMiddleware(logger *slog.Logger, sampler AccessLogSampler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			// decided before handling the request, the handlers may change it
+			sampled := sampler == nil || rand.Float64() < sampler(r)
+			sw := newStatusWriter(w)
+			next.ServeHTTP(sw, r)
+			if !sampled && sw.status < http.StatusBadRequest {
+				return
+			}
+			version, cipher := tlsInfo(r)
+			logger.Info("Access", "method", r.Method, "path", r.URL.Path, "status", sw.status,
+				"duration", time.Since(start).String(), "remote_addr", r.RemoteAddr,
+				"tls_version", version, "tls_cipher", cipher)
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessLogMiddleware(t *testing.T) {
+	tests := []struct {
+		name      string
+		newServer func(http.Handler) *httptest.Server
+		tls       bool
+	}{
+		{"tls", httptest.NewTLSServer, true},
+		{"plaintext", httptest.NewServer, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, nil))
+			srv := tt.newServer(AccessLogMiddleware(logger, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+			})))
+			defer srv.Close()
+
+			resp, err := srv.Client().Get(srv.URL + "/orders")
+			assert.Nil(t, err)
+			_ = resp.Body.Close()
+
+			var entry map[string]interface{}
+			assert.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+			assert.Equal(t, "/orders", entry["path"])
+			assert.Equal(t, float64(http.StatusAccepted), entry["status"])
+			if tt.tls {
+				assert.Equal(t, "TLS 1.3", entry["tls_version"])
+				assert.NotEmpty(t, entry["tls_cipher"])
+			} else {
+				assert.Equal(t, "", entry["tls_version"])
+				assert.Equal(t, "", entry["tls_cipher"])
+			}
+		})
+	}
+}
+
+func TestAccessLogMiddlewareImplicitStatus(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	// the handler writes nothing, the response is an implicit 200
+	h := AccessLogMiddleware(logger, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/orders", nil))
+
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, float64(http.StatusOK), entry["status"])
+}
+
+func TestAccessLogMiddlewareSampling(t *testing.T) {
+	tests := []struct {
+		name      string
+		rate      float64
+		successes int
+	}{
+		{"none sampled", 0, 0},
+		{"all sampled", 1, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, nil))
+			sampler := func(*http.Request) float64 { return tt.rate }
+			h := AccessLogMiddleware(logger, sampler)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/fail" {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			for i := 0; i < 10; i++ {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ok", nil))
+			}
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fail", nil))
+
+			// the errors are logged whatever the rate
+			logged := map[string]int{}
+			dec := json.NewDecoder(&buf)
+			for dec.More() {
+				var entry map[string]interface{}
+				assert.Nil(t, dec.Decode(&entry))
+				logged[entry["path"].(string)]++
+			}
+			assert.Equal(t, tt.successes, logged["/ok"])
+			assert.Equal(t, 1, logged["/fail"])
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// AdminAuthMiddleware only lets through requests with the admin bearer token, every
+// request is rejected if the token is empty
+func AdminAuthMiddleware(token []byte) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if len(token) == 0 || !ok || subtle.ConstantTimeCompare([]byte(given), token) != 1 {
+				slog.Error("Unauthorized admin request", "path", r.URL.Path, "method", r.Method)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
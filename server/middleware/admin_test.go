@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminAuthMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	tests := []struct {
+		name     string
+		token    []byte
+		header   string
+		expected int
+	}{
+		{name: "valid token", token: []byte("secret"), header: "Bearer secret", expected: http.StatusOK},
+		{name: "invalid token", token: []byte("secret"), header: "Bearer other", expected: http.StatusUnauthorized},
+		{name: "missing bearer prefix", token: []byte("secret"), header: "secret", expected: http.StatusUnauthorized},
+		{name: "missing header", token: []byte("secret"), expected: http.StatusUnauthorized},
+		{name: "no token configured", header: "Bearer ", expected: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/debug/state", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			AdminAuthMiddleware(tt.token)(ok).ServeHTTP(w, r)
+			assert.Equal(t, tt.expected, w.Code)
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/feature"
+)
+
+// recordingWriter writes the response to the client while keeping a copy of it
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(code int) {
+	if rw.status == 0 {
+		rw.status = code
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// DeduplicationMiddleware replays the stored response of a request which was already made
+// with the same idempotency key by the same caller, a duplicate of a request still being
+// handled gets a 409. Server errors are not stored so the request can be retried.
+func DeduplicationMiddleware(store *feature.DeduplicationStore) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			idempotencyKey := r.Header.Get(store.Header)
+			if !store.IsEnabled() || idempotencyKey == "" {
+				next(w, r)
+				return
+			}
+			key := store.Key(r.Method, r.URL.String(), idempotencyKey, feature.CallerIdentity(r))
+			if replay(w, r, store, key) {
+				return
+			}
+			if !store.Begin(key) {
+				slog.Warn("Duplicate request in progress", "path", r.URL.Path, "method", r.Method)
+				http.Error(w, "duplicate request in progress", http.StatusConflict)
+				return
+			}
+			defer store.End(key)
+			// the request may have completed between the lookup and marking it
+			if replay(w, r, store, key) {
+				return
+			}
+			rw := &recordingWriter{ResponseWriter: w}
+			next(rw, r)
+			if rw.status != 0 && rw.status < http.StatusInternalServerError {
+				store.Set(key, &feature.StoredResponse{Status: rw.status, Header: w.Header().Clone(), Body: rw.body.Bytes()})
+			}
+		}
+	}
+}
+
+// replay writes the stored response of the request, it returns false if there is none
+func replay(w http.ResponseWriter, r *http.Request, store *feature.DeduplicationStore, key string) bool {
+	resp, ok := store.Get(key)
+	if !ok {
+		return false
+	}
+	slog.Info("Replaying duplicate request", "path", r.URL.Path, "method", r.Method)
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.Status)
+	if _, err := w.Write(resp.Body); err != nil {
+		slog.Error("Error writing response", "error", err.Error())
+	}
+	return true
+}
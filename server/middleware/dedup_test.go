@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/ArmaanKatyal/go-api-gateway/server/feature"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduplicationMiddleware(t *testing.T) {
+	defer func(c config.Conf) { config.AppConfig = c }(config.AppConfig)
+	config.AppConfig.Server.Deduplication.Enabled = true
+
+	newHandler := func(status int) (http.HandlerFunc, *int) {
+		calls := 0
+		store := feature.NewDeduplicationStore()
+		return DeduplicationMiddleware(store)(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Header().Set("X-Call", strings.Repeat("i", calls))
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte("created"))
+		}), &calls
+	}
+	request := func(key string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/orders/", nil)
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		return r
+	}
+
+	t.Run("duplicate replayed", func(t *testing.T) {
+		h, calls := newHandler(http.StatusCreated)
+		first := httptest.NewRecorder()
+		h(first, request("abc"))
+		second := httptest.NewRecorder()
+		h(second, request("abc"))
+		assert.Equal(t, 1, *calls)
+		assert.Equal(t, first.Code, second.Code)
+		assert.Equal(t, first.Body.String(), second.Body.String())
+		assert.Equal(t, "i", second.Header().Get("X-Call"))
+
+		h(httptest.NewRecorder(), request("other"))
+		assert.Equal(t, 2, *calls)
+	})
+	t.Run("without key", func(t *testing.T) {
+		h, calls := newHandler(http.StatusCreated)
+		h(httptest.NewRecorder(), request(""))
+		h(httptest.NewRecorder(), request(""))
+		assert.Equal(t, 2, *calls)
+	})
+	t.Run("other caller not replayed", func(t *testing.T) {
+		h, calls := newHandler(http.StatusCreated)
+		r := request("abc")
+		r.Header.Set("Authorization", "alice")
+		h(httptest.NewRecorder(), r)
+		r = request("abc")
+		r.Header.Set("Authorization", "bob")
+		h(httptest.NewRecorder(), r)
+		assert.Equal(t, 2, *calls)
+	})
+	t.Run("concurrent duplicate rejected", func(t *testing.T) {
+		store := feature.NewDeduplicationStore()
+		entered, release := make(chan struct{}), make(chan struct{})
+		h := DeduplicationMiddleware(store)(func(w http.ResponseWriter, r *http.Request) {
+			close(entered)
+			<-release
+			w.WriteHeader(http.StatusCreated)
+		})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			h(httptest.NewRecorder(), request("abc"))
+		}()
+		<-entered
+		w := httptest.NewRecorder()
+		h(w, request("abc"))
+		assert.Equal(t, http.StatusConflict, w.Code)
+		close(release)
+		<-done
+
+		// replayed once the first completed
+		w = httptest.NewRecorder()
+		h(w, request("abc"))
+		assert.Equal(t, http.StatusCreated, w.Code)
+	})
+	t.Run("server error not stored", func(t *testing.T) {
+		h, calls := newHandler(http.StatusBadGateway)
+		h(httptest.NewRecorder(), request("abc"))
+		h(httptest.NewRecorder(), request("abc"))
+		assert.Equal(t, 2, *calls)
+	})
+}
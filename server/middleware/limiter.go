@@ -3,17 +3,34 @@ package middleware
 import (
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/ArmaanKatyal/go-api-gateway/server/feature"
+	"github.com/ArmaanKatyal/go-api-gateway/server/observability"
 )
 
-func RateLimiterMiddleware(limiter *feature.GlobalRateLimiter) func(http.HandlerFunc) http.HandlerFunc {
+// GlobalEventService is the service of the rate limit events of the requests resolving to no
+// registered service
+const GlobalEventService = "global"
+
+// ServiceResolver returns the name of the registered service the request resolves to, empty if none
+type ServiceResolver func(r *http.Request) string
+
+// RateLimiterMiddleware rejects the requests over the global rate limit, they are recorded in
+// the event log if it is enabled
+func RateLimiterMiddleware(limiter *feature.GlobalRateLimiter, proxies *feature.TrustedProxies, events *observability.RateLimitEventLog, resolve ServiceResolver) func(http.HandlerFunc) http.HandlerFunc {
 	return func(next http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
 			if limiter.IsEnabled() {
-				v := limiter.GetVisitor(r.RemoteAddr)
+				ip := proxies.Resolve(r).For
+				service := resolve(r)
+				v := limiter.GetVisitor(limiter.Key(ip, service))
 				if !v.Limiter.Allow() {
-					slog.Error("Rate limit exceeded", "path", r.URL.Path, "method", r.Method, "ip", r.RemoteAddr)
+					slog.Error("Rate limit exceeded", "path", r.URL.Path, "method", r.Method, "ip", ip, "service", service)
+					if service == "" {
+						service = GlobalEventService
+					}
+					events.Record(observability.RateLimitEvent{Timestamp: time.Now(), IP: ip, Service: service, Path: r.URL.Path, Method: r.Method})
 					http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
 					return
 				}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/ArmaanKatyal/go-api-gateway/server/feature"
+	"github.com/ArmaanKatyal/go-api-gateway/server/observability"
+	"github.com/stretchr/testify/assert"
+)
+
+// newGlobalRateLimiter returns a global limiter with a burst of 2 requests per client
+func newGlobalRateLimiter(t *testing.T, perRoute bool) *feature.GlobalRateLimiter {
+	t.Helper()
+	defer func(c config.Conf) { config.AppConfig = c }(config.AppConfig)
+	config.AppConfig.Server.RateLimiter = config.RateLimiterSettings{Enabled: true, Rate: 1, Burst: 2, CleanupInterval: 60}
+	config.AppConfig.Server.RateLimitPerRoute = perRoute
+	return feature.NewGlobalRateLimiter()
+}
+
+// resolveFirstSegment resolves the first segment of the path to the service, unless it is unknown
+func resolveFirstSegment(r *http.Request) string {
+	service, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if strings.HasPrefix(service, "unknown") {
+		return ""
+	}
+	return service
+}
+
+func TestRateLimiterMiddlewarePerRoute(t *testing.T) {
+	h := RateLimiterMiddleware(newGlobalRateLimiter(t, true), feature.NewTrustedProxies(nil), nil, resolveFirstSegment)(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	request := func(path string) int {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request("/noisy/"))
+	assert.Equal(t, http.StatusOK, request("/noisy/"))
+	assert.Equal(t, http.StatusTooManyRequests, request("/noisy/"))
+	// the throttled service doesn't use up the allowance of the other one
+	assert.Equal(t, http.StatusOK, request("/quiet/"))
+	assert.Equal(t, http.StatusOK, request("/quiet/"))
+
+	// changing the unresolved first segment doesn't get a fresh allowance
+	assert.Equal(t, http.StatusOK, request("/unknown-1/"))
+	assert.Equal(t, http.StatusOK, request("/unknown-2/"))
+	assert.Equal(t, http.StatusTooManyRequests, request("/unknown-3/"))
+}
+
+func TestRateLimiterMiddlewareEventLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimit.log")
+	events, err := observability.NewRateLimitEventLog(path, nil)
+	assert.Nil(t, err)
+	h := RateLimiterMiddleware(newGlobalRateLimiter(t, false), feature.NewTrustedProxies(nil), events, resolveFirstSegment)(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	for _, path := range []string{"/orders/1", "/orders/1", "/orders/1", "/unknown/1"} {
+		h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	assert.Nil(t, events.Close())
+
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	var services []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var e observability.RateLimitEvent
+		assert.Nil(t, json.Unmarshal([]byte(line), &e))
+		assert.Equal(t, "192.0.2.1", e.IP)
+		services = append(services, e.Service)
+	}
+	// the requests resolving to no service are recorded as global
+	assert.Equal(t, []string{"orders", GlobalEventService}, services)
+}
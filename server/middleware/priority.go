@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/feature"
+)
+
+// PriorityLimitMiddleware rejects the requests over the gateway wide concurrency limit of their
+// priority with a 503. While the limit is enabled the priority header is stripped so it isn't
+// forwarded to the services, otherwise the request is left untouched.
+func PriorityLimitMiddleware(sem *feature.PrioritySemaphore) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !sem.IsEnabled() {
+				next(w, r)
+				return
+			}
+			priority := sem.Priority(r)
+			r.Header.Del(sem.Header)
+			if !sem.TryAcquire(priority) {
+				slog.Error("Gateway concurrency limit reached", "path", r.URL.Path, "method", r.Method, "priority", priority.String())
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			defer sem.Release()
+			next(w, r)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/feature"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPriorityLimitMiddleware(t *testing.T) {
+	// the requests of httptest come from 192.0.2.1
+	sem := &feature.PrioritySemaphore{Max: 10, Header: feature.DefaultPriorityHeader, Proxies: feature.NewTrustedProxies([]string{"192.0.2.1"})}
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	h := PriorityLimitMiddleware(sem)(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get(feature.DefaultPriorityHeader))
+		if r.URL.Path == "/batch" {
+			started <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	request := func(path string, priority string, remoteAddr ...string) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if len(remoteAddr) > 0 {
+			r.RemoteAddr = remoteAddr[0]
+		}
+		if priority != "" {
+			r.Header.Set(feature.DefaultPriorityHeader, priority)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code
+	}
+
+	// fill the capacity available to the low priority requests with batch jobs
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, http.StatusOK, request("/batch", "low"))
+		}()
+		<-started
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, request("/batch", "low"))
+	assert.Equal(t, http.StatusOK, request("/orders", "high"))
+	assert.Equal(t, http.StatusOK, request("/orders", ""))
+	// the priority of a client which isn't a trusted proxy is ignored
+	assert.Equal(t, http.StatusOK, request("/orders", "low", "10.0.0.1:1234"))
+	assert.Equal(t, int64(8), sem.InFlight())
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, http.StatusOK, request("/orders", "low"))
+	assert.Equal(t, int64(0), sem.InFlight())
+}
+
+func TestPriorityLimitMiddlewareDisabled(t *testing.T) {
+	for _, sem := range []*feature.PrioritySemaphore{nil, {Max: 0, Header: feature.DefaultPriorityHeader}} {
+		var forwarded string
+		h := PriorityLimitMiddleware(sem)(func(w http.ResponseWriter, r *http.Request) {
+			forwarded = r.Header.Get(feature.DefaultPriorityHeader)
+			w.WriteHeader(http.StatusOK)
+		})
+		r := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		r.Header.Set(feature.DefaultPriorityHeader, "high")
+		w := httptest.NewRecorder()
+		h(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		// the services reading the header still get it
+		assert.Equal(t, "high", forwarded)
+	}
+}
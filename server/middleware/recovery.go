@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/observability"
+)
+
+// recoveryWriter keeps track of whether the headers have been sent
+type recoveryWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (rw *recoveryWriter) WriteHeader(code int) {
+	rw.wroteHeader = true
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recoveryWriter) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *recoveryWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// PanicRecoveryMiddleware recovers panics from the next handler, the panic is logged and
+// counted and a 500 is returned if the headers have not been sent yet
+func PanicRecoveryMiddleware(metrics *observability.PromMetrics) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw := &recoveryWriter{ResponseWriter: w}
+			defer func() {
+				if err := recover(); err != nil {
+					if err == http.ErrAbortHandler {
+						// the handler aborted on purpose, let the server deal with it
+						panic(err)
+					}
+					slog.Error("panic", "error", err, "path", r.URL.Path, "method", r.Method, "stack", string(debug.Stack()))
+					metrics.IncPanics()
+					if !rw.wroteHeader {
+						http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					}
+				}
+			}()
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
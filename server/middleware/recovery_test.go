@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/ArmaanKatyal/go-api-gateway/server/observability"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func counterValue(t *testing.T, metrics *observability.PromMetrics, name string) float64 {
+	t.Helper()
+	families, err := metrics.Registry().Gather()
+	assert.Nil(t, err)
+	for _, f := range families {
+		if f.GetName() == name {
+			return f.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestPanicRecoveryMiddleware(t *testing.T) {
+	config.AppConfig.Server.Metrics.Prefix = "recovery_test"
+	metrics := observability.NewPromMetrics()
+
+	t.Run("panic returns 500", func(t *testing.T) {
+		before := counterValue(t, metrics, "recovery_test_panics_total")
+		h := PanicRecoveryMiddleware(metrics)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Equal(t, before+1, counterValue(t, metrics, "recovery_test_panics_total"))
+	})
+	t.Run("panic after headers sent keeps status", func(t *testing.T) {
+		before := counterValue(t, metrics, "recovery_test_panics_total")
+		h := PanicRecoveryMiddleware(metrics)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+			panic("boom")
+		}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Equal(t, before+1, counterValue(t, metrics, "recovery_test_panics_total"))
+	})
+	t.Run("no panic", func(t *testing.T) {
+		h := PanicRecoveryMiddleware(metrics)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
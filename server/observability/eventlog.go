@@ -0,0 +1,107 @@
+package observability
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// EventLogBuffer is the number of events queued for the writer before new ones are dropped
+const EventLogBuffer = 1024
+
+// RateLimitEvent is a request rejected by one of the rate limiters
+type RateLimitEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	IP        string    `json:"ip"`
+	Service   string    `json:"service"`
+	Path      string    `json:"path"`
+	Method    string    `json:"method"`
+}
+
+// RateLimitEventLog appends the rate limit events to a file as JSON lines. The events are
+// written by a worker so recording one never blocks the request.
+type RateLimitEventLog struct {
+	file    *os.File
+	events  chan RateLimitEvent
+	dropped func()
+	done    chan struct{}
+	// guards closing the channel against concurrent records
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewRateLimitEventLog opens the file for appending and starts the writer, dropped is called
+// for every event dropped because the writer is falling behind
+func NewRateLimitEventLog(path string, dropped func()) (*RateLimitEventLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	l := &RateLimitEventLog{
+		file:    f,
+		events:  make(chan RateLimitEvent, EventLogBuffer),
+		dropped: dropped,
+		done:    make(chan struct{}),
+	}
+	go l.write()
+	return l, nil
+}
+
+// Record queues the event without blocking, it is dropped if the queue is full
+func (l *RateLimitEventLog) Record(e RateLimitEvent) {
+	if l == nil {
+		return
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.events <- e:
+	default:
+		if l.dropped != nil {
+			l.dropped()
+		}
+	}
+}
+
+// Close writes the queued events and closes the file
+func (l *RateLimitEventLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.events)
+	l.mu.Unlock()
+	<-l.done
+	return l.file.Close()
+}
+
+// write encodes the events to the file, flushing whenever the queue is drained
+func (l *RateLimitEventLog) write() {
+	defer close(l.done)
+	w := bufio.NewWriter(l.file)
+	enc := json.NewEncoder(w)
+	for e := range l.events {
+		if err := enc.Encode(e); err != nil {
+			slog.Error("Error writing rate limit event", "error", err.Error())
+		}
+		if len(l.events) == 0 {
+			if err := w.Flush(); err != nil {
+				slog.Error("Error flushing rate limit events", "error", err.Error())
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		slog.Error("Error flushing rate limit events", "error", err.Error())
+	}
+}
@@ -0,0 +1,48 @@
+package observability
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitEventLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimit.log")
+	l, err := NewRateLimitEventLog(path, nil)
+	assert.Nil(t, err)
+	now := time.Now().UTC()
+	for i := 0; i < 10; i++ {
+		l.Record(RateLimitEvent{Timestamp: now, IP: "1.1.1.1", Service: "orders", Path: "/orders/1", Method: "GET"})
+	}
+	assert.Nil(t, l.Close())
+	// recording after closing is a noop
+	l.Record(RateLimitEvent{})
+
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e RateLimitEvent
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &e))
+		assert.Equal(t, RateLimitEvent{Timestamp: now, IP: "1.1.1.1", Service: "orders", Path: "/orders/1", Method: "GET"}, e)
+		lines++
+	}
+	assert.Equal(t, 10, lines)
+}
+
+func TestRateLimitEventLogDropped(t *testing.T) {
+	dropped := 0
+	// without a writer draining the queue
+	l := &RateLimitEventLog{events: make(chan RateLimitEvent, 1), dropped: func() { dropped++ }}
+	l.Record(RateLimitEvent{})
+	l.Record(RateLimitEvent{})
+	l.Record(RateLimitEvent{})
+	assert.Equal(t, 2, dropped)
+}
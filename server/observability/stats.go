@@ -0,0 +1,103 @@
+package observability
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+)
+
+const DefaultStatsWindow = 60
+
+// ServiceRate is the summary of the requests to a service over the stats window
+type ServiceRate struct {
+	Requests int `json:"requests"`
+	Errors   int `json:"errors"`
+	// requests per second
+	RequestRate float64 `json:"requestRate"`
+	// ratio of the requests which failed with a server error
+	ErrorRate float64 `json:"errorRate"`
+}
+
+// statsBucket counts the requests of a single second
+type statsBucket struct {
+	second   int64
+	requests int
+	errors   int
+}
+
+// ServiceStats keeps rolling request and error counts per service over a sliding window
+// of one second buckets, without having to query prometheus
+type ServiceStats struct {
+	mu       sync.Mutex
+	window   int
+	services map[string][]statsBucket
+	now      func() time.Time
+}
+
+func NewServiceStats() *ServiceStats {
+	window := config.AppConfig.Server.Metrics.StatsWindow
+	if window <= 0 {
+		window = DefaultStatsWindow
+	}
+	return &ServiceStats{
+		window:   window,
+		services: make(map[string][]statsBucket),
+		now:      time.Now,
+	}
+}
+
+// Record counts a request to the service, server errors are counted as errors
+func (s *ServiceStats) Record(service string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buckets, ok := s.services[service]
+	if !ok {
+		buckets = make([]statsBucket, s.window)
+		s.services[service] = buckets
+	}
+	sec := s.now().Unix()
+	b := &buckets[sec%int64(s.window)]
+	if b.second != sec {
+		*b = statsBucket{second: sec}
+	}
+	b.requests++
+	if status >= http.StatusInternalServerError {
+		b.errors++
+	}
+}
+
+// Rate returns the summary of the service over the window
+func (s *ServiceStats) Rate(service string) ServiceRate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rate(s.services[service])
+}
+
+// Rates returns the summary of every service which received requests
+func (s *ServiceStats) Rates() map[string]ServiceRate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rates := make(map[string]ServiceRate, len(s.services))
+	for name, buckets := range s.services {
+		rates[name] = s.rate(buckets)
+	}
+	return rates
+}
+
+func (s *ServiceStats) rate(buckets []statsBucket) ServiceRate {
+	var r ServiceRate
+	oldest := s.now().Unix() - int64(s.window)
+	for _, b := range buckets {
+		if b.second > oldest {
+			r.Requests += b.requests
+			r.Errors += b.errors
+		}
+	}
+	r.RequestRate = float64(r.Requests) / float64(s.window)
+	if r.Requests > 0 {
+		r.ErrorRate = float64(r.Errors) / float64(r.Requests)
+	}
+	return r
+}
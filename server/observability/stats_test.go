@@ -0,0 +1,34 @@
+package observability
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceStats(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := NewServiceStats()
+	s.window = 10
+	s.now = func() time.Time { return now }
+
+	s.Record("orders", http.StatusOK)
+	s.Record("orders", http.StatusNotFound)
+	assert.Equal(t, ServiceRate{Requests: 2, RequestRate: 0.2}, s.Rate("orders"))
+
+	now = now.Add(time.Second)
+	s.Record("orders", http.StatusBadGateway)
+	s.Record("orders", http.StatusInternalServerError)
+	assert.Equal(t, ServiceRate{Requests: 4, Errors: 2, RequestRate: 0.4, ErrorRate: 0.5}, s.Rate("orders"))
+	assert.Equal(t, ServiceRate{}, s.Rate("payments"))
+
+	// the first second falls out of the window
+	now = now.Add(9 * time.Second)
+	assert.Equal(t, ServiceRate{Requests: 2, Errors: 2, RequestRate: 0.2, ErrorRate: 1}, s.Rate("orders"))
+	// a bucket reused after a full window starts from zero
+	s.Record("orders", http.StatusOK)
+	assert.Equal(t, ServiceRate{Requests: 3, Errors: 2, RequestRate: 0.3, ErrorRate: 2.0 / 3}, s.Rate("orders"))
+	assert.Len(t, s.Rates(), 1)
+}
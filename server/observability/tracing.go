@@ -3,26 +3,45 @@ package observability
 import (
 	"fmt"
 	"reflect"
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/ArmaanKatyal/go-api-gateway/server/config"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 )
 
 type PromMetrics struct {
 	// Note: just collecting basic observability anything more complex not needed for this project
 	prefix                    string
+	service                   string
+	registry                  *prometheus.Registry
 	httpTransactionTotal      *prometheus.CounterVec
 	httpResponseTimeHistogram *prometheus.HistogramVec
+	whitelistDeniedTotal      *prometheus.CounterVec
+	rateLimitedTotal          *prometheus.CounterVec
+	activeVisitors            *prometheus.GaugeVec
+	breakerRequests           *prometheus.GaugeVec
+	breakerSuccesses          *prometheus.GaugeVec
+	breakerFailures           *prometheus.GaugeVec
+	breakerConsecutiveFails   *prometheus.GaugeVec
+	webSocketConnections      *prometheus.GaugeVec
+	cacheBytes                *prometheus.GaugeVec
+	responseSizeBytes         *prometheus.HistogramVec
+	panicsTotal               prometheus.Counter
+	rateLimitEventsDropped    prometheus.Counter
 	buckets                   []float64
 }
 
+// MetricsInput are the label values of a request, the fields tagged label:"-" aren't labels
 type MetricsInput struct {
 	Code   string
 	Method string
 	Route  string
+	// the service the request resolved to, it selects the metrics the request is recorded in
+	Service string `label:"-"`
 }
 
 // ToList converts the MetricsInput struct to a list of strings
@@ -31,6 +50,9 @@ func (m *MetricsInput) ToList() []string {
 	inputValue := reflect.ValueOf(*m)
 
 	for i := 0; i < inputValue.NumField(); i++ {
+		if inputValue.Type().Field(i).Tag.Get("label") == "-" {
+			continue
+		}
 		value := inputValue.Field(i)
 		values = append(values, fmt.Sprint(value.Interface()))
 	}
@@ -43,25 +65,150 @@ func getLabels() []string {
 	var labels []string
 	metricsInputType := reflect.TypeOf(MetricsInput{})
 	for i := 0; i < metricsInputType.NumField(); i++ {
+		if metricsInputType.Field(i).Tag.Get("label") == "-" {
+			continue
+		}
 		labels = append(labels, metricsInputType.Field(i).Name)
 	}
 	return labels
 }
 
-func NewPromMetrics() *PromMetrics {
-	prefix := config.AppConfig.Server.Metrics.Prefix
-	return &PromMetrics{
-		prefix: prefix,
-		httpTransactionTotal: promauto.NewCounterVec(prometheus.CounterOpts{
-			Name: prefix + "_requests_total",
-			Help: "Total HTTP requests processed",
-		}, getLabels()),
-		httpResponseTimeHistogram: promauto.NewHistogramVec(prometheus.HistogramOpts{
-			Name: prefix + "_response_time_seconds",
-			Help: "Histogram of response time for handler",
-		}, getLabels()),
-		buckets: config.AppConfig.Server.Metrics.Buckets,
+// DefaultSizeBuckets are the buckets (bytes) of the response size histogram when they aren't configured
+var DefaultSizeBuckets = []float64{100, 1024, 10240, 102400, 1048576}
+
+// MetricsOption customizes the metrics created by NewPromMetrics
+type MetricsOption func(*PromMetrics)
+
+// invalidMetricChars are the characters of a service name not allowed in a metric name
+var invalidMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// ForService scopes the metrics to the service, they are named {prefix}_{service}_... instead
+// of having a service label and are registered with the registry of the service
+func ForService(name string, registry *prometheus.Registry) MetricsOption {
+	return func(pm *PromMetrics) {
+		pm.service = name
+		pm.prefix += "_" + invalidMetricChars.ReplaceAllString(name, "_")
+		pm.registry = registry
+	}
+}
+
+// NewPromMetrics creates the metrics registered with a registry of their own, so several
+// gateways can live in the same process. The options scope them e.g. to a single service
+func NewPromMetrics(opts ...MetricsOption) *PromMetrics {
+	pm := &PromMetrics{prefix: config.AppConfig.Server.Metrics.Prefix}
+	for _, opt := range opts {
+		opt(pm)
+	}
+	if pm.registry == nil {
+		pm.registry = prometheus.NewRegistry()
+		// the runtime metrics are only exposed once, by the gateway registry
+		pm.registry.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+	prefix := pm.prefix
+	// the service label is redundant for the metrics of a single service
+	serviceLabels := []string{"service"}
+	if pm.service != "" {
+		serviceLabels = nil
+	}
+	pm.httpTransactionTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_requests_total",
+		Help: "Total HTTP requests processed",
+	}, getLabels())
+	pm.httpResponseTimeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: prefix + "_response_time_seconds",
+		Help: "Histogram of response time for handler",
+	}, getLabels())
+	// Note: source ip is deliberately not a label to keep the cardinality bounded
+	pm.whitelistDeniedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_whitelist_denied_total",
+		Help: "Total requests denied by the service IP whitelist",
+	}, serviceLabels)
+	pm.rateLimitedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_rate_limited_requests_total",
+		Help: "Total requests rejected by the service rate limiter",
+	}, serviceLabels)
+	pm.activeVisitors = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: prefix + "_rate_limiter_active_visitors",
+		Help: "Number of clients tracked by the service rate limiter",
+	}, serviceLabels)
+	// Note: the breaker counts are reset whenever the breaker changes state or its interval elapses
+	pm.breakerRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: prefix + "_circuit_breaker_requests",
+		Help: "Requests counted by the service circuit breaker",
+	}, serviceLabels)
+	pm.breakerSuccesses = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: prefix + "_circuit_breaker_successes",
+		Help: "Successful requests counted by the service circuit breaker",
+	}, serviceLabels)
+	pm.breakerFailures = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: prefix + "_circuit_breaker_failures",
+		Help: "Failed requests counted by the service circuit breaker",
+	}, serviceLabels)
+	pm.breakerConsecutiveFails = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: prefix + "_circuit_breaker_consecutive_failures",
+		Help: "Consecutive failed requests counted by the service circuit breaker",
+	}, serviceLabels)
+	pm.webSocketConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: prefix + "_websocket_connections_active",
+		Help: "Upgraded e.g. websocket connections to the service currently open",
+	}, serviceLabels)
+	pm.cacheBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: prefix + "_cache_bytes",
+		Help: "Estimated bytes of the response bodies, including their gzip encoded variants, held in the service cache",
+	}, serviceLabels)
+	sizeBuckets := config.AppConfig.Server.Metrics.SizeBuckets
+	if len(sizeBuckets) == 0 {
+		sizeBuckets = DefaultSizeBuckets
+	}
+	pm.responseSizeBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    prefix + "_response_size_bytes",
+		Help:    "Histogram of the size of the response bodies of the service",
+		Buckets: sizeBuckets,
+	}, append(serviceLabels, "method", "status"))
+	pm.panicsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: prefix + "_panics_total",
+		Help: "Total panics recovered while handling requests",
+	})
+	pm.rateLimitEventsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: prefix + "_rate_limit_events_dropped_total",
+		Help: "Total rate limit events not written to the event log because it was falling behind",
+	})
+	pm.buckets = config.AppConfig.Server.Metrics.Buckets
+	pm.registry.MustRegister(
+		pm.httpTransactionTotal,
+		pm.httpResponseTimeHistogram,
+		pm.whitelistDeniedTotal,
+		pm.rateLimitedTotal,
+		pm.activeVisitors,
+		pm.breakerRequests,
+		pm.breakerSuccesses,
+		pm.breakerFailures,
+		pm.breakerConsecutiveFails,
+		pm.webSocketConnections,
+		pm.cacheBytes,
+		pm.responseSizeBytes,
+	)
+	// the panics and the rate limit events are of the whole gateway, not of a service
+	if pm.service == "" {
+		pm.registry.MustRegister(pm.panicsTotal, pm.rateLimitEventsDropped)
+	}
+	return pm
+}
+
+// Registry returns the registry the metrics are registered with
+func (pm *PromMetrics) Registry() *prometheus.Registry {
+	return pm.registry
+}
+
+// labels returns the values of the service label, none if the metrics are scoped to the service
+func (pm *PromMetrics) labels(service string) []string {
+	if pm.service != "" {
+		return nil
 	}
+	return []string{service}
 }
 
 func (pm *PromMetrics) ObserveResponseTime(input *MetricsInput, time float64) {
@@ -72,6 +219,78 @@ func (pm *PromMetrics) IncHttpTransaction(input *MetricsInput) {
 	pm.httpTransactionTotal.WithLabelValues(input.ToList()...).Inc()
 }
 
+func (pm *PromMetrics) IncWhitelistDenied(service string) {
+	pm.whitelistDeniedTotal.WithLabelValues(pm.labels(service)...).Inc()
+}
+
+func (pm *PromMetrics) IncRateLimited(service string) {
+	pm.rateLimitedTotal.WithLabelValues(pm.labels(service)...).Inc()
+}
+
+func (pm *PromMetrics) IncRateLimitEventsDropped() {
+	pm.rateLimitEventsDropped.Inc()
+}
+
+func (pm *PromMetrics) SetActiveVisitors(service string, count int) {
+	pm.activeVisitors.WithLabelValues(pm.labels(service)...).Set(float64(count))
+}
+
+// ActiveVisitors returns the gauge of the number of clients tracked by the service rate limiter
+func (pm *PromMetrics) ActiveVisitors(service string) prometheus.Gauge {
+	return pm.activeVisitors.WithLabelValues(pm.labels(service)...)
+}
+
+// DeleteActiveVisitors removes the series of a deregistered service
+func (pm *PromMetrics) DeleteActiveVisitors(service string) {
+	pm.activeVisitors.DeleteLabelValues(pm.labels(service)...)
+}
+
+// SetCircuitBreakerCounts samples the counts of the service circuit breaker
+func (pm *PromMetrics) SetCircuitBreakerCounts(service string, requests, successes, failures, consecutiveFailures uint32) {
+	pm.breakerRequests.WithLabelValues(pm.labels(service)...).Set(float64(requests))
+	pm.breakerSuccesses.WithLabelValues(pm.labels(service)...).Set(float64(successes))
+	pm.breakerFailures.WithLabelValues(pm.labels(service)...).Set(float64(failures))
+	pm.breakerConsecutiveFails.WithLabelValues(pm.labels(service)...).Set(float64(consecutiveFailures))
+}
+
+// DeleteCircuitBreakerCounts removes the series of a deregistered service
+func (pm *PromMetrics) DeleteCircuitBreakerCounts(service string) {
+	pm.breakerRequests.DeleteLabelValues(pm.labels(service)...)
+	pm.breakerSuccesses.DeleteLabelValues(pm.labels(service)...)
+	pm.breakerFailures.DeleteLabelValues(pm.labels(service)...)
+	pm.breakerConsecutiveFails.DeleteLabelValues(pm.labels(service)...)
+}
+
+// IncWebSocketConnections counts an upgraded connection to the service as open
+func (pm *PromMetrics) IncWebSocketConnections(service string) {
+	pm.webSocketConnections.WithLabelValues(pm.labels(service)...).Inc()
+}
+
+// DecWebSocketConnections counts an upgraded connection to the service as closed
+func (pm *PromMetrics) DecWebSocketConnections(service string) {
+	pm.webSocketConnections.WithLabelValues(pm.labels(service)...).Dec()
+}
+
+// SetCacheBytes samples the bytes held in the service cache
+func (pm *PromMetrics) SetCacheBytes(service string, size int64) {
+	pm.cacheBytes.WithLabelValues(pm.labels(service)...).Set(float64(size))
+}
+
+// DeleteCacheBytes removes the series of a deregistered service
+func (pm *PromMetrics) DeleteCacheBytes(service string) {
+	pm.cacheBytes.DeleteLabelValues(pm.labels(service)...)
+}
+
+// ObserveResponseSize records the size of a response body of the service
+func (pm *PromMetrics) ObserveResponseSize(service string, method string, status int, size int64) {
+	labels := append(pm.labels(service), method, strconv.Itoa(status))
+	pm.responseSizeBytes.WithLabelValues(labels...).Observe(float64(size))
+}
+
+func (pm *PromMetrics) IncPanics() {
+	pm.panicsTotal.Inc()
+}
+
 // Collect collects the ResponseTime and HttpTransaction observability
 func (pm *PromMetrics) Collect(input *MetricsInput, t time.Time) {
 	elapsed := time.Since(t).Seconds()
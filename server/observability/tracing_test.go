@@ -1,20 +1,26 @@
 package observability
 
 import (
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/ArmaanKatyal/go-api-gateway/server/config"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestTracingToList(t *testing.T) {
 	m := MetricsInput{
-		Code:   "test-code",
-		Method: "test-method",
-		Route:  "test-route",
+		Code:    "test-code",
+		Method:  "test-method",
+		Route:   "test-route",
+		Service: "test-service",
 	}
 	assert.Equal(t, []string{"test-code", "test-method", "test-route"}, m.ToList())
+	assert.Equal(t, []string{"Code", "Method", "Route"}, getLabels())
 }
 
 func TestTracingNewPromMetrics(t *testing.T) {
@@ -25,6 +31,108 @@ func TestTracingNewPromMetrics(t *testing.T) {
 	})
 }
 
+func TestTracingIsolatedRegistries(t *testing.T) {
+	defer func(c config.Conf) { config.AppConfig = c }(config.AppConfig)
+	config.AppConfig.Server.Metrics.Prefix = "isolated"
+	metrics := make([]*PromMetrics, 2)
+	var wg sync.WaitGroup
+	for i := range metrics {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// the same names are registered twice without panicking
+			metrics[i] = NewPromMetrics()
+		}()
+	}
+	wg.Wait()
+
+	metrics[0].IncPanics()
+	metrics[0].IncPanics()
+	metrics[1].IncPanics()
+	for i, want := range []float64{2, 1} {
+		families, err := metrics[i].Registry().Gather()
+		assert.Nil(t, err)
+		got := -1.0
+		for _, f := range families {
+			if f.GetName() == "isolated_panics_total" {
+				got = f.GetMetric()[0].GetCounter().GetValue()
+			}
+		}
+		assert.Equal(t, want, got)
+	}
+}
+
 func TestTracingGetLabels(t *testing.T) {
 	assert.Equal(t, []string{"Code", "Method", "Route"}, getLabels())
 }
+
+func TestTracingForService(t *testing.T) {
+	defer func(c config.Conf) { config.AppConfig = c }(config.AppConfig)
+	config.AppConfig.Server.Metrics.Prefix = "scoped"
+	registry := prometheus.NewRegistry()
+	orders := NewPromMetrics(ForService("orders", registry))
+	assert.Equal(t, "scoped_orders", orders.prefix)
+	// the scoped metrics have no service label
+	orders.IncRateLimited("orders")
+	orders.SetCircuitBreakerCounts("orders", 3, 2, 1, 1)
+	orders.DeleteCircuitBreakerCounts("orders")
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	names := make([]string, 0, len(families))
+	for _, f := range families {
+		names = append(names, f.GetName())
+		if f.GetName() == "scoped_orders_rate_limited_requests_total" {
+			assert.Empty(t, f.GetMetric()[0].GetLabel())
+		}
+	}
+	assert.Contains(t, names, "scoped_orders_rate_limited_requests_total")
+	assert.NotContains(t, names, "scoped_orders_circuit_breaker_requests")
+	assert.NotContains(t, names, "go_goroutines")
+
+	assert.Equal(t, "scoped_payment_api", NewPromMetrics(ForService("payment-api", prometheus.NewRegistry())).prefix)
+}
+
+func TestTracingResponseSize(t *testing.T) {
+	defer func(c config.Conf) { config.AppConfig = c }(config.AppConfig)
+	config.AppConfig.Server.Metrics.Prefix = "sizes"
+	config.AppConfig.Server.Metrics.SizeBuckets = []float64{100, 1024, 10240}
+	pm := NewPromMetrics()
+	// one response per bucket
+	for _, size := range []int64{50, 500, 5000} {
+		pm.ObserveResponseSize("orders", "GET", 200, size)
+	}
+
+	expected := `
+# HELP sizes_response_size_bytes Histogram of the size of the response bodies of the service
+# TYPE sizes_response_size_bytes histogram
+sizes_response_size_bytes_bucket{method="GET",service="orders",status="200",le="100"} 1
+sizes_response_size_bytes_bucket{method="GET",service="orders",status="200",le="1024"} 2
+sizes_response_size_bytes_bucket{method="GET",service="orders",status="200",le="10240"} 3
+sizes_response_size_bytes_bucket{method="GET",service="orders",status="200",le="+Inf"} 3
+sizes_response_size_bytes_sum{method="GET",service="orders",status="200"} 5550
+sizes_response_size_bytes_count{method="GET",service="orders",status="200"} 3
+`
+	assert.Nil(t, testutil.CollectAndCompare(pm.responseSizeBytes, strings.NewReader(expected), "sizes_response_size_bytes"))
+
+	// the buckets default when they aren't configured
+	config.AppConfig.Server.Metrics.SizeBuckets = nil
+	config.AppConfig.Server.Metrics.Prefix = "default_sizes"
+	pm = NewPromMetrics()
+	pm.ObserveResponseSize("orders", "GET", 404, 2048)
+	assert.Equal(t, 1, testutil.CollectAndCount(pm.responseSizeBytes))
+	scoped := NewPromMetrics(ForService("orders", prometheus.NewRegistry()))
+	scoped.ObserveResponseSize("orders", "POST", 201, 10)
+	assert.Nil(t, testutil.CollectAndCompare(scoped.responseSizeBytes, strings.NewReader(`
+# HELP default_sizes_orders_response_size_bytes Histogram of the size of the response bodies of the service
+# TYPE default_sizes_orders_response_size_bytes histogram
+default_sizes_orders_response_size_bytes_bucket{method="POST",status="201",le="100"} 1
+default_sizes_orders_response_size_bytes_bucket{method="POST",status="201",le="1024"} 1
+default_sizes_orders_response_size_bytes_bucket{method="POST",status="201",le="10240"} 1
+default_sizes_orders_response_size_bytes_bucket{method="POST",status="201",le="102400"} 1
+default_sizes_orders_response_size_bytes_bucket{method="POST",status="201",le="1.048576e+06"} 1
+default_sizes_orders_response_size_bytes_bucket{method="POST",status="201",le="+Inf"} 1
+default_sizes_orders_response_size_bytes_sum{method="POST",status="201"} 10
+default_sizes_orders_response_size_bytes_count{method="POST",status="201"} 1
+`), "default_sizes_orders_response_size_bytes"))
+}
@@ -1,18 +1,30 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
-	"net"
+	"maps"
 	"net/http"
 	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ArmaanKatyal/go-api-gateway/server/auth"
 	"github.com/ArmaanKatyal/go-api-gateway/server/config"
 	"github.com/ArmaanKatyal/go-api-gateway/server/feature"
 	"github.com/ArmaanKatyal/go-api-gateway/server/observability"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type RegisterBody config.ServiceConf
@@ -21,23 +33,55 @@ type UpdateBody config.ServiceConf
 
 type RegisterResponse struct {
 	Message string `json:"message"`
+	HealthResponse
+}
+
+type UpdateResponse struct {
+	Message string `json:"message"`
+	HealthResponse
+}
+
+// HealthResponse is the result of the health check made on register or update, empty if none was made
+type HealthResponse struct {
+	Health string `json:"health,omitempty"`
+	Error  string `json:"error,omitempty"`
 }
 
 type ResponseBody struct {
 	Message string `json:"message"`
 }
 
+// LabelRouteBody routes the requests to the path prefix Service to the services matching Selector
+type LabelRouteBody struct {
+	Service  string            `json:"service"`
+	Selector map[string]string `json:"selector"`
+}
+
 type DeregisterBody struct {
 	Name string `json:"name"`
 }
 
+// PatchBody is the name of the service to patch, the rest of the body is a partial ServiceConf
+type PatchBody struct {
+	Name string `json:"name"`
+}
+
+type ReloadAuthBody struct {
+	Name string `json:"name"`
+}
+
 type DeregisterResponse struct {
 	Message string `json:"message"`
 }
 
+type RenewResponse struct {
+	Token string `json:"token"`
+}
+
 // IAuth Interface for authenticating requests
 type IAuth interface {
-	Authenticate(*http.Request) auth.JwtError
+	AuthenticateRoute(*http.Request, string) auth.JwtError
+	Renew(string) (string, error)
 	IsEnabled() bool
 }
 
@@ -45,7 +89,12 @@ type IAuth interface {
 type ICircuitBreaker interface {
 	Execute(string, func() ([]byte, error)) ([]byte, error)
 	IsOpen() bool
+	State() string
+	Counts() feature.CircuitCounts
 	IsEnabled() bool
+	RequestTimeout() time.Duration
+	Snapshot() feature.CircuitState
+	StateFile() string
 }
 
 // IWhitelist Interface for handling IP whitelist
@@ -57,12 +106,43 @@ type IWhitelist interface {
 
 type IRateLimiter interface {
 	GetVisitor(ip string) *feature.Visitor
+	Allow(ctx context.Context, ip string) bool
+	VisitorCount() int
+	OnVisitorsChange(func(int))
+	IsEnabled() bool
+	State() feature.RateLimiterState
+	Stop()
+}
+
+// IMock Interface for serving mocked responses
+type IMock interface {
+	Match(method string, route string) (*feature.MockResponse, bool)
 	IsEnabled() bool
 }
 
+// IRouter Interface for routing requests to a different address based on the headers
+type IRouter interface {
+	Match(http.Header) (string, bool)
+}
+
+// IRetryBudget Interface for limiting the retries to a service
+type IRetryBudget interface {
+	Allow() bool
+}
+
+// IPicker Interface for selecting the address among weighted backends
+type IPicker interface {
+	Pick() (string, bool)
+	PickKey(string) (string, bool)
+}
+
 type HealthCheck struct {
-	Enabled bool   `json:"enabled"`
-	Uri     string `json:"uri"`
+	Enabled             bool   `json:"enabled"`
+	Uri                 string `json:"uri"`
+	Method              string `json:"method"`
+	Body                string `json:"body"`
+	ContentType         string `json:"contentType"`
+	SuccessBodyContains string `json:"successBodyContains"`
 }
 
 func (h *HealthCheck) IsEnabled() bool {
@@ -74,86 +154,720 @@ func (h *HealthCheck) GetUri() string {
 }
 
 func NewHealthCheck(conf *config.HealthCheckSettings) HealthCheck {
-	return HealthCheck{
-		Enabled: conf.Enabled,
-		Uri:     conf.Uri,
+	h := HealthCheck{
+		Enabled:             conf.Enabled,
+		Uri:                 conf.Uri,
+		Method:              strings.ToUpper(conf.Method),
+		Body:                conf.Body,
+		ContentType:         conf.ContentType,
+		SuccessBodyContains: conf.SuccessBodyContains,
+	}
+	if h.Method == "" {
+		h.Method = http.MethodGet
+	}
+	return h
+}
+
+// NewRequest builds the health check request against the base url of the service
+func (h *HealthCheck) NewRequest(base string) (*http.Request, error) {
+	var body io.Reader
+	if h.Body != "" {
+		body = strings.NewReader(h.Body)
+	}
+	req, err := http.NewRequest(h.Method, base+h.GetUri(), body)
+	if err != nil {
+		return nil, err
+	}
+	if h.ContentType != "" {
+		req.Header.Set("Content-Type", h.ContentType)
+	}
+	return req, nil
+}
+
+const (
+	HealthHealthy     = "healthy"
+	HealthUnhealthy   = "unhealthy"
+	HealthUnreachable = "unreachable"
+)
+
+// HealthCheckTimeout bounds a single health check of a service
+const HealthCheckTimeout = 5 * time.Second
+
+// CheckHealth requests the health uri of the service with its own transport, the error
+// describes why the service is unhealthy or unreachable
+func (s *Service) CheckHealth() (string, error) {
+	client := &http.Client{Transport: s.Transport, Timeout: HealthCheckTimeout}
+	req, err := s.Health.NewRequest(withScheme(s.Scheme, s.Addr))
+	if err != nil {
+		return HealthUnreachable, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return HealthUnreachable, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return HealthUnhealthy, fmt.Errorf("health check returned status %d", resp.StatusCode)
+	}
+	if s.Health.SuccessBodyContains != "" {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return HealthUnhealthy, err
+		}
+		if !strings.Contains(string(body), s.Health.SuccessBodyContains) {
+			return HealthUnhealthy, fmt.Errorf("health check response doesn't contain %q", s.Health.SuccessBodyContains)
+		}
+	}
+	return HealthHealthy, nil
+}
+
+// checkOnRegister checks the health of a registered or updated service if Registry.CheckOnRegister is set
+func checkOnRegister(name string, s *Service) HealthResponse {
+	if !config.AppConfig.Registry.CheckOnRegister || !s.Health.IsEnabled() {
+		return HealthResponse{}
 	}
+	health, err := s.CheckHealth()
+	if err != nil {
+		slog.Warn("Service failed its initial health check", "name", name, "address", s.Addr, "health", health, "error", err.Error())
+		return HealthResponse{Health: health, Error: err.Error()}
+	}
+	return HealthResponse{Health: health}
 }
 
 type Service struct {
-	Addr           string          `json:"addr"`
-	FallbackUri    string          `json:"fallbackUri"`
-	Health         HealthCheck     `json:"health"`
-	IPWhiteList    IWhitelist      `json:"ipWhitelist"`
-	CircuitBreaker ICircuitBreaker `json:"circuitBreaker"`
-	Auth           IAuth           `json:"auth"`
-	Cache          Cacher          `json:"cache"`
-	RateLimiter    IRateLimiter    `json:"rateLimiter"`
-	mu             sync.Mutex
+	Addr                  string            `json:"addr"`
+	Scheme                string            `json:"scheme"`
+	Labels                map[string]string `json:"labels"`
+	Group                 string            `json:"group"`
+	Tags                  []string          `json:"tags"`
+	FallbackUris          []string          `json:"fallbackUris"`
+	Health                HealthCheck       `json:"health"`
+	IPWhiteList           IWhitelist        `json:"ipWhitelist"`
+	CircuitBreaker        ICircuitBreaker   `json:"circuitBreaker"`
+	Auth                  IAuth             `json:"auth"`
+	Cache                 Cacher            `json:"cache"`
+	RateLimiter           IRateLimiter      `json:"rateLimiter"`
+	Transport             http.RoundTripper `json:"-"`
+	Mock                  IMock             `json:"mock"`
+	Router                IRouter           `json:"router"`
+	Backends              IPicker           `json:"backends"`
+	DecompressRequest     bool              `json:"decompressRequest"`
+	MaxDecompressedSize   int64             `json:"maxDecompressedSize"`
+	WriteTimeout          time.Duration     `json:"writeTimeout"`
+	MaxConcurrentRequests int               `json:"maxConcurrentRequests"`
+	ResponseHeaders       map[string]string `json:"responseHeaders"`
+	IgnoreQueryInRoute    bool              `json:"ignoreQueryInRoute"`
+	Retries               int               `json:"retries"`
+	RetryBudget           IRetryBudget      `json:"retryBudget"`
+	StickyCookie          string            `json:"stickyCookie"`
+	HTTPMethodOverride    bool              `json:"httpMethodOverride"`
+	ForwardTrailers       bool              `json:"forwardTrailers"`
+	UpstreamPathPrefix    string            `json:"upstreamPathPrefix"`
+	ForwardedHeaders      string            `json:"forwardedHeaders"`
+	PathPattern           string            `json:"pathPattern"`
+	MaxWebSockets         int               `json:"maxWebSocketConnections"`
+	// the maximum size of the request headers, the headers added by the gateway over it are
+	// dropped. Unlimited if 0
+	MaxHeaderBytes int `json:"maxHeaderBytes"`
+	// picks the requests whose info logs are written
+	LogSampler *feature.LogSampler `json:"logSampler"`
+	// sampling of the access log, the successful requests are all logged unless it is sampled
+	AccessLog config.AccessLogSettings `json:"accessLog"`
+	// range of the number of segments of the paths forwarded, unbounded if zero
+	PathDepth config.PathDepthSettings `json:"pathDepth"`
+	// timeout of the requests to the service, overridden per method and per endpoint
+	Timeouts *feature.EndpointTimeouts `json:"timeouts"`
+	// failed attempts retried up to Retries times
+	RetryPolicy *feature.RetryPolicy `json:"retryPolicy"`
+	// reaction to the auth failures of the service, nil if disabled
+	AuthFailure *feature.AuthFailurePolicy `json:"authFailure"`
+	// logs the request and response bodies, nil if disabled
+	DebugBodies *feature.BodyLogger `json:"debugLogBodies"`
+	// request headers forwarded to the service, nil if all of them are
+	HeaderAllowList *feature.HeaderAllowList `json:"headerAllowList"`
+	mu              sync.Mutex
+	// semaphore limiting the concurrent requests, nil if unlimited
+	sem chan struct{}
+	// semaphore limiting the upgraded connections, nil if unlimited
+	upgradeSem chan struct{}
+	// number of requests currently being handled
+	inFlight atomic.Int64
+	// compiled PathPattern, nil if the service is only routed by its name
+	pattern *feature.PathPattern
+	// configuration the service was created from, the secret is read again from its auth
+	// settings on reload and partial updates are merged into it
+	conf config.ServiceConf
+	// result and time of the last health check by the heartbeat, guarded by mu
+	health          string
+	healthCheckedAt time.Time
+	// metrics of the service in a registry of its own, nil if they are labelled in the gateway metrics
+	metrics *observability.PromMetrics
 }
 
-func (s *Service) IsRateLimiterEnabled() bool {
-	return s.RateLimiter.IsEnabled()
+// FallbackTimeout bounds the wait for the response of a single fallback of a service
+const FallbackTimeout = time.Second
+
+// DefaultScheme is used to reach a service whose address has no scheme when it doesn't configure one
+const DefaultScheme = "http"
+
+// DefaultWriteTimeout is the time allowed to write a response when the service doesn't configure one
+const DefaultWriteTimeout = 5 * time.Second
+
+// serviceWriteTimeout converts the configured write timeout, a negative timeout disables it
+func serviceWriteTimeout(secs int) time.Duration {
+	switch {
+	case secs == 0:
+		return DefaultWriteTimeout
+	case secs < 0:
+		return -1
+	default:
+		return time.Duration(secs) * time.Second
+	}
+}
+
+// newSemaphore creates the semaphore limiting the concurrent requests, nil if size is not positive
+func newSemaphore(size int) chan struct{} {
+	if size <= 0 {
+		return nil
+	}
+	return make(chan struct{}, size)
 }
 
-func (s *Service) RateLimitIP(ip string) bool {
-	ip, _, err := net.SplitHostPort(ip)
+// NewService creates a service from its configuration
+// Note: new fields for service in the config must be added here
+func NewService(conf *config.ServiceConf) (*Service, error) {
+	router, err := feature.NewHeaderRouter(conf.MatchRules)
 	if err != nil {
+		return nil, err
+	}
+	timeouts, err := feature.NewEndpointTimeouts(conf.TimeoutSeconds, conf.EndpointTimeouts, conf.MethodTimeouts)
+	if err != nil {
+		return nil, err
+	}
+	var pattern *feature.PathPattern
+	if conf.PathPattern != "" {
+		if pattern, err = feature.NewPathPattern(conf.PathPattern); err != nil {
+			return nil, err
+		}
+	}
+	w := feature.NewIPWhiteList()
+	feature.PopulateIPWhiteList(w, conf.WhiteList)
+	file, err := os.Open(conf.Auth.Secret)
+	if err != nil {
+		slog.Error("failed to open secret file", "service", conf.Name, "path", conf.Auth.Secret)
+	} else {
+		defer file.Close()
+	}
+	scheme := conf.Scheme
+	if scheme == "" {
+		scheme = DefaultScheme
+	}
+	maxHeaderBytes := conf.MaxHeaderBytes
+	if maxHeaderBytes == 0 {
+		maxHeaderBytes = config.AppConfig.Server.MaxHeaderBytes
+	}
+	normalized := normalizeConf(*conf)
+	return &Service{
+		Addr:                  conf.Addr,
+		Scheme:                scheme,
+		Labels:                conf.Labels,
+		Group:                 conf.Group,
+		Tags:                  conf.Tags,
+		FallbackUris:          normalized.FallbackUris,
+		Health:                NewHealthCheck(&conf.Health),
+		IPWhiteList:           w,
+		CircuitBreaker:        feature.NewCircuitBreaker(conf.Name, conf.CircuitBreaker),
+		Auth:                  auth.NewJwtAuth(&conf.Auth, file),
+		Cache:                 feature.NewCacheHandler(&conf.Cache),
+		RateLimiter:           feature.NewServiceRateLimiter(&conf.RateLimiter),
+		Transport:             feature.NewUpstreamTransport(&conf.UpstreamTLS, &conf.UpstreamTransport),
+		Mock:                  feature.NewMockHandler(&conf.Mock),
+		Router:                router,
+		Backends:              feature.NewCanaryPicker(conf.Addr, &conf.Canary),
+		DecompressRequest:     conf.DecompressRequest,
+		MaxDecompressedSize:   conf.MaxDecompressedSize,
+		WriteTimeout:          serviceWriteTimeout(conf.WriteTimeout),
+		MaxConcurrentRequests: conf.MaxConcurrentRequests,
+		ResponseHeaders:       conf.ResponseHeaders.Add,
+		IgnoreQueryInRoute:    conf.IgnoreQueryInRoute,
+		Retries:               conf.Retries,
+		RetryBudget:           feature.NewServiceRetryBudget(&conf.RetryBudget),
+		RetryPolicy:           feature.NewRetryPolicy(&conf.RetryPolicy),
+		StickyCookie:          conf.StickyCookie,
+		HTTPMethodOverride:    conf.HTTPMethodOverride,
+		ForwardTrailers:       conf.ForwardTrailers,
+		UpstreamPathPrefix:    conf.UpstreamPathPrefix,
+		ForwardedHeaders:      conf.ForwardedHeaders,
+		PathPattern:           conf.PathPattern,
+		MaxWebSockets:         conf.MaxWebSocketConnections,
+		MaxHeaderBytes:        maxHeaderBytes,
+		LogSampler:            feature.NewLogSampler(conf.LogSampleRate),
+		AccessLog:             conf.AccessLog,
+		PathDepth:             conf.PathDepthRouting,
+		Timeouts:              timeouts,
+		AuthFailure:           feature.NewAuthFailurePolicy(&conf.AuthFailure),
+		DebugBodies:           feature.NewBodyLogger(&conf.DebugLogBodies),
+		HeaderAllowList:       feature.NewHeaderAllowList(&conf.ForwardHeaders),
+		sem:                   newSemaphore(conf.MaxConcurrentRequests),
+		upgradeSem:            newSemaphore(conf.MaxWebSocketConnections),
+		pattern:               pattern,
+		conf:                  normalized,
+		metrics:               newServiceMetrics(conf),
+	}, nil
+}
+
+// newServiceMetrics creates the metrics of a service using a namespace of its own, nil otherwise
+// normalizeConf returns the configuration a service keeps, with a single list of fallbacks so
+// patching the fallbacks replaces them
+func normalizeConf(conf config.ServiceConf) config.ServiceConf {
+	conf.FallbackUris, conf.FallbackUri = conf.Fallbacks(), ""
+	return conf
+}
+
+// configuredBy reports whether the service was created from the configuration
+func (s *Service) configuredBy(conf config.ServiceConf) bool {
+	return reflect.DeepEqual(s.conf, normalizeConf(conf))
+}
+
+func newServiceMetrics(conf *config.ServiceConf) *observability.PromMetrics {
+	if !conf.Metrics.PerServiceNamespace {
+		return nil
+	}
+	return observability.NewPromMetrics(observability.ForService(conf.Name, prometheus.NewRegistry()))
+}
+
+// AcceptsDepth reports whether a request path with depth segments is forwarded to the service
+func (s *Service) AcceptsDepth(depth int) bool {
+	if depth < s.PathDepth.MinDepth {
 		return false
 	}
-	v := s.RateLimiter.GetVisitor(ip)
-	return v.Limiter.Allow()
+	return s.PathDepth.MaxDepth == 0 || depth <= s.PathDepth.MaxDepth
 }
 
-func (s *Service) IsWhitelisted(addr string) (bool, error) {
-	ip, _, err := net.SplitHostPort(addr)
-	if err != nil {
-		return false, err
+// tryAcquire reserves a slot for a request without blocking, it returns false if the
+// service is already handling MaxConcurrentRequests requests
+func (s *Service) tryAcquire() bool {
+	if s.sem == nil {
+		return true
+	}
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	default:
+		return false
 	}
-	return s.IPWhiteList.Allowed(ip), nil
 }
 
-func (s *Service) GetFallbackUri() string {
-	return s.FallbackUri
+// release frees the slot reserved by tryAcquire
+func (s *Service) release() {
+	if s.sem != nil {
+		<-s.sem
+	}
+}
+
+// tryAcquireUpgrade reserves a slot for an upgraded connection without blocking, it returns
+// false if the service already has MaxWebSockets open
+func (s *Service) tryAcquireUpgrade() bool {
+	if s.upgradeSem == nil {
+		return true
+	}
+	select {
+	case s.upgradeSem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseUpgrade frees the slot reserved by tryAcquireUpgrade
+func (s *Service) releaseUpgrade() {
+	if s.upgradeSem != nil {
+		<-s.upgradeSem
+	}
 }
 
-func (s *Service) Authenticate(r *http.Request) error {
-	return s.Auth.Authenticate(r)
+// InFlight returns the number of requests to the service currently being handled
+func (s *Service) InFlight() int64 {
+	return s.inFlight.Load()
+}
+
+func (s *Service) IsRateLimiterEnabled() bool {
+	return s.RateLimiter.IsEnabled()
+}
+
+// RateLimitIP checks the rate limit of the client ip, waiting for its turn if the limiter queues
+// the requests over the limit
+func (s *Service) RateLimitIP(ctx context.Context, ip string) bool {
+	return s.RateLimiter.Allow(ctx, feature.NormalizeIP(ip))
+}
+
+func (s *Service) IsWhitelisted(ip string) bool {
+	return s.IPWhiteList.Allowed(ip)
+}
+
+func (s *Service) GetFallbackUris() []string {
+	return s.FallbackUris
+}
+
+// Authenticate authenticates the request if the route it resolved to requires it
+func (s *Service) Authenticate(r *http.Request, route []string) error {
+	return s.getAuth().AuthenticateRoute(r, "/"+strings.Join(route, "/"))
+}
+
+// serviceFields are the fields of a service, without its MarshalJSON
+type serviceFields Service
+
+// serviceJSON is the serialized service, with its rates when returned by the registry
+type serviceJSON struct {
+	*serviceFields
+	Stats *observability.ServiceRate `json:"stats,omitempty"`
+}
+
+func (s *Service) MarshalJSON() ([]byte, error) {
+	return s.marshal(nil)
+}
+
+// marshal serializes the service with its rates under its lock, as ReloadAuth may replace the
+// auth meanwhile
+func (s *Service) marshal(rate *observability.ServiceRate) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Marshal(serviceJSON{serviceFields: (*serviceFields)(s), Stats: rate})
+}
+
+func (s *Service) getAuth() IAuth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Auth
+}
+
+// ReloadAuth reads the secret file again and replaces the auth of the service, the
+// current auth is kept if the file can't be opened
+func (s *Service) ReloadAuth() error {
+	file, err := os.Open(s.conf.Auth.Secret)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	ja := auth.NewJwtAuth(&s.conf.Auth, file)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Auth = ja
+	return nil
 }
 
 type ServiceRegistry struct {
 	mu       sync.RWMutex
 	Metrics  *observability.PromMetrics
 	Services map[string]*Service `json:"services"`
+	// rolling request and error counts of the services, returned with them
+	Stats *observability.ServiceStats
+	// services selected by labels for a path prefix, they take precedence over the service
+	// registered with the prefix as name
+	labelRoutes map[string]*feature.WeightedPicker
+	// closed by Stop to end the background loops
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// keepMetrics carries the metrics of a replaced service over to the service replacing it, so
+// its counters and the registry served at /services/{name}/metrics survive the update
+func keepMetrics(current *Service, updated *Service) {
+	if current != nil && current.metrics != nil && updated.metrics != nil {
+		updated.metrics = current.metrics
+	}
+}
+
+// metricsFor returns the metrics of the service, the gateway metrics unless it has a namespace of its own
+func (sr *ServiceRegistry) metricsFor(name string) *observability.PromMetrics {
+	if s := sr.GetService(name); s != nil && s.metrics != nil {
+		return s.metrics
+	}
+	return sr.Metrics
 }
 
 // Register registers a service with the registry
-func (sr *ServiceRegistry) Register(name string, s *Service) {
+func (sr *ServiceRegistry) Register(name string, s *Service) error {
 	slog.Info("Registering service", "name", name, "address", s.Addr)
 	sr.mu.Lock()
 	defer sr.mu.Unlock()
 	if _, ok := sr.Services[name]; ok {
 		slog.Error("service already exists", "name", name)
+		return ErrServiceAlreadyExists
+	}
+	if sr.addressInUse(name, s.Addr) {
+		slog.Error("service address already registered", "name", name, "address", s.Addr)
+		return ErrDuplicateAddress
 	}
 	sr.Services[name] = s
+	sr.observeVisitors(name, s)
+	sr.observeCacheSize(name, s)
+	return nil
+}
+
+// RegisterOrUpdate registers the service or overwrites it if it already exists
+func (sr *ServiceRegistry) RegisterOrUpdate(name string, s *Service) {
+	slog.Info("Registering or updating service", "name", name, "address", s.Addr)
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	keepMetrics(sr.Services[name], s)
+	retire(sr.Services[name])
+	sr.Services[name] = s
+	sr.observeVisitors(name, s)
+	sr.observeCacheSize(name, s)
 }
 
 // Update updates a service in the registry
-func (sr *ServiceRegistry) Update(name string, updated *Service) {
+func (sr *ServiceRegistry) Update(name string, updated *Service) error {
 	slog.Info("Updating registered service", "name", name)
 	sr.mu.Lock()
 	defer sr.mu.Unlock()
-	if _, ok := sr.Services[name]; ok {
+	if sr.addressInUse(name, updated.Addr) {
+		slog.Error("service address already registered", "name", name, "address", updated.Addr)
+		return ErrDuplicateAddress
+	}
+	if current, ok := sr.Services[name]; ok {
+		keepMetrics(current, updated)
+		retire(current)
 		sr.Services[name] = updated
+		sr.observeVisitors(name, updated)
+		sr.observeCacheSize(name, updated)
+	}
+	return nil
+}
+
+// Patch merges the partial configuration, a JSON encoded ServiceConf, into the configuration
+// of the service and replaces it. Only the fields present in the patch are changed, nested
+// settings are merged field by field. The service lock serializes concurrent patches.
+func (sr *ServiceRegistry) Patch(name string, patch []byte) (*Service, error) {
+	for {
+		s := sr.GetService(name)
+		if s == nil {
+			return nil, ErrServiceNotFound
+		}
+		s.mu.Lock()
+		// the service was replaced while waiting for the lock, merge into the new one
+		if sr.GetService(name) != s {
+			s.mu.Unlock()
+			continue
+		}
+		updated, err := sr.patch(name, s, patch)
+		s.mu.Unlock()
+		return updated, err
 	}
 }
 
+// patch merges and replaces the service, s.mu must be held
+func (sr *ServiceRegistry) patch(name string, s *Service, patch []byte) (*Service, error) {
+	// round trip the configuration so the patch can't modify the maps and slices of the current one
+	current, err := json.Marshal(s.conf)
+	if err != nil {
+		return nil, err
+	}
+	var conf config.ServiceConf
+	if err := json.Unmarshal(current, &conf); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &conf); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPatch, err)
+	}
+	conf.Name = name
+	conf, err = config.AppConfig.ApplyTemplate(conf)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPatch, err)
+	}
+	if err := config.Validate.Struct(conf); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPatch, err)
+	}
+	updated, err := NewService(&conf)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPatch, err)
+	}
+	if err := sr.Update(name, updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// observeVisitors reports the number of visitors of the service rate limiter until the service
+// is replaced or deregistered. sr.mu must be held.
+func (sr *ServiceRegistry) observeVisitors(name string, s *Service) {
+	if sr.Metrics == nil || s.RateLimiter == nil {
+		return
+	}
+	// the hook is called under the limiter lock, it can't take sr.mu
+	metrics := sr.Metrics
+	if s.metrics != nil {
+		metrics = s.metrics
+	}
+	s.RateLimiter.OnVisitorsChange(func(count int) {
+		metrics.SetActiveVisitors(name, count)
+	})
+}
+
+// retire stops the reports and the visitor cleanup of a replaced or deregistered service, nil
+// is ignored
+func retire(s *Service) {
+	if s != nil && s.RateLimiter != nil {
+		s.RateLimiter.OnVisitorsChange(nil)
+		s.RateLimiter.Stop()
+	}
+}
+
+// observeCacheSize reports the bytes held in the service cache, a replaced service stops
+// reporting. sr.mu must be held.
+func (sr *ServiceRegistry) observeCacheSize(name string, s *Service) {
+	if sr.Metrics == nil || s.Cache == nil || !s.Cache.IsEnabled() {
+		return
+	}
+	// the replaced service may have reported its own size, sr.metricsFor would take sr.mu
+	metrics := sr.Metrics
+	if s.metrics != nil {
+		metrics = s.metrics
+	}
+	metrics.SetCacheBytes(name, s.Cache.Size())
+	s.Cache.OnSizeChange(func(size int64) {
+		if sr.GetService(name) == s {
+			sr.metricsFor(name).SetCacheBytes(name, size)
+		}
+	})
+}
+
+// addressInUse checks if a service other than name is registered with the address,
+// it is only enforced when Registry.EnforceUniqueAddresses is set. sr.mu must be held.
+func (sr *ServiceRegistry) addressInUse(name string, addr string) bool {
+	if !config.AppConfig.Registry.EnforceUniqueAddresses {
+		return false
+	}
+	for n, s := range sr.Services {
+		if n != name && s.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
 // Deregister removes a service from the registry
 func (sr *ServiceRegistry) Deregister(name string) {
 	slog.Info("Unregistering service", "name", name)
 	sr.mu.Lock()
 	defer sr.mu.Unlock()
+	retire(sr.Services[name])
 	delete(sr.Services, name)
+	// the label routes don't pick the service anymore, the ones left without a service are removed
+	for prefix, picker := range sr.labelRoutes {
+		picker.Remove(name)
+		if _, ok := picker.Pick(); !ok {
+			delete(sr.labelRoutes, prefix)
+		}
+	}
+	if sr.Metrics != nil {
+		sr.Metrics.DeleteActiveVisitors(name)
+		sr.Metrics.DeleteCircuitBreakerCounts(name)
+		sr.Metrics.DeleteCacheBytes(name)
+	}
+}
+
+// RouteByLabels atomically routes the requests to the prefix to the services matching every
+// label of the selector, the requests are spread evenly if several services match. The
+// services not selected stay registered. It returns the names of the selected services.
+func (sr *ServiceRegistry) RouteByLabels(prefix string, selector map[string]string) ([]string, error) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	picker := feature.NewWeightedPicker()
+	var selected []string
+	for name, s := range sr.Services {
+		if matchLabels(s.Labels, selector) {
+			picker.Set(name, 1)
+			selected = append(selected, name)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, ErrServiceNotFound
+	}
+	if sr.labelRoutes == nil {
+		sr.labelRoutes = make(map[string]*feature.WeightedPicker)
+	}
+	sr.labelRoutes[prefix] = picker
+	sort.Strings(selected)
+	return selected, nil
+}
+
+// InGroup checks if the service is in the group and has every tag, an empty group matches
+// every service
+func (s *Service) InGroup(group string, tags []string) bool {
+	if group != "" && s.Group != group {
+		return false
+	}
+	for _, tag := range tags {
+		if !slices.Contains(s.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchLabels checks if the labels have every key and value of the selector
+func matchLabels(labels map[string]string, selector map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveName returns the name of the service handling the requests to the path prefix
+func (sr *ServiceRegistry) ResolveName(prefix string) string {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	if picker, ok := sr.labelRoutes[prefix]; ok {
+		if name, ok := picker.Pick(); ok {
+			return name
+		}
+	}
+	return prefix
+}
+
+// MatchService returns the service named after the first segment of the path or else the
+// service whose path pattern matches it, preferring the most literal segments, and the route
+// path to forward
+func MatchService(urlPath string, services map[string]*Service) (*Service, string) {
+	parts := strings.SplitN(strings.TrimPrefix(urlPath, "/"), "/", 2)
+	if s, ok := services[parts[0]]; ok {
+		if len(parts) < 2 {
+			return s, ""
+		}
+		return s, "/" + parts[1]
+	}
+	var matched *Service
+	var route, name string
+	for n, s := range services {
+		if s.pattern == nil {
+			continue
+		}
+		suffix, ok := s.pattern.Match(urlPath)
+		if !ok {
+			continue
+		}
+		// the most specific pattern wins, ties are broken by name so the result is stable
+		if matched == nil || s.pattern.Literal() > matched.pattern.Literal() ||
+			(s.pattern.Literal() == matched.pattern.Literal() && n < name) {
+			matched, route, name = s, suffix, n
+		}
+	}
+	return matched, route
+}
+
+// MatchPattern returns the name of the service whose path pattern matches the path and the route to forward
+func (sr *ServiceRegistry) MatchPattern(urlPath string) (string, string, bool) {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	s, route := MatchService(urlPath, sr.Services)
+	if s == nil {
+		return "", "", false
+	}
+	return s.conf.Name, route, true
 }
 
 // GetAddress returns the address of the service with the given name
@@ -175,43 +889,84 @@ func (sr *ServiceRegistry) GetService(name string) *Service {
 	return nil
 }
 
-// GetFallbackUri returns the fallback uri of the service with the given name
-func (sr *ServiceRegistry) GetFallbackUri(name string) string {
+// GetFallbackUris returns the fallback uris of the service with the given name in the order they are tried
+func (sr *ServiceRegistry) GetFallbackUris(name string) []string {
+	s := sr.GetService(name)
+	if s == nil {
+		return nil
+	}
+	return s.FallbackUris
+}
+
+// GetScheme returns the scheme used to reach the service with the given name
+func (sr *ServiceRegistry) GetScheme(name string) string {
+	s := sr.GetService(name)
+	if s == nil {
+		return DefaultScheme
+	}
+	return s.Scheme
+}
+
+// GetUpstreamPathPrefix returns the prefix of the upstream paths of the service with the given name
+func (sr *ServiceRegistry) GetUpstreamPathPrefix(name string) string {
 	s := sr.GetService(name)
 	if s == nil {
 		return ""
 	}
-	return s.FallbackUri
+	return s.UpstreamPathPrefix
 }
 
 // populateRegistryServices populates the service registry with the services in the configuration
 func populateRegistryServices(sr *ServiceRegistry) {
 	slog.Info("Populating registry services")
 	for _, v := range config.AppConfig.Registry.Services {
-		w := feature.NewIPWhiteList()
-		feature.PopulateIPWhiteList(w, v.WhiteList)
-		// Note: new fields for service in the config must be added here
-		file, err := os.Open(v.Auth.Secret)
+		s, err := NewService(&v)
+		if err != nil {
+			slog.Error("Error creating service", "service", v.Name, "error", err.Error())
+			continue
+		}
+		sr.RegisterOrUpdate(v.Name, s)
+	}
+}
+
+// Reload registers or updates the services of the configuration file, services missing from the
+// file stay registered and the server settings only change on restart. The services whose
+// configuration didn't change are kept as they are, with their circuit, cache and rate limits
+func (sr *ServiceRegistry) Reload(path string) error {
+	slog.Info("Reloading registry services", "path", path)
+	services, err := config.ReloadConf(path)
+	if err != nil {
+		return err
+	}
+	for _, v := range services {
+		current := sr.GetService(v.Name)
+		if current != nil && current.configuredBy(v) {
+			continue
+		}
+		s, err := NewService(&v)
 		if err != nil {
-			slog.Error("failed to read service secret", "service", v.Name, "path", v.Auth.Secret)
+			slog.Error("Error creating service", "service", v.Name, "error", err.Error())
+			continue
 		}
-		sr.Services[v.Name] = &Service{
-			Addr:           v.Addr,
-			FallbackUri:    v.FallbackUri,
-			Health:         NewHealthCheck(&v.Health),
-			IPWhiteList:    w,
-			CircuitBreaker: feature.NewCircuitBreaker(v.Name, v.CircuitBreaker),
-			Auth:           auth.NewJwtAuth(&v.Auth, file),
-			Cache:          feature.NewCacheHandler(&v.Cache),
-			RateLimiter:    feature.NewServiceRateLimiter(&v.RateLimiter),
+		if current == nil {
+			err = sr.Register(v.Name, s)
+		} else {
+			err = sr.Update(v.Name, s)
+		}
+		if err != nil {
+			slog.Error("Error reloading service", "service", v.Name, "error", err.Error())
+			retire(s)
 		}
 	}
+	return nil
 }
 
 func NewServiceRegistry(metrics *observability.PromMetrics) *ServiceRegistry {
 	r := ServiceRegistry{
 		Services: make(map[string]*Service),
 		Metrics:  metrics,
+		Stats:    observability.NewServiceStats(),
+		stop:     make(chan struct{}),
 	}
 	populateRegistryServices(&r)
 	return &r
@@ -228,6 +983,14 @@ func (sr *ServiceRegistry) RegisterService(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	merged, err := config.AppConfig.ApplyTemplate(config.ServiceConf(rb))
+	if err != nil {
+		slog.Error("Error applying service template", "error", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rb = RegisterBody(merged)
+
 	err = config.Validate.Struct(rb)
 	if err != nil {
 		slog.Error("Error validating body", "error", err.Error())
@@ -235,28 +998,19 @@ func (sr *ServiceRegistry) RegisterService(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	wl := feature.NewIPWhiteList()
-	feature.PopulateIPWhiteList(wl, rb.WhiteList)
-
-	var na *auth.JwtAuth
-	file, err := os.Open(rb.Auth.Secret)
+	s, err := NewService((*config.ServiceConf)(&rb))
 	if err != nil {
-		slog.Error("failed to open secret file", "service", rb.Name, "path", rb.Auth.Secret)
+		slog.Error("Error creating service", "service", rb.Name, "error", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	na = auth.NewJwtAuth(&rb.Auth, file)
 
-	sr.Register(rb.Name, &Service{
-		Addr:           rb.Addr,
-		FallbackUri:    rb.FallbackUri,
-		IPWhiteList:    wl,
-		CircuitBreaker: feature.NewCircuitBreaker(rb.Name, rb.CircuitBreaker),
-		Auth:           na,
-		Cache:          feature.NewCacheHandler(&rb.Cache),
-		Health:         NewHealthCheck(&rb.Health),
-		RateLimiter:    feature.NewServiceRateLimiter(&rb.RateLimiter),
-		mu:             sync.Mutex{},
-	})
-	j, err := json.Marshal(RegisterResponse{Message: "service " + rb.Name + " registered"})
+	err = sr.Register(rb.Name, s)
+	if err != nil {
+		http.Error(w, err.Error(), StatusCode(err))
+		return
+	}
+	j, err := json.Marshal(RegisterResponse{Message: "service " + rb.Name + " registered", HealthResponse: checkOnRegister(rb.Name, s)})
 	if err != nil {
 		slog.Error("Error marshalling response", "error", err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -280,6 +1034,14 @@ func (sr *ServiceRegistry) UpdateService(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	merged, err := config.AppConfig.ApplyTemplate(config.ServiceConf(ub))
+	if err != nil {
+		slog.Error("Error applying service template", "error", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ub = UpdateBody(merged)
+
 	err = config.Validate.Struct(ub)
 	if err != nil {
 		slog.Error("Error validating update request body", "error", err.Error())
@@ -289,36 +1051,25 @@ func (sr *ServiceRegistry) UpdateService(w http.ResponseWriter, r *http.Request)
 
 	s := sr.GetService(ub.Name)
 	if s == nil {
-		slog.Error("Defined service doesn't exists")
-		http.Error(w, "service doesn't exists", http.StatusBadRequest)
+		slog.Error("Defined service doesn't exists", "service", ub.Name)
+		http.Error(w, ErrServiceNotFound.Error(), http.StatusBadRequest)
 		return
 	}
 
-	wl := feature.NewIPWhiteList()
-	feature.PopulateIPWhiteList(wl, ub.WhiteList)
-
-	var na *auth.JwtAuth
-	file, err := os.Open(ub.Auth.Secret)
+	updated, err := NewService((*config.ServiceConf)(&ub))
 	if err != nil {
-		slog.Error("failed to open secret file", "service", ub.Name, "path", ub.Auth.Secret)
-	}
-	na = auth.NewJwtAuth(&ub.Auth, file)
-	updated := &Service{
-		Addr:           ub.Addr,
-		FallbackUri:    ub.FallbackUri,
-		IPWhiteList:    wl,
-		CircuitBreaker: feature.NewCircuitBreaker(ub.Name, ub.CircuitBreaker),
-		Auth:           na,
-		Cache:          feature.NewCacheHandler(&ub.Cache),
-		Health:         NewHealthCheck(&ub.Health),
-		RateLimiter:    feature.NewServiceRateLimiter(&ub.RateLimiter),
-		mu:             sync.Mutex{},
+		slog.Error("Error creating service", "service", ub.Name, "error", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	// Update the service in the registry
-	sr.Update(ub.Name, updated)
+	if err := sr.Update(ub.Name, updated); err != nil {
+		http.Error(w, err.Error(), StatusCode(err))
+		return
+	}
 
-	j, err := json.Marshal(ResponseBody{Message: "service " + ub.Name + " updated"})
+	j, err := json.Marshal(UpdateResponse{Message: "service " + ub.Name + " updated", HealthResponse: checkOnRegister(ub.Name, updated)})
 	if err != nil {
 		slog.Error("Error marshalling response", "error", err.Error(), "service", ub.Name)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -332,6 +1083,46 @@ func (sr *ServiceRegistry) UpdateService(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// PatchService updates only the fields of an existing service present in the request body
+func (sr *ServiceRegistry) PatchService(w http.ResponseWriter, r *http.Request) {
+	slog.Info("Patching service", "req", RequestToMap(r))
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		slog.Error("Error reading request", "error", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var pb PatchBody
+	if err := json.Unmarshal(patch, &pb); err != nil {
+		slog.Error("Error decoding request", "error", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pb.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	updated, err := sr.Patch(pb.Name, patch)
+	if err != nil {
+		slog.Error("Error patching service", "service", pb.Name, "error", err.Error())
+		http.Error(w, err.Error(), StatusCode(err))
+		return
+	}
+
+	j, err := json.Marshal(UpdateResponse{Message: "service " + pb.Name + " updated", HealthResponse: checkOnRegister(pb.Name, updated)})
+	if err != nil {
+		slog.Error("Error marshalling response", "error", err.Error(), "service", pb.Name)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(j); err != nil {
+		slog.Error("Error writing response", "error", err.Error())
+	}
+}
+
 // DeregisterService unregisters a service from the registry
 func (sr *ServiceRegistry) DeregisterService(w http.ResponseWriter, r *http.Request) {
 	slog.Info("Unregistering service", "req", RequestToMap(r))
@@ -356,12 +1147,231 @@ func (sr *ServiceRegistry) DeregisterService(w http.ResponseWriter, r *http.Requ
 	}
 }
 
-// GetServices returns the registered services
+// RouteLabels routes the requests to a path prefix to the services selected by labels
+func (sr *ServiceRegistry) RouteLabels(w http.ResponseWriter, r *http.Request) {
+	slog.Info("Routing by labels", "req", RequestToMap(r))
+	var lb LabelRouteBody
+	if err := json.NewDecoder(r.Body).Decode(&lb); err != nil {
+		slog.Error("Error decoding request", "error", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if lb.Service == "" || len(lb.Selector) == 0 {
+		http.Error(w, "service and selector are required", http.StatusBadRequest)
+		return
+	}
+	selected, err := sr.RouteByLabels(lb.Service, lb.Selector)
+	if err != nil {
+		slog.Error("No service matches the selector", "service", lb.Service, "selector", lb.Selector)
+		http.Error(w, err.Error(), StatusCode(err))
+		return
+	}
+	slog.Info("Routed by labels", "service", lb.Service, "selected", selected)
+	j, err := json.Marshal(ResponseBody{Message: "service " + lb.Service + " routed to " + strings.Join(selected, ", ")})
+	if err != nil {
+		slog.Error("Error marshalling response", "error", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(j); err != nil {
+		slog.Error("Error writing response", "error", err.Error())
+	}
+}
+
+// RenewToken issues a fresh token for a valid token of the service, the token is verified
+// with the service's own auth so only holders of a valid token can renew
+func (sr *ServiceRegistry) RenewToken(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	slog.Info("Renewing token", "service", name)
+	s := sr.GetService(name)
+	if s == nil {
+		http.Error(w, ErrServiceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	token, err := s.getAuth().Renew(r.Header.Get("Authorization"))
+	if err != nil {
+		if errors.Is(err, auth.ErrAuthDisabled) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = opError("renew token", name, ErrAuthFailure, err)
+		http.Error(w, errorMessage(err), StatusCode(err))
+		return
+	}
+	j, err := json.Marshal(RenewResponse{Token: token})
+	if err != nil {
+		slog.Error("Error marshalling response", "error", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(j); err != nil {
+		slog.Error("Error writing response", "error", err.Error())
+	}
+}
+
+// ReloadAuth re-reads the secret file of a service, e.g. after the secret was rotated
+func (sr *ServiceRegistry) ReloadAuth(w http.ResponseWriter, r *http.Request) {
+	slog.Info("Reloading service auth", "req", RequestToMap(r))
+	var rb ReloadAuthBody
+	if err := json.NewDecoder(r.Body).Decode(&rb); err != nil {
+		slog.Error("Error decoding request", "error", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s := sr.GetService(rb.Name)
+	if s == nil {
+		http.Error(w, ErrServiceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err := s.ReloadAuth(); err != nil {
+		slog.Error("Error reloading auth", "service", rb.Name, "error", err.Error())
+		err = opError("reload auth", rb.Name, ErrSecretUnavailable, err)
+		http.Error(w, errorMessage(err), StatusCode(err))
+		return
+	}
+	j, err := json.Marshal(ResponseBody{Message: "service " + rb.Name + " auth reloaded"})
+	if err != nil {
+		slog.Error("Error marshalling response", "error", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(j); err != nil {
+		slog.Error("Error writing response", "error", err.Error())
+	}
+}
+
+// CircuitBreakerCounts returns the state and the counts of the circuit breaker of the service named in the path
+func (sr *ServiceRegistry) CircuitBreakerCounts(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	s := sr.GetService(name)
+	if s == nil {
+		http.Error(w, ErrServiceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if !s.CircuitBreaker.IsEnabled() {
+		http.Error(w, "circuit breaker is disabled", http.StatusBadRequest)
+		return
+	}
+	j, err := json.Marshal(s.CircuitBreaker.Counts())
+	if err != nil {
+		slog.Error("Error marshalling response", "error", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(j); err != nil {
+		slog.Error("Error writing response", "error", err.Error())
+	}
+}
+
+// RateLimiterState returns the state of the rate limiter of the service named in the path with
+// its most recent visitors
+func (sr *ServiceRegistry) RateLimiterState(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	s := sr.GetService(name)
+	if s == nil {
+		http.Error(w, ErrServiceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if s.RateLimiter == nil {
+		http.Error(w, "service has no rate limiter", http.StatusNotFound)
+		return
+	}
+	j, err := json.Marshal(s.RateLimiter.State())
+	if err != nil {
+		slog.Error("Error marshalling response", "error", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(j); err != nil {
+		slog.Error("Error writing response", "error", err.Error())
+	}
+}
+
+// ServiceMetrics serves the metrics of the service named in the path, only the services with a
+// namespace of their own have them
+func (sr *ServiceRegistry) ServiceMetrics(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	s := sr.GetService(name)
+	if s == nil {
+		http.Error(w, ErrServiceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if s.metrics == nil {
+		http.Error(w, "service metrics are not namespaced", http.StatusNotFound)
+		return
+	}
+	promhttp.HandlerFor(s.metrics.Registry(), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// GetServices returns the registered services with their request and error rates, the group
+// and tag query parameters only return the services in the group and with every tag
 func (sr *ServiceRegistry) GetServices(w http.ResponseWriter, r *http.Request) {
 	slog.Info("Retrieved registered services", "req", RequestToMap(r))
-	j, err := json.Marshal(sr.Services)
+	group, tags := r.URL.Query().Get("group"), r.URL.Query()["tag"]
+	sr.mu.RLock()
+	services := make(map[string]*Service, len(sr.Services))
+	for name, s := range sr.Services {
+		if s.InGroup(group, tags) {
+			services[name] = s
+		}
+	}
+	sr.mu.RUnlock()
+	marshalled := make(map[string]json.RawMessage, len(services))
+	for name, s := range services {
+		m, err := s.marshal(sr.rate(name))
+		if err != nil {
+			slog.Error("Error marshalling response", "error", err.Error(), "service", name)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		marshalled[name] = m
+	}
+	j, err := json.Marshal(marshalled)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(j); err != nil {
+		slog.Error("Error writing response", "error", err.Error())
+	}
+}
+
+// rate returns the request and error rates of the service, nil if the stats aren't kept
+func (sr *ServiceRegistry) rate(name string) *observability.ServiceRate {
+	if sr.Stats == nil {
+		return nil
+	}
+	rate := sr.Stats.Rate(name)
+	return &rate
+}
+
+// GetServiceByName returns the registered service named in the path with its request and error
+// rates, the auth secret is never serialized so it is not exposed
+func (sr *ServiceRegistry) GetServiceByName(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	slog.Info("Get service", "service", name, "req", RequestToMap(r))
+	s := sr.GetService(name)
+	if s == nil {
+		http.Error(w, ErrServiceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	j, err := s.marshal(sr.rate(name))
 	if err != nil {
+		slog.Error("Error marshalling response", "error", err.Error(), "service", name)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -370,33 +1380,172 @@ func (sr *ServiceRegistry) GetServices(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Heartbeat checks the health of the registered services
-func (sr *ServiceRegistry) Heartbeat() {
+// LogSampleSummaryInterval is how often the requests left out of the logs of the services are summarized
+const LogSampleSummaryInterval = time.Minute
+
+// SummarizeLogSampling periodically logs how many of the requests to the sampled services were
+// logged until Stop is called
+func (sr *ServiceRegistry) SummarizeLogSampling() {
+	ticker := time.NewTicker(LogSampleSummaryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sr.stop:
+			return
+		case <-ticker.C:
+			sr.logSampleSummary(LogSampleSummaryInterval)
+		}
+	}
+}
+
+// logSampleSummary logs the requests to the sampled services since the previous summary
+func (sr *ServiceRegistry) logSampleSummary(window time.Duration) {
+	sr.mu.RLock()
+	services := maps.Clone(sr.Services)
+	sr.mu.RUnlock()
+	for name, s := range services {
+		if !s.LogSampler.IsSampled() {
+			continue
+		}
+		if sampled, total := s.LogSampler.Reset(); total > 0 {
+			slog.Info(fmt.Sprintf("sampled %d requests in last %d seconds", sampled, int(window.Seconds())),
+				"service", name, "total", total, "rate", s.LogSampler.Rate)
+		}
+	}
+}
+
+// OpenCircuitBreakers returns the number of open circuit breakers and of the services with the
+// circuit breaker enabled
+func (sr *ServiceRegistry) OpenCircuitBreakers() (int, int) {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	open, total := 0, 0
+	for _, s := range sr.Services {
+		if s.CircuitBreaker == nil || !s.CircuitBreaker.IsEnabled() {
+			continue
+		}
+		total++
+		if s.CircuitBreaker.IsOpen() {
+			open++
+		}
+	}
+	return open, total
+}
+
+// SaveCircuitStates saves the state of the circuit breakers persisting it to their state
+// files, the services sharing a file are saved together
+func (sr *ServiceRegistry) SaveCircuitStates() {
+	sr.mu.RLock()
+	services := maps.Clone(sr.Services)
+	sr.mu.RUnlock()
+	files := make(map[string]map[string]feature.CircuitState)
+	for name, s := range services {
+		if s.CircuitBreaker == nil {
+			continue
+		}
+		file := s.CircuitBreaker.StateFile()
+		if file == "" {
+			continue
+		}
+		if files[file] == nil {
+			files[file] = make(map[string]feature.CircuitState)
+		}
+		files[file][name] = s.CircuitBreaker.Snapshot()
+	}
+	for file, states := range files {
+		if err := feature.SaveCircuitStates(file, states); err != nil {
+			slog.Error("Unable to save circuit breaker states", "file", file, "error", err.Error())
+			continue
+		}
+		slog.Info("Saved circuit breaker states", "file", file, "services", len(states))
+	}
+}
+
+// Heartbeat checks the health of the registered services every interval until Stop is called
+func (sr *ServiceRegistry) Heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
-		time.Sleep(time.Duration(config.AppConfig.Registry.HeartbeatInterval) * time.Second)
-		sr.mu.RLock()
-		slog.Info("Heartbeat registered services")
-		for name, v := range sr.Services {
-			if v.Health.IsEnabled() {
-				resp, err := http.Get("http://" + v.Addr + v.Health.GetUri())
-				if err != nil {
-					slog.Error("Service is down", "name", name, "address", v.Addr)
-					continue
-				}
-				if resp.StatusCode != http.StatusOK {
-					slog.Warn("Service is unhealthy", "name", name, "address", v.Addr)
-				}
-				_ = resp.Body.Close()
+		select {
+		case <-sr.stop:
+			return
+		case <-ticker.C:
+			sr.checkHealth()
+		}
+	}
+}
+
+// Stop ends the heartbeat and the log sampling summaries of the registry
+func (sr *ServiceRegistry) Stop() {
+	sr.stopOnce.Do(func() {
+		if sr.stop != nil {
+			close(sr.stop)
+		}
+	})
+}
+
+// checkHealth checks the health of the registered services once. The registry is only locked
+// to take a snapshot of the services so it isn't blocked by the health checks.
+func (sr *ServiceRegistry) checkHealth() {
+	sr.mu.RLock()
+	services := maps.Clone(sr.Services)
+	sr.mu.RUnlock()
+	slog.Info("Heartbeat registered services")
+	for name, v := range services {
+		if !v.Health.IsEnabled() {
+			continue
+		}
+		health, err := v.CheckHealth()
+		// only the transitions are logged so a service which stays down doesn't flood the logs
+		previous := v.setHealth(health)
+		if health == previous {
+			continue
+		}
+		switch health {
+		case HealthUnreachable:
+			slog.Error("Service is down", "name", name, "address", v.Addr, "error", err)
+		case HealthUnhealthy:
+			slog.Warn("Service is unhealthy", "name", name, "address", v.Addr, "error", err)
+		case HealthHealthy:
+			if previous != "" {
+				slog.Info("Service recovered", "name", name, "address", v.Addr, "was", previous)
 			}
 		}
-		sr.mu.RUnlock()
 	}
 }
 
+// setHealth records the result of a health check of the service, it returns the previous result
+func (s *Service) setHealth(health string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := s.health
+	s.health, s.healthCheckedAt = health, time.Now()
+	return previous
+}
+
+// HealthStatus returns the result and time of the last health check by the heartbeat, the
+// status is empty if the service wasn't checked yet
+func (s *Service) HealthStatus() (string, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.health, s.healthCheckedAt
+}
+
 type Cacher interface {
 	Get(string) (interface{}, bool)
+	GetAndRefresh(string) (interface{}, bool)
 	Set(string, interface{}, feature.CacheExpiration)
+	SetResource(string, string, interface{}, feature.CacheExpiration)
+	Delete(string)
+	Invalidate(string)
+	IsWriteThrough() bool
 	IsEnabled() bool
+	StatusHeader() (string, bool)
+	IsCacheableContentType(string) bool
+	FitsBody(int) bool
+	ExpirationFor(http.Header) feature.CacheExpiration
+	Size() int64
+	OnSizeChange(func(int64))
 }
 
 func (sr *ServiceRegistry) GetCache(name string, key string) (interface{}, bool) {
@@ -407,12 +1556,14 @@ func (sr *ServiceRegistry) GetCache(name string, key string) (interface{}, bool)
 	return s.Cache.Get(key)
 }
 
-func (sr *ServiceRegistry) SetCache(name string, key string, value interface{}) bool {
+// SetCache caches the value of the resource e.g. the request url for the max-age of the
+// response header or the default ttl
+func (sr *ServiceRegistry) SetCache(name string, resource string, key string, value interface{}, header http.Header) bool {
 	s := sr.GetService(name)
 	if s == nil {
 		return false
 	}
-	s.Cache.Set(key, value, feature.DefaultExpiration)
+	s.Cache.SetResource(resource, key, value, s.Cache.ExpirationFor(header))
 	return true
 }
 
@@ -423,3 +1574,24 @@ func (sr *ServiceRegistry) IsCacheEnabled(name string) bool {
 	}
 	return s.Cache.IsEnabled()
 }
+
+// ReloadConfig reloads the services from the configuration file
+func (sr *ServiceRegistry) ReloadConfig(w http.ResponseWriter, r *http.Request) {
+	slog.Info("Reloading config", "req", RequestToMap(r))
+	if err := sr.Reload(config.Path); err != nil {
+		slog.Error("Error reloading config", "error", err.Error())
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	j, err := json.Marshal(ResponseBody{Message: "config reloaded"})
+	if err != nil {
+		slog.Error("Error marshalling response", "error", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(j); err != nil {
+		slog.Error("Error writing response", "error", err.Error())
+	}
+}
@@ -0,0 +1,924 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/ArmaanKatyal/go-api-gateway/server/feature"
+	"github.com/ArmaanKatyal/go-api-gateway/server/observability"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRegistry() *ServiceRegistry {
+	return &ServiceRegistry{Services: make(map[string]*Service), stop: make(chan struct{})}
+}
+
+func registerRequest(t *testing.T, body config.ServiceConf) *http.Request {
+	t.Helper()
+	b, err := json.Marshal(body)
+	assert.Nil(t, err)
+	return httptest.NewRequest(http.MethodPost, "/services/register", bytes.NewReader(b))
+}
+
+func testServiceConf(name string, addr string) config.ServiceConf {
+	return config.ServiceConf{
+		Name:      name,
+		Addr:      addr,
+		WhiteList: []string{"ALL"},
+		Health:    config.HealthCheckSettings{Uri: "/health"},
+	}
+}
+
+func TestRegistryEnforceUniqueAddresses(t *testing.T) {
+	defer func(v bool) { config.AppConfig.Registry.EnforceUniqueAddresses = v }(config.AppConfig.Registry.EnforceUniqueAddresses)
+
+	t.Run("duplicate address rejected", func(t *testing.T) {
+		config.AppConfig.Registry.EnforceUniqueAddresses = true
+		sr := newTestRegistry()
+		w := httptest.NewRecorder()
+		sr.RegisterService(w, registerRequest(t, testServiceConf("a", "localhost:8001")))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = httptest.NewRecorder()
+		sr.RegisterService(w, registerRequest(t, testServiceConf("b", "localhost:8001")))
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Nil(t, sr.GetService("b"))
+		assert.NotNil(t, sr.GetService("a"))
+	})
+	t.Run("update to duplicate address rejected", func(t *testing.T) {
+		config.AppConfig.Registry.EnforceUniqueAddresses = true
+		sr := newTestRegistry()
+		assert.Nil(t, sr.Register("a", &Service{Addr: "localhost:8001"}))
+		assert.Nil(t, sr.Register("b", &Service{Addr: "localhost:8002"}))
+		assert.ErrorIs(t, sr.Update("b", &Service{Addr: "localhost:8001"}), ErrDuplicateAddress)
+		assert.Equal(t, "localhost:8002", sr.GetAddress("b"))
+		// updating a service with its own address is allowed
+		assert.Nil(t, sr.Update("a", &Service{Addr: "localhost:8001"}))
+	})
+	t.Run("duplicate address allowed when not enforced", func(t *testing.T) {
+		config.AppConfig.Registry.EnforceUniqueAddresses = false
+		sr := newTestRegistry()
+		assert.Nil(t, sr.Register("a", &Service{Addr: "localhost:8001"}))
+		assert.Nil(t, sr.Register("b", &Service{Addr: "localhost:8001"}))
+		assert.NotNil(t, sr.GetService("b"))
+	})
+}
+
+func TestRegistryRegister(t *testing.T) {
+	t.Run("duplicate name rejected", func(t *testing.T) {
+		sr := newTestRegistry()
+		first := &Service{Addr: "localhost:8001"}
+		assert.Nil(t, sr.Register("a", first))
+		assert.ErrorIs(t, sr.Register("a", &Service{Addr: "localhost:8002"}), ErrServiceAlreadyExists)
+		assert.Same(t, first, sr.GetService("a"))
+	})
+	t.Run("duplicate name conflict response", func(t *testing.T) {
+		sr := newTestRegistry()
+		w := httptest.NewRecorder()
+		sr.RegisterService(w, registerRequest(t, testServiceConf("a", "localhost:8001")))
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = httptest.NewRecorder()
+		sr.RegisterService(w, registerRequest(t, testServiceConf("a", "localhost:8002")))
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Equal(t, "localhost:8001", sr.GetAddress("a"))
+	})
+	t.Run("register or update overwrites", func(t *testing.T) {
+		sr := newTestRegistry()
+		assert.Nil(t, sr.Register("a", &Service{Addr: "localhost:8001"}))
+		updated := &Service{Addr: "localhost:8002"}
+		sr.RegisterOrUpdate("a", updated)
+		assert.Same(t, updated, sr.GetService("a"))
+		sr.RegisterOrUpdate("b", &Service{Addr: "localhost:8003"})
+		assert.Equal(t, "localhost:8003", sr.GetAddress("b"))
+	})
+}
+
+func TestRegistryInvalidMatchRule(t *testing.T) {
+	sr := newTestRegistry()
+	conf := testServiceConf("a", "localhost:8001")
+	conf.MatchRules = []config.MatchRuleSettings{{Header: "X-Api-Version", Pattern: "v(2", Addr: "localhost:8002"}}
+	w := httptest.NewRecorder()
+	sr.RegisterService(w, registerRequest(t, conf))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Nil(t, sr.GetService("a"))
+}
+
+func TestServiceWriteTimeout(t *testing.T) {
+	assert.Equal(t, DefaultWriteTimeout, serviceWriteTimeout(0))
+	assert.Equal(t, 30*time.Second, serviceWriteTimeout(30))
+	assert.Equal(t, time.Duration(-1), serviceWriteTimeout(-1))
+}
+
+func TestServiceAuthenticateResolvedRoute(t *testing.T) {
+	conf := testServiceConf("svc", "localhost:8001")
+	conf.Auth = config.AuthSettings{Enabled: true, Routes: []string{"/a/*"}}
+	s, err := NewService(&conf)
+	assert.Nil(t, err)
+	rh := &RequestHandler{}
+	tests := []struct {
+		path     string
+		required bool
+	}{
+		{"/svc", false},
+		{"/svc/", false},
+		{"/svc/a", true},
+		{"/svc/a/b/c", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, route := rh.resolvePath(tt.path)
+			err := s.Authenticate(httptest.NewRequest(http.MethodGet, tt.path, nil), route)
+			assert.Equal(t, tt.required, err != nil)
+		})
+	}
+}
+
+func TestRegistryRegisterWithTemplate(t *testing.T) {
+	defer func(c config.Conf) { config.AppConfig = c }(config.AppConfig)
+	config.AppConfig.Registry.Templates = map[string]config.ServiceConf{
+		"shared": {
+			WhiteList: []string{"ALL"},
+			Health:    config.HealthCheckSettings{Uri: "/health"},
+			Cache:     config.CacheSettings{Enabled: true},
+		},
+	}
+	sr := newTestRegistry()
+	w := httptest.NewRecorder()
+	sr.RegisterService(w, registerRequest(t, config.ServiceConf{Name: "a", Addr: "localhost:8001", Template: "shared"}))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, sr.IsCacheEnabled("a"))
+
+	w = httptest.NewRecorder()
+	sr.RegisterService(w, registerRequest(t, config.ServiceConf{Name: "b", Addr: "localhost:8002", Template: "missing"}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRegistryGetServiceByName(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	assert.Nil(t, os.WriteFile(secret, []byte("super-secret-key"), 0o600))
+	conf := testServiceConf("a", "localhost:8001")
+	conf.Auth = config.AuthSettings{Enabled: true, Secret: secret}
+	s, err := NewService(&conf)
+	assert.Nil(t, err)
+	sr := newTestRegistry()
+	assert.Nil(t, sr.Register("a", s))
+
+	t.Run("existing service", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/services/a", nil)
+		r.SetPathValue("name", "a")
+		w := httptest.NewRecorder()
+		sr.GetServiceByName(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		var got struct {
+			Addr string `json:"addr"`
+		}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &got))
+		assert.Equal(t, "localhost:8001", got.Addr)
+		assert.NotContains(t, w.Body.String(), "super-secret-key")
+	})
+	t.Run("missing service", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/services/b", nil)
+		r.SetPathValue("name", "b")
+		w := httptest.NewRecorder()
+		sr.GetServiceByName(w, r)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestRegistryGetServices(t *testing.T) {
+	sr := newTestRegistry()
+	assert.Nil(t, sr.Register("a", &Service{Addr: "localhost:8001", Group: "payments", Tags: []string{"production", "eu"}}))
+	assert.Nil(t, sr.Register("b", &Service{Addr: "localhost:8002", Group: "payments", Tags: []string{"staging"}}))
+	assert.Nil(t, sr.Register("c", &Service{Addr: "localhost:8003", Group: "orders", Tags: []string{"production"}}))
+	assert.Nil(t, sr.Register("d", &Service{Addr: "localhost:8004"}))
+
+	tests := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{name: "unfiltered", query: "", expected: []string{"a", "b", "c", "d"}},
+		{name: "group", query: "?group=payments", expected: []string{"a", "b"}},
+		{name: "tag", query: "?tag=production", expected: []string{"a", "c"}},
+		{name: "group and tag", query: "?group=payments&tag=production", expected: []string{"a"}},
+		{name: "every tag", query: "?tag=production&tag=eu", expected: []string{"a"}},
+		{name: "unknown group", query: "?group=shipping", expected: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sr.GetServices(w, httptest.NewRequest(http.MethodGet, "/services"+tt.query, nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+			var got map[string]json.RawMessage
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &got))
+			names := make([]string, 0, len(got))
+			for name := range got {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+}
+
+func TestRegistryRouteByLabels(t *testing.T) {
+	sr := newTestRegistry()
+	assert.Nil(t, sr.Register("a", &Service{Addr: "localhost:8001", Labels: map[string]string{"env": "blue"}}))
+	assert.Nil(t, sr.Register("b", &Service{Addr: "localhost:8002", Labels: map[string]string{"env": "green"}}))
+	assert.Nil(t, sr.Register("c", &Service{Addr: "localhost:8003", Labels: map[string]string{"env": "green"}}))
+	assert.Equal(t, "svc", sr.ResolveName("svc"))
+
+	selected, err := sr.RouteByLabels("svc", map[string]string{"env": "green"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b", "c"}, selected)
+	for i := 0; i < 20; i++ {
+		assert.Contains(t, []string{"b", "c"}, sr.ResolveName("svc"))
+	}
+	assert.Equal(t, "a", sr.ResolveName("a"))
+
+	_, err = sr.RouteByLabels("svc", map[string]string{"env": "red"})
+	assert.ErrorIs(t, err, ErrServiceNotFound)
+
+	// the deregistered services aren't picked anymore
+	sr.Deregister("b")
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, "c", sr.ResolveName("svc"))
+	}
+	sr.Deregister("c")
+	assert.Equal(t, "svc", sr.ResolveName("svc"))
+	assert.Empty(t, sr.labelRoutes)
+}
+
+func TestRegistryActiveVisitorsMetric(t *testing.T) {
+	sr := &ServiceRegistry{Services: make(map[string]*Service), Metrics: observability.NewPromMetrics()}
+	visitors := sr.Metrics.ActiveVisitors("a")
+
+	limiter := feature.NewServiceRateLimiter(&config.RateLimiterSettings{Enabled: true, Rate: 1, Burst: 1})
+	assert.Nil(t, sr.Register("a", &Service{Addr: "localhost:8001", RateLimiter: limiter}))
+	limiter.GetVisitor("10.0.0.1")
+	limiter.GetVisitor("10.0.0.2")
+	assert.Equal(t, float64(2), testutil.ToFloat64(visitors))
+	limiter.RemoveStaleVisitors()
+	assert.Equal(t, float64(0), testutil.ToFloat64(visitors))
+
+	// the limiter of a replaced service no longer reports
+	sr.RegisterOrUpdate("a", &Service{Addr: "localhost:8001", RateLimiter: feature.NewServiceRateLimiter(&config.RateLimiterSettings{Enabled: true})})
+	limiter.GetVisitor("10.0.0.3")
+	assert.Equal(t, float64(0), testutil.ToFloat64(visitors))
+}
+
+func TestRegistryReloadAuth(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	assert.Nil(t, os.WriteFile(secret, []byte("old-secret"), 0o600))
+	conf := testServiceConf("a", "localhost:8001")
+	conf.Auth = config.AuthSettings{Enabled: true, Secret: secret}
+	s, err := NewService(&conf)
+	assert.Nil(t, err)
+	sr := newTestRegistry()
+	assert.Nil(t, sr.Register("a", s))
+	reload := func(name string) *httptest.ResponseRecorder {
+		b, err := json.Marshal(ReloadAuthBody{Name: name})
+		assert.Nil(t, err)
+		w := httptest.NewRecorder()
+		sr.ReloadAuth(w, httptest.NewRequest(http.MethodPost, "/services/auth/reload", bytes.NewReader(b)))
+		return w
+	}
+	sign := func(key string) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}).SignedString([]byte(key))
+		assert.Nil(t, err)
+		return token
+	}
+
+	t.Run("rotated secret", func(t *testing.T) {
+		assert.Nil(t, os.WriteFile(secret, []byte("new-secret"), 0o600))
+		_, err := s.getAuth().Renew(sign("new-secret"))
+		assert.NotNil(t, err)
+
+		w := reload("a")
+		assert.Equal(t, http.StatusOK, w.Code)
+		_, err = s.getAuth().Renew(sign("new-secret"))
+		assert.Nil(t, err)
+		_, err = s.getAuth().Renew(sign("old-secret"))
+		assert.NotNil(t, err)
+	})
+	t.Run("missing secret file", func(t *testing.T) {
+		assert.Nil(t, os.Remove(secret))
+		w := reload("a")
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		// the previous secret stays in use
+		_, err := s.getAuth().Renew(sign("new-secret"))
+		assert.Nil(t, err)
+	})
+	t.Run("missing service", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, reload("b").Code)
+	})
+	t.Run("served while reloading", func(t *testing.T) {
+		assert.Nil(t, os.WriteFile(secret, []byte("new-secret"), 0o600))
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				assert.Equal(t, http.StatusOK, reload("a").Code)
+			}()
+			go func() {
+				defer wg.Done()
+				r := httptest.NewRequest(http.MethodGet, "/services/a", nil)
+				r.SetPathValue("name", "a")
+				w := httptest.NewRecorder()
+				sr.GetServiceByName(w, r)
+				assert.Equal(t, http.StatusOK, w.Code)
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func TestRegistryReload(t *testing.T) {
+	defer func(p string) { config.Path = p }(config.Path)
+	config.Path = filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(config.Path, []byte(`
+server:
+  host: localhost
+  port: "8080"
+registry:
+  services:
+    - name: a
+      addr: "localhost:8101"
+      whitelist: ["ALL"]
+      health:
+        uri: "/health"
+    - name: b
+      addr: "localhost:8102"
+      whitelist: ["ALL"]
+      health:
+        uri: "/health"
+    - name: c
+      addr: "c.invalid:8103"
+      whitelist: ["ALL"]
+      health:
+        uri: "/health"
+`), 0o644))
+	sr := newTestRegistry()
+	for name, addr := range map[string]string{"a": "localhost:8001", "c": "localhost:8002", "d": "localhost:8003"} {
+		conf := testServiceConf(name, addr)
+		s, err := NewService(&conf)
+		assert.Nil(t, err)
+		assert.Nil(t, sr.Register(name, s))
+	}
+
+	w := httptest.NewRecorder()
+	sr.ReloadConfig(w, httptest.NewRequest(http.MethodPost, "/admin/config/reload", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "localhost:8101", sr.GetService("a").Addr)
+	assert.Equal(t, "localhost:8102", sr.GetService("b").Addr)
+	// the unresolvable service keeps its settings and the services missing from the file stay
+	assert.Equal(t, "localhost:8002", sr.GetService("c").Addr)
+	assert.Equal(t, "localhost:8003", sr.GetService("d").Addr)
+
+	assert.Nil(t, os.WriteFile(config.Path, []byte("server: ["), 0o644))
+	w = httptest.NewRecorder()
+	sr.ReloadConfig(w, httptest.NewRequest(http.MethodPost, "/admin/config/reload", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, "localhost:8101", sr.GetService("a").Addr)
+}
+
+// stopRecorder records that the limiter of a service was stopped
+type stopRecorder struct {
+	IRateLimiter
+	stopped bool
+}
+
+func (r *stopRecorder) Stop() {
+	r.stopped = true
+	r.IRateLimiter.Stop()
+}
+
+func TestRegistryReloadUnchanged(t *testing.T) {
+	defer func(p string) { config.Path = p }(config.Path)
+	config.Path = filepath.Join(t.TempDir(), "config.yaml")
+	write := func(bAddr string) {
+		assert.Nil(t, os.WriteFile(config.Path, []byte(`
+server:
+  host: localhost
+  port: "8080"
+registry:
+  services:
+    - name: a
+      addr: "localhost:8101"
+      whitelist: ["ALL"]
+      health:
+        uri: "/health"
+      circuitBreaker:
+        enabled: true
+        timeout: 60
+        failureRatio: 0.5
+        minimumRequests: 1
+    - name: b
+      addr: "`+bAddr+`"
+      whitelist: ["ALL"]
+      health:
+        uri: "/health"
+`), 0o644))
+	}
+	sr := newTestRegistry()
+	write("localhost:8102")
+	assert.Nil(t, sr.Reload(config.Path))
+	a, b := sr.GetService("a"), sr.GetService("b")
+	_, _ = a.CircuitBreaker.Execute("a", func() ([]byte, error) { return nil, ErrForwardFailure })
+	assert.True(t, a.CircuitBreaker.IsOpen())
+	limiter := &stopRecorder{IRateLimiter: b.RateLimiter}
+	b.RateLimiter = limiter
+
+	// the unchanged service is kept with its open circuit, the changed one is replaced
+	write("localhost:8202")
+	assert.Nil(t, sr.Reload(config.Path))
+	assert.Same(t, a, sr.GetService("a"))
+	assert.True(t, sr.GetService("a").CircuitBreaker.IsOpen())
+	assert.NotSame(t, b, sr.GetService("b"))
+	assert.Equal(t, "localhost:8202", sr.GetService("b").Addr)
+	assert.True(t, limiter.stopped)
+}
+
+func TestRegistryCheckOnRegister(t *testing.T) {
+	defer func(c config.Conf) { config.AppConfig = c }(config.AppConfig)
+	config.AppConfig.Registry.CheckOnRegister = true
+	reachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/health", r.URL.Path)
+	}))
+	defer reachable.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	tests := []struct {
+		name   string
+		addr   string
+		health string
+	}{
+		{"reachable", reachable.URL, HealthHealthy},
+		{"unreachable", unreachable.URL, HealthUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sr := newTestRegistry()
+			conf := testServiceConf("a", tt.addr)
+			conf.Health.Enabled = true
+			w := httptest.NewRecorder()
+			sr.RegisterService(w, registerRequest(t, conf))
+			assert.Equal(t, http.StatusOK, w.Code)
+			var res RegisterResponse
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, tt.health, res.Health)
+			assert.Equal(t, tt.health == HealthUnreachable, res.Error != "")
+
+			b, err := json.Marshal(conf)
+			assert.Nil(t, err)
+			w = httptest.NewRecorder()
+			sr.UpdateService(w, httptest.NewRequest(http.MethodPost, "/services/update", bytes.NewReader(b)))
+			assert.Equal(t, http.StatusOK, w.Code)
+			var updated UpdateResponse
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &updated))
+			assert.Equal(t, tt.health, updated.Health)
+		})
+	}
+
+	t.Run("health check disabled", func(t *testing.T) {
+		sr := newTestRegistry()
+		w := httptest.NewRecorder()
+		sr.RegisterService(w, registerRequest(t, testServiceConf("a", reachable.URL)))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), "health")
+	})
+}
+
+func TestRegistryCheckHealthBody(t *testing.T) {
+	defer func(c config.Conf) { config.AppConfig = c }(config.AppConfig)
+	config.AppConfig.Registry.CheckOnRegister = true
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Check bool `json:"check"`
+		}
+		if r.Method != http.MethodPost || r.URL.Path != "/health" ||
+			r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&body) != nil {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !body.Check {
+			_, _ = w.Write([]byte(`{"status": "down"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status": "ok"}`))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		health string
+	}{
+		{"body check passes", "post", `{"check": true}`, HealthHealthy},
+		{"body check fails", "post", `{"check": false}`, HealthUnhealthy},
+		{"wrong method", "", "", HealthUnhealthy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sr := newTestRegistry()
+			conf := testServiceConf("a", upstream.URL)
+			conf.Health = config.HealthCheckSettings{
+				Enabled:             true,
+				Uri:                 "/health",
+				Method:              tt.method,
+				Body:                tt.body,
+				ContentType:         "application/json",
+				SuccessBodyContains: "ok",
+			}
+			w := httptest.NewRecorder()
+			sr.RegisterService(w, registerRequest(t, conf))
+			assert.Equal(t, http.StatusOK, w.Code)
+			var res RegisterResponse
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, tt.health, res.Health)
+		})
+	}
+}
+
+func TestRegistryPatchService(t *testing.T) {
+	sr := newTestRegistry()
+	conf := testServiceConf("a", "localhost:8001")
+	conf.Labels = map[string]string{"env": "blue"}
+	conf.Cache = config.CacheSettings{Enabled: true, ExpirationInterval: 30}
+	w := httptest.NewRecorder()
+	sr.RegisterService(w, registerRequest(t, conf))
+	assert.Equal(t, http.StatusOK, w.Code)
+	original := sr.GetService("a")
+
+	patch := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		sr.PatchService(w, httptest.NewRequest(http.MethodPatch, "/services/update", strings.NewReader(body)))
+		return w
+	}
+
+	w = patch(`{"name": "a", "fallbackUri": "localhost:9000"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	s := sr.GetService("a")
+	assert.NotSame(t, original, s)
+	assert.Equal(t, []string{"localhost:9000"}, s.FallbackUris)
+	assert.Equal(t, "localhost:8001", s.Addr)
+	assert.Equal(t, map[string]string{"env": "blue"}, s.Labels)
+	assert.True(t, s.Cache.IsEnabled())
+	assert.True(t, s.IsWhitelisted("10.0.0.1"))
+
+	// nested settings are merged field by field
+	w = patch(`{"name": "a", "cache": {"enabled": false}, "labels": {"tier": "web"}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	s = sr.GetService("a")
+	assert.False(t, s.Cache.IsEnabled())
+	assert.Equal(t, map[string]string{"env": "blue", "tier": "web"}, s.Labels)
+	assert.Equal(t, []string{"localhost:9000"}, s.FallbackUris)
+	// the configuration of the replaced service is left untouched
+	assert.Equal(t, map[string]string{"env": "blue"}, original.Labels)
+
+	assert.Equal(t, http.StatusBadRequest, patch(`{"fallbackUri": "localhost:9000"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, patch(`{"name": "a", "addr": ""}`).Code)
+	assert.Equal(t, http.StatusNotFound, patch(`{"name": "b", "fallbackUri": "localhost:9000"}`).Code)
+	assert.Equal(t, "localhost:8001", sr.GetAddress("a"))
+}
+
+func TestLogSampleSummary(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(l *slog.Logger) { slog.SetDefault(l) }(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	none := 0.0
+	sr := newTestRegistry()
+	sr.RegisterOrUpdate("sampled", &Service{Addr: "localhost:8001", LogSampler: feature.NewLogSampler(&none)})
+	sr.RegisterOrUpdate("plain", &Service{Addr: "localhost:8002", LogSampler: feature.NewLogSampler(nil)})
+	for i := 0; i < 10; i++ {
+		sr.GetService("sampled").LogSampler.Sample()
+		sr.GetService("plain").LogSampler.Sample()
+	}
+
+	buf.Reset()
+	sr.logSampleSummary(time.Minute)
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "sampled 0 requests in last 60 seconds", entry["msg"])
+	assert.Equal(t, "sampled", entry["service"])
+	assert.Equal(t, 10.0, entry["total"])
+
+	// nothing to summarize until more requests come in
+	buf.Reset()
+	sr.logSampleSummary(time.Minute)
+	assert.Empty(t, buf.String())
+}
+
+func TestCheckHealthLogsTransitions(t *testing.T) {
+	var healthy atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+	var buf bytes.Buffer
+	defer func(l *slog.Logger) { slog.SetDefault(l) }(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	sc := testServiceConf("a", upstream.URL)
+	sc.Health.Enabled = true
+	s, err := NewService(&sc)
+	assert.Nil(t, err)
+	sr := newTestRegistry()
+	assert.Nil(t, sr.Register("a", s))
+	checks := func(n int) int {
+		buf.Reset()
+		for i := 0; i < n; i++ {
+			sr.checkHealth()
+		}
+		return strings.Count(buf.String(), "Service is unhealthy")
+	}
+
+	assert.Equal(t, 1, checks(3))
+	healthy.Store(true)
+	assert.Equal(t, 0, checks(1))
+	healthy.Store(false)
+	assert.Equal(t, 1, checks(2))
+}
+
+func TestHeartbeatStop(t *testing.T) {
+	var checks atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks.Add(1)
+	}))
+	defer upstream.Close()
+	sc := testServiceConf("a", upstream.URL)
+	sc.Health.Enabled = true
+	s, err := NewService(&sc)
+	assert.Nil(t, err)
+	sr := newTestRegistry()
+	assert.Nil(t, sr.Register("a", s))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sr.Heartbeat(10 * time.Millisecond)
+	}()
+	assert.Eventually(t, func() bool { return checks.Load() > 0 }, time.Second, 10*time.Millisecond)
+	sr.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("heartbeat not stopped")
+	}
+	// stopping again is a no-op
+	sr.Stop()
+}
+
+func TestRegistrySaveCircuitStates(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "circuit-state.json")
+	sr := newTestRegistry()
+	newService := func(t *testing.T, name string, persist bool) *Service {
+		t.Helper()
+		sc := testServiceConf(name, "localhost:9000")
+		sc.CircuitBreaker = config.CircuitSettings{Enabled: true, Timeout: 60, FailureRatio: 0.5, MinimumRequests: 1, PersistState: persist, StateFile: stateFile}
+		s, err := NewService(&sc)
+		assert.Nil(t, err)
+		return s
+	}
+	orders := newService(t, "orders", true)
+	_, _ = orders.CircuitBreaker.Execute("orders", func() ([]byte, error) { return nil, ErrForwardFailure })
+	assert.True(t, orders.CircuitBreaker.IsOpen())
+	sr.Services["orders"] = orders
+	sr.Services["payments"] = newService(t, "payments", true)
+	sr.Services["users"] = newService(t, "users", false)
+
+	sr.SaveCircuitStates()
+	states, err := feature.LoadCircuitStates(stateFile)
+	assert.Nil(t, err)
+	assert.Len(t, states, 2)
+	assert.Equal(t, "open", states["orders"].State)
+	assert.Equal(t, "closed", states["payments"].State)
+
+	// the services registered after a restart start in the saved state
+	assert.True(t, newService(t, "orders", true).CircuitBreaker.IsOpen())
+	assert.False(t, newService(t, "payments", true).CircuitBreaker.IsOpen())
+}
+
+// gathered sums the values of the series of the counter or gauge named in the registry
+func gathered(t *testing.T, registry *prometheus.Registry, name string) float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	total := 0.0
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			total += m.GetCounter().GetValue() + m.GetGauge().GetValue()
+		}
+	}
+	return total
+}
+
+func TestRegistryRenewToken(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	assert.Nil(t, os.WriteFile(secret, []byte("renew"), 0o600))
+	conf := testServiceConf("auth", "localhost:8001")
+	conf.Auth = config.AuthSettings{Enabled: true, Secret: secret, TokenTTL: 600}
+	s, err := NewService(&conf)
+	assert.Nil(t, err)
+	sr := newTestRegistry()
+	assert.Nil(t, sr.Register("auth", s))
+	exp := time.Now().Add(time.Minute)
+	sign := func(key string) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"sub": "orders",
+			"exp": exp.Unix(),
+		}).SignedString([]byte(key))
+		assert.Nil(t, err)
+		return token
+	}
+	renew := func(name string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/services/"+name+"/auth/renew", nil)
+		r.SetPathValue("name", name)
+		r.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		sr.RenewToken(w, r)
+		return w
+	}
+
+	w := renew("auth", sign("renew"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res RenewResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(res.Token, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte("renew"), nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "orders", claims["sub"])
+	renewed, err := claims.GetExpirationTime()
+	assert.Nil(t, err)
+	assert.True(t, renewed.After(exp))
+
+	assert.Equal(t, http.StatusUnauthorized, renew("auth", sign("forged")).Code)
+	assert.Equal(t, http.StatusNotFound, renew("missing", sign("renew")).Code)
+}
+
+func TestRegistryCircuitBreakerCounts(t *testing.T) {
+	sc := testServiceConf("breaker", refusedAddr(t))
+	sc.CircuitBreaker = config.CircuitSettings{Enabled: true, Timeout: 60, FailureRatio: 0.5, MinimumRequests: 3}
+	rh := newTestHandler(t, []config.ServiceConf{sc}, func(c *config.Conf) {
+		c.Server.Metrics.Prefix = "counts"
+	})
+	sr := rh.ServiceRegistry
+	counts := func(name string) (int, feature.CircuitCounts) {
+		r := httptest.NewRequest(http.MethodGet, "/services/"+name+"/circuit-breaker/counts", nil)
+		r.SetPathValue("name", name)
+		w := httptest.NewRecorder()
+		sr.CircuitBreakerCounts(w, r)
+		var c feature.CircuitCounts
+		if w.Code == http.StatusOK {
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &c))
+		}
+		return w.Code, c
+	}
+
+	for i := 0; i < 2; i++ {
+		record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, "/breaker/resource", nil))
+	}
+	registry := sr.Metrics.Registry()
+	assert.Equal(t, 2.0, gathered(t, registry, "counts_circuit_breaker_requests"))
+	assert.Equal(t, 2.0, gathered(t, registry, "counts_circuit_breaker_failures"))
+	assert.Equal(t, 2.0, gathered(t, registry, "counts_circuit_breaker_consecutive_failures"))
+	assert.Equal(t, 0.0, gathered(t, registry, "counts_circuit_breaker_successes"))
+	code, c := counts("breaker")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "closed", c.State)
+	assert.Equal(t, uint32(2), c.Requests)
+	assert.Equal(t, uint32(2), c.TotalFailures)
+	assert.Equal(t, uint32(2), c.ConsecutiveFailures)
+	assert.Nil(t, c.OpenedAt)
+
+	// the third failure trips the breaker, which starts a new generation with reset counts
+	record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, "/breaker/resource", nil))
+	assert.Equal(t, 0.0, gathered(t, registry, "counts_circuit_breaker_failures"))
+	_, c = counts("breaker")
+	assert.Equal(t, "open", c.State)
+	assert.Equal(t, uint32(0), c.TotalFailures)
+	if assert.NotNil(t, c.OpenedAt) {
+		assert.WithinDuration(t, time.Now(), *c.OpenedAt, 10*time.Second)
+	}
+
+	code, _ = counts("missing")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestRegistryServiceStats(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rh := newTestHandler(t, []config.ServiceConf{testServiceConf("orders", upstream.Listener.Addr().String())})
+	sr := rh.ServiceRegistry
+	type withStats struct {
+		Stats observability.ServiceRate `json:"stats"`
+	}
+
+	for _, path := range []string{"/orders/list", "/orders/list?page=2", "/missing/list"} {
+		record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	// the rates are returned with the services
+	w := httptest.NewRecorder()
+	sr.GetServices(w, httptest.NewRequest(http.MethodGet, "/services", nil))
+	var services map[string]withStats
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &services))
+	assert.NotContains(t, services, "missing")
+	assert.Equal(t, 2, services["orders"].Stats.Requests)
+	assert.Equal(t, 0, services["orders"].Stats.Errors)
+
+	upstream.Close()
+	assert.Equal(t, http.StatusInternalServerError, record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, "/orders/list", nil)).Code)
+	r := httptest.NewRequest(http.MethodGet, "/services/orders", nil)
+	r.SetPathValue("name", "orders")
+	w = httptest.NewRecorder()
+	sr.GetServiceByName(w, r)
+	var orders withStats
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &orders))
+	assert.Equal(t, 3, orders.Stats.Requests)
+	assert.Equal(t, 1, orders.Stats.Errors)
+	assert.InDelta(t, 1.0/3, orders.Stats.ErrorRate, 0.001)
+}
+
+func TestRegistryServiceMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	addr := upstream.Listener.Addr().String()
+	namespaced := config.ServiceMetricsSettings{PerServiceNamespace: true}
+	orders, payments, static := testServiceConf("orders", addr), testServiceConf("payment-api", addr), testServiceConf("static", addr)
+	orders.Metrics, payments.Metrics, static.Metrics = namespaced, namespaced, namespaced
+	static.PathPattern = "/static/**"
+	rh := newTestHandler(t, []config.ServiceConf{orders, payments, static, testServiceConf("users", addr)}, func(c *config.Conf) {
+		c.Server.Metrics.Prefix = "scoped"
+		c.Server.VirtualHosts = map[string]string{"orders.gateway.com": "orders"}
+	})
+	sr := rh.ServiceRegistry
+	metrics := func(name string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/services/"+name+"/metrics", nil)
+		r.SetPathValue("name", name)
+		w := httptest.NewRecorder()
+		sr.ServiceMetrics(w, r)
+		return w
+	}
+
+	// the requests are recorded under the service they were forwarded to
+	byHost := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+	byHost.Host = "orders.gateway.com"
+	for _, r := range []*http.Request{
+		byHost,
+		httptest.NewRequest(http.MethodGet, "/orders/2", nil),
+		httptest.NewRequest(http.MethodGet, "/payment-api/1", nil),
+		httptest.NewRequest(http.MethodGet, "/static/css/app.css", nil),
+		httptest.NewRequest(http.MethodGet, "/users/1", nil),
+	} {
+		assert.Equal(t, http.StatusOK, record(rh.HandleRequest, r).Code)
+	}
+	assert.Equal(t, 2.0, gathered(t, sr.GetService("orders").metrics.Registry(), "scoped_orders_requests_total"))
+	assert.Equal(t, 1.0, gathered(t, sr.GetService("payment-api").metrics.Registry(), "scoped_payment_api_requests_total"))
+	assert.Equal(t, 1.0, gathered(t, sr.GetService("static").metrics.Registry(), "scoped_static_requests_total"))
+	// the namespaced services are left out of the gateway metrics
+	assert.Equal(t, 1.0, gathered(t, sr.Metrics.Registry(), "scoped_requests_total"))
+
+	w := metrics("orders")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "payment_api")
+	assert.NotContains(t, w.Body.String(), "go_goroutines")
+	// nor the metrics of the whole gateway
+	assert.NotContains(t, w.Body.String(), "panics_total")
+	assert.NotContains(t, w.Body.String(), "rate_limit_events_dropped_total")
+	assert.Equal(t, http.StatusNotFound, metrics("users").Code)
+
+	// the metrics of the service survive its update
+	patch := httptest.NewRequest(http.MethodPatch, "/services/update", strings.NewReader(`{"name":"orders","timeoutSeconds":5,"health":{"uri":"/health"}}`))
+	w = httptest.NewRecorder()
+	sr.PatchService(w, patch)
+	assert.Equal(t, http.StatusOK, w.Code)
+	record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, "/orders/3", nil))
+	assert.Equal(t, 3.0, gathered(t, sr.GetService("orders").metrics.Registry(), "scoped_orders_requests_total"))
+}
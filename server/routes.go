@@ -1,16 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
-	"github.com/ArmaanKatyal/go-api-gateway/server/auth"
 	"github.com/ArmaanKatyal/go-api-gateway/server/config"
 	"github.com/ArmaanKatyal/go-api-gateway/server/feature"
 	"github.com/ArmaanKatyal/go-api-gateway/server/middleware"
@@ -24,18 +31,76 @@ import (
 type RequestHandler struct {
 	ServiceRegistry *ServiceRegistry
 	RateLimiter     *feature.GlobalRateLimiter
+	PerIPLimiter    *feature.GlobalPerIPRateLimiter
 	Metrics         *observability.PromMetrics
+	Proxies         *feature.TrustedProxies
+	Deduplication   *feature.DeduplicationStore
+	RetryBudget     *feature.RetryBudget
+	Correlation     *feature.Correlation
+	Priority        *feature.PrioritySemaphore
+	// log of the rate limited requests, nil if disabled
+	RateLimitEvents *observability.RateLimitEventLog
+	// bearer token of the admin endpoints, empty if not configured
+	AdminToken []byte
+	// draining is set once the gateway is shutting down so /ready fails
+	draining atomic.Bool
+	// /ready fails while more than this percentage of the circuit breakers are open, disabled if 0
+	maxOpenBreakers float64
+	// hooks called around the forwarding of the requests
+	preForwardHooks  []PreForwardHook
+	postForwardHooks []PostForwardHook
+	// service names by lower case host
+	virtualHosts map[string]string
+	// semaphore limiting the requests to all the services in flight, nil if unlimited
+	upstreamSem chan struct{}
+	// limits of the request headers forwarded to the services
+	headerLimits headerLimits
 }
 
 func NewRequestHandler() *RequestHandler {
 	m := observability.NewPromMetrics()
+	proxies := feature.NewTrustedProxies(config.AppConfig.Server.TrustedProxies)
 	return &RequestHandler{
 		ServiceRegistry: NewServiceRegistry(m),
 		RateLimiter:     feature.NewGlobalRateLimiter(),
+		PerIPLimiter:    feature.NewGlobalPerIPRateLimiter(&config.AppConfig.Server.PerIPRateLimiter),
 		Metrics:         m,
+		Proxies:         proxies,
+		Deduplication:   feature.NewDeduplicationStore(),
+		RetryBudget:     feature.NewRetryBudget(&config.AppConfig.Server.RetryBudget),
+		Correlation:     feature.NewCorrelation(),
+		Priority:        feature.NewPrioritySemaphore(proxies),
+		RateLimitEvents: newRateLimitEventLog(config.AppConfig.Server.RateLimiter.EventLog, m),
+		AdminToken:      loadAdminToken(config.AppConfig.Server.Admin.TokenFile),
+		virtualHosts:    newVirtualHosts(config.AppConfig.Server.VirtualHosts),
+		upstreamSem:     newSemaphore(config.AppConfig.Server.MaxConcurrentUpstream),
+		maxOpenBreakers: config.AppConfig.Server.MaxOpenBreakersPercent,
+		headerLimits:    headerLimits{count: config.AppConfig.Server.MaxForwardedHeaders, bytes: config.AppConfig.Server.MaxForwardedHeaderBytes},
 	}
 }
 
+// newRateLimitEventLog opens the rate limit event log, the events are only logged with the
+// application logs if the path is empty or the file can't be opened
+func newRateLimitEventLog(path string, m *observability.PromMetrics) *observability.RateLimitEventLog {
+	if path == "" {
+		return nil
+	}
+	l, err := observability.NewRateLimitEventLog(path, m.IncRateLimitEventsDropped)
+	if err != nil {
+		slog.Error("Error opening rate limit event log", "path", path, "error", err.Error())
+		return nil
+	}
+	return l
+}
+
+func newVirtualHosts(hosts map[string]string) map[string]string {
+	vh := make(map[string]string, len(hosts))
+	for host, name := range hosts {
+		vh[strings.ToLower(host)] = name
+	}
+	return vh
+}
+
 // RequestToMap converts the request to a map
 func RequestToMap(r *http.Request) map[string]interface{} {
 	result := make(map[string]interface{})
@@ -57,9 +122,11 @@ func RequestToMap(r *http.Request) map[string]interface{} {
 	}
 	result["query_params"] = queryParams
 
-	if err := r.ParseForm(); err == nil {
+	// only log a form which was already parsed, parsing it here would consume the body
+	// before it is forwarded
+	if r.PostForm != nil {
 		formValues := make(map[string]string)
-		for name, values := range r.Form {
+		for name, values := range r.PostForm {
 			formValues[name] = values[0]
 		}
 		result["form_values"] = formValues
@@ -72,6 +139,12 @@ func GetStatusCode(statusCode int) string {
 	return string(rune(statusCode))
 }
 
+// parseStatusCode reverses GetStatusCode
+func parseStatusCode(code string) int {
+	r, _ := utf8.DecodeRuneInString(code)
+	return int(r)
+}
+
 // Health is a simple health check endpoint
 func Health(w http.ResponseWriter, r *http.Request) {
 	slog.Info("Health check", "req", RequestToMap(r))
@@ -81,6 +154,32 @@ func Health(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Ready reports whether the gateway should receive traffic, it fails once the gateway starts draining
+// or while too many circuit breakers are open i.e. the services are failing widely
+func (rh *RequestHandler) Ready(w http.ResponseWriter, r *http.Request) {
+	if rh.draining.Load() {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	if rh.maxOpenBreakers > 0 {
+		open, total := rh.ServiceRegistry.OpenCircuitBreakers()
+		if total > 0 && float64(open)*100 > rh.maxOpenBreakers*float64(total) {
+			slog.Warn("Not ready, too many circuit breakers open", "open", open, "total", total)
+			http.Error(w, "too many circuit breakers open", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte("OK")); err != nil {
+		slog.Error("Error writing response", "error", err.Error())
+	}
+}
+
+// Drain marks the gateway as not ready so load balancers stop routing to it
+func (rh *RequestHandler) Drain() {
+	rh.draining.Store(true)
+}
+
 // Config returns the application configuration
 func Config(w http.ResponseWriter, r *http.Request) {
 	slog.Info("Get config", "req", RequestToMap(r))
@@ -92,27 +191,215 @@ func Config(w http.ResponseWriter, r *http.Request) {
 }
 
 // InitializeRoutes initializes the application routes
-func InitializeRoutes(r *RequestHandler) *http.ServeMux {
-	go r.ServiceRegistry.Heartbeat()
+func InitializeRoutes(r *RequestHandler) http.Handler {
+	go r.ServiceRegistry.Heartbeat(time.Duration(config.AppConfig.Registry.HeartbeatInterval) * time.Second)
+	go r.ServiceRegistry.SummarizeLogSampling()
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("POST /services/register", r.ServiceRegistry.RegisterService)
 	mux.HandleFunc("POST /services/deregister", r.ServiceRegistry.DeregisterService)
 	mux.HandleFunc("GET /services", r.ServiceRegistry.GetServices)
+	mux.HandleFunc("GET /services/{name}", r.ServiceRegistry.GetServiceByName)
 	mux.HandleFunc("POST /services/update", r.ServiceRegistry.UpdateService)
+	mux.HandleFunc("PATCH /services/update", r.ServiceRegistry.PatchService)
+	mux.HandleFunc("POST /services/labels/route", r.ServiceRegistry.RouteLabels)
+	mux.HandleFunc("POST /services/{name}/auth/renew", r.ServiceRegistry.RenewToken)
+	mux.HandleFunc("POST /services/auth/reload", r.ServiceRegistry.ReloadAuth)
+	mux.Handle("POST /admin/config/reload", middleware.AdminAuthMiddleware(r.AdminToken)(http.HandlerFunc(r.ServiceRegistry.ReloadConfig)))
+	mux.HandleFunc("GET /services/{name}/circuit-breaker/counts", r.ServiceRegistry.CircuitBreakerCounts)
+	mux.HandleFunc("GET /services/{name}/metrics", r.ServiceRegistry.ServiceMetrics)
+	mux.Handle("GET /services/{name}/rate-limiter/state", middleware.AdminAuthMiddleware(r.AdminToken)(http.HandlerFunc(r.ServiceRegistry.RateLimiterState)))
 	mux.HandleFunc("GET /health", Health)
+	mux.HandleFunc("GET /ready", r.Ready)
 	mux.HandleFunc("GET /config", Config)
-	mux.HandleFunc("/", middleware.RateLimiterMiddleware(r.RateLimiter)(r.HandleRequest))
-	mux.Handle("GET /metrics", promhttp.Handler())
-	return mux
+	mux.HandleFunc("/", middleware.RateLimiterMiddleware(r.RateLimiter, r.Proxies, r.RateLimitEvents, r.resolvedService)(
+		middleware.PriorityLimitMiddleware(r.Priority)(r.HandleRequest)))
+	mux.Handle("GET /metrics", promhttp.HandlerFor(r.Metrics.Registry(), promhttp.HandlerOpts{}))
+	mux.Handle("POST /admin/loglevel", middleware.AdminAuthMiddleware(r.AdminToken)(http.HandlerFunc(r.SetLogLevel)))
+	if config.AppConfig.Server.Debug.Pprof {
+		registerDebugRoutes(mux, r)
+	}
+	return middleware.PanicRecoveryMiddleware(r.Metrics)(r.resolveMiddleware(middleware.AccessLogMiddleware(slog.Default(), r.accessLogSampleRate)(mux)))
 }
 
 func (rh *RequestHandler) circuitBreakerEnabled(svc string) bool {
 	return rh.ServiceRegistry.GetService(svc).CircuitBreaker.IsEnabled()
 }
 
+// setCacheHeader advertises if the response was served from the cache of the service
+func (rh *RequestHandler) setCacheHeader(w http.ResponseWriter, svc string, status string) {
+	s := rh.ServiceRegistry.GetService(svc)
+	if s == nil {
+		return
+	}
+	if name, ok := s.Cache.StatusHeader(); ok {
+		w.Header().Set(name, status)
+	}
+}
+
+// setResponseHeaders sets the configured headers of the service on the response
+func (rh *RequestHandler) setResponseHeaders(w http.ResponseWriter, svc string) {
+	s := rh.ServiceRegistry.GetService(svc)
+	if s == nil {
+		return
+	}
+	setResponseHeaders(w, s.ResponseHeaders)
+}
+
+func setResponseHeaders(w http.ResponseWriter, headers map[string]string) {
+	for k, v := range headers {
+		w.Header().Set(k, v)
+	}
+}
+
+// setWriteDeadline bounds the time left to write the response of the service. The deadline
+// is never later than the server WriteTimeout measured from when the request was received.
+func (rh *RequestHandler) setWriteDeadline(w http.ResponseWriter, svc string, start time.Time) {
+	s := rh.ServiceRegistry.GetService(svc)
+	if s == nil {
+		return
+	}
+	setWriteDeadline(w, s.WriteTimeout, start)
+}
+
+func setWriteDeadline(w http.ResponseWriter, timeout time.Duration, start time.Time) {
+	if timeout < 0 {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	if limit := time.Duration(config.AppConfig.Server.WriteTimeout) * time.Second; limit > 0 && start.Add(limit).Before(deadline) {
+		deadline = start.Add(limit)
+	}
+	if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil {
+		slog.Debug("Unable to set write deadline", "error", err.Error())
+	}
+}
+
+// upstreamClient returns the client used to forward requests to the service
+func (rh *RequestHandler) upstreamClient(svc string) *http.Client {
+	s := rh.ServiceRegistry.GetService(svc)
+	if s == nil || s.Transport == nil {
+		return &http.Client{}
+	}
+	return &http.Client{Transport: s.Transport}
+}
+
+// metricsInput returns the metrics labels of the response to the request with the status code
+func (rh *RequestHandler) metricsInput(r *http.Request, code int) *observability.MetricsInput {
+	return &observability.MetricsInput{Code: GetStatusCode(code), Method: r.Method, Route: rh.route(r), Service: rh.resolved(r).name}
+}
+
 func (rh *RequestHandler) CollectMetrics(input *observability.MetricsInput, t time.Time) {
-	rh.Metrics.Collect(input, t)
+	rh.ServiceRegistry.metricsFor(input.Service).Collect(input, t)
+	// only registered services are tracked to keep the stats bounded
+	if rh.ServiceRegistry.Stats != nil && rh.ServiceRegistry.GetService(input.Service) != nil {
+		rh.ServiceRegistry.Stats.Record(input.Service, parseStatusCode(input.Code))
+	}
+}
+
+// route returns the route of the request used as metrics label, the query is left out if the service ignores it
+func (rh *RequestHandler) route(r *http.Request) string {
+	if s := rh.resolved(r).service; s != nil && s.IgnoreQueryInRoute {
+		return r.URL.Path
+	}
+	return r.URL.String()
+}
+
+// resolution is the service a request resolves to
+type resolution struct {
+	name  string
+	route []string
+	// nil if no service is registered with the name
+	service *Service
+}
+
+type resolutionKey struct{}
+
+// resolveMiddleware resolves the service of the request once, a label route then picks the
+// same service for forwarding the request as for its logs, metrics and stats
+func (rh *RequestHandler) resolveMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), resolutionKey{}, rh.resolve(r))))
+	})
+}
+
+// resolved returns the service the request was resolved to, it is resolved if it wasn't yet
+func (rh *RequestHandler) resolved(r *http.Request) resolution {
+	if res, ok := r.Context().Value(resolutionKey{}).(resolution); ok {
+		return res
+	}
+	return rh.resolve(r)
+}
+
+// resolvedService returns the name of the registered service the request resolved to, empty if none
+func (rh *RequestHandler) resolvedService(r *http.Request) string {
+	if res := rh.resolved(r); res.service != nil {
+		return res.name
+	}
+	return ""
+}
+
+func (rh *RequestHandler) resolve(r *http.Request) resolution {
+	name, route := rh.resolveService(r)
+	return resolution{name: name, route: route, service: rh.ServiceRegistry.GetService(name)}
+}
+
+// resolveService returns the name of the service handling the request and the route path,
+// a virtual host takes precedence over the path prefix
+func (rh *RequestHandler) resolveService(r *http.Request) (string, []string) {
+	if name, ok := rh.virtualHost(r.Host); ok {
+		return name, strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	}
+	prefix, route := rh.resolvePath(r.URL.Path)
+	name := rh.ServiceRegistry.ResolveName(prefix)
+	if rh.ServiceRegistry.GetService(name) == nil {
+		if matched, suffix, ok := rh.ServiceRegistry.MatchPattern(r.URL.Path); ok {
+			if suffix == "" {
+				return matched, nil
+			}
+			return matched, strings.Split(strings.TrimPrefix(suffix, "/"), "/")
+		}
+	}
+	return name, route
+}
+
+// accessLogSampleRate returns the access log sample rate of the service the request resolved to,
+// the server rate applies to the other requests
+func (rh *RequestHandler) accessLogSampleRate(r *http.Request) float64 {
+	if s := rh.resolved(r).service; s != nil && s.AccessLog.Sampled {
+		return s.AccessLog.SampleRate
+	}
+	if server := config.AppConfig.Server.AccessLog; server.Sampled {
+		return server.SampleRate
+	}
+	return 1
+}
+
+// virtualHost returns the service name of the host, with or without its port
+func (rh *RequestHandler) virtualHost(host string) (string, bool) {
+	if len(rh.virtualHosts) == 0 {
+		return "", false
+	}
+	host = strings.ToLower(host)
+	if name, ok := rh.virtualHosts[host]; ok {
+		return name, true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name, ok := rh.virtualHosts[h]
+		return name, ok
+	}
+	return "", false
+}
+
+// pathDepth returns the number of non-empty segments of the path e.g. 3 for /orders/items/1
+func pathDepth(path string) int {
+	depth := 0
+	for _, seg := range strings.Split(path, "/") {
+		if seg != "" {
+			depth++
+		}
+	}
+	return depth
 }
 
 // resolvePath splits the path into service name and route path
@@ -124,273 +411,858 @@ func (rh *RequestHandler) resolvePath(path string) (string, []string) {
 	return parts[1], parts[2:]
 }
 
-// createForwardURI creates a new uri based on the resolved request
-func (rh *RequestHandler) createForwardURI(address string, route []string, query string) string {
-	if !strings.HasPrefix(address, "http://") && !strings.HasPrefix(address, "https://") {
-		address = "http://" + address
-	}
-	forwardUri := address + "/" + strings.Join(route, "/")
+// createForwardURI creates a new uri based on the resolved request, scheme is used if the address has none
+// and pathPrefix is prepended to the route
+func (rh *RequestHandler) createForwardURI(scheme string, address string, pathPrefix string, route []string, query string) string {
+	forwardUri := withScheme(scheme, address) + withPathPrefix(pathPrefix, "/"+strings.Join(route, "/"))
 	if query != "" {
 		forwardUri = forwardUri + "?" + query
 	}
 	return forwardUri
 }
 
+// withScheme prefixes the address with the scheme, defaulting to http, unless it already has one
+func withScheme(scheme string, address string) string {
+	if strings.HasPrefix(address, "http://") || strings.HasPrefix(address, "https://") {
+		return address
+	}
+	if scheme == "" {
+		scheme = DefaultScheme
+	}
+	return scheme + "://" + address
+}
+
+// withPathPrefix prepends the prefix to the path, the prefix is used with a single leading
+// slash and no trailing slash whatever its configured form
+func withPathPrefix(prefix string, path string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return path
+	}
+	return "/" + prefix + path
+}
+
 // HandleRequest handles the incoming request and forwards it to the resolved service
 func (rh *RequestHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	slog.Info("Received request", "req", RequestToMap(r))
-	serviceName, route := rh.resolvePath(r.URL.Path)
-	slog.Info("Resolving service", "service_name", serviceName)
-	service := rh.ServiceRegistry.GetService(serviceName)
+	res := rh.resolved(r)
+	serviceName, route, service := res.name, res.route, res.service
+	// the requests to the service are logged at its sample rate, the errors are always logged
+	if service != nil && !service.LogSampler.Sample() {
+		r = r.WithContext(observability.WithLogger(r.Context(), discardLogger))
+	}
+	log := observability.Logger(r.Context())
+	log.Info("Received request", "req", RequestToMap(r))
+	log.Info("Resolving service", "service_name", serviceName)
 	if service == nil {
-		slog.Error("No service exists with the provided name", "service", serviceName)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		rh.writeError(w, r, opError("resolve service", serviceName, ErrServiceNotFound, nil), start)
+		return
+	}
+	if depth := pathDepth(r.URL.Path); !service.AcceptsDepth(depth) {
+		log.Info("Path depth outside the range of the service", "service", serviceName, "path", r.URL.Path, "depth", depth)
+		rh.writeError(w, r, opError("match path depth", serviceName, ErrServiceNotFound, nil), start)
+		return
+	}
+	// the headers are checked before the gateway adds its own e.g. the claims
+	if size := headerSize(r.Header); service.MaxHeaderBytes > 0 && size > service.MaxHeaderBytes {
+		err := fmt.Errorf("%d header bytes exceed the limit of %d", size, service.MaxHeaderBytes)
+		rh.writeError(w, r, opError("read request", serviceName, ErrHeadersTooLarge, err), start)
+		return
+	}
+	// override the method first so the policies below see the intended method
+	if service.HTTPMethodOverride {
+		if method, ok := feature.OverrideMethod(r); ok {
+			log.Debug("Overriding request method", "service", serviceName, "path", r.URL.Path, "method", method)
+		}
+	}
+	// the rate limits are checked first, a request waiting in the queue of the limiter doesn't
+	// hold a concurrency slot nor count as in flight
+	client := rh.Proxies.Resolve(r)
+	if rh.PerIPLimiter != nil && rh.PerIPLimiter.IsEnabled() && !rh.PerIPLimiter.GetVisitor(client.For).Limiter.Allow() {
+		rh.RateLimitEvents.Record(rateLimitEvent(r, client.For, serviceName))
+		rh.writeError(w, r, opError("per ip rate limit", serviceName, ErrRateLimited, fmt.Errorf("ip %s", client.For)), start)
 		return
 	}
-	if service.IsRateLimiterEnabled() && !service.RateLimitIP(r.RemoteAddr) {
-		slog.Error("Rate limit exceeded", "path", r.URL.Path, "method", r.Method, "ip", r.RemoteAddr, "service", serviceName)
-		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
-		rh.CollectMetrics(&observability.MetricsInput{Code: GetStatusCode(http.StatusTooManyRequests), Method: r.Method, Route: r.URL.String()}, start)
+	if service.IsRateLimiterEnabled() && !service.RateLimitIP(r.Context(), client.For) {
+		rh.ServiceRegistry.metricsFor(serviceName).IncRateLimited(serviceName)
+		rh.RateLimitEvents.Record(rateLimitEvent(r, client.For, serviceName))
+		rh.writeError(w, r, opError("rate limit", serviceName, ErrRateLimited, fmt.Errorf("ip %s", client.For)), start)
 		return
 	}
-	if ok, err := service.IsWhitelisted(r.RemoteAddr); !ok || err != nil {
-		slog.Error("Unauthorized request", "path", r.URL.Path, "method", r.Method, "ip", r.RemoteAddr, "service_name", serviceName)
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		rh.CollectMetrics(&observability.MetricsInput{Code: GetStatusCode(http.StatusUnauthorized), Method: r.Method, Route: r.URL.String()}, start)
+	if !service.tryAcquire() {
+		rh.writeError(w, r, opError("acquire", serviceName, ErrServiceBusy, nil), start)
+		return
+	}
+	defer service.release()
+	service.inFlight.Add(1)
+	defer service.inFlight.Add(-1)
+	rh.RetryBudget.Begin()
+	defer rh.RetryBudget.End()
+	if !service.IsWhitelisted(client.For) {
+		rh.ServiceRegistry.metricsFor(serviceName).IncWhitelistDenied(serviceName)
+		rh.writeError(w, r, opError("whitelist", serviceName, ErrNotWhitelisted, fmt.Errorf("ip %s", client.For)), start)
 		return
 	}
 
-	if err := service.Authenticate(r); err != nil {
+	if err := service.Authenticate(r, route); err != nil {
 		// If Auth fails reject the request with an appropriate message and status code
-		switch err {
-		case auth.ErrTokenMissing:
-			slog.Error("Auth failed", "service_name", serviceName, "error", err.Error())
-			http.Error(w, "token missing", http.StatusUnauthorized)
-			rh.CollectMetrics(&observability.MetricsInput{Code: GetStatusCode(http.StatusUnauthorized), Method: r.Method, Route: r.URL.String()}, start)
-			return
-		case auth.ErrInvalidToken:
-			slog.Error("Auth failed", "service_name", serviceName, "error", err.Error())
-			http.Error(w, "invalid token", http.StatusUnauthorized)
-			rh.CollectMetrics(&observability.MetricsInput{Code: GetStatusCode(http.StatusUnauthorized), Method: r.Method, Route: r.URL.String()}, start)
-			return
-		default:
-			slog.Error("Auth failed", "service_name", serviceName, "error", err.Error())
-			http.Error(w, "auth failed", http.StatusUnauthorized)
-			rh.CollectMetrics(&observability.MetricsInput{Code: GetStatusCode(http.StatusUnauthorized), Method: r.Method, Route: r.URL.String()}, start)
+		rh.writeError(w, r, opError("authenticate", serviceName, ErrAuthFailure, err), start)
+		return
+	}
+
+	if service.Addr == "" {
+		rh.writeError(w, r, opError("resolve address", serviceName, ErrServiceNotFound, nil), start)
+		return
+	}
+
+	// duplicates are only replayed to the caller which made the request, once it is authenticated
+	middleware.DeduplicationMiddleware(rh.Deduplication)(func(w http.ResponseWriter, r *http.Request) {
+		rh.serveRequest(w, r, service, serviceName, route, start)
+	})(w, r)
+}
+
+// serveRequest serves the authenticated request from the mock or the cache of the service, or
+// forwards it to the service
+func (rh *RequestHandler) serveRequest(w http.ResponseWriter, r *http.Request, service *Service, serviceName string, route []string, start time.Time) {
+	log := observability.Logger(r.Context())
+	if service.DecompressRequest {
+		if err := feature.DecompressRequest(r, service.MaxDecompressedSize); err != nil {
+			rh.writeError(w, r, opError("decompress request", serviceName, ErrBadRequest, err), start)
 			return
 		}
 	}
 
-	if service.Addr == "" {
-		slog.Error("Service not found", "service_name", serviceName)
-		http.Error(w, "service not found", http.StatusNotFound)
-		rh.CollectMetrics(&observability.MetricsInput{Code: GetStatusCode(http.StatusNotFound), Method: r.Method, Route: r.URL.String()}, start)
+	// Serve mocked responses instead of forwarding
+	if service.Mock.IsEnabled() {
+		rh.serveMock(w, r, service.Mock, serviceName, route, start)
 		return
 	}
 
-	// Check cache for the service
+	// Check cache for the service, writes to a write through cache always reach the service
+	writeThrough := isWriteThrough(service, r)
 	key := rh.generateCacheKey(serviceName, r)
 	v, hit := service.Cache.Get(key)
-	if service.Cache.IsEnabled() && hit {
-		slog.Info("Cache hit", "service", serviceName, "path", r.URL.Path, "method", r.Method)
+	if cached, ok := v.(*feature.CachedResponse); ok && hit {
+		// a body encoded by the service is only served to the clients accepting its encoding
+		_, _, hit = cached.Negotiate(r.Header.Get("Accept-Encoding"))
+	}
+	upgrade := isUpgradeRequest(r)
+	if service.Cache.IsEnabled() && hit && !writeThrough && !upgrade {
+		log.Info("Cache hit", "service", serviceName, "path", r.URL.Path, "method", r.Method)
 		switch value := v.(type) {
-		case []byte:
+		case *feature.CachedResponse:
+			// the entry is stored once, gzip is served to the clients accepting it
+			body, encoding, _ := value.Negotiate(r.Header.Get("Accept-Encoding"))
+			if value.ContentType != "" {
+				w.Header().Set("Content-Type", value.ContentType)
+			}
+			if encoding != "" {
+				w.Header().Set("Content-Encoding", encoding)
+			}
+			w.Header().Add("Vary", "Accept-Encoding")
+			setResponseHeaders(w, service.ResponseHeaders)
+			rh.setCacheHeader(w, serviceName, feature.CacheHit)
 			w.WriteHeader(http.StatusOK)
-			_, err := w.Write(value)
+			_, err := w.Write(body)
 			if err != nil {
 				slog.Error("Error writing response", "error", err.Error())
 				http.Error(w, "error writing response", http.StatusInternalServerError)
-				rh.CollectMetrics(&observability.MetricsInput{Code: GetStatusCode(http.StatusInternalServerError), Method: r.Method, Route: r.URL.String()}, start)
+				rh.CollectMetrics(rh.metricsInput(r, http.StatusInternalServerError), start)
 				return
 			}
-			rh.CollectMetrics(&observability.MetricsInput{Code: GetStatusCode(http.StatusOK), Method: r.Method, Route: r.URL.String()}, start)
+			rh.CollectMetrics(rh.metricsInput(r, http.StatusOK), start)
 			return
 		default:
-			slog.Error("Wrong type data from cache", "service", serviceName, "path", r.URL.Path)
-			http.Error(w, "return data type mismatch", http.StatusInternalServerError)
-			rh.CollectMetrics(&observability.MetricsInput{Code: GetStatusCode(http.StatusInternalServerError), Method: r.Method, Route: r.URL.String()}, start)
+			rh.writeError(w, r, opError("get cache", serviceName, ErrCacheFailure, fmt.Errorf("unexpected type %T", value)), start)
 			return
 		}
 	}
 
-	// Create a new uri based on the resolved request
-	forwardUri := rh.createForwardURI(service.Addr, route, r.URL.RawQuery)
+	// Create a new uri based on the resolved request, match rules take precedence over the weighted backends
+	addr := service.Addr
+	if picked, ok := pickBackend(w, r, service); ok {
+		addr = picked
+	}
+	if matched, ok := service.Router.Match(r.Header); ok {
+		log.Info("Matched routing rule", "service", serviceName, "address", matched)
+		addr = matched
+	}
+	forwardUri := rh.createForwardURI(service.Scheme, addr, service.UpstreamPathPrefix, route, r.URL.RawQuery)
+
+	log.Info("Forwarding request", "forward_uri", forwardUri, "service_name", serviceName)
 
-	slog.Info("Forwarding request", "forward_uri", forwardUri, "service_name", serviceName)
+	if err := rh.runPreForwardHooks(r, service); err != nil {
+		rh.writeError(w, r, opError("pre forward hook", serviceName, ErrHookFailure, err), start)
+		return
+	}
+
+	// upgraded connections are long lived, they are neither bounded by the timeouts nor retried
+	if upgrade {
+		if err := rh.proxyUpgrade(w, r, forwardUri, service, serviceName, start); err != nil {
+			rh.writeError(w, r, err, start)
+		}
+		return
+	}
+
+	// bound the request to the service, the endpoint and then the method timeouts override the
+	// one of the service
+	var timeout time.Duration
+	if service.Timeouts != nil {
+		timeout = service.Timeouts.MatchRequest(r.Method, "/"+strings.Join(route, "/"))
+	}
 
 	var err error
 	// Forward the request with or without circuit breaker
 	if rh.circuitBreakerEnabled(serviceName) {
-		err = rh.forwardRequestCB(w, r, forwardUri, service.CircuitBreaker, serviceName, start)
+		// the breaker bounds the attempt itself so a timeout counts as a failure without
+		// cutting the fallback short
+		err = rh.forwardRequestCB(w, r, forwardUri, service.CircuitBreaker, serviceName, timeout, start)
 	} else {
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
 		err = rh.forwardRequest(w, r, forwardUri, serviceName, start)
 	}
+	if writeThrough {
+		// invalidate after the write completes, reads during the write may still see the old value
+		service.Cache.Invalidate(r.URL.String())
+	}
 	if err != nil {
-		slog.Error("Error forwarding request", "error", err.Error(), "service_name", serviceName)
-		http.Error(w, "service is down", http.StatusInternalServerError)
-		rh.CollectMetrics(&observability.MetricsInput{Code: GetStatusCode(http.StatusInternalServerError), Method: r.Method, Route: r.URL.String()}, start)
+		rh.writeError(w, r, err, start)
+	}
+}
+
+// rateLimitEvent describes the rate limited request of the client to the service
+func rateLimitEvent(r *http.Request, ip string, service string) observability.RateLimitEvent {
+	return observability.RateLimitEvent{Timestamp: time.Now(), IP: ip, Service: service, Path: r.URL.Path, Method: r.Method}
+}
+
+// pickBackend picks the address among the weighted backends of the service, with sticky
+// sessions the session cookie is hashed so the client keeps the same backend
+func pickBackend(w http.ResponseWriter, r *http.Request, s *Service) (string, bool) {
+	if s.StickyCookie == "" {
+		return s.Backends.Pick()
+	}
+	var session string
+	if c, err := r.Cookie(s.StickyCookie); err == nil && c.Value != "" {
+		session = c.Value
+	} else {
+		session = uuid.NewString()
+		http.SetCookie(w, &http.Cookie{Name: s.StickyCookie, Value: session, Path: "/", HttpOnly: true})
+	}
+	return s.Backends.PickKey(session)
+}
+
+// writeError logs the error and replies with the status code derived from it
+func (rh *RequestHandler) writeError(w http.ResponseWriter, r *http.Request, err error, t time.Time) {
+	code := StatusCode(err)
+	var opErr *OpError
+	if errors.As(err, &opErr) {
+		slog.Error("Request failed", "operation", opErr.Op, "service_name", opErr.Service, "path", r.URL.Path, "error", err.Error())
+	} else {
+		slog.Error("Request failed", "path", r.URL.Path, "error", err.Error())
+	}
+	if isRejection(err) {
+		w.Header().Set("Retry-After", "1")
+	}
+	http.Error(w, errorMessage(err), code)
+	rh.CollectMetrics(rh.metricsInput(r, code), t)
+}
+
+// serveMock writes the mocked response matching the request or a 404 if there is none
+func (rh *RequestHandler) serveMock(w http.ResponseWriter, r *http.Request, mock IMock, service string, route []string, t time.Time) {
+	path := "/" + strings.Join(route, "/")
+	resp, ok := mock.Match(r.Method, path)
+	if !ok {
+		rh.writeError(w, r, opError("match mock", service, ErrMockNotFound, fmt.Errorf("%s %s", r.Method, path)), t)
+		return
+	}
+	observability.Logger(r.Context()).Info("Serving mock", "service", service, "path", path, "method", r.Method)
+	if err := resp.Write(w); err != nil {
+		slog.Error("Error writing response", "error", err.Error())
 	}
+	rh.CollectMetrics(rh.metricsInput(r, resp.Status), t)
 }
 
-// generateCacheKey generates a key based on the service name and request.URL
+// generateCacheKey generates a key based on the service name, the normalized method and request.URL
 // TODO: maybe also include request.Headers and hash them together to generate more cohesive key
 func (rh *RequestHandler) generateCacheKey(service string, r *http.Request) string {
+	// sort the header names so the key doesn't depend on map iteration order
+	names := make([]string, 0, len(r.Header))
+	for k := range r.Header {
+		// the encoding is negotiated on hit from the one stored entry
+		if k == "Accept-Encoding" {
+			continue
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
 	headers := ""
-	for k, v := range r.Header {
-		headers += "[" + k + "-" + strings.Join(v, "-") + "]"
+	for _, k := range names {
+		headers += "[" + k + "-" + normalizeHeaderValues(r.Header[k]) + "]"
 	}
 	val, err := io.ReadAll(r.Body)
 	if err != nil {
 		slog.Error("failed to parse req body while generating cache key", "service", service, "req", RequestToMap(r))
 		val = []byte{}
 	}
-	components := []string{service, r.Method, r.URL.String(), headers, string(val)}
+	// restore the body so it can still be forwarded
+	r.Body = io.NopCloser(bytes.NewReader(val))
+	components := []string{service, strings.ToUpper(r.Method), r.URL.String(), headers, string(val)}
 	baseKey := "cache-" + strings.Join(components, "-")
 	h := sha256.New()
 	h.Write([]byte(baseKey))
 	return string(h.Sum(nil))
 }
 
-// forwardRequest forwards the request to the resolved service
-func (rh *RequestHandler) forwardRequest(w http.ResponseWriter, r *http.Request, forwardUri string, service string, t time.Time) error {
-	req, err := http.NewRequest(r.Method, forwardUri, r.Body)
-	if err != nil {
-		rh.CollectMetrics(&observability.MetricsInput{Code: GetStatusCode(http.StatusInternalServerError), Method: r.Method, Route: r.URL.String()}, t)
-		return err
+// normalizeHeaderValues joins the values of a header repeated on several lines in sorted order, so
+// the order of the lines doesn't change the cache key. The values themselves are kept as sent, the
+// order within a line can be significant e.g. for Accept-Language
+func normalizeHeaderValues(values []string) string {
+	if len(values) > 1 {
+		values = slices.Clone(values)
+		sort.Strings(values)
 	}
-	req.Header = cloneHeader(r.Header)
+	return strings.Join(values, "\n")
+}
 
-	// add a unique trace id to every request for tracing
-	req.Header.Add("X-Trace-Id", uuid.NewString())
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// forwardRequest forwards the request to the resolved service
+func (rh *RequestHandler) forwardRequest(w http.ResponseWriter, r *http.Request, forwardUri string, service string, t time.Time) error {
+	resp, err := rh.sendUpstream(r, forwardUri, service)
 	if err != nil {
-		rh.CollectMetrics(&observability.MetricsInput{Code: GetStatusCode(http.StatusInternalServerError), Method: r.Method, Route: r.URL.String()}, t)
 		return err
 	}
 	defer func(Body io.ReadCloser) {
 		_ = Body.Close()
 	}(resp.Body)
+	return rh.writeResponse(w, r, resp, service, t)
+}
+
+// writeResponse copies the response of the service to the client, caching it if allowed
+func (rh *RequestHandler) writeResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, service string, t time.Time) error {
+	s := rh.ServiceRegistry.GetService(service)
+	if err := rh.runPostForwardHooks(resp, s); err != nil {
+		return opError("post forward hook", service, ErrHookFailure, err)
+	}
+	rh.purgeOnAuthFailure(r, service, resp.StatusCode)
 	// Copy the response from the resolved service
 	copyResponseHeaders(w, resp)
+	rh.setResponseHeaders(w, service)
+	cacheable := rh.isCacheable(r, service, resp.StatusCode, resp.Header)
+	if cacheable {
+		rh.setCacheHeader(w, service, feature.CacheMiss)
+	}
+	announceTrailers(w, resp.Trailer, s)
 	w.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(w, resp.Body)
+	rh.setWriteDeadline(w, service, t)
+	// keep a copy of the body while writing it if it is going to be cached or logged
+	var bodies *feature.BodyLogger
+	if s != nil {
+		bodies = s.DebugBodies
+	}
+	var body bytes.Buffer
+	var src io.Reader = resp.Body
+	if cacheable || bodies != nil {
+		src = io.TeeReader(resp.Body, &body)
+	}
+	n, err := io.Copy(w, src)
 	if err != nil {
-		return err
+		return opError("copy response", service, ErrForwardFailure, err)
 	}
+	rh.ServiceRegistry.metricsFor(service).ObserveResponseSize(service, r.Method, resp.StatusCode, n)
+	// the trailers are only known once the body is read
+	copyTrailers(w, resp.Trailer, s)
+	bodies.LogResponse(service, r, resp.StatusCode, body.Bytes())
 
 	// Save the response in the cache
-	val, err := io.ReadAll(resp.Body)
+	if cacheable && rh.fitsCache(r, service, body.Len()) {
+		key := rh.generateCacheKey(service, r)
+		if ok := rh.ServiceRegistry.SetCache(service, r.URL.String(), key, feature.NewCachedResponse(body.Bytes(), resp.Header), resp.Header); !ok {
+			return opError("set cache", service, ErrCacheFailure, nil)
+		}
+		observability.Logger(r.Context()).Info("SetCache successful", "service", service, "path", r.URL.String(), "key", key)
+	}
+
+	rh.CollectMetrics(rh.metricsInput(r, resp.StatusCode), t)
+	return nil
+}
+
+// sendUpstream sends the request to the service. The failed attempts matching the retry policy
+// of the service are retried up to its retries while the retry budget allows it.
+func (rh *RequestHandler) sendUpstream(r *http.Request, forwardURI string, service string) (*http.Response, error) {
+	retries, maxHeaderBytes := 0, 0
+	var budget IRetryBudget
+	var policy *feature.RetryPolicy
+	var authFailure *feature.AuthFailurePolicy
+	var bodies *feature.BodyLogger
+	var allow *feature.HeaderAllowList
+	forwarded := ""
+	trailers := false
+	if s := rh.ServiceRegistry.GetService(service); s != nil {
+		retries, budget, authFailure, forwarded = s.Retries, s.RetryBudget, s.AuthFailure, s.ForwardedHeaders
+		policy, bodies, trailers = s.RetryPolicy, s.DebugBodies, s.ForwardTrailers
+		maxHeaderBytes, allow = s.MaxHeaderBytes, s.HeaderAllowList
+	}
+	if err := bodies.LogRequest(service, r); err != nil {
+		return nil, opError("read request", service, ErrForwardFailure, err)
+	}
+	// a request which isn't safe to send twice is only attempted once
+	if !policy.Retriable(r) {
+		retries = 0
+	}
+	// keep the body so it can be sent again
+	replay := retries > 0 || authFailure.StripsClaims(r.Header)
+	var body []byte
+	stream := r.Body
+	if replay && r.Body != nil {
+		limit := policy.BodyLimit()
+		var err error
+		if body, err = io.ReadAll(io.LimitReader(r.Body, limit+1)); err != nil {
+			return nil, opError("read request", service, ErrForwardFailure, err)
+		}
+		// a body over the limit isn't kept, the request is sent once with the part already read
+		if int64(len(body)) > limit {
+			slog.Warn("Request body too large to retry", "service", service, "limit", limit)
+			stream = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			replay, retries, body = false, 0, nil
+		}
+	}
+	// correlate the request with the id sent by the client or a new one, it is the same for the retries
+	traceID := rh.Correlation.ID(r)
+	// the header is checked once, the attempts forward their own copy of it
+	header, err := cloneHeader(r.Header, rh.headerLimits, allow)
 	if err != nil {
-		return err
+		return nil, opError("forward", service, ErrHeadersTooLarge, err)
+	}
+	client := rh.upstreamClient(service)
+	send := func() (*http.Response, error) {
+		reqBody := stream
+		if replay {
+			reqBody = io.NopCloser(bytes.NewReader(body))
+		}
+		req, err := http.NewRequestWithContext(r.Context(), r.Method, forwardURI, reqBody)
+		if err != nil {
+			return nil, opError("create request", service, ErrForwardFailure, err)
+		}
+		req.Header = header.Clone()
+		// the values of the trailers are filled in once the body is read, while it is sent
+		if trailers && len(r.Trailer) > 0 {
+			req.Trailer = r.Trailer
+			// trailers are only sent with a chunked body, the length of the body is left unknown
+			req.ContentLength = -1
+		}
+		rh.Proxies.ForwardHeadersWithPolicy(req.Header, r, forwarded)
+		rh.Correlation.Set(req.Header, traceID)
+		dropOversizedHeaders(req.Header, maxHeaderBytes, service)
+		if !rh.acquireUpstream() {
+			slog.Error("Upstream concurrency limit reached", "service", service, "path", r.URL.Path)
+			return nil, opError("forward", service, ErrUpstreamLimit, nil)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			rh.releaseUpstream()
+			if isTimeout(err) {
+				return nil, opError("forward", service, ErrUpstreamTimeout, err)
+			}
+			return nil, opError("forward", service, ErrForwardFailure, err)
+		}
+		// the request is in flight until its response is read
+		resp.Body = &releaseBody{ReadCloser: resp.Body, release: rh.releaseUpstream}
+		return resp, nil
+	}
+
+	resp, err := send()
+	for attempt := 1; attempt <= retries && !errors.Is(err, ErrUpstreamLimit) && policy.ShouldRetry(resp, err); attempt++ {
+		if !rh.RetryBudget.TryAcquire() {
+			slog.Warn("Retry budget exhausted", "service", service, "attempt", attempt)
+			return resp, err
+		}
+		if budget != nil && !budget.Allow() {
+			rh.RetryBudget.Release()
+			slog.Warn("Service retry budget exhausted", "service", service, "attempt", attempt)
+			return resp, err
+		}
+		if err != nil {
+			observability.Logger(r.Context()).Info("Retrying request", "service", service, "attempt", attempt, "error", err.Error())
+		} else {
+			observability.Logger(r.Context()).Info("Retrying request", "service", service, "attempt", attempt, "status", resp.StatusCode)
+			_ = resp.Body.Close()
+		}
+		resp, err = send()
+		rh.RetryBudget.Release()
+	}
+	// give the service a chance to authenticate the request itself once it rejected the claims
+	if err == nil && replay && authFailure.ShouldRetryWithoutClaims(resp.StatusCode, header) && rh.RetryBudget.TryAcquire() {
+		observability.Logger(r.Context()).Info("Retrying request without claims", "service", service, "status", resp.StatusCode)
+		_ = resp.Body.Close()
+		header = header.Clone()
+		header.Del(feature.ClaimsHeader)
+		resp, err = send()
+		rh.RetryBudget.Release()
+	}
+	return resp, err
+}
+
+// isTimeout reports whether the request to a service failed because it took too long, the
+// client going away isn't a timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// acquireUpstream reserves a slot for a request to a service without blocking, it returns
+// false if Server.MaxConcurrentUpstream requests are already in flight
+func (rh *RequestHandler) acquireUpstream() bool {
+	if rh.upstreamSem == nil {
+		return true
+	}
+	select {
+	case rh.upstreamSem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// upstreamFull reports whether Server.MaxConcurrentUpstream requests are in flight, without
+// reserving a slot
+func (rh *RequestHandler) upstreamFull() bool {
+	return rh.upstreamSem != nil && len(rh.upstreamSem) == cap(rh.upstreamSem)
+}
+
+func (rh *RequestHandler) releaseUpstream() {
+	if rh.upstreamSem != nil {
+		<-rh.upstreamSem
+	}
+}
+
+// releaseBody releases the upstream slot of the response once its body is closed
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// purgeOnAuthFailure deletes the cached response of the request once the service rejects it
+// as unauthorized, so the stale response isn't served until it expires
+func (rh *RequestHandler) purgeOnAuthFailure(r *http.Request, service string, status int) {
+	s := rh.ServiceRegistry.GetService(service)
+	if s == nil || !s.Cache.IsEnabled() || !s.AuthFailure.ShouldPurge(status) {
+		return
 	}
 	key := rh.generateCacheKey(service, r)
-	if ok := rh.ServiceRegistry.SetCache(service, key, val); !ok {
-		slog.Error("error setting value in cache", "service", service, "path", r.URL.String(), "key", key)
-		return errors.New("SetCache failed")
+	s.Cache.Delete(key)
+	observability.Logger(r.Context()).Info("Purged cache on auth failure", "service", service, "path", r.URL.String(), "status", status)
+}
+
+// isCacheable checks if the upstream response can be stored in the cache. Only the body is
+// stored and a cache hit is replayed as a 200, so other statuses are not cached.
+func (rh *RequestHandler) isCacheable(r *http.Request, svc string, status int, h http.Header) bool {
+	if status != http.StatusOK {
+		return false
+	}
+	s := rh.ServiceRegistry.GetService(svc)
+	if s == nil || isWriteThrough(s, r) {
+		return false
+	}
+	// a response with a max-age of 0 is already stale
+	if ttl, ok := feature.MaxAge(h); ok && ttl == 0 {
+		return false
+	}
+	return s.Cache.IsCacheableContentType(h.Get("Content-Type"))
+}
+
+// fitsCache checks if a response body of size bytes is small enough to be cached by the service
+func (rh *RequestHandler) fitsCache(r *http.Request, svc string, size int) bool {
+	s := rh.ServiceRegistry.GetService(svc)
+	if s == nil {
+		return false
+	}
+	if !s.Cache.FitsBody(size) {
+		slog.Debug("Response too large to cache", "service", svc, "path", r.URL.String(), "size", size)
+		return false
 	}
-	slog.Info("SetCache successful", "service", service, "path", r.URL.String(), "key", key)
+	return true
+}
 
-	rh.CollectMetrics(&observability.MetricsInput{Code: GetStatusCode(resp.StatusCode), Method: r.Method, Route: r.URL.String()}, t)
+// isWriteThrough checks if the request is a write whose resource must be invalidated
+func isWriteThrough(s *Service, r *http.Request) bool {
+	if !s.Cache.IsEnabled() || !s.Cache.IsWriteThrough() {
+		return false
+	}
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// headerLimits bounds the number of values and the total size of the request headers forwarded
+// to a service, a limit of 0 is unlimited
+type headerLimits struct {
+	count int
+	bytes int
+}
+
+// check returns an error if the header exceeds the limits, the size of every value includes
+// the size of its name
+func (l headerLimits) check(h http.Header) error {
+	if l.count == 0 && l.bytes == 0 {
+		return nil
+	}
+	count := 0
+	for _, v := range h {
+		count += len(v)
+	}
+	if l.count > 0 && count > l.count {
+		return fmt.Errorf("%d header values exceed the limit of %d", count, l.count)
+	}
+	if size := headerSize(h); l.bytes > 0 && size > l.bytes {
+		return fmt.Errorf("%d header bytes exceed the limit of %d", size, l.bytes)
+	}
 	return nil
 }
 
-// cloneHeader clones the header
-func cloneHeader(h http.Header) http.Header {
+// headerSize returns the size of the names and values of the header, the name counts once per value
+func headerSize(h http.Header) int {
+	size := 0
+	for k, v := range h {
+		size += fieldSize(k, v)
+	}
+	return size
+}
+
+// fieldSize returns the size of the name and values of a header, the name is counted once per value
+func fieldSize(k string, v []string) int {
+	size := 0
+	for _, value := range v {
+		size += len(k) + len(value)
+	}
+	return size
+}
+
+// dropOversizedHeaders removes the headers whose values alone exceed the maximum size, the
+// headers of the client were checked so only the ones added by the gateway can be dropped
+func dropOversizedHeaders(h http.Header, maxBytes int, service string) {
+	if maxBytes == 0 {
+		return
+	}
+	for k, v := range h {
+		if size := fieldSize(k, v); size > maxBytes {
+			slog.Warn("Dropping oversized header", "service", service, "header", k, "size", size, "maxHeaderBytes", maxBytes)
+			delete(h, k)
+		}
+	}
+}
+
+// cloneHeader clones the header forwarded to a service, it fails if the header exceeds the limits.
+// Only the headers allowed by the service are cloned
+func cloneHeader(h http.Header, limits headerLimits, allow *feature.HeaderAllowList) (http.Header, error) {
+	if err := limits.check(h); err != nil {
+		return nil, err
+	}
 	cloned := make(http.Header, len(h))
 	for k, v := range h {
-		cloned[k] = append([]string(nil), v...)
+		if allow.Allows(k) {
+			cloned[k] = append([]string(nil), v...)
+		}
 	}
-	return cloned
+	return cloned, nil
 }
 
-// copyResponseHeaders copies the response headers
+// copyResponseHeaders copies the response headers, the values are added to the ones already
+// set by the gateway e.g. the sticky session cookie
 func copyResponseHeaders(w http.ResponseWriter, resp *http.Response) {
 	for k, v := range resp.Header {
-		w.Header()[k] = v
+		w.Header()[k] = append(w.Header()[k], v...)
+	}
+}
+
+// announceTrailers declares the trailers the service announced before the response is written
+// so it is chunked, a response with a length can't carry trailers
+func announceTrailers(w http.ResponseWriter, trailer http.Header, s *Service) {
+	if s == nil || !s.ForwardTrailers {
+		return
+	}
+	for k := range trailer {
+		w.Header().Add("Trailer", k)
+	}
+}
+
+// copyTrailers sets the trailers of the upstream response on the response to the client if the
+// service forwards them, they are sent after the body
+func copyTrailers(w http.ResponseWriter, trailer http.Header, s *Service) {
+	if s == nil || !s.ForwardTrailers {
+		return
+	}
+	for k, v := range trailer {
+		for _, value := range v {
+			w.Header().Add(http.TrailerPrefix+k, value)
+		}
 	}
 }
 
-// forwardRequestCB forwards the request to the resolved service with circuit breaker
-func (rh *RequestHandler) forwardRequestCB(w http.ResponseWriter, r *http.Request, forwardURI string, cb ICircuitBreaker, service string, t time.Time) error {
+// forwardRequestCB forwards the request to the resolved service with circuit breaker, the
+// attempt is bounded by the timeout of the service or the request timeout of the breaker,
+// whichever is shorter
+func (rh *RequestHandler) forwardRequestCB(w http.ResponseWriter, r *http.Request, forwardURI string, cb ICircuitBreaker, service string, timeout time.Duration, t time.Time) error {
+	// status and headers of the upstream response, captured by the request execution
+	status := http.StatusOK
+	var respHeader, trailer http.Header
 	// Define the request execution function
 	executeRequest := func() ([]byte, error) {
-		// Create a new request
-		req, err := http.NewRequest(r.Method, forwardURI, r.Body)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create new request: %w", err)
+		// bound the attempt, a cancelled attempt returns an error which the breaker counts as a failure
+		req := r
+		d := cb.RequestTimeout()
+		if timeout > 0 && (d == 0 || timeout < d) {
+			d = timeout
+		}
+		if d > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			req = r.WithContext(ctx)
 		}
-
-		// Copy headers from the original request and add a trace ID
-		req.Header = cloneHeader(r.Header)
-		req.Header.Add("X-Trace-Id", uuid.NewString())
-
 		// Execute the request
-		client := &http.Client{}
-		resp, err := client.Do(req)
+		resp, err := rh.sendUpstream(req, forwardURI, service)
 		if err != nil {
-			return nil, fmt.Errorf("request execution failed: %w", err)
+			return nil, err
 		}
 		defer func(Body io.ReadCloser) {
 			_ = Body.Close()
 		}(resp.Body)
 
 		// Copy response headers and status code
+		status, respHeader = resp.StatusCode, resp.Header
 		copyResponseHeaders(w, resp)
+		rh.setResponseHeaders(w, service)
+		if rh.isCacheable(r, service, status, respHeader) {
+			rh.setCacheHeader(w, service, feature.CacheMiss)
+		}
+		announceTrailers(w, resp.Trailer, rh.ServiceRegistry.GetService(service))
 		w.WriteHeader(resp.StatusCode)
+		rh.setWriteDeadline(w, service, t)
 
 		// Read the response body
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read response body: %w", err)
+			return nil, opError("read response", service, ErrForwardFailure, err)
 		}
+		trailer = resp.Trailer
 		return body, nil
 	}
 
+	// the headers of the client aren't a failure of the service, they are rejected before the
+	// breaker counts them
+	if err := rh.headerLimits.check(r.Header); err != nil {
+		return opError("forward", service, ErrHeadersTooLarge, err)
+	}
+	// neither is the gateway reaching its own upstream limit
+	if rh.upstreamFull() {
+		slog.Error("Upstream concurrency limit reached", "service", service, "path", r.URL.Path)
+		return opError("forward", service, ErrUpstreamLimit, nil)
+	}
 	// Execute the request with the circuit breaker
 	body, err := cb.Execute(service, executeRequest)
+	// sample after the execution, it includes a state change resetting the counts
+	counts := cb.Counts()
+	rh.ServiceRegistry.metricsFor(service).SetCircuitBreakerCounts(service, counts.Requests, counts.TotalSuccesses, counts.TotalFailures, counts.ConsecutiveFailures)
 	if err != nil {
 		// Handle the case where the circuit is open and fallback is needed
 		if cb.IsOpen() || errors.Is(err, gobreaker.ErrOpenState) {
 			return rh.handleFallbackRequest(w, r, service, t)
 		}
-		return err
+		return opError("circuit breaker", service, ErrForwardFailure, err)
 	}
+	rh.purgeOnAuthFailure(r, service, status)
 
 	// Write the response body
 	_, err = w.Write(body)
 	if err != nil {
-		return fmt.Errorf("failed to write response body: %w", err)
+		return opError("write response", service, ErrForwardFailure, err)
+	}
+	rh.ServiceRegistry.metricsFor(service).ObserveResponseSize(service, r.Method, status, int64(len(body)))
+	if s := rh.ServiceRegistry.GetService(service); s != nil {
+		copyTrailers(w, trailer, s)
+		s.DebugBodies.LogResponse(service, r, status, body)
 	}
 
 	// Save the response in the cache
-	key := rh.generateCacheKey(service, r)
-	if ok := rh.ServiceRegistry.SetCache(service, key, body); !ok {
-		slog.Error("error setting value in cache", "service", service, "path", r.URL.String(), "key", key)
-		return errors.New("SetCache failed")
+	if rh.isCacheable(r, service, status, respHeader) && rh.fitsCache(r, service, len(body)) {
+		key := rh.generateCacheKey(service, r)
+		if ok := rh.ServiceRegistry.SetCache(service, r.URL.String(), key, feature.NewCachedResponse(body, respHeader), respHeader); !ok {
+			return opError("set cache", service, ErrCacheFailure, nil)
+		}
+		observability.Logger(r.Context()).Info("SetCache successful cb", "service", service, "path", r.URL.String(), "key", key)
 	}
-	slog.Info("SetCache successful cb", "service", service, "path", r.URL.String(), "key", key)
 
-	rh.CollectMetrics(&observability.MetricsInput{Code: GetStatusCode(http.StatusOK), Method: r.Method, Route: r.URL.String()}, t)
+	rh.CollectMetrics(rh.metricsInput(r, status), t)
 	return nil
 }
 
 // handleFallbackRequest handles the case where the circuit breaker is open and a fallback request is needed
 func (rh *RequestHandler) handleFallbackRequest(w http.ResponseWriter, r *http.Request, service string, t time.Time) error {
 	slog.Error("Circuit breaker is open, making a fallback request", "service", service)
-	fallbackURI := rh.ServiceRegistry.GetFallbackUri(service)
-	if fallbackURI == "" {
-		// If fallbackURI is not provided the default behavior is to return a 503
-		slog.Info("no fallbackURI provided", "service", service)
-		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
-		rh.CollectMetrics(&observability.MetricsInput{Code: GetStatusCode(http.StatusServiceUnavailable), Method: r.Method, Route: r.URL.String()}, t)
-		return nil
+	fallbacks := rh.ServiceRegistry.GetFallbackUris(service)
+	if len(fallbacks) == 0 {
+		// If no fallback is provided the default behavior is to return a 503
+		observability.Logger(r.Context()).Info("no fallbackUris provided", "service", service)
+	}
+	// keep the body so every fallback receives it
+	var body []byte
+	if len(fallbacks) > 1 && r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return opError("read request", service, ErrForwardFailure, err)
+		}
+	}
+
+	// Resolve the path and try the fallbacks in order
+	route := rh.resolved(r).route
+	for _, fallbackURI := range fallbacks {
+		forwardURI := rh.createForwardURI(rh.ServiceRegistry.GetScheme(service), fallbackURI, rh.ServiceRegistry.GetUpstreamPathPrefix(service), route, r.URL.RawQuery)
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		done, err := rh.tryFallback(w, r, forwardURI, service, t)
+		if done {
+			return err
+		}
+		slog.Warn("Fallback failed", "service", service, "fallback", fallbackURI, "error", err)
 	}
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	rh.CollectMetrics(rh.metricsInput(r, http.StatusServiceUnavailable), t)
+	return nil
+}
 
-	// Resolve the path and create a new URI
-	_, route := rh.resolvePath(r.URL.Path)
-	forwardURI := rh.createForwardURI(fallbackURI, route, r.URL.RawQuery)
-	// Forward the request
-	return rh.forwardRequest(w, r, forwardURI, service, t)
+// tryFallback forwards the request to a fallback, which has FallbackTimeout to respond. done is false
+// if the fallback failed before anything was written so the next one can be tried
+func (rh *RequestHandler) tryFallback(w http.ResponseWriter, r *http.Request, forwardURI string, service string, t time.Time) (bool, error) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	// the timeout only bounds the wait for the response, not reading its body
+	timer := time.AfterFunc(FallbackTimeout, cancel)
+	resp, err := rh.sendUpstream(r.WithContext(ctx), forwardURI, service)
+	timer.Stop()
+	if err != nil {
+		return false, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return false, fmt.Errorf("fallback responded with %d", resp.StatusCode)
+	}
+	return true, rh.writeResponse(w, r, resp, service, t)
 }
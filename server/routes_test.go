@@ -0,0 +1,1177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/ArmaanKatyal/go-api-gateway/server/feature"
+	"github.com/ArmaanKatyal/go-api-gateway/server/testutil"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetWriteDeadline(t *testing.T) {
+	cancelled := make(chan time.Duration, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		w.WriteHeader(http.StatusOK)
+		setWriteDeadline(w, 100*time.Millisecond, start)
+		// slow writer streaming a chunk every 10ms for far longer than the deadline
+		rc := http.NewResponseController(w)
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				cancelled <- time.Since(start)
+				return
+			case <-ticker.C:
+				if _, err := w.Write([]byte("chunk\n")); err != nil {
+					continue
+				}
+				if err := rc.Flush(); err != nil {
+					continue
+				}
+			}
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	resp, err := http.Get(srv.URL)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	_, err = io.ReadAll(resp.Body)
+	assert.NotNil(t, err, "connection should be closed before the response completes")
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+
+	select {
+	case elapsed := <-cancelled:
+		assert.Less(t, elapsed, 200*time.Millisecond)
+	case <-time.After(time.Second):
+		t.Fatal("request context not cancelled")
+	}
+}
+
+func TestCreateForwardURI(t *testing.T) {
+	rh := &RequestHandler{}
+	tests := []struct {
+		name       string
+		scheme     string
+		address    string
+		pathPrefix string
+		expected   string
+	}{
+		{"bare host with https scheme", "https", "orders:8443", "", "https://orders:8443/items/1?a=b"},
+		{"bare host default http", "", "orders:8080", "", "http://orders:8080/items/1?a=b"},
+		{"explicit scheme in the address", "http", "https://orders:8443", "", "https://orders:8443/items/1?a=b"},
+		{"path prefix", "", "orders:8080", "/internal", "http://orders:8080/internal/items/1?a=b"},
+		{"path prefix without slashes", "", "orders:8080", "internal/", "http://orders:8080/internal/items/1?a=b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, rh.createForwardURI(tt.scheme, tt.address, tt.pathPrefix, []string{"items", "1"}, "a=b"))
+		})
+	}
+}
+
+func TestAccessLogSampleRate(t *testing.T) {
+	sr := newTestRegistry()
+	sr.RegisterOrUpdate("sampled", &Service{Addr: "localhost:8001", AccessLog: config.AccessLogSettings{Sampled: true, SampleRate: 0.25}})
+	sr.RegisterOrUpdate("plain", &Service{Addr: "localhost:8002", AccessLog: config.AccessLogSettings{SampleRate: 0.25}})
+	rh := &RequestHandler{ServiceRegistry: sr}
+	rate := func(path string) float64 {
+		return rh.accessLogSampleRate(httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	assert.Equal(t, 0.25, rate("/sampled/orders"))
+	assert.Equal(t, 1.0, rate("/plain/orders"))
+	assert.Equal(t, 1.0, rate("/missing/orders"))
+
+	// the service already resolved for the request is used
+	r := httptest.NewRequest(http.MethodGet, "/plain/orders", nil)
+	r = r.WithContext(context.WithValue(r.Context(), resolutionKey{}, rh.resolve(httptest.NewRequest(http.MethodGet, "/sampled/orders", nil))))
+	assert.Equal(t, 0.25, rh.accessLogSampleRate(r))
+}
+
+func TestPathDepth(t *testing.T) {
+	assert.Equal(t, 0, pathDepth("/"))
+	assert.Equal(t, 1, pathDepth("/orders"))
+	assert.Equal(t, 1, pathDepth("/orders/"))
+	assert.Equal(t, 3, pathDepth("/orders/items/1"))
+	assert.Equal(t, 3, pathDepth("/orders//items/1"))
+
+	s := &Service{PathDepth: config.PathDepthSettings{MinDepth: 2, MaxDepth: 3}}
+	assert.False(t, s.AcceptsDepth(1))
+	assert.True(t, s.AcceptsDepth(2))
+	assert.True(t, s.AcceptsDepth(3))
+	assert.False(t, s.AcceptsDepth(4))
+	assert.True(t, (&Service{}).AcceptsDepth(10))
+}
+
+func TestIsUpgradeRequest(t *testing.T) {
+	upgrade := func(connection string, protocol string) bool {
+		r := httptest.NewRequest(http.MethodGet, "/chat/socket", nil)
+		r.Header.Set("Connection", connection)
+		r.Header.Set("Upgrade", protocol)
+		return isUpgradeRequest(r)
+	}
+	assert.True(t, upgrade("Upgrade", "websocket"))
+	assert.True(t, upgrade("keep-alive, upgrade", "websocket"))
+	assert.False(t, upgrade("keep-alive", "websocket"))
+	assert.False(t, upgrade("Upgrade", ""))
+}
+
+func TestGenerateCacheKey(t *testing.T) {
+	rh := &RequestHandler{}
+	key := func(method string) string {
+		return rh.generateCacheKey("orders", httptest.NewRequest(method, "/orders/items/1?a=b", nil))
+	}
+	assert.Equal(t, key(http.MethodGet), key(http.MethodGet))
+	assert.NotEqual(t, key(http.MethodGet), key(http.MethodHead))
+	// the method is normalized
+	assert.Equal(t, key(http.MethodGet), key("get"))
+
+	withHeader := func(values ...string) string {
+		r := httptest.NewRequest(http.MethodGet, "/orders/items/1", nil)
+		for _, v := range values {
+			r.Header.Add("Accept-Language", v)
+		}
+		return rh.generateCacheKey("orders", r)
+	}
+	// repeated lines are keyed regardless of their order
+	assert.Equal(t, withHeader("en", "fr"), withHeader("fr", "en"))
+	assert.Equal(t, withHeader("en;q=0.8", "de", "fr"), withHeader("de", "fr", "en;q=0.8"))
+	assert.NotEqual(t, withHeader("en", "fr"), withHeader("en"))
+	assert.NotEqual(t, withHeader("en", "fr"), withHeader("en", "de"))
+	// the order within a line is significant
+	assert.NotEqual(t, withHeader("fr, en"), withHeader("en, fr"))
+	// the values aren't split on their commas
+	assert.NotEqual(t, withHeader("en,fr", "de"), withHeader("en", "fr,de"))
+
+	// the key doesn't depend on the order the headers are iterated in
+	r := httptest.NewRequest(http.MethodGet, "/orders/items/1", nil)
+	for i := 0; i < 10; i++ {
+		r.Header.Set(fmt.Sprintf("X-Custom-%d", i), "value")
+	}
+	first := rh.generateCacheKey("orders", r)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, first, rh.generateCacheKey("orders", r))
+	}
+}
+
+func TestHeartbeatConcurrentRequests(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			<-release
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	defer func(c config.Conf) { config.AppConfig = c }(config.AppConfig)
+	config.AppConfig.Server.Metrics.Prefix = "routes_test_heartbeat"
+	rh := NewRequestHandler()
+	sc := testServiceConf("orders", upstream.URL)
+	sc.Health.Enabled = true
+	s, err := NewService(&sc)
+	assert.Nil(t, err)
+	rh.ServiceRegistry.Services["orders"] = s
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rh.ServiceRegistry.checkHealth()
+	}()
+	// the registry isn't locked while the health check is in flight
+	registered := make(chan error, 1)
+	go func() {
+		registered <- rh.ServiceRegistry.Register("payments", &Service{Addr: "localhost:9001"})
+	}()
+	select {
+	case err := <-registered:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("registry locked during the health check")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			rh.HandleRequest(w, httptest.NewRequest(http.MethodGet, "/orders/items/1", nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+		}()
+	}
+	close(release)
+	wg.Wait()
+	<-done
+
+	health, checkedAt := s.HealthStatus()
+	assert.Equal(t, HealthUnhealthy, health)
+	assert.False(t, checkedAt.IsZero())
+}
+
+func TestAuthFailure(t *testing.T) {
+	var received atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		if r.Header.Get("X-Claims") != "" || r.Header.Get("Authorization") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer upstream.Close()
+
+	defer func(c config.Conf) { config.AppConfig = c }(config.AppConfig)
+	config.AppConfig.Server.Metrics.Prefix = "routes_test_auth_failure"
+	handler := NewRequestHandler()
+	newHandler := func(t *testing.T, conf config.AuthFailureSettings) (*RequestHandler, *Service) {
+		t.Helper()
+		sc := testServiceConf("orders", upstream.URL)
+		sc.Cache.Enabled = true
+		sc.AuthFailure = conf
+		s, err := NewService(&sc)
+		assert.Nil(t, err)
+		handler.ServiceRegistry.Services["orders"] = s
+		return handler, s
+	}
+
+	t.Run("cache purged on 401", func(t *testing.T) {
+		for _, purge := range []bool{true, false} {
+			rh, s := newHandler(t, config.AuthFailureSettings{PurgeCache: purge})
+			r := httptest.NewRequest(http.MethodGet, "/orders/items/1", nil)
+			key := rh.generateCacheKey("orders", r)
+			s.Cache.Set(key, feature.NewCachedResponse([]byte("stale"), http.Header{}), feature.DefaultExpiration)
+
+			w := httptest.NewRecorder()
+			assert.Nil(t, rh.forwardRequest(w, r, upstream.URL+"/items/1", "orders", time.Now()))
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			_, cached := s.Cache.Get(key)
+			assert.Equal(t, !purge, cached)
+		}
+	})
+
+	t.Run("claims stripped on retry", func(t *testing.T) {
+		for _, strip := range []bool{true, false} {
+			received.Store(0)
+			rh, _ := newHandler(t, config.AuthFailureSettings{StripClaims: strip})
+			r := httptest.NewRequest(http.MethodGet, "/orders/items/1", nil)
+			r.Header.Set("Authorization", "token")
+			r.Header.Set("X-Claims", `{"service":"orders"}`)
+
+			w := httptest.NewRecorder()
+			assert.Nil(t, rh.forwardRequest(w, r, upstream.URL+"/items/1", "orders", time.Now()))
+			if strip {
+				assert.Equal(t, http.StatusOK, w.Code)
+				assert.Equal(t, "token", w.Body.String())
+				assert.Equal(t, int32(2), received.Load())
+			} else {
+				assert.Equal(t, http.StatusUnauthorized, w.Code)
+				assert.Equal(t, int32(1), received.Load())
+			}
+		}
+	})
+}
+
+// countingTransport counts the attempts of the requests sent through it
+type countingTransport struct {
+	attempts atomic.Int32
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.attempts.Add(1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestRetryPolicyConnectionErrorsOnly(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	// nothing listens on the address of a closed listener, connecting to it is refused
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	refused := "http://" + ln.Addr().String()
+	_ = ln.Close()
+
+	defer func(c config.Conf) { config.AppConfig = c }(config.AppConfig)
+	config.AppConfig.Server.Metrics.Prefix = "routes_test_retry_policy"
+	rh := NewRequestHandler()
+	newService := func(t *testing.T, mode string) *countingTransport {
+		t.Helper()
+		sc := testServiceConf("orders", failing.URL)
+		sc.Retries = 2
+		sc.RetryPolicy.Mode = mode
+		s, err := NewService(&sc)
+		assert.Nil(t, err)
+		transport := &countingTransport{}
+		s.Transport = transport
+		rh.ServiceRegistry.Services["orders"] = s
+		return transport
+	}
+
+	t.Run("connection refused retried", func(t *testing.T) {
+		transport := newService(t, feature.RetryOnConnectionErrors)
+		r := httptest.NewRequest(http.MethodGet, "/orders/items/1", nil)
+		_, err := rh.sendUpstream(r, refused+"/items/1", "orders")
+		assert.ErrorIs(t, err, ErrForwardFailure)
+		assert.True(t, feature.IsConnectionError(err))
+		assert.Equal(t, int32(3), transport.attempts.Load())
+	})
+
+	t.Run("500 not retried", func(t *testing.T) {
+		for _, mode := range []string{feature.RetryOnConnectionErrors, feature.RetryOnErrors} {
+			transport := newService(t, mode)
+			r := httptest.NewRequest(http.MethodGet, "/orders/items/1", nil)
+			resp, err := rh.sendUpstream(r, failing.URL+"/items/1", "orders")
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+			_ = resp.Body.Close()
+			assert.Equal(t, int32(1), transport.attempts.Load())
+		}
+	})
+
+	t.Run("500 retried as a retriable status", func(t *testing.T) {
+		transport := newService(t, feature.RetryOnStatuses)
+		rh.ServiceRegistry.Services["orders"].RetryPolicy = feature.NewRetryPolicy(&config.RetryPolicySettings{
+			Mode:     feature.RetryOnStatuses,
+			Statuses: []int{http.StatusInternalServerError},
+		})
+		r := httptest.NewRequest(http.MethodGet, "/orders/items/1", nil)
+		resp, err := rh.sendUpstream(r, failing.URL+"/items/1", "orders")
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		_ = resp.Body.Close()
+		assert.Equal(t, int32(3), transport.attempts.Load())
+	})
+}
+
+func TestRetryIdempotentRequests(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	defer func(c config.Conf) { config.AppConfig = c }(config.AppConfig)
+	config.AppConfig.Server.Metrics.Prefix = "routes_test_retry_idempotent"
+	rh := NewRequestHandler()
+	sc := testServiceConf("orders", failing.URL)
+	sc.Retries = 2
+	sc.RetryPolicy = config.RetryPolicySettings{Mode: feature.RetryOnStatuses, MaxBodyBytes: 8}
+	s, err := NewService(&sc)
+	assert.Nil(t, err)
+	rh.ServiceRegistry.Services["orders"] = s
+	send := func(method string, body string, header http.Header) (*http.Response, int32, error) {
+		transport := &countingTransport{}
+		s.Transport = transport
+		r := httptest.NewRequest(method, "/orders/items", strings.NewReader(body))
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		resp, err := rh.sendUpstream(r, failing.URL+"/items", "orders")
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		return resp, transport.attempts.Load(), err
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		_, attempts, err := send(method, "", nil)
+		assert.Nil(t, err)
+		assert.Equal(t, int32(3), attempts, method)
+	}
+	for _, method := range []string{http.MethodPost, http.MethodPatch} {
+		resp, attempts, err := send(method, "{}", nil)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, int32(1), attempts, method)
+	}
+	_, attempts, err := send(http.MethodPost, "{}", http.Header{"Idempotency-Key": {"order-1"}})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), attempts)
+
+	// a body over the limit kept to be sent again is sent once
+	_, attempts, err = send(http.MethodPut, `{"id": "order-1"}`, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), attempts)
+}
+
+func TestRetryLargeBody(t *testing.T) {
+	orders := testutil.NewUpstream("orders")
+	defer orders.Close()
+	sc := testServiceConf("orders", orders.Addr())
+	sc.Retries = 2
+	rh := newTestHandler(t, []config.ServiceConf{sc})
+
+	// enabling the retries doesn't reject the bodies over the default limit
+	body := bytes.Repeat([]byte("a"), 2<<20)
+	w := record(rh.HandleRequest, httptest.NewRequest(http.MethodPut, "/orders/items/1", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	requests := orders.Requests()
+	if assert.Len(t, requests, 1) {
+		assert.Equal(t, body, requests[0].Body)
+	}
+
+	// nor are they retried
+	orders.SetStatus(http.StatusServiceUnavailable)
+	w = record(rh.HandleRequest, httptest.NewRequest(http.MethodPut, "/orders/items/2", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, 1, orders.Received(http.MethodPut, "/items/2"))
+}
+
+// trailerTransport answers every request with a response carrying trailers, echoing the
+// trailers of the request
+type trailerTransport struct {
+	received http.Header
+}
+
+func (tt *trailerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	tt.received = r.Trailer.Clone()
+	trailer := http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"OK"}}
+	for k, v := range r.Trailer {
+		trailer["Echo-"+k] = v
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/grpc-web"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Trailer:    trailer,
+		Request:    r,
+	}, nil
+}
+
+func TestForwardTrailers(t *testing.T) {
+	defer func(c config.Conf) { config.AppConfig = c }(config.AppConfig)
+	config.AppConfig.Server.Metrics.Prefix = "routes_test_trailers"
+	rh := NewRequestHandler()
+	gateway := httptest.NewServer(http.HandlerFunc(rh.HandleRequest))
+	defer gateway.Close()
+
+	for _, tc := range []struct {
+		name    string
+		forward bool
+		breaker bool
+	}{
+		{"forwarded", true, false},
+		{"forwarded with circuit breaker", true, true},
+		{"dropped", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sc := testServiceConf("grpc", "localhost:9000")
+			sc.ForwardTrailers = tc.forward
+			sc.CircuitBreaker = config.CircuitSettings{Enabled: tc.breaker, Timeout: 60, FailureRatio: 0.5}
+			s, err := NewService(&sc)
+			assert.Nil(t, err)
+			transport := &trailerTransport{}
+			s.Transport = transport
+			rh.ServiceRegistry.Services["grpc"] = s
+
+			// the values of the trailers are sent after the body
+			req, err := http.NewRequest(http.MethodPost, gateway.URL+"/grpc/echo", strings.NewReader("payload"))
+			assert.Nil(t, err)
+			req.ContentLength = -1
+			req.Trailer = http.Header{"Checksum": {"abc"}}
+			resp, err := http.DefaultClient.Do(req)
+			assert.Nil(t, err)
+			body, err := io.ReadAll(resp.Body)
+			assert.Nil(t, err)
+			_ = resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "payload", string(body))
+
+			if !tc.forward {
+				assert.Empty(t, transport.received)
+				assert.Empty(t, resp.Trailer)
+				return
+			}
+			assert.Equal(t, "abc", transport.received.Get("Checksum"))
+			assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+			assert.Equal(t, "OK", resp.Trailer.Get("Grpc-Message"))
+			assert.Equal(t, "abc", resp.Trailer.Get("Echo-Checksum"))
+		})
+	}
+}
+
+func TestForwardTrailersRetried(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, r.Trailer.Get("Checksum"))
+		// fail the first attempt so the request is sent again
+		if len(received) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+
+	defer func(c config.Conf) { config.AppConfig = c }(config.AppConfig)
+	config.AppConfig.Server.Metrics.Prefix = "routes_test_trailers_retried"
+	rh := NewRequestHandler()
+	gateway := httptest.NewServer(http.HandlerFunc(rh.HandleRequest))
+	defer gateway.Close()
+	sc := testServiceConf("grpc", strings.TrimPrefix(upstream.URL, "http://"))
+	sc.ForwardTrailers = true
+	sc.Retries = 1
+	sc.RetryPolicy.Mode = feature.RetryOnStatuses
+	s, err := NewService(&sc)
+	assert.Nil(t, err)
+	rh.ServiceRegistry.Services["grpc"] = s
+
+	req, err := http.NewRequest(http.MethodPut, gateway.URL+"/grpc/echo", strings.NewReader("payload"))
+	assert.Nil(t, err)
+	req.ContentLength = -1
+	req.Trailer = http.Header{"Checksum": {"abc"}}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	// both attempts carry the trailers
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"abc", "abc"}, received)
+}
+
+func TestDropOversizedHeaders(t *testing.T) {
+	h := http.Header{
+		"X-Small":    {"value"},
+		"X-Claims":   {strings.Repeat("a", 600)},
+		"X-Repeated": {strings.Repeat("b", 300), strings.Repeat("c", 300)},
+	}
+	dropOversizedHeaders(h, 512, "orders")
+	assert.Equal(t, http.Header{"X-Small": {"value"}}, h)
+
+	// unlimited
+	h = http.Header{"X-Claims": {strings.Repeat("a", 600)}}
+	dropOversizedHeaders(h, 0, "orders")
+	assert.Len(t, h, 1)
+}
+
+// newTestHandler builds a request handler with the services of the configuration changed by
+// opts registered, the configuration is restored when the test ends
+func newTestHandler(t *testing.T, services []config.ServiceConf, opts ...func(*config.Conf)) *RequestHandler {
+	t.Helper()
+	previous := config.AppConfig
+	t.Cleanup(func() { config.AppConfig = previous })
+	c := config.Conf{}
+	c.Registry.Services = services
+	for _, opt := range opts {
+		opt(&c)
+	}
+	c.Verify()
+	config.AppConfig = c
+	rh := NewRequestHandler()
+	t.Cleanup(rh.ServiceRegistry.Stop)
+	return rh
+}
+
+// record handles the request and returns the recorded response
+func record(h http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+// refusedAddr returns an address nothing listens on, connecting to it is refused
+func refusedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+func TestFallbackUris(t *testing.T) {
+	east, west := testutil.NewUpstream("east"), testutil.NewUpstream("west")
+	defer east.Close()
+	defer west.Close()
+	sc := testServiceConf("primary", refusedAddr(t))
+	sc.FallbackUris = []string{east.Addr(), west.Addr()}
+	sc.CircuitBreaker = config.CircuitSettings{Enabled: true, Timeout: 60, FailureRatio: 0.5, MinimumRequests: 1}
+	rh := newTestHandler(t, []config.ServiceConf{sc})
+
+	east.SetStatus(http.StatusBadGateway)
+	west.SetStatus(http.StatusBadGateway)
+	w := record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, "/primary/fallback", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, 1, east.Received(http.MethodGet, "/fallback"))
+	assert.Equal(t, 1, west.Received(http.MethodGet, "/fallback"))
+
+	// the gateway falls through the failing fallback to the one restored
+	west.SetStatus(http.StatusOK)
+	w = record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, "/primary/fallback", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "west /fallback", w.Body.String())
+	assert.Equal(t, 2, east.Received(http.MethodGet, "/fallback"))
+}
+
+// requestTimeoutBreaker bounds the attempts of the breaker to a timeout shorter than the
+// configuration allows, so the tests don't wait for whole seconds
+type requestTimeoutBreaker struct {
+	*feature.CircuitBreaker
+	timeout time.Duration
+}
+
+func (b requestTimeoutBreaker) RequestTimeout() time.Duration {
+	return b.timeout
+}
+
+func TestCircuitBreakerRequestTimeout(t *testing.T) {
+	slow := testutil.NewUpstream("slow")
+	defer slow.Close()
+	slow.SetDelay(time.Second)
+	sc := testServiceConf("slow", slow.Addr())
+	sc.CircuitBreaker = config.CircuitSettings{Enabled: true, Timeout: 60, FailureRatio: 0.5}
+	rh := newTestHandler(t, []config.ServiceConf{sc})
+	s := rh.ServiceRegistry.GetService("slow")
+	cb := s.CircuitBreaker.(*feature.CircuitBreaker)
+	s.CircuitBreaker = requestTimeoutBreaker{CircuitBreaker: cb, timeout: 100 * time.Millisecond}
+
+	// the attempt is cancelled after the request timeout instead of waiting on the service
+	start := time.Now()
+	w := record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, "/slow/resource", nil))
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Contains(t, w.Body.String(), "service timed out")
+	assert.Equal(t, uint32(1), cb.Counts().TotalFailures)
+}
+
+func TestServiceTimeoutOpensCircuit(t *testing.T) {
+	slow, backup := testutil.NewUpstream("slow"), testutil.NewUpstream("backup")
+	defer slow.Close()
+	defer backup.Close()
+	// the service responds, only too slowly
+	slow.SetDelay(1500 * time.Millisecond)
+	sc := testServiceConf("slow", slow.Addr())
+	sc.TimeoutSeconds = 1
+	sc.FallbackUris = []string{backup.Addr()}
+	sc.CircuitBreaker = config.CircuitSettings{Enabled: true, Timeout: 60, FailureRatio: 0.5, MinimumRequests: 1}
+	rh := newTestHandler(t, []config.ServiceConf{sc})
+
+	// the timeout opens the circuit, the request is served by the fallback
+	start := time.Now()
+	w := record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, "/slow/resource", nil))
+	assert.Less(t, time.Since(start), 1400*time.Millisecond)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "backup /resource", w.Body.String())
+
+	// the open circuit skips the service altogether
+	w = record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, "/slow/other", nil))
+	assert.Equal(t, "backup /other", w.Body.String())
+	assert.Equal(t, 0, slow.Received(http.MethodGet, "/other"))
+}
+
+func TestReadyOpenCircuitBreakers(t *testing.T) {
+	services := []config.ServiceConf{testServiceConf("plain", "localhost:9000")}
+	for i, name := range []string{"a", "b", "c", "d"} {
+		sc := testServiceConf(name, fmt.Sprintf("localhost:%d", 9001+i))
+		sc.CircuitBreaker = config.CircuitSettings{Enabled: true, Timeout: 60, FailureRatio: 0.5, MinimumRequests: 1}
+		services = append(services, sc)
+	}
+	rh := newTestHandler(t, services, func(c *config.Conf) {
+		c.Server.MaxOpenBreakersPercent = 50
+	})
+	ready := func() int {
+		w := httptest.NewRecorder()
+		rh.Ready(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return w.Code
+	}
+	trip := func(name string) {
+		_, _ = rh.ServiceRegistry.GetService(name).CircuitBreaker.Execute(name, func() ([]byte, error) { return nil, ErrForwardFailure })
+	}
+
+	// half of the breakers open is within the threshold, the service without one isn't counted
+	assert.Equal(t, http.StatusOK, ready())
+	trip("a")
+	trip("b")
+	assert.Equal(t, http.StatusOK, ready())
+	// crossing it fails readiness
+	trip("c")
+	assert.Equal(t, http.StatusServiceUnavailable, ready())
+}
+
+func TestResolveService(t *testing.T) {
+	services := []config.ServiceConf{testServiceConf("tenant-a", "localhost:9001"), testServiceConf("tenant-b", "localhost:9002")}
+	static := testServiceConf("static", "localhost:9003")
+	static.PathPattern = "/static/**"
+	assets := testServiceConf("assets", "localhost:9004")
+	assets.PathPattern = "/api/v[12]/*"
+	rh := newTestHandler(t, append(services, static, assets), func(c *config.Conf) {
+		c.Server.VirtualHosts = map[string]string{"tenant-a.gateway.com": "tenant-a", "Tenant-B.gateway.com": "tenant-b"}
+	})
+	resolve := func(host string, path string) (string, []string) {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Host = host
+		return rh.resolveService(r)
+	}
+	tests := []struct {
+		name    string
+		host    string
+		path    string
+		service string
+		route   []string
+	}{
+		{"virtual host", "tenant-a.gateway.com", "/orders/1", "tenant-a", []string{"orders", "1"}},
+		{"virtual host with port", "tenant-b.gateway.com:8080", "/tenant-a/orders/1", "tenant-b", []string{"tenant-a", "orders", "1"}},
+		{"other host", "gateway.com", "/tenant-b/orders/1", "tenant-b", []string{"orders", "1"}},
+		{"path pattern", "gateway.com", "/static/css/main.css", "static", []string{"css", "main.css"}},
+		{"path pattern with class", "gateway.com", "/api/v2/logo.png", "assets", []string{"v2", "logo.png"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, route := resolve(tt.host, tt.path)
+			assert.Equal(t, tt.service, service)
+			assert.Equal(t, tt.route, route)
+		})
+	}
+	assert.Nil(t, rh.resolve(httptest.NewRequest(http.MethodGet, "/api/v3/logo.png", nil)).service)
+}
+
+func TestRouteIgnoresQuery(t *testing.T) {
+	search := testServiceConf("search", "localhost:9001")
+	search.IgnoreQueryInRoute = true
+	rh := newTestHandler(t, []config.ServiceConf{search, testServiceConf("plain", "localhost:9002")})
+
+	assert.Equal(t, "/search/items", rh.route(httptest.NewRequest(http.MethodGet, "/search/items?q=a", nil)))
+	assert.Equal(t, "/plain/items?q=a", rh.route(httptest.NewRequest(http.MethodGet, "/plain/items?q=a", nil)))
+}
+
+func TestPerIPRateLimit(t *testing.T) {
+	a, b := testutil.NewUpstream("a"), testutil.NewUpstream("b")
+	defer a.Close()
+	defer b.Close()
+	rh := newTestHandler(t, []config.ServiceConf{testServiceConf("a", a.Addr()), testServiceConf("b", b.Addr())}, func(c *config.Conf) {
+		c.Server.PerIPRateLimiter = config.RateLimiterSettings{Enabled: true, Rate: 1, Burst: 3, CleanupInterval: 60}
+	})
+	code := func(path string) int {
+		return record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, path, nil)).Code
+	}
+
+	// requests to a use up the quota of the client for b too
+	assert.Equal(t, http.StatusOK, code("/a/"))
+	assert.Equal(t, http.StatusOK, code("/a/"))
+	assert.Equal(t, http.StatusOK, code("/b/"))
+	assert.Equal(t, http.StatusTooManyRequests, code("/b/"))
+	assert.Equal(t, http.StatusTooManyRequests, code("/a/"))
+	assert.Equal(t, 1, b.Received(http.MethodGet, "/"))
+}
+
+func TestFormBodyForwarded(t *testing.T) {
+	forms := testutil.NewUpstream("forms")
+	defer forms.Close()
+	rh := newTestHandler(t, []config.ServiceConf{testServiceConf("forms", forms.Addr())})
+
+	form := "name=gopher&lang=go"
+	r := httptest.NewRequest(http.MethodPost, "/forms/submit", strings.NewReader(form))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	assert.Equal(t, http.StatusOK, record(rh.HandleRequest, r).Code)
+	requests := forms.Requests()
+	if assert.Len(t, requests, 1) {
+		assert.Equal(t, form, string(requests[0].Body))
+	}
+}
+
+func TestMaxConcurrentUpstream(t *testing.T) {
+	orders, users := testutil.NewUpstream("orders"), testutil.NewUpstream("users")
+	defer orders.Close()
+	defer users.Close()
+	guarded := testServiceConf("users", users.Addr())
+	// a single failure would open the circuit
+	guarded.CircuitBreaker = config.CircuitSettings{Enabled: true, Timeout: 60, FailureRatio: 0.5, MinimumRequests: 1}
+	rh := newTestHandler(t, []config.ServiceConf{testServiceConf("orders", orders.Addr()), guarded}, func(c *config.Conf) {
+		c.Server.MaxConcurrentUpstream = 2
+	})
+
+	// hold both slots
+	assert.True(t, rh.acquireUpstream())
+	assert.True(t, rh.acquireUpstream())
+	for _, path := range []string{"/orders/1", "/users/1"} {
+		w := record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code, path)
+		assert.Equal(t, "1", w.Header().Get("Retry-After"), path)
+	}
+	assert.Empty(t, orders.Requests())
+	assert.Empty(t, users.Requests())
+
+	// the rejection didn't open the circuit
+	rh.releaseUpstream()
+	rh.releaseUpstream()
+	w := record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, "/users/1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, users.Received(http.MethodGet, "/1"))
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	slow := testutil.NewUpstream("slow")
+	defer slow.Close()
+	sc := testServiceConf("slow", slow.Addr())
+	sc.MaxConcurrentRequests = 2
+	rh := newTestHandler(t, []config.ServiceConf{sc})
+	s := rh.ServiceRegistry.GetService("slow")
+
+	assert.True(t, s.tryAcquire())
+	assert.True(t, s.tryAcquire())
+	w := record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, "/slow/resource", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Empty(t, slow.Requests())
+
+	// the slots are released once the requests complete
+	s.release()
+	s.release()
+	w = record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, "/slow/resource", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestQueuedRequestsHoldNoSlot(t *testing.T) {
+	orders := testutil.NewUpstream("orders")
+	defer orders.Close()
+	sc := testServiceConf("orders", orders.Addr())
+	sc.MaxConcurrentRequests = 1
+	sc.RateLimiter = config.RateLimiterSettings{Enabled: true, Rate: 5, Burst: 1, CleanupInterval: 60,
+		Queue: config.RateLimiterQueueSettings{Enabled: true, MaxWait: 1000}}
+	rh := newTestHandler(t, []config.ServiceConf{sc})
+	s := rh.ServiceRegistry.GetService("orders")
+
+	assert.Equal(t, http.StatusOK, record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, "/orders/1", nil)).Code)
+	done := make(chan int, 1)
+	go func() {
+		done <- record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, "/orders/2", nil)).Code
+	}()
+	// the request waits for its turn without taking the slot of the service
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int64(0), s.InFlight())
+	assert.True(t, s.tryAcquire())
+	s.release()
+	assert.Equal(t, http.StatusOK, <-done)
+}
+
+func TestIsCacheable(t *testing.T) {
+	sc := testServiceConf("orders", "localhost:9001")
+	sc.Cache = config.CacheSettings{Enabled: true, ExpirationInterval: 60, CleanupInterval: 60,
+		CacheableContentTypes: []string{"application/json", "text/"}, WriteThrough: true}
+	rh := newTestHandler(t, []config.ServiceConf{sc})
+	get := httptest.NewRequest(http.MethodGet, "/orders/1", nil)
+	header := func(contentType string, cacheControl string) http.Header {
+		h := http.Header{"Content-Type": {contentType}}
+		if cacheControl != "" {
+			h.Set("Cache-Control", cacheControl)
+		}
+		return h
+	}
+
+	assert.True(t, rh.isCacheable(get, "orders", http.StatusOK, header("application/json; charset=utf-8", "")))
+	assert.True(t, rh.isCacheable(get, "orders", http.StatusOK, header("text/plain", "no-store")))
+	// a cache hit is replayed as a 200, the other statuses aren't cached
+	assert.False(t, rh.isCacheable(get, "orders", http.StatusInternalServerError, header("application/json", "")))
+	assert.False(t, rh.isCacheable(get, "orders", http.StatusOK, header("application/octet-stream", "")))
+	assert.False(t, rh.isCacheable(get, "orders", http.StatusOK, header("application/json", "max-age=0")))
+	// the writes invalidate the resource of a write through cache
+	assert.False(t, rh.isCacheable(httptest.NewRequest(http.MethodPut, "/orders/1", nil), "orders", http.StatusOK, header("application/json", "")))
+	assert.False(t, rh.isCacheable(get, "missing", http.StatusOK, header("application/json", "")))
+}
+
+func TestCachedResponses(t *testing.T) {
+	for _, cb := range []bool{false, true} {
+		t.Run(fmt.Sprintf("circuit breaker %v", cb), func(t *testing.T) {
+			upstream := testutil.NewUpstream("orders")
+			defer upstream.Close()
+			upstream.SetHeader("Cache-Control", "no-store")
+			sc := testServiceConf("orders", upstream.Addr())
+			sc.Cache = config.CacheSettings{Enabled: true, ExpirationInterval: 60, CleanupInterval: 60, MaxBodySize: 1024, WriteThrough: true}
+			sc.CircuitBreaker = config.CircuitSettings{Enabled: cb, Timeout: 60, FailureRatio: 0.5}
+			sc.ResponseHeaders = config.ResponseHeaderSettings{Add: map[string]string{"X-Service-Version": "1.2.0", "Cache-Control": "max-age=60"}}
+			rh := newTestHandler(t, []config.ServiceConf{sc})
+			request := func(method string, path string) *httptest.ResponseRecorder {
+				return record(rh.HandleRequest, httptest.NewRequest(method, "/orders"+path, nil))
+			}
+
+			// the configured headers are set on the misses and the hits
+			for i := 0; i < 2; i++ {
+				w := request(http.MethodGet, "/1")
+				assert.Equal(t, http.StatusOK, w.Code)
+				assert.Equal(t, "orders /1", w.Body.String())
+				assert.Equal(t, "1.2.0", w.Header().Get("X-Service-Version"))
+				assert.Equal(t, "max-age=60", w.Header().Get("Cache-Control"))
+			}
+			assert.Equal(t, 1, upstream.Received(http.MethodGet, "/1"))
+
+			// the upstream echoes the path so a long path makes a 2KB response, too large to cache
+			path := "/" + strings.Repeat("a", 2048)
+			request(http.MethodGet, path)
+			request(http.MethodGet, path)
+			assert.Equal(t, 2, upstream.Received(http.MethodGet, path))
+
+			// a write reaches the service and purges the cached resource
+			request(http.MethodPut, "/1")
+			request(http.MethodPut, "/1")
+			assert.Equal(t, 2, upstream.Received(http.MethodPut, "/1"))
+			request(http.MethodGet, "/1")
+			assert.Equal(t, 2, upstream.Received(http.MethodGet, "/1"))
+		})
+	}
+}
+
+func TestForwardedHeaderLimits(t *testing.T) {
+	orders, guarded := testutil.NewUpstream("orders"), testutil.NewUpstream("guarded")
+	defer orders.Close()
+	defer guarded.Close()
+	sc := testServiceConf("guarded", guarded.Addr())
+	// a single counted failure would open the circuit
+	sc.CircuitBreaker = config.CircuitSettings{Enabled: true, Timeout: 60, FailureRatio: 0.5, MinimumRequests: 1}
+	rh := newTestHandler(t, []config.ServiceConf{testServiceConf("orders", orders.Addr()), sc}, func(c *config.Conf) {
+		c.Server.MaxForwardedHeaders = 10
+		c.Server.MaxForwardedHeaderBytes = 1024
+	})
+	request := func(path string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		return record(rh.HandleRequest, r)
+	}
+
+	assert.Equal(t, http.StatusOK, request("/orders/1", http.Header{"X-Custom": {"a", "b"}}).Code)
+
+	many := http.Header{}
+	for i := 0; i < 20; i++ {
+		many.Add(fmt.Sprintf("X-Custom-%d", i), "value")
+	}
+	for _, path := range []string{"/orders/2", "/guarded/2"} {
+		w := request(path, many)
+		assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, w.Code, path)
+		assert.Equal(t, "request headers too large\n", w.Body.String(), path)
+	}
+	w := request("/guarded/3", http.Header{"X-Custom": {strings.Repeat("a", 2048)}})
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, w.Code)
+	assert.Empty(t, orders.Requests()[1:])
+	assert.Empty(t, guarded.Requests())
+
+	// the rejected requests aren't failures of the service
+	assert.Equal(t, http.StatusOK, request("/guarded/4", nil).Code)
+}
+
+func TestServiceMaxHeaderBytes(t *testing.T) {
+	orders, users := testutil.NewUpstream("orders"), testutil.NewUpstream("users")
+	defer orders.Close()
+	defer users.Close()
+	sc := testServiceConf("orders", orders.Addr())
+	sc.MaxHeaderBytes = 512
+	rh := newTestHandler(t, []config.ServiceConf{sc, testServiceConf("users", users.Addr())}, func(c *config.Conf) {
+		c.Server.MaxHeaderBytes = 4096
+	})
+	code := func(path string, size int) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("X-Context", strings.Repeat("a", size))
+		return record(rh.HandleRequest, r).Code
+	}
+
+	assert.Equal(t, http.StatusOK, code("/orders/1", 100))
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, code("/orders/2", 1024))
+	assert.Equal(t, 0, orders.Received(http.MethodGet, "/2"))
+	// the services without a limit of their own default to the one of the server
+	assert.Equal(t, http.StatusOK, code("/users/1", 1024))
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, code("/users/2", 8192))
+}
+
+func TestPickBackendStickySessions(t *testing.T) {
+	s := &Service{StickyCookie: "gw-session", Backends: feature.NewCanaryPicker("stateful:80", &config.CanarySettings{Addr: "replica:80", Weight: 50})}
+	pick := func(cookie string) (string, *httptest.ResponseRecorder) {
+		r := httptest.NewRequest(http.MethodGet, "/stateful/cart", nil)
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "gw-session", Value: cookie})
+		}
+		w := httptest.NewRecorder()
+		addr, ok := pickBackend(w, r, s)
+		assert.True(t, ok)
+		return addr, w
+	}
+
+	// the same cookie picks the same backend
+	first, w := pick("session-1")
+	assert.Empty(t, w.Result().Cookies())
+	for i := 0; i < 10; i++ {
+		addr, _ := pick("session-1")
+		assert.Equal(t, first, addr)
+	}
+	// different cookies distribute
+	seen := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		addr, _ := pick(fmt.Sprintf("session-%d", i))
+		seen[addr] = true
+	}
+	assert.Len(t, seen, 2)
+
+	// a cookie is set when the request has none and pins the following requests
+	addr, w := pick("")
+	cookies := w.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, "gw-session", cookies[0].Name)
+		for i := 0; i < 10; i++ {
+			pinned, _ := pick(cookies[0].Value)
+			assert.Equal(t, addr, pinned)
+		}
+	}
+}
+
+func TestDeduplicationAuthenticated(t *testing.T) {
+	orders := testutil.NewUpstream("orders")
+	defer orders.Close()
+	secret := filepath.Join(t.TempDir(), "secret")
+	assert.Nil(t, os.WriteFile(secret, []byte("dedup"), 0o600))
+	sc := testServiceConf("orders", orders.Addr())
+	sc.Auth = config.AuthSettings{Enabled: true, Secret: secret, Routes: []string{"/create"}}
+	rh := newTestHandler(t, []config.ServiceConf{sc}, func(c *config.Conf) {
+		c.Server.Deduplication.Enabled = true
+	})
+	create := func(subject string) int {
+		r := httptest.NewRequest(http.MethodPost, "/orders/create", nil)
+		r.Header.Set("Idempotency-Key", "order-1")
+		if subject != "" {
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+				"sub": subject,
+				"exp": time.Now().Add(time.Hour).Unix(),
+			}).SignedString([]byte("dedup"))
+			assert.Nil(t, err)
+			r.Header.Set("Authorization", token)
+		}
+		return record(rh.HandleRequest, r).Code
+	}
+
+	assert.Equal(t, http.StatusOK, create("alice"))
+	assert.Equal(t, http.StatusOK, create("alice"))
+	assert.Equal(t, 1, orders.Received(http.MethodPost, "/create"))
+	// the stored response isn't replayed before the caller is authenticated
+	assert.Equal(t, http.StatusUnauthorized, create(""))
+	// nor to another caller using the same key
+	assert.Equal(t, http.StatusOK, create("bob"))
+	assert.Equal(t, 2, orders.Received(http.MethodPost, "/create"))
+}
+
+func TestForwardHooks(t *testing.T) {
+	signed := testutil.NewUpstream("signed")
+	defer signed.Close()
+	rh := newTestHandler(t, []config.ServiceConf{testServiceConf("signed", signed.Addr())})
+	sign := func(method string, path string) string {
+		return method + " " + path
+	}
+	rh.AddPreForwardHook(func(r *http.Request, s *Service) error {
+		if r.Header.Get("X-Reject") != "" {
+			return errors.New("rejected by hook")
+		}
+		r.Header.Set("X-Signature", sign(r.Method, r.URL.Path))
+		return nil
+	})
+	rh.AddPostForwardHook(func(resp *http.Response, s *Service) error {
+		if resp.Header.Get("X-Invalid") != "" {
+			return errors.New("invalid response")
+		}
+		return nil
+	})
+
+	w := record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, "/signed/orders/1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "signed /orders/1", w.Body.String())
+	assert.Equal(t, sign(http.MethodGet, "/signed/orders/1"), signed.Requests()[0].Header.Get("X-Signature"))
+
+	// a failing pre forward hook aborts the request before it is forwarded
+	r := httptest.NewRequest(http.MethodGet, "/signed/orders/2", nil)
+	r.Header.Set("X-Reject", "1")
+	assert.Equal(t, http.StatusInternalServerError, record(rh.HandleRequest, r).Code)
+	assert.Equal(t, 0, signed.Received(http.MethodGet, "/orders/2"))
+
+	// a failing post forward hook aborts the response
+	signed.SetHeader("X-Invalid", "1")
+	w = record(rh.HandleRequest, httptest.NewRequest(http.MethodGet, "/signed/orders/3", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.NotContains(t, w.Body.String(), "signed /orders/3")
+}
+
+// dialUpgrade opens a connection to the server and asks to upgrade it, the response is returned
+// with the connection and the reader to use for the upgraded protocol
+func dialUpgrade(t *testing.T, srv *httptest.Server, path string) (*http.Response, net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	assert.Nil(t, req.Write(conn))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return resp, conn, br
+}
+
+func TestUpgradeConnectionLimit(t *testing.T) {
+	chat := testutil.NewUpstream("chat")
+	defer chat.Close()
+	sc := testServiceConf("chat", chat.Addr())
+	sc.MaxWebSocketConnections = 2
+	rh := newTestHandler(t, []config.ServiceConf{sc}, func(c *config.Conf) {
+		c.Server.Metrics.Prefix = "upgrade"
+	})
+	srv := httptest.NewServer(http.HandlerFunc(rh.HandleRequest))
+	defer srv.Close()
+
+	conns := make([]net.Conn, 0, 2)
+	for i := 0; i < 2; i++ {
+		resp, conn, br := dialUpgrade(t, srv, "/chat/socket")
+		defer conn.Close()
+		assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		// the upstream echoes what is sent over the upgraded connection
+		_, err := conn.Write([]byte("hello\n"))
+		assert.Nil(t, err)
+		line, err := br.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "hello\n", line)
+		conns = append(conns, conn)
+	}
+	assert.Equal(t, 2.0, gathered(t, rh.Metrics.Registry(), "upgrade_websocket_connections_active"))
+
+	resp, conn, _ := dialUpgrade(t, srv, "/chat/socket")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	_ = conn.Close()
+
+	// closing a connection frees its slot
+	_ = conns[0].Close()
+	assert.Eventually(t, func() bool {
+		resp, conn, _ := dialUpgrade(t, srv, "/chat/socket")
+		defer conn.Close()
+		return resp.StatusCode == http.StatusSwitchingProtocols
+	}, time.Second, 10*time.Millisecond)
+}
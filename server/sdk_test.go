@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ArmaanKatyal/go-api-gateway/sdk"
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+	"github.com/ArmaanKatyal/go-api-gateway/server/testutil"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSDKClient(t *testing.T) {
+	gw, cleanup := testutil.NewTestGateway(t, nil)
+	defer cleanup()
+	ctx := context.Background()
+	c := sdk.NewClient(gw.BaseURL, nil)
+
+	conf := testServiceConf("orders", "localhost:8001")
+	conf.WriteTimeout = 30
+	res, err := c.Register(ctx, conf)
+	assert.Nil(t, err)
+	assert.Equal(t, "service orders registered", res.Message)
+
+	_, err = c.Register(ctx, conf)
+	assert.ErrorIs(t, err, sdk.ErrServiceAlreadyExists)
+	var sdkErr *sdk.Error
+	assert.ErrorAs(t, err, &sdkErr)
+	assert.Equal(t, http.StatusConflict, sdkErr.StatusCode)
+
+	_, err = c.Register(ctx, config.ServiceConf{Name: "invalid"})
+	assert.ErrorIs(t, err, sdk.ErrInvalidRequest)
+
+	conf.Addr = "localhost:8002"
+	res, err = c.Update(ctx, conf)
+	assert.Nil(t, err)
+	assert.Equal(t, "service orders updated", res.Message)
+
+	_, err = c.Update(ctx, testServiceConf("missing", "localhost:8003"))
+	assert.ErrorIs(t, err, sdk.ErrServiceNotFound)
+
+	services, err := c.List(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "localhost:8002", services["orders"].Addr)
+	assert.Equal(t, "/health", services["orders"].Health.Uri)
+	assert.Equal(t, 30*time.Second, services["orders"].WriteTimeout)
+
+	res, err = c.Deregister(ctx, "orders")
+	assert.Nil(t, err)
+	assert.Equal(t, "service orders deregistered", res.Message)
+	services, err = c.List(ctx)
+	assert.Nil(t, err)
+	assert.NotContains(t, services, "orders")
+}
@@ -0,0 +1,325 @@
+package testutil
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ArmaanKatyal/go-api-gateway/server/config"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// NewGateway builds the gateway handler from config.AppConfig and returns it with the func
+// stopping its background loops. The gateway lives in package main which cannot be imported,
+// so the tests in that package assign it before calling NewTestGateway.
+var NewGateway func() (http.Handler, func())
+
+// gateways is used to give every gateway a unique metrics prefix
+var gateways atomic.Int32
+
+type RecordedRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// Upstream is a mock upstream service which records every request it receives, upgrade
+// requests are switched to a protocol echoing what the client sends
+type Upstream struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []RecordedRequest
+	status   int
+	header   http.Header
+	delay    time.Duration
+	drop     bool
+}
+
+// NewUpstream starts a mock upstream responding with its name and the path of the request
+func NewUpstream(name string) *Upstream {
+	u := &Upstream{status: http.StatusOK, header: http.Header{}}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		u.mu.Lock()
+		u.requests = append(u.requests, RecordedRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone(), Body: body})
+		status := u.status
+		for k, v := range u.header {
+			w.Header()[k] = v
+		}
+		delay, drop := u.delay, u.drop
+		u.mu.Unlock()
+		time.Sleep(delay)
+		if drop {
+			if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+				_ = conn.Close()
+			}
+			return
+		}
+		if r.Header.Get("Upgrade") != "" {
+			serveUpgrade(w, r)
+			return
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(name + " " + r.URL.Path))
+	}))
+	return u
+}
+
+// serveUpgrade switches to the requested protocol and echoes everything the client sends
+func serveUpgrade(w http.ResponseWriter, r *http.Request) {
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, _ = fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %s\r\nConnection: Upgrade\r\n\r\n", r.Header.Get("Upgrade"))
+	if brw.Flush() != nil {
+		return
+	}
+	_, _ = io.Copy(conn, brw)
+}
+
+// Addr returns the host:port of the upstream as expected by ServiceConf.Addr
+func (u *Upstream) Addr() string {
+	return strings.TrimPrefix(u.URL, "http://")
+}
+
+// SetStatus sets the status code of the following responses, 200 by default
+func (u *Upstream) SetStatus(status int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.status = status
+}
+
+// SetHeader sets a header of the following responses
+func (u *Upstream) SetHeader(key string, value string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.header.Set(key, value)
+}
+
+// SetDelay delays the following responses to simulate a slow upstream
+func (u *Upstream) SetDelay(d time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.delay = d
+}
+
+// SetDrop closes the connection of the following requests without responding, after the delay
+func (u *Upstream) SetDrop(drop bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.drop = drop
+}
+
+// Requests returns a copy of the requests received by the upstream
+func (u *Upstream) Requests() []RecordedRequest {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]RecordedRequest(nil), u.requests...)
+}
+
+// Received returns the number of requests received matching the method and path
+func (u *Upstream) Received(method string, path string) int {
+	count := 0
+	for _, r := range u.Requests() {
+		if r.Method == method && r.Path == path {
+			count++
+		}
+	}
+	return count
+}
+
+type TestGateway struct {
+	*httptest.Server
+	// BaseURL of the gateway, requests are made to BaseURL + "/" + service + route
+	BaseURL string
+	// Prefix of the metrics exposed by this gateway
+	Prefix    string
+	upstreams map[string]*Upstream
+}
+
+// NewTestGateway starts a mock upstream for each service and a gateway with all the
+// services registered. A fallback uri, match rule or canary Addr naming another service in the list
+// is rewritten to the address of that service's upstream. The opts can change the rest of the
+// configuration before the gateway starts. The returned func shuts everything down and restores
+// the configuration.
+func NewTestGateway(t *testing.T, services []config.ServiceConf, opts ...func(*config.Conf)) (*TestGateway, func()) {
+	t.Helper()
+	if NewGateway == nil {
+		t.Fatal("testutil.NewGateway is not set")
+	}
+
+	upstreams := make(map[string]*Upstream, len(services))
+	for _, s := range services {
+		upstreams[s.Name] = NewUpstream(s.Name)
+	}
+	confs := make([]config.ServiceConf, len(services))
+	for i, s := range services {
+		s.Addr = upstreams[s.Name].Addr()
+		if u, ok := upstreams[s.FallbackUri]; ok {
+			s.FallbackUri = u.Addr()
+		}
+		fallbacks := make([]string, len(s.FallbackUris))
+		for j, uri := range s.FallbackUris {
+			if u, ok := upstreams[uri]; ok {
+				uri = u.Addr()
+			}
+			fallbacks[j] = uri
+		}
+		s.FallbackUris = fallbacks
+		rules := make([]config.MatchRuleSettings, len(s.MatchRules))
+		for j, rule := range s.MatchRules {
+			if u, ok := upstreams[rule.Addr]; ok {
+				rule.Addr = u.Addr()
+			}
+			rules[j] = rule
+		}
+		s.MatchRules = rules
+		if u, ok := upstreams[s.Canary.Addr]; ok {
+			s.Canary.Addr = u.Addr()
+		}
+		if s.WhiteList == nil {
+			s.WhiteList = []string{"ALL"}
+		}
+		confs[i] = s
+	}
+
+	c := config.Conf{}
+	c.Server.Host = "localhost"
+	c.Server.Port = "0"
+	c.Server.Metrics.Prefix = fmt.Sprintf("gateway_test_%d", gateways.Add(1))
+	// heartbeat often so health checks can be asserted without slowing the tests down
+	c.Registry.HeartbeatInterval = 1
+	c.Registry.Services = confs
+	for _, opt := range opts {
+		opt(&c)
+	}
+	c.Verify()
+	previous := config.AppConfig
+	config.AppConfig = c
+
+	handler, stop := NewGateway()
+	g := &TestGateway{
+		Server:    httptest.NewServer(handler),
+		Prefix:    c.Server.Metrics.Prefix,
+		upstreams: upstreams,
+	}
+	g.BaseURL = g.URL
+	return g, func() {
+		g.Close()
+		stop()
+		for _, u := range upstreams {
+			u.Close()
+		}
+		config.AppConfig = previous
+	}
+}
+
+// Upstream returns the mock upstream of the service
+func (g *TestGateway) Upstream(service string) *Upstream {
+	return g.upstreams[service]
+}
+
+// AssertUpstreamReceived asserts the upstream of the service received at least one
+// request with the method and path
+func (g *TestGateway) AssertUpstreamReceived(t *testing.T, service string, method string, path string) {
+	t.Helper()
+	u, ok := g.upstreams[service]
+	if !ok {
+		t.Fatalf("no upstream for service %s", service)
+	}
+	if u.Received(method, path) == 0 {
+		t.Errorf("upstream %s did not receive %s %s, got %v", service, method, path, u.Requests())
+	}
+}
+
+// AssertMetric asserts the sum of all the series of the named metric. Counters and
+// gauges are summed by value and histograms by sample count.
+func (g *TestGateway) AssertMetric(t *testing.T, name string, value float64) {
+	t.Helper()
+	g.assertMetric(t, g.gather(t, "/metrics"), name, value)
+}
+
+// AssertServiceMetric asserts the sum of all the series of the named metric of a service with
+// a metrics namespace of its own
+func (g *TestGateway) AssertServiceMetric(t *testing.T, service string, name string, value float64) {
+	t.Helper()
+	g.assertMetric(t, g.gather(t, "/services/"+service+"/metrics"), name, value)
+}
+
+func (g *TestGateway) assertMetric(t *testing.T, families map[string]*dto.MetricFamily, name string, value float64) {
+	t.Helper()
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		got := 0.0
+		for _, m := range f.GetMetric() {
+			got += metricValue(m)
+		}
+		if got != value {
+			t.Errorf("metric %s = %v, expected %v", name, got, value)
+		}
+		return
+	}
+	t.Errorf("metric %s not found", name)
+}
+
+// AssertMetricSeries asserts the number of series of the named metric, i.e. the number of
+// distinct label combinations
+func (g *TestGateway) AssertMetricSeries(t *testing.T, name string, count int) {
+	t.Helper()
+	for _, f := range g.gather(t, "/metrics") {
+		if f.GetName() == name {
+			if got := len(f.GetMetric()); got != count {
+				t.Errorf("metric %s has %d series, expected %d", name, got, count)
+			}
+			return
+		}
+	}
+	t.Errorf("metric %s not found", name)
+}
+
+// gather scrapes a metrics endpoint of the gateway, every gateway has its own registry
+func (g *TestGateway) gather(t *testing.T, path string) map[string]*dto.MetricFamily {
+	t.Helper()
+	resp, err := http.Get(g.URL + path)
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		t.Fatalf("failed to gather metrics: %s", resp.Status)
+	}
+	defer resp.Body.Close()
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to parse metrics: %v", err)
+	}
+	return families
+}
+
+func metricValue(m *dto.Metric) float64 {
+	switch {
+	case m.GetCounter() != nil:
+		return m.GetCounter().GetValue()
+	case m.GetGauge() != nil:
+		return m.GetGauge().GetValue()
+	case m.GetHistogram() != nil:
+		return float64(m.GetHistogram().GetSampleCount())
+	case m.GetUntyped() != nil:
+		return m.GetUntyped().GetValue()
+	}
+	return 0
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// sessionTicketKeys is the number of keys kept, the newest encrypts the tickets and the
+// previous one still decrypts the tickets issued before the last rotation
+const sessionTicketKeys = 2
+
+// sessionTicketRotator replaces the key encrypting the TLS session tickets every interval, so
+// a leaked key only exposes the sessions of a bounded window
+type sessionTicketRotator struct {
+	conf *tls.Config
+	mu   sync.Mutex
+	// newest first
+	keys [][32]byte
+	stop chan struct{}
+}
+
+// startSessionTicketRotation sets a new session ticket key on the config and rotates it every
+// interval in the background until Stop is called
+func startSessionTicketRotation(conf *tls.Config, interval time.Duration) (*sessionTicketRotator, error) {
+	tr := &sessionTicketRotator{conf: conf, stop: make(chan struct{})}
+	if err := tr.rotate(); err != nil {
+		return nil, err
+	}
+	go tr.run(interval)
+	slog.Info("Rotating session ticket keys", "interval", interval.String())
+	return tr, nil
+}
+
+func (tr *sessionTicketRotator) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tr.stop:
+			return
+		case <-ticker.C:
+			if err := tr.rotate(); err != nil {
+				// keep the current keys, the next rotation may succeed
+				slog.Error("Unable to rotate session ticket keys", "error", err.Error())
+			}
+		}
+	}
+}
+
+// rotate generates a new key and makes it the one encrypting the tickets
+func (tr *sessionTicketRotator) rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.keys = append([][32]byte{key}, tr.keys...)
+	if len(tr.keys) > sessionTicketKeys {
+		tr.keys = tr.keys[:sessionTicketKeys]
+	}
+	tr.conf.SetSessionTicketKeys(tr.keys)
+	return nil
+}
+
+// Keys returns the current keys, newest first
+func (tr *sessionTicketRotator) Keys() [][32]byte {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return append([][32]byte(nil), tr.keys...)
+}
+
+// Stop stops the rotation, the current keys are kept
+func (tr *sessionTicketRotator) Stop() {
+	close(tr.stop)
+}
+
+// newTLSListener serves TLS on the listener with the certificate of the files. Unlike ServeTLS
+// the config isn't cloned, so the session ticket keys set on it later are used by the server.
+func newTLSListener(ln net.Listener, conf *tls.Config, certFile string, keyFile string) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf.Certificates = []tls.Certificate{cert}
+	if len(conf.NextProtos) == 0 {
+		conf.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return tls.NewListener(ln, conf), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionTicketRotation(t *testing.T) {
+	tr, err := startSessionTicketRotation(&tls.Config{}, 20*time.Millisecond)
+	assert.Nil(t, err)
+	defer tr.Stop()
+	first := tr.Keys()
+	assert.Len(t, first, 1)
+
+	// the background rotation makes a new key the current one and keeps the previous
+	assert.Eventually(t, func() bool {
+		keys := tr.Keys()
+		return len(keys) == sessionTicketKeys && keys[0] != first[0]
+	}, time.Second, 5*time.Millisecond)
+	keys := tr.Keys()
+	assert.NotEqual(t, keys[0], keys[1])
+	assert.Eventually(t, func() bool { return tr.Keys()[1] != first[0] }, time.Second, 5*time.Millisecond)
+}
+
+func TestSessionTicketRotationResumption(t *testing.T) {
+	// borrow the certificate and the client trusting it from a test server
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	conf := &tls.Config{Certificates: ts.TLS.Certificates, MinVersion: tls.VersionTLS12}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go func() { _ = server.Serve(tls.NewListener(ln, conf)) }()
+	defer server.Close()
+
+	// rotated by hand, the interval is never reached
+	tr, err := startSessionTicketRotation(conf, time.Hour)
+	assert.Nil(t, err)
+	defer tr.Stop()
+
+	transport := ts.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	transport.DisableKeepAlives = true
+	client := &http.Client{Transport: transport}
+	resumed := func() bool {
+		resp, err := client.Get("https://" + ln.Addr().String())
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		_ = resp.Body.Close()
+		return resp.TLS.DidResume
+	}
+
+	assert.False(t, resumed())
+	// the ticket of the previous key is still accepted by the running server
+	assert.Nil(t, tr.rotate())
+	assert.True(t, resumed())
+	// once its key is dropped the ticket can't be resumed
+	assert.Nil(t, tr.rotate())
+	assert.Nil(t, tr.rotate())
+	assert.False(t, resumed())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isUpgradeRequest checks if the client asks to switch the connection to another protocol e.g. websocket
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// proxyUpgrade forwards an upgrade request and, once the service switches protocols, copies the
+// data between the client and the service until either closes the connection. The service
+// responses which aren't a switch are written like any other response.
+func (rh *RequestHandler) proxyUpgrade(w http.ResponseWriter, r *http.Request, forwardURI string, service *Service, name string, t time.Time) error {
+	if !service.tryAcquireUpgrade() {
+		slog.Error("Websocket connection limit reached", "service", name, "path", r.URL.Path)
+		return opError("upgrade", name, ErrWebSocketLimit, nil)
+	}
+	defer service.releaseUpgrade()
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, forwardURI, nil)
+	if err != nil {
+		return opError("create request", name, ErrForwardFailure, err)
+	}
+	if req.Header, err = cloneHeader(r.Header, rh.headerLimits, service.HeaderAllowList); err != nil {
+		return opError("upgrade", name, ErrHeadersTooLarge, err)
+	}
+	rh.Proxies.ForwardHeadersWithPolicy(req.Header, r, service.ForwardedHeaders)
+	rh.Correlation.Set(req.Header, rh.Correlation.ID(r))
+	resp, err := rh.upstreamClient(name).Do(req)
+	if err != nil {
+		return opError("upgrade", name, ErrForwardFailure, err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer func(Body io.ReadCloser) {
+			_ = Body.Close()
+		}(resp.Body)
+		return rh.writeResponse(w, r, resp, name, t)
+	}
+	backend, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		_ = resp.Body.Close()
+		return opError("upgrade", name, ErrForwardFailure, errors.New("upgraded connection is not writable"))
+	}
+	defer backend.Close()
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return opError("hijack", name, ErrForwardFailure, err)
+	}
+	defer conn.Close()
+	// the read and write timeouts of the server don't apply to the upgraded connection
+	_ = conn.SetDeadline(time.Time{})
+	resp.Body = nil
+	if err := resp.Write(brw); err != nil {
+		slog.Error("Error writing upgrade response", "service", name, "error", err.Error())
+		return nil
+	}
+	if err := brw.Flush(); err != nil {
+		slog.Error("Error writing upgrade response", "service", name, "error", err.Error())
+		return nil
+	}
+	rh.CollectMetrics(rh.metricsInput(r, http.StatusSwitchingProtocols), t)
+	metrics := rh.ServiceRegistry.metricsFor(name)
+	metrics.IncWebSocketConnections(name)
+	defer metrics.DecWebSocketConnections(name)
+
+	// the buffered reader may already hold data sent by the client after the request
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(conn, backend)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(backend, brw)
+		done <- struct{}{}
+	}()
+	<-done
+	slog.Info("Upgraded connection closed", "service", name, "path", r.URL.Path)
+	return nil
+}